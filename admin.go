@@ -0,0 +1,311 @@
+package percy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminAPI serves the MD's administrative HTTP interface.  Every request must
+// carry an "Authorization: Bearer <token>" header with a token that the MD's
+// AuthProvider accepts.  It is meant to be mounted under a prefix, e.g.:
+//
+//	http.Handle("/admin/", http.StripPrefix("/admin", percy.NewAdminAPI(md)))
+type AdminAPI struct {
+	mdd *MDD
+	mux *http.ServeMux
+
+	// Where POST /heap writes heap reports; disabled if empty
+	ReportDir string
+}
+
+func NewAdminAPI(mdd *MDD) *AdminAPI {
+	api := &AdminAPI{
+		mdd: mdd,
+		mux: http.NewServeMux(),
+	}
+
+	api.Handle("/capabilities", api.handleCapabilities)
+	api.Handle("/stats", api.handleStats)
+	api.Handle("/metrics", api.handleMetrics)
+	api.Handle("/trace", api.handleTrace)
+	api.Handle("/loopback", api.handleLoopback)
+	api.Handle("/pause", api.handlePause)
+	api.Handle("/heap", api.handleHeap)
+	api.Handle("/unknown", api.handleUnknown)
+	api.Handle("/node", api.handleNode)
+	api.Handle("/conference", api.handleConference)
+	api.Handle("/place", api.handlePlace)
+	api.Handle("/allocation", api.handleAllocation)
+	api.Handle("/drain", api.handleDrain)
+	api.Handle("/labels", api.handleLabels)
+	api.Handle("/provision", api.handleProvision)
+	api.Handle("/lastn", api.handleLastN)
+	api.Handle("/mute", api.handleMute)
+	api.Handle("/timeline", api.handleTimeline)
+	api.Handle("/bind", api.handleBind)
+	api.Handle("/candidates", api.handleCandidates)
+	api.Handle("/subscriptions", api.handleSubscriptions)
+
+	return api
+}
+
+// Adds an endpoint to the API; authorization is handled by the AdminAPI
+func (api *AdminAPI) Handle(pattern string, handler http.HandlerFunc) {
+	api.mux.HandleFunc(pattern, handler)
+}
+
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if api.mdd.Auth.AdminTokenValid(token) {
+		api.mux.ServeHTTP(w, r)
+		return
+	}
+
+	if tenantID, ok := api.mdd.tenantForToken(token); ok {
+		api.serveTenant(tenantID, w, r)
+		return
+	}
+
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// Tenant tokens can only see the tenant's own stats
+func (api *AdminAPI) serveTenant(tenantID TenantID, w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/capabilities":
+		api.handleCapabilities(w, r)
+
+	case "/stats":
+		stats, err := api.mdd.TenantStats(tenantID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, stats)
+
+	default:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, val interface{}) {
+	w.Header().Set("content-type", "application/json")
+	err := json.NewEncoder(w).Encode(val)
+	if err != nil {
+		log.Printf("Error writing admin API response: %v", err)
+	}
+}
+
+func (api *AdminAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, api.mdd.StatsSnapshot())
+}
+
+// GET returns the trace ring.  POST with ssrc=<n> or assoc=<n> (and
+// optionally on=false) changes what is traced.  DELETE clears the ring.
+func (api *AdminAPI) handleTrace(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, api.mdd.TraceEntries())
+
+	case http.MethodPost:
+		on := r.FormValue("on") != "false"
+
+		if val := r.FormValue("ssrc"); len(val) > 0 {
+			ssrc, err := strconv.ParseUint(val, 0, 32)
+			if err != nil {
+				http.Error(w, "Invalid SSRC", http.StatusBadRequest)
+				return
+			}
+			api.mdd.TraceSSRC(uint32(ssrc), on)
+		}
+
+		if val := r.FormValue("assoc"); len(val) > 0 {
+			assocID, err := strconv.ParseUint(val, 0, 16)
+			if err != nil {
+				http.Error(w, "Invalid association ID", http.StatusBadRequest)
+				return
+			}
+			api.mdd.TraceAssociation(AssociationID(assocID), on)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		api.mdd.ClearTrace()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET returns the counts and samples of unknown traffic.  DELETE clears them.
+func (api *AdminAPI) handleUnknown(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, api.mdd.UnknownTraffic())
+
+	case http.MethodDelete:
+		api.mdd.ClearUnknownTraffic()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST with assoc=<n> (and optionally on=false) turns loopback on or off for
+// an association
+func (api *AdminAPI) handleLoopback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	assocID, err := strconv.ParseUint(r.FormValue("assoc"), 0, 16)
+	if err != nil {
+		http.Error(w, "Invalid association ID", http.StatusBadRequest)
+		return
+	}
+
+	api.mdd.SetLoopback(AssociationID(assocID), r.FormValue("on") != "false")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST with conf=<n> (and optionally on=false) pauses or resumes a
+// conference's media
+func (api *AdminAPI) handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	confID, err := strconv.ParseUint(r.FormValue("conf"), 0, 32)
+	if err != nil {
+		http.Error(w, "Invalid conference ID", http.StatusBadRequest)
+		return
+	}
+
+	api.mdd.SetConferencePaused(ConfID(confID), r.FormValue("on") != "false")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST creates a conference, and DELETE destroys it
+func (api *AdminAPI) handleConference(w http.ResponseWriter, r *http.Request) {
+	confID, err := strconv.ParseUint(r.FormValue("conf"), 0, 32)
+	if err != nil {
+		http.Error(w, "Invalid conference ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		err = api.mdd.CreateConference(ConfID(confID))
+	case http.MethodDelete:
+		err = api.mdd.DestroyConference(ConfID(confID))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *AdminAPI) handleNode(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, api.mdd.NodeInfo())
+}
+
+// GET returns an association's labels, and POST replaces them with the JSON
+// object in the body
+func (api *AdminAPI) handleLabels(w http.ResponseWriter, r *http.Request) {
+	assocID, err := strconv.ParseUint(r.FormValue("assoc"), 0, 16)
+	if err != nil {
+		http.Error(w, "Invalid association ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		labels, err := api.mdd.AssociationLabels(AssociationID(assocID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, labels)
+
+	case http.MethodPost:
+		labels := map[string]string{}
+		err := json.NewDecoder(r.Body).Decode(&labels)
+		if err != nil {
+			http.Error(w, "Invalid labels", http.StatusBadRequest)
+			return
+		}
+		api.mdd.SetAssociationLabels(AssociationID(assocID), labels)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST starts draining the node, and DELETE stops
+func (api *AdminAPI) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		api.mdd.Drain()
+	case http.MethodDelete:
+		api.mdd.StopDraining()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST asks whether this node will take a participant in a conference,
+// optionally from a region
+func (api *AdminAPI) handlePlace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	confID, err := strconv.ParseUint(r.FormValue("conf"), 0, 32)
+	if err != nil {
+		http.Error(w, "Invalid conference ID", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, api.mdd.Place(PlacementRequest{Conference: ConfID(confID), Region: r.FormValue("region")}))
+}
+
+// POST writes a heap profile and an allocation summary to the report
+// directory, and returns their paths
+func (api *AdminAPI) handleHeap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(api.ReportDir) == 0 {
+		http.Error(w, "No report directory configured", http.StatusNotFound)
+		return
+	}
+
+	report, err := WriteHeapReport(api.ReportDir)
+	if err != nil {
+		log.Printf("Error writing heap report: %v", err)
+		http.Error(w, "Error writing heap report", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Wrote heap report to %s and %s", report.Profile, report.Summary)
+	writeJSON(w, report)
+}
@@ -0,0 +1,86 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// By default, any source that sends the MD a packet becomes an association
+// in the default conference ("first packet wins").  Conferencing apps that
+// know who their participants are can instead add clients explicitly, and
+// run the MD in AdmitListed mode, where packets from anyone else are dropped
+// without creating any state.
+
+type AdmissionMode uint8
+
+const (
+	AdmitAll AdmissionMode = iota
+	AdmitListed
+)
+
+func (mode AdmissionMode) String() string {
+	switch mode {
+	case AdmitAll:
+		return "all"
+	case AdmitListed:
+		return "listed"
+	default:
+		return fmt.Sprintf("<%d>", int(mode))
+	}
+}
+
+func ParseAdmissionMode(val string) (AdmissionMode, error) {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "all":
+		return AdmitAll, nil
+	case "listed":
+		return AdmitListed, nil
+	default:
+		return 0, fmt.Errorf("Unknown admission mode '%s'", val)
+	}
+}
+
+// Admits the client at an address to a conference, before it has sent
+// anything.  Returns the ID of its association.
+func (mdd *MDD) AddClient(addr net.Addr, confID ConfID) (AssociationID, error) {
+	assocID, _, err := mdd.addressAssoc(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	err = mdd.SetAssociationConference(assocID, confID)
+	if err != nil {
+		return assocID, err
+	}
+
+	mdd.mu.Lock()
+	if assoc, ok := mdd.assocs.get(assocID); ok {
+		assoc.addr = addr
+	}
+	mdd.mu.Unlock()
+	return assocID, nil
+}
+
+// Removes a client, closing its DTLS session and KD tunnel and wiping its
+// keys.  In AdmitAll mode, it will be added back if it sends anything else.
+func (mdd *MDD) RemoveClient(assocID AssociationID) error {
+	mdd.mu.Lock()
+	assoc, ok := mdd.assocs.get(assocID)
+	if ok {
+		mdd.assocs.remove(assocID)
+		mdd.forgetPaths(assocID)
+		delete(mdd.rtcpPending, assocID)
+		delete(mdd.rejected, assocID)
+	}
+	mdd.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Unknown client [%04x]", assocID)
+	}
+
+	mdd.teardown(assoc, mdd.tunnel(assoc))
+	log.Printf("Removed association %s", mdd.describe(assoc))
+	return nil
+}
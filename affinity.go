@@ -0,0 +1,68 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// On large multi-socket hosts, latency is more predictable when each group
+// of the MD's goroutines stays on the same CPUs: the socket readers, the
+// processing loop (which does the SRTP crypto), and the STUN workers.  Each
+// goroutine in a group with CPUs configured locks itself to an OS thread
+// and sets that thread's affinity.  Only affinity is set: the Go heap is
+// shared by all threads, so the buffers the goroutines use are not
+// allocated on any particular NUMA node.
+//
+// Affinity is only supported on Linux; elsewhere, it is logged and ignored.
+
+type CPUAffinity struct {
+	Readers   []int `json:"readers,omitempty"`
+	Processor []int `json:"processor,omitempty"`
+	STUN      []int `json:"stun,omitempty"`
+}
+
+// Parses a CPU list in the kernel's format, e.g., "0-3,8,10-11"
+func ParseCPUList(list string) ([]int, error) {
+	cpus := []int{}
+	if len(strings.TrimSpace(list)) == 0 {
+		return cpus, nil
+	}
+
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("Invalid CPU [%s]", part)
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, fmt.Errorf("Invalid CPU range [%s]", part)
+			}
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// Pins the calling goroutine to the given CPUs, if any.  The goroutine keeps
+// its OS thread until it exits, so the affinity doesn't leak to others.
+func pinGoroutine(group string, cpus []int) {
+	if len(cpus) == 0 {
+		return
+	}
+
+	runtime.LockOSThread()
+	err := setAffinity(cpus)
+	if err != nil {
+		log.Printf("Error pinning %s to CPUs %v: %v", group, cpus, err)
+	}
+}
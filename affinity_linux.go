@@ -0,0 +1,27 @@
+package percy
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const maxAffinityCPUs = 1024
+
+// Sets the CPU affinity of the calling thread
+func setAffinity(cpus []int) error {
+	var mask [maxAffinityCPUs / 64]uint64
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= maxAffinityCPUs {
+			return fmt.Errorf("CPU %d out of range", cpu)
+		}
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+
+	// A pid of zero means the calling thread
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package percy
+
+import (
+	"fmt"
+)
+
+func setAffinity(cpus []int) error {
+	return fmt.Errorf("CPU affinity is only supported on Linux")
+}
@@ -0,0 +1,31 @@
+package percy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cases := map[string][]int{
+		"":           {},
+		"3":          {3},
+		"0-3,8":      {0, 1, 2, 3, 8},
+		" 1, 4-5 ":   {1, 4, 5},
+		"10-11,2-2,": nil,
+		"3-1":        nil,
+		"a":          nil,
+	}
+
+	for list, expected := range cases {
+		cpus, err := ParseCPUList(list)
+		if expected == nil {
+			if err == nil {
+				t.Fatalf("Invalid CPU list [%s] accepted: %v", list, cpus)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(cpus, expected) {
+			t.Fatalf("Incorrect CPUs for [%s]: %v %v", list, cpus, err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package percy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A conference can be given a total downstream budget, which the MD divides
+// between its receivers, and then between the streams each receiver gets:
+//
+//   - Each receiver gets an equal share of the budget
+//   - Audio streams always get what they are sending at
+//   - Video streams share the rest equally, with what smaller streams don't
+//     need going to larger ones
+//   - FEC streams get what video leaves over, smallest first
+//
+// Receivers are moved to lower simulcast layers to fit their share (see
+// simulcast.go).  Otherwise, a video stream that doesn't fit in its share is
+// withheld from that receiver, until it fits again.
+// Allocation runs on the processing loop every second (with the expiry
+// check), from the rates measured for each SSRC.  Streams are told apart
+// by SlowReceivers.AudioPayloadTypes.
+
+type StreamAllocation struct {
+	SSRC      uint32        `json:"ssrc"`
+	Sender    AssociationID `json:"sender"`
+	Audio     bool          `json:"audio,omitempty"`
+	FEC       bool          `json:"fec,omitempty"`
+	Rate      float64       `json:"rate"`      // Measured, in bits per second
+	Allocated float64       `json:"allocated"` // Bits per second
+	Forwarded bool          `json:"forwarded"`
+}
+
+type ReceiverAllocation struct {
+	Receiver AssociationID      `json:"receiver"`
+	Share    float64            `json:"share"` // Bits per second
+	Streams  []StreamAllocation `json:"streams"`
+}
+
+// Sets a conference's total downstream budget in bits per second; zero
+// removes it
+func (mdd *MDD) SetConferenceBudget(confID ConfID, bitrate float64) error {
+	if bitrate < 0 {
+		return fmt.Errorf("Invalid budget %v", bitrate)
+	}
+
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.budget = bitrate
+	return nil
+}
+
+// Returns how a conference's budget was last divided, by receiver
+func (mdd *MDD) Allocation(confID ConfID) []ReceiverAllocation {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	conf, ok := mdd.conferences[confID]
+	if !ok {
+		return nil
+	}
+	return conf.allocation
+}
+
+// Divides each conference's budget between its receivers and streams.  Runs
+// on the processing loop.
+func (mdd *MDD) allocate(now time.Time) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	receivers := map[ConfID][]*association{}
+	for _, assoc := range mdd.assocs.snapshot() {
+		if assoc.addr != nil {
+			receivers[assoc.conf] = append(receivers[assoc.conf], assoc)
+		}
+	}
+
+	for confID, conf := range mdd.conferences {
+		if conf.budget == 0 {
+			if conf.allocation != nil {
+				for _, receiver := range receivers[confID] {
+					receiver.withheld = nil
+					receiver.videoShare = 0
+				}
+				conf.allocation = nil
+			}
+			continue
+		}
+
+		// The streams each receiver would get without a budget
+		streams := map[AssociationID][]StreamAllocation{}
+		for _, sender := range mdd.assocs.snapshot() {
+			if sender.conf != confID {
+				continue
+			}
+			for ssrc, counters := range sender.stats.ssrcs {
+				if now.Sub(counters.last) > ssrcRateWindow {
+					continue
+				}
+
+				stream := StreamAllocation{
+					SSRC:   ssrc,
+					Sender: sender.id,
+					Audio:  mdd.SlowReceivers.isAudioPayloadType(counters.source.payloadType),
+					FEC:    mdd.isFECPayloadType(counters.source.payloadType),
+					Rate:   counters.stats(ssrc, now).Bitrate,
+				}
+				for _, receiver := range mdd.conferencePeers(sender) {
+					if sender.simulcast != nil && sender.simulcast.index(ssrc) >= 0 && receiver.layers[sender.id] != ssrc {
+						continue
+					}
+					if stream.FEC && receiver.noFEC {
+						continue
+					}
+					if receiver.subscriptions == nil || receiver.subscriptions[ssrc] {
+						streams[receiver.id] = append(streams[receiver.id], stream)
+					}
+				}
+			}
+		}
+
+		allocation := []ReceiverAllocation{}
+		for _, receiver := range receivers[confID] {
+			share := conf.budget / float64(len(receivers[confID]))
+			alloc := divideShare(receiver.id, share, streams[receiver.id])
+			receiver.withheld = map[uint32]bool{}
+			receiver.videoShare = videoShare(alloc)
+			for _, stream := range alloc.Streams {
+				if !stream.Forwarded {
+					receiver.withheld[stream.SSRC] = true
+				}
+			}
+			allocation = append(allocation, alloc)
+		}
+
+		sort.Slice(allocation, func(i, j int) bool {
+			return allocation[i].Receiver < allocation[j].Receiver
+		})
+		conf.allocation = allocation
+	}
+}
+
+// What's left of a receiver's share after audio, per video stream, for
+// choosing simulcast layers
+func videoShare(alloc ReceiverAllocation) float64 {
+	left, videos := alloc.Share, 0
+	for _, stream := range alloc.Streams {
+		switch {
+		case stream.Audio:
+			left -= stream.Allocated
+		case !stream.FEC:
+			videos += 1
+		}
+	}
+	if videos > 0 {
+		left /= float64(videos)
+	}
+	return math.Max(left, 1)
+}
+
+// Divides one receiver's share between its streams
+func divideShare(receiverID AssociationID, share float64, streams []StreamAllocation) ReceiverAllocation {
+	alloc := ReceiverAllocation{Receiver: receiverID, Share: share, Streams: streams}
+
+	// Audio first, whatever it takes
+	left := share
+	video, fec := []int{}, []int{}
+	for i := range streams {
+		switch {
+		case streams[i].Audio:
+			streams[i].Allocated = streams[i].Rate
+			streams[i].Forwarded = true
+			left -= streams[i].Rate
+		case streams[i].FEC:
+			fec = append(fec, i)
+		default:
+			video = append(video, i)
+		}
+	}
+
+	// Then video, smallest first, so that what small streams leave over is
+	// shared between the larger ones
+	sort.Slice(video, func(i, j int) bool {
+		return streams[video[i]].Rate < streams[video[j]].Rate
+	})
+	for n, i := range video {
+		fair := 0.0
+		if left > 0 {
+			fair = left / float64(len(video)-n)
+		}
+
+		stream := &streams[i]
+		stream.Forwarded = stream.Rate <= fair
+		stream.Allocated = fair
+		if stream.Forwarded {
+			stream.Allocated = stream.Rate
+		}
+		if stream.Forwarded {
+			left -= stream.Allocated
+		}
+	}
+
+	// Then FEC, with whatever is left
+	sort.Slice(fec, func(i, j int) bool {
+		return streams[fec[i]].Rate < streams[fec[j]].Rate
+	})
+	for _, i := range fec {
+		stream := &streams[i]
+		stream.Forwarded = stream.Rate <= left
+		if stream.Forwarded {
+			stream.Allocated = stream.Rate
+			left -= stream.Allocated
+		}
+	}
+
+	sort.Slice(alloc.Streams, func(i, j int) bool {
+		return alloc.Streams[i].SSRC < alloc.Streams[j].SSRC
+	})
+	return alloc
+}
+
+func (api *AdminAPI) handleAllocation(w http.ResponseWriter, r *http.Request) {
+	confID, err := strconv.ParseUint(r.FormValue("conf"), 0, 32)
+	if err != nil {
+		http.Error(w, "Invalid conference ID", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, api.mdd.Allocation(ConfID(confID)))
+}
@@ -0,0 +1,85 @@
+package percy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDivideShare(t *testing.T) {
+	streams := func() []StreamAllocation {
+		return []StreamAllocation{
+			{SSRC: 1, Audio: true, Rate: 100},
+			{SSRC: 2, Rate: 900},
+			{SSRC: 3, Rate: 200},
+			{SSRC: 4, Rate: 400},
+		}
+	}
+
+	// 900 is left after audio; the smallest video fits in a third of that,
+	// and the others don't fit in half of the rest
+	alloc := divideShare(0x0001, 1000, streams())
+	forwarded := map[uint32]bool{}
+	for _, stream := range alloc.Streams {
+		forwarded[stream.SSRC] = stream.Forwarded
+	}
+	if !forwarded[1] || forwarded[2] || !forwarded[3] || forwarded[4] {
+		t.Fatalf("Incorrect allocation: %+v", alloc.Streams)
+	}
+	if alloc.Streams[3].Allocated != 350 {
+		t.Fatalf("Incorrect allocation for a withheld stream: %+v", alloc.Streams[3])
+	}
+
+	alloc = divideShare(0x0001, 2000, streams())
+	for _, stream := range alloc.Streams {
+		if !stream.Forwarded || stream.Allocated != stream.Rate {
+			t.Fatalf("Stream withheld with enough budget: %+v", alloc.Streams)
+		}
+	}
+
+	// Audio is forwarded even if it doesn't fit
+	alloc = divideShare(0x0001, 50, streams())
+	if !alloc.Streams[0].Forwarded || alloc.Streams[1].Forwarded {
+		t.Fatalf("Incorrect allocation without room for audio: %+v", alloc.Streams)
+	}
+}
+
+func TestConferenceBudget(t *testing.T) {
+	mdd := NewMDD()
+	sender := mdd.association(0x0001)
+	receiver := mdd.association(0x0002)
+	sender.addr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+	receiver.addr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5000}
+
+	// Opus at 8kbps and video at 400kbps
+	audio := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}
+	video := append([]byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02}, make([]byte, 988)...)
+	now := time.Now()
+	for i := 0; i < 250; i++ {
+		at := now.Add(time.Duration(i-250) * 20 * time.Millisecond)
+		audioHeader, _ := ParseRTPHeader(audio)
+		videoHeader, _ := ParseRTPHeader(video)
+		sender.countSSRC(audioHeader, 20, at)
+		sender.countSSRC(videoHeader, 1000, at)
+	}
+
+	mdd.SetConferenceBudget(DefaultConfID, 100000)
+	mdd.allocate(now)
+	if receivers := mdd.subscribers(sender, video); len(receivers) != 0 {
+		t.Fatalf("Video forwarded over budget")
+	}
+	if receivers := mdd.subscribers(sender, audio); len(receivers) != 1 {
+		t.Fatalf("Audio not forwarded")
+	}
+
+	allocation := mdd.Allocation(DefaultConfID)
+	if len(allocation) != 2 || allocation[1].Receiver != 0x0002 || len(allocation[1].Streams) != 2 {
+		t.Fatalf("Incorrect allocation: %+v", allocation)
+	}
+
+	mdd.SetConferenceBudget(DefaultConfID, 0)
+	mdd.allocate(now)
+	if receivers := mdd.subscribers(sender, video); len(receivers) != 1 || mdd.Allocation(DefaultConfID) != nil {
+		t.Fatalf("Video still withheld without a budget")
+	}
+}
@@ -0,0 +1,218 @@
+// Package v1 is percy's stable API: the types and functions an application
+// needs to run a media distributor, talk to a key distributor, and watch
+// what happens.  Everything here keeps its name, signature and meaning for
+// as long as v1 exists; changes that break any of that go in a v2 next to
+// it.
+//
+// The MD itself is wrapped: v1 covers the settings in Config and the
+// methods on MDD, and nothing else percy.MDD has.  The data types (keys,
+// STUN messages, events, stats) are aliases for the percy package's, so
+// values move freely between the two.  Everything else in the percy
+// package is the implementation, and may change between commits.
+package v1
+
+import (
+	"time"
+
+	"github.com/bifurcation/percy"
+)
+
+// The media distributor
+type (
+	AssociationID = percy.AssociationID
+	ConfID        = percy.ConfID
+
+	ForwardingMode = percy.ForwardingMode
+)
+
+const DefaultConfID = percy.DefaultConfID
+
+const (
+	ModePERC  = percy.ModePERC
+	ModeSFU   = percy.ModeSFU
+	ModeRelay = percy.ModeRelay
+)
+
+// The settings an MD starts with.  Zero values keep the defaults.
+type Config struct {
+	KD                 KMFTunnel     // Where DTLS from clients goes
+	Capacity           int           // Associations; zero for no limit
+	ReconnectGrace     time.Duration // How long a client's keys outlive its path
+	AssociationTimeout time.Duration // How long a silent client is kept
+}
+
+type MDD struct {
+	mdd *percy.MDD
+}
+
+// The MD is the MDDTunnel its KD's tunnel delivers to
+var _ MDDTunnel = (*MDD)(nil)
+
+func NewMDD(config Config) *MDD {
+	mdd := percy.NewMDD()
+	mdd.KD = config.KD
+	mdd.Capacity = config.Capacity
+	if config.ReconnectGrace > 0 {
+		mdd.ReconnectGrace = config.ReconnectGrace
+	}
+	if config.AssociationTimeout > 0 {
+		mdd.AssociationTimeout = config.AssociationTimeout
+	}
+	return &MDD{mdd}
+}
+
+// Listens for media on the given UDP port
+func (md *MDD) Listen(port int) error {
+	return md.mdd.Listen(port)
+}
+
+func (md *MDD) Stop() {
+	md.mdd.Stop()
+}
+
+// Sends a DTLS record from the KD to a client
+func (md *MDD) Send(assocID AssociationID, msg []byte) error {
+	return md.mdd.Send(assocID, msg)
+}
+
+// Installs the hop-by-hop keys the KD derived for a client
+func (md *MDD) SetKeys(assocID AssociationID, keys HBHKeys) error {
+	return md.mdd.SetKeys(assocID, keys)
+}
+
+func (md *MDD) CreateConference(confID ConfID) error {
+	return md.mdd.CreateConference(confID)
+}
+
+func (md *MDD) DestroyConference(confID ConfID) error {
+	return md.mdd.DestroyConference(confID)
+}
+
+func (md *MDD) SetConferenceMode(confID ConfID, mode ForwardingMode) {
+	md.mdd.SetConferenceMode(confID, mode)
+}
+
+func (md *MDD) OnEvent(handler EventHandler) {
+	md.mdd.OnEvent(handler)
+}
+
+func (md *MDD) StatsSnapshot() *StatsSnapshot {
+	return md.mdd.StatsSnapshot()
+}
+
+func ParseForwardingMode(val string) (ForwardingMode, error) {
+	return percy.ParseForwardingMode(val)
+}
+
+// Keying: the tunnels between the MD and the KD, and the hop-by-hop keys
+// that come through them.  HBHKeys are the SRTP keys for one association.
+type (
+	KMFTunnel         = percy.KMFTunnel
+	MDDTunnel         = percy.MDDTunnel
+	UDPForwarder      = percy.UDPForwarder
+	HBHKeys           = percy.HBHKeys
+	ProtectionProfile = percy.ProtectionProfile
+	KeyEscrow         = percy.KeyEscrow
+	EscrowedKeys      = percy.EscrowedKeys
+
+	TunnelMessage = percy.TunnelMessage
+	TunnelCodec   = percy.TunnelCodec
+)
+
+const (
+	SRTP_AES128_CM_HMAC_SHA1_80              = percy.SRTP_AES128_CM_HMAC_SHA1_80
+	SRTP_AES128_CM_HMAC_SHA1_32              = percy.SRTP_AES128_CM_HMAC_SHA1_32
+	SRTP_NULL_HMAC_SHA1_80                   = percy.SRTP_NULL_HMAC_SHA1_80
+	SRTP_NULL_HMAC_SHA1_32                   = percy.SRTP_NULL_HMAC_SHA1_32
+	SRTP_AEAD_AES_128_GCM                    = percy.SRTP_AEAD_AES_128_GCM
+	SRTP_AEAD_AES_256_GCM                    = percy.SRTP_AEAD_AES_256_GCM
+	DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM = percy.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM
+	DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM = percy.DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM
+	SRTP_ARIA_128_CTR_HMAC_SHA1_80           = percy.SRTP_ARIA_128_CTR_HMAC_SHA1_80
+	SRTP_ARIA_128_CTR_HMAC_SHA1_32           = percy.SRTP_ARIA_128_CTR_HMAC_SHA1_32
+	SRTP_ARIA_256_CTR_HMAC_SHA1_80           = percy.SRTP_ARIA_256_CTR_HMAC_SHA1_80
+	SRTP_ARIA_256_CTR_HMAC_SHA1_32           = percy.SRTP_ARIA_256_CTR_HMAC_SHA1_32
+	SRTP_AEAD_ARIA_128_GCM                   = percy.SRTP_AEAD_ARIA_128_GCM
+	SRTP_AEAD_ARIA_256_GCM                   = percy.SRTP_AEAD_ARIA_256_GCM
+)
+
+func NewUDPForwarder(server string) (*UDPForwarder, error) {
+	return percy.NewUDPForwarder(server)
+}
+
+func ParseProtectionProfile(val string) (ProtectionProfile, error) {
+	return percy.ParseProtectionProfile(val)
+}
+
+func ParseProtectionProfiles(val string) ([]ProtectionProfile, error) {
+	return percy.ParseProtectionProfiles(val)
+}
+
+func RegisterTunnelCodec(codec TunnelCodec) {
+	percy.RegisterTunnelCodec(codec)
+}
+
+func LookupTunnelCodec(name string) (TunnelCodec, bool) {
+	return percy.LookupTunnelCodec(name)
+}
+
+func ParseTunnelCodecs(names string) ([]TunnelCodec, error) {
+	return percy.ParseTunnelCodecs(names)
+}
+
+// STUN, for clients and health checks
+type (
+	STUNMessage   = percy.STUNMessage
+	TransactionID = percy.TransactionID
+)
+
+func NewBindingRequest(txnID TransactionID, password string) *STUNMessage {
+	return percy.NewBindingRequest(txnID, password)
+}
+
+func ParseSTUN(msg []byte) (*STUNMessage, error) {
+	return percy.ParseSTUN(msg)
+}
+
+// Observing the MD: events, and stats snapshots
+type (
+	Event        = percy.Event
+	EventType    = percy.EventType
+	EventHandler = percy.EventHandler
+
+	StatsSnapshot    = percy.StatsSnapshot
+	GlobalStats      = percy.GlobalStats
+	ConferenceStats  = percy.ConferenceStats
+	AssociationStats = percy.AssociationStats
+	TrafficStats     = percy.TrafficStats
+)
+
+const (
+	EventSocketError            = percy.EventSocketError
+	EventSocketRebinding        = percy.EventSocketRebinding
+	EventSocketRebound          = percy.EventSocketRebound
+	EventParticipantRejected    = percy.EventParticipantRejected
+	EventInterfacesChanged      = percy.EventInterfacesChanged
+	EventReceiverCongested      = percy.EventReceiverCongested
+	EventReceiverFailed         = percy.EventReceiverFailed
+	EventReceiverRecovered      = percy.EventReceiverRecovered
+	EventSendError              = percy.EventSendError
+	EventConferencePaused       = percy.EventConferencePaused
+	EventConferenceResumed      = percy.EventConferenceResumed
+	EventConferenceExpiring     = percy.EventConferenceExpiring
+	EventConferenceExpired      = percy.EventConferenceExpired
+	EventAssociationResumed     = percy.EventAssociationResumed
+	EventConferenceDestroyed    = percy.EventConferenceDestroyed
+	EventSourceLost             = percy.EventSourceLost
+	EventSourceRestored         = percy.EventSourceRestored
+	EventConferenceMigrating    = percy.EventConferenceMigrating
+	EventNodeDrained            = percy.EventNodeDrained
+	EventPathChanged            = percy.EventPathChanged
+	EventAssociationEvicted     = percy.EventAssociationEvicted
+	EventDominantSpeakerChanged = percy.EventDominantSpeakerChanged
+	EventAssociationMuted       = percy.EventAssociationMuted
+	EventAssociationUnmuted     = percy.EventAssociationUnmuted
+	EventPeerReflexiveCandidate = percy.EventPeerReflexiveCandidate
+	EventEncryptionDowngraded   = percy.EventEncryptionDowngraded
+	EventForwardingLoop         = percy.EventForwardingLoop
+)
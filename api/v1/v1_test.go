@@ -0,0 +1,88 @@
+package v1
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy"
+)
+
+type testCodec struct {
+	name string
+}
+
+func (codec testCodec) Name() string {
+	return codec.name
+}
+
+func (codec testCodec) Encode(msg TunnelMessage) ([]byte, error) {
+	return msg.DTLS, nil
+}
+
+func (codec testCodec) Decode(data []byte) (TunnelMessage, error) {
+	return TunnelMessage{DTLS: data}, nil
+}
+
+func TestCodecRegistry(t *testing.T) {
+	// Codecs registered through either package are visible through the other
+	RegisterTunnelCodec(testCodec{"v1-test"})
+	if codec, ok := percy.LookupTunnelCodec("v1-test"); !ok || codec.Name() != "v1-test" {
+		t.Fatalf("Codec registered through v1 not visible through percy")
+	}
+
+	percy.RegisterTunnelCodec(testCodec{"percy-test"})
+	codecs, err := ParseTunnelCodecs("percy-test,v1-test")
+	if err != nil || len(codecs) != 2 || codecs[0].Name() != "percy-test" {
+		t.Fatalf("Codec registered through percy not visible through v1: %v", err)
+	}
+
+	data, err := codecs[0].Encode(TunnelMessage{DTLS: []byte{0x16}})
+	if err != nil || !bytes.Equal(data, []byte{0x16}) {
+		t.Fatalf("Incorrect encoding: %x %v", data, err)
+	}
+}
+
+func TestMDD(t *testing.T) {
+	md := NewMDD(Config{Capacity: 10, AssociationTimeout: time.Minute})
+	if err := md.Listen(0); err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer md.Stop()
+
+	destroyed := make(chan Event, 10)
+	md.OnEvent(func(event Event) {
+		if event.Type == EventConferenceDestroyed {
+			destroyed <- event
+		}
+	})
+
+	if err := md.CreateConference(5); err != nil {
+		t.Fatalf("Error creating conference: %v", err)
+	}
+	md.SetConferenceMode(5, ModeSFU)
+
+	found := false
+	for _, conf := range md.StatsSnapshot().Conferences {
+		found = found || conf.ID == 5
+	}
+	if !found {
+		t.Fatalf("Conference not in stats")
+	}
+
+	if err := md.SetKeys(0x1234, HBHKeys{Profile: SRTP_AEAD_AES_128_GCM}); err == nil {
+		t.Fatalf("Keys set with a single-AEAD profile")
+	}
+	if err := md.DestroyConference(5); err != nil {
+		t.Fatalf("Error destroying conference: %v", err)
+	}
+	select {
+	case <-destroyed:
+	case <-time.After(time.Second):
+		t.Fatalf("No event for the destroyed conference")
+	}
+
+	if EventForwardingLoop.String() != "ForwardingLoop" || ModeRelay.String() != "relay" {
+		t.Fatalf("Incorrect names: %v %v", EventForwardingLoop, ModeRelay)
+	}
+}
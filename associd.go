@@ -0,0 +1,68 @@
+package percy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Association IDs are 16 bits, since that's what the KMF tunnel carries, and
+// are derived from the client's address.  With enough clients, two addresses
+// will get the same ID, and without a check, the second client's packets
+// would be taken for the first's and its media delivered to the wrong place.
+// So when an address's ID belongs to an association at another address, the
+// MD tries again with the next attempt number, and counts the collision.
+// The ID it settles on is recorded as a path of the address, so that the
+// client keeps it after the association holding the first ID goes; the
+// path is forgotten with the association.
+//
+// The IDs can be derived differently by setting MDD.AssociationIDs, e.g., to
+// give each signaling session a block of its own.
+
+const maxAssocIDAttempts = 16
+
+// Derives an association ID from a client's address.  attempt counts up
+// from zero while the IDs it returns are taken by other clients.
+type AssociationIDFunc func(addr net.Addr, attempt int) AssociationID
+
+// The default AssociationIDFunc, which hashes the address and attempt number
+func HashAssociationID(addr net.Addr, attempt int) AssociationID {
+	if attempt == 0 {
+		return addrToAssoc(addr)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(addr.String()))
+	binary.Write(h, binary.BigEndian, uint32(attempt))
+	sum := h.Sum(nil)
+	return AssociationID(binary.BigEndian.Uint16(sum[:2]))
+}
+
+// Returns the ID for a client's address, and whether it belongs to a known
+// association.  IDs held by another address, or by an injector, are skipped.
+func (mdd *MDD) addressAssoc(addr net.Addr) (AssociationID, bool, error) {
+	generate := mdd.AssociationIDs
+	if generate == nil {
+		generate = HashAssociationID
+	}
+
+	for attempt := 0; attempt < maxAssocIDAttempts; attempt++ {
+		assocID := generate(addr, attempt)
+		assoc, known := mdd.assocs.get(assocID)
+
+		mdd.mu.Lock()
+		collides := known && (assoc.injector != nil || (assoc.addr != nil && assoc.addr.String() != addr.String()))
+		if collides && attempt == 0 {
+			mdd.stats.collisions += 1
+		}
+		if !collides && attempt > 0 {
+			mdd.paths[addr.String()] = assocID
+		}
+		mdd.mu.Unlock()
+		if !collides {
+			return assocID, known, nil
+		}
+	}
+	return 0, false, fmt.Errorf("No free association ID for %v", addr)
+}
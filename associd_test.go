@@ -0,0 +1,77 @@
+package percy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestAssociationIDCollision(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+
+	// Every address starts out with the same ID
+	mdd.AssociationIDs = func(addr net.Addr, attempt int) AssociationID {
+		return AssociationID(100 + attempt)
+	}
+
+	first, _ := NewClient(network, "10.0.0.1:5000")
+	defer first.Stop()
+	second, _ := NewClient(network, "10.0.0.2:5000")
+	defer second.Stop()
+
+	media := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	first.Write(media)
+	AssertNotRecvPacket(t, first, "Media looped back to the sender")
+	second.Write(media)
+	AssertRecvPacket(t, first, media, "Media not forwarded between colliding clients")
+	AssertNotRecvPacket(t, second, "Media delivered to the wrong client")
+
+	stats := mdd.StatsSnapshot()
+	if stats.Global.Associations != 2 || stats.Global.Collisions != 1 {
+		t.Fatalf("Incorrect association stats: %+v", stats.Global)
+	}
+
+	ids := map[AssociationID]string{}
+	for _, assoc := range stats.Associations {
+		ids[assoc.ID] = assoc.Address
+	}
+	if ids[100] != "10.0.0.1:5000" || ids[101] != "10.0.0.2:5000" {
+		t.Fatalf("Incorrect association IDs: %v", ids)
+	}
+
+	// The second client keeps its ID once the first ID is free again
+	if err := mdd.RemoveClient(100); err != nil {
+		t.Fatalf("Error removing client: %v", err)
+	}
+	second.Write(media)
+	AssertNotRecvPacket(t, second, "Media looped back to the sender")
+	stats = mdd.StatsSnapshot()
+	if len(stats.Associations) != 1 || stats.Associations[0].ID != 101 {
+		t.Fatalf("Client moved to another ID: %+v", stats.Associations)
+	}
+
+	// And the assignment goes with the association
+	if err := mdd.RemoveClient(101); err != nil {
+		t.Fatalf("Error removing client: %v", err)
+	}
+	mdd.mu.Lock()
+	_, recorded := mdd.paths["10.0.0.2:5000"]
+	mdd.mu.Unlock()
+	if recorded {
+		t.Fatalf("Assignment kept after the association was removed")
+	}
+}
+
+func TestHashAssociationID(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	if HashAssociationID(addr, 0) != addrToAssoc(addr) {
+		t.Fatalf("First attempt doesn't match the address hash")
+	}
+	if HashAssociationID(addr, 1) == HashAssociationID(addr, 0) {
+		t.Fatalf("Retry gave the same ID")
+	}
+}
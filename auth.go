@@ -0,0 +1,107 @@
+package percy
+
+import (
+	"crypto/md5"
+	"sync"
+
+	"github.com/bifurcation/percy/internal/cryptoutil"
+)
+
+// AuthProvider answers every credential lookup the MD needs to make, so that
+// deployments can back them with LDAP, a database, or a secret store.
+type AuthProvider interface {
+	// ICEPassword returns the local ICE password that goes with a local ufrag
+	ICEPassword(ufrag string) (string, bool)
+
+	// TURNKey returns the long-term credential key for a user in a realm,
+	// i.e., MD5(username ":" realm ":" password) per RFC 5389 §15.4
+	TURNKey(username, realm string) ([]byte, bool)
+
+	// AdminTokenValid reports whether a token grants access to the admin API
+	AdminTokenValid(token string) bool
+}
+
+// MemoryAuthProvider is the default AuthProvider, holding all credentials in
+// memory.  It is safe for concurrent use.
+type MemoryAuthProvider struct {
+	mu           sync.RWMutex
+	icePasswords map[string]string
+	turnKeys     map[string][]byte
+	adminTokens  []string
+}
+
+func NewMemoryAuthProvider() *MemoryAuthProvider {
+	return &MemoryAuthProvider{
+		icePasswords: map[string]string{},
+		turnKeys:     map[string][]byte{},
+		adminTokens:  []string{},
+	}
+}
+
+func TURNLongTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+func turnKeyIndex(username, realm string) string {
+	return username + "\x00" + realm
+}
+
+func (auth *MemoryAuthProvider) SetICEPassword(ufrag, password string) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	auth.icePasswords[ufrag] = password
+}
+
+func (auth *MemoryAuthProvider) RemoveICEPassword(ufrag string) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	delete(auth.icePasswords, ufrag)
+}
+
+func (auth *MemoryAuthProvider) SetTURNCredential(username, realm, password string) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	auth.turnKeys[turnKeyIndex(username, realm)] = TURNLongTermKey(username, realm, password)
+}
+
+func (auth *MemoryAuthProvider) AddAdminToken(token string) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if !cryptoutil.OneOf(token, auth.adminTokens) {
+		auth.adminTokens = append(auth.adminTokens, token)
+	}
+}
+
+func (auth *MemoryAuthProvider) RemoveAdminToken(token string) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	tokens := []string{}
+	for _, existing := range auth.adminTokens {
+		if existing != token {
+			tokens = append(tokens, existing)
+		}
+	}
+	auth.adminTokens = tokens
+}
+
+func (auth *MemoryAuthProvider) ICEPassword(ufrag string) (string, bool) {
+	auth.mu.RLock()
+	defer auth.mu.RUnlock()
+	password, ok := auth.icePasswords[ufrag]
+	return password, ok
+}
+
+func (auth *MemoryAuthProvider) TURNKey(username, realm string) ([]byte, bool) {
+	auth.mu.RLock()
+	defer auth.mu.RUnlock()
+	key, ok := auth.turnKeys[turnKeyIndex(username, realm)]
+	return key, ok
+}
+
+func (auth *MemoryAuthProvider) AdminTokenValid(token string) bool {
+	auth.mu.RLock()
+	defer auth.mu.RUnlock()
+	// A map lookup would leak how much of a guessed token is right
+	return len(token) > 0 && cryptoutil.OneOf(token, auth.adminTokens)
+}
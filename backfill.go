@@ -0,0 +1,69 @@
+package percy
+
+import (
+	"time"
+)
+
+// Clients start sending media as soon as their own DTLS handshake is done,
+// which can be before the KD has sent the MD their hop-by-hop keys.  Media
+// that arrives in that window can't be decrypted, and the first packets of a
+// video stream are its keyframe, so receivers would wait for the next one.
+// With BackfillPackets set, the MD holds up to that many SRTP packets from
+// each association until its first keys are installed, and then runs them
+// through the SRTP engine ahead of the next packet from that client, in the
+// order they arrived.  Packets held longer than backfillMaxAge are stale by
+// then, and are dropped.
+
+const backfillMaxAge = 2 * time.Second
+
+// Holds an SRTP packet from an association that has no keys yet.  Returns
+// false if the association has keys, or backfill is off.
+func (mdd *MDD) holdForKeys(sender *association, msg []byte, now time.Time, trace *packetTrace) bool {
+	if mdd.BackfillPackets <= 0 {
+		return false
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if sender.keyEpoch > 0 {
+		return false
+	}
+
+	if len(sender.early) >= mdd.BackfillPackets {
+		mdd.stats.unfilled += 1
+		trace.log("decrypt", "dropped: no keys, and the backfill buffer is full")
+		return true
+	}
+	sender.early = append(sender.early, packet{msg: msg, recvTime: now})
+	trace.log("decrypt", "held until keys are installed")
+	return true
+}
+
+// Runs the packets held for an association through the SRTP engine, once it
+// has keys.  Runs on the processing loop.
+func (mdd *MDD) backfill(sender *association, now time.Time) {
+	mdd.mu.Lock()
+	if sender.keyEpoch == 0 || len(sender.early) == 0 {
+		mdd.mu.Unlock()
+		return
+	}
+	early := sender.early
+	sender.early = nil
+	mdd.mu.Unlock()
+
+	for _, pkt := range early {
+		if now.Sub(pkt.recvTime) > backfillMaxAge {
+			mdd.mu.Lock()
+			mdd.stats.unfilled += 1
+			mdd.mu.Unlock()
+			continue
+		}
+
+		trace := mdd.startTrace(sender.id, packetSSRC(packetClassSRTP, pkt.msg))
+		trace.log("decrypt", "backfilled after %v", now.Sub(pkt.recvTime))
+		mdd.mu.Lock()
+		mdd.stats.backfilled += 1
+		mdd.mu.Unlock()
+		mdd.handleSRTP(sender, pkt.msg, pkt.recvTime, trace)
+	}
+}
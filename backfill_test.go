@@ -0,0 +1,45 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackfill(t *testing.T) {
+	mdd := NewMDD()
+	mdd.BackfillPackets = 2
+	mdd.SetAssociationConference(0x0001, DefaultConfID)
+	sender := mdd.association(0x0001)
+
+	now := time.Now()
+	srtp := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	stale := now.Add(-2 * backfillMaxAge)
+	for _, at := range []time.Time{stale, now, now} {
+		if !mdd.holdForKeys(sender, srtp, at, nil) {
+			t.Fatalf("Packet without keys not held")
+		}
+	}
+	if len(sender.early) != 2 || mdd.stats.unfilled != 1 {
+		t.Fatalf("Incorrect backfill buffer: %d held, %d dropped", len(sender.early), mdd.stats.unfilled)
+	}
+
+	// Nothing is released until there are keys
+	mdd.backfill(sender, now)
+	if len(sender.early) != 2 {
+		t.Fatalf("Packets released without keys")
+	}
+
+	sender.keyEpoch = 1
+	mdd.backfill(sender, now)
+	if len(sender.early) != 0 || mdd.stats.backfilled != 1 || mdd.stats.unfilled != 2 {
+		t.Fatalf("Incorrect backfill: %d left, %d backfilled, %d dropped", len(sender.early), mdd.stats.backfilled, mdd.stats.unfilled)
+	}
+	if mdd.holdForKeys(sender, srtp, now, nil) {
+		t.Fatalf("Packet held after keys were installed")
+	}
+
+	mdd.BackfillPackets = 0
+	if mdd.holdForKeys(mdd.association(0x0002), srtp, now, nil) {
+		t.Fatalf("Packet held with backfill off")
+	}
+}
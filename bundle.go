@@ -0,0 +1,92 @@
+package percy
+
+import (
+	"fmt"
+	"sort"
+)
+
+// With BUNDLE (RFC 8843), a client sends all of its media sections over one
+// transport, and the SSRCs alone don't say which m-line each stream belongs
+// to.  With MIDExtensionID set, the MD reads the MID header extension (and
+// the RID, with RIDExtensionID) of each packet a client sends, and binds the
+// SSRC to the media section and RTP stream it names.  Both are in the clear
+// under PERC.  Clients send them until they know the other side has
+// learned the SSRC, so bindings are kept for the life of the association,
+// not only while the stream is active.
+//
+// The bindings are in each stream's /stats (`mid`, `rid`), and
+// BundleStreams and BundleSSRC let signaling turn an m-line into SSRCs, e.g.,
+// to Subscribe a receiver to it.  At most bundleMaxStreams SSRCs are bound
+// per association.
+
+const bundleMaxStreams = 64
+
+// The media section and RTP stream an SSRC was sent for
+type BundleStream struct {
+	SSRC uint32 `json:"ssrc"`
+	MID  string `json:"mid,omitempty"`
+	RID  string `json:"rid,omitempty"`
+}
+
+// Binds a packet's SSRC to the MID and RID it carries.  The caller holds
+// mdd.mu.
+func (mdd *MDD) learnBundle(assoc *association, header *RTPHeader) {
+	mid, hasMID := header.ExtensionElement(mdd.MIDExtensionID)
+	rid, hasRID := header.ExtensionElement(mdd.RIDExtensionID)
+	if !hasMID && !hasRID {
+		return
+	}
+
+	stream, ok := assoc.bundle[header.SSRC]
+	if !ok {
+		if len(assoc.bundle) >= bundleMaxStreams {
+			return
+		}
+		if assoc.bundle == nil {
+			assoc.bundle = map[uint32]*BundleStream{}
+		}
+		stream = &BundleStream{SSRC: header.SSRC}
+		assoc.bundle[header.SSRC] = stream
+	}
+	if hasMID {
+		stream.MID = string(mid)
+	}
+	if hasRID {
+		stream.RID = string(rid)
+	}
+}
+
+// Lists the streams a sender has been heard sending, by SSRC
+func (mdd *MDD) BundleStreams(senderID AssociationID) ([]BundleStream, error) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assoc, ok := mdd.assocs.get(senderID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown client [%04x]", senderID)
+	}
+	streams := make([]BundleStream, 0, len(assoc.bundle))
+	for _, stream := range assoc.bundle {
+		streams = append(streams, *stream)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].SSRC < streams[j].SSRC })
+	return streams, nil
+}
+
+// Returns the SSRC a sender uses for a media section, and RTP stream if it
+// sends more than one there (empty otherwise)
+func (mdd *MDD) BundleSSRC(senderID AssociationID, mid, rid string) (uint32, bool) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assoc, ok := mdd.assocs.get(senderID)
+	if !ok {
+		return 0, false
+	}
+	for ssrc, stream := range assoc.bundle {
+		if stream.MID == mid && stream.RID == rid {
+			return ssrc, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,67 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestBundleDemux(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.MIDExtensionID = 3
+	mdd.RIDExtensionID = 5
+
+	clients := newKeyedClients(t, network, mdd, "10.0.0.1:5000", "10.0.0.2:5000")
+
+	// Audio in section "0", and the high layer of video in section "1"; the
+	// last packet no longer carries the MID
+	sender, receiver := clients[0], clients[1]
+	packets := [][]byte{
+		{
+			0x90, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+			0xbe, 0xde, 0x00, 0x01, 0x30, '0', 0x00, 0x00,
+			0xaa,
+		},
+		{
+			0x90, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+			0xbe, 0xde, 0x00, 0x01, 0x30, '1', 0x50, 'h',
+			0xaa,
+		},
+		{
+			0x80, 0x60, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+			0xaa,
+		},
+	}
+	for _, pkt := range packets {
+		sender.Write(pkt)
+		AssertRecvPacket(t, receiver, pkt, "SRTP packet not forwarded")
+	}
+
+	streams, err := mdd.BundleStreams(sender.Assoc())
+	if err != nil {
+		t.Fatalf("Error listing streams: %v", err)
+	}
+	if len(streams) != 2 || streams[0] != (BundleStream{SSRC: 1, MID: "0"}) || streams[1] != (BundleStream{SSRC: 2, MID: "1", RID: "h"}) {
+		t.Fatalf("Incorrect streams: %+v", streams)
+	}
+	if ssrc, ok := mdd.BundleSSRC(sender.Assoc(), "1", "h"); !ok || ssrc != 2 {
+		t.Fatalf("Incorrect SSRC for section 1: %08x %v", ssrc, ok)
+	}
+	if _, ok := mdd.BundleSSRC(sender.Assoc(), "2", ""); ok {
+		t.Fatalf("SSRC found for an unknown section")
+	}
+	if _, err := mdd.BundleStreams(0xffff); err == nil {
+		t.Fatalf("Streams listed for an unknown client")
+	}
+
+	for _, stats := range mdd.StatsSnapshot().Associations {
+		if stats.ID != sender.Assoc() {
+			continue
+		}
+		if len(stats.Streams) != 2 || stats.Streams[1].MID != "1" || stats.Streams[1].RID != "h" {
+			t.Fatalf("Streams not demuxed in stats: %+v", stats.Streams)
+		}
+	}
+}
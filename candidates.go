@@ -0,0 +1,106 @@
+package percy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// An ICE-lite MD never gathers candidates of its own, but it still learns
+// the client's peer-reflexive ones (RFC 8445, section 7.3.1.3): addresses
+// that a check with valid credentials arrives from, but that signaling never
+// gave it.  Full ICE agents would add them as candidate pairs, so the MD
+// raises an EventPeerReflexiveCandidate event for each, and keeps them, so
+// that signaling can move the association to one with AdoptCandidate,
+// rather than waiting for the client to nominate it or send media on it.
+
+// Records an address a check verified, if it isn't the association's
+// current path.  Returns whether it's new.  The caller holds mdd.mu.
+func (mdd *MDD) learnCandidate(assoc *association, addr net.Addr) bool {
+	key := addr.String()
+	if assoc.addr == nil || assoc.addr.String() == key {
+		return false
+	}
+	if _, ok := assoc.candidates[key]; ok {
+		return false
+	}
+
+	if assoc.candidates == nil {
+		assoc.candidates = map[string]net.Addr{}
+	}
+	assoc.candidates[key] = addr
+	return true
+}
+
+// Returns the peer-reflexive candidates learned for an association, other
+// than its current path
+func (mdd *MDD) PeerReflexiveCandidates(assocID AssociationID) ([]string, error) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assoc, ok := mdd.assocs.get(assocID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown client [%04x]", assocID)
+	}
+
+	candidates := []string{}
+	for key := range assoc.candidates {
+		if assoc.addr == nil || assoc.addr.String() != key {
+			candidates = append(candidates, key)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates, nil
+}
+
+// Makes a peer-reflexive candidate an association's current path, as
+// nominating it would
+func (mdd *MDD) AdoptCandidate(assocID AssociationID, addr string) error {
+	mdd.mu.Lock()
+	assoc, ok := mdd.assocs.get(assocID)
+	if !ok {
+		mdd.mu.Unlock()
+		return fmt.Errorf("Unknown client [%04x]", assocID)
+	}
+	candidate, learned := assoc.candidates[addr]
+	bound := assoc.dtls != nil
+	mdd.mu.Unlock()
+
+	switch {
+	case !learned:
+		return fmt.Errorf("No peer-reflexive candidate %s for client [%04x]", addr, assocID)
+	case bound:
+		return fmt.Errorf("Client [%04x] is bound to its DTLS path", assocID)
+	}
+	return mdd.runOnLoop(func() { mdd.movePath(assoc, candidate) })
+}
+
+func (api *AdminAPI) handleCandidates(w http.ResponseWriter, r *http.Request) {
+	assocID, err := strconv.ParseUint(r.FormValue("assoc"), 0, 16)
+	if err != nil {
+		http.Error(w, "Invalid association ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		candidates, err := api.mdd.PeerReflexiveCandidates(AssociationID(assocID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, candidates)
+
+	case http.MethodPost:
+		if err := api.mdd.AdoptCandidate(AssociationID(assocID), r.FormValue("addr")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
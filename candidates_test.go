@@ -0,0 +1,93 @@
+package percy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestPeerReflexiveCandidates(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+
+	auth := NewMemoryAuthProvider()
+	auth.AddAdminToken("secret")
+	mdd.Auth = auth
+
+	learned := make(chan Event, 10)
+	mdd.OnEvent(func(evt Event) {
+		if evt.Type == EventPeerReflexiveCandidate {
+			learned <- evt
+		}
+	})
+
+	peer, _ := NewClient(network, "10.0.0.1:5000")
+	defer peer.Stop()
+	client, _ := NewClient(network, "10.0.0.2:5000")
+	defer client.Stop()
+	assocID := client.Assoc()
+	mdd.SetICECredentials(assocID, "assoc", "0123456789abcdef01234567")
+
+	check := func(client *Client) {
+		request := NewBindingRequest(TransactionID{7, 8, 9}, "0123456789abcdef01234567")
+		request.Add(ATTR_USERNAME, []byte("assoc:remote"))
+		request.AddMessageIntegrity()
+		msg, _ := request.Serialize()
+		client.Write(msg)
+
+		if _, err := client.Recv(); err != nil {
+			t.Fatalf("No STUN response: %v", err)
+		}
+	}
+
+	// The first path isn't a candidate
+	check(client)
+	select {
+	case evt := <-learned:
+		t.Fatalf("First path reported as a candidate: %+v", evt)
+	default:
+	}
+
+	rebound, _ := NewClient(network, "10.0.0.2:6000")
+	defer rebound.Stop()
+	check(rebound)
+	check(rebound)
+	if evt := <-learned; evt.Assoc != assocID || evt.Detail != "10.0.0.2:6000" {
+		t.Fatalf("Incorrect candidate event: %+v", evt)
+	}
+	if len(learned) > 0 {
+		t.Fatalf("Candidate reported more than once")
+	}
+
+	api := NewAdminAPI(mdd)
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/candidates?assoc=%d", assocID), nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	var candidates []string
+	if err := json.Unmarshal(w.Body.Bytes(), &candidates); err != nil || len(candidates) != 1 || candidates[0] != "10.0.0.2:6000" {
+		t.Fatalf("Incorrect candidates: %d %s", w.Code, w.Body.String())
+	}
+
+	if err := mdd.AdoptCandidate(assocID, "10.0.0.2:7000"); err == nil {
+		t.Fatalf("Adopted an unknown candidate")
+	}
+	if err := mdd.AdoptCandidate(assocID, "10.0.0.2:6000"); err != nil {
+		t.Fatalf("Error adopting candidate: %v", err)
+	}
+
+	media := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	peer.Write(media)
+	AssertRecvPacket(t, rebound, media, "Media not sent to the adopted candidate")
+	AssertNotRecvPacket(t, client, "Media sent on the old path")
+
+	if candidates, _ := mdd.PeerReflexiveCandidates(assocID); len(candidates) != 0 {
+		t.Fatalf("Current path listed as a candidate: %v", candidates)
+	}
+}
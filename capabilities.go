@@ -0,0 +1,99 @@
+package percy
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Capabilities let orchestration tooling discover what a given percy build
+// supports before invoking it.  Each optional subsystem is listed with its own
+// version, which is bumped whenever its admin API or behavior changes
+// incompatibly; subsystems this build doesn't have are listed as unsupported,
+// so that tooling can tell "not built in" from "unknown to this version".
+
+// Version of the admin API as a whole
+const AdminAPIVersion = 1
+
+type Feature struct {
+	Name      string `json:"name"`
+	Version   int    `json:"version,omitempty"`
+	Supported bool   `json:"supported"`
+}
+
+type Capabilities struct {
+	APIVersion int       `json:"api_version"`
+	Features   []Feature `json:"features"`
+}
+
+var (
+	featuresMu sync.Mutex
+	features   = map[string]Feature{}
+)
+
+func init() {
+	for _, feature := range []Feature{
+		{Name: "stats", Version: 1, Supported: true},
+		{Name: "metrics", Version: 1, Supported: true},
+		{Name: "trace", Version: 1, Supported: true},
+		{Name: "loopback", Version: 1, Supported: true},
+		{Name: "heap-reports", Version: 1, Supported: true},
+		{Name: "forwarding-modes", Version: 1, Supported: true},
+		{Name: "data-channels", Version: 1, Supported: true},
+		{Name: "tunnel-codecs", Version: 1, Supported: true},
+		{Name: "state-snapshot", Version: 1, Supported: true},
+		{Name: "long-term-credentials", Version: 1, Supported: true},
+		{Name: "tenants", Version: 1, Supported: true},
+		{Name: "participant-limits", Version: 1, Supported: true},
+		{Name: "unknown-traffic", Version: 1, Supported: true},
+		{Name: "pause", Version: 1, Supported: true},
+		{Name: "conference-expiry", Version: 1, Supported: true},
+		{Name: "reconnect-resume", Version: 1, Supported: true},
+		{Name: "placement", Version: 1, Supported: true},
+		{Name: "egress-rules", Version: 1, Supported: true},
+		{Name: "client-admission", Version: 1, Supported: true},
+		{Name: "conference-lifecycle", Version: 1, Supported: true},
+		{Name: "media-injection", Version: 1, Supported: true},
+		{Name: "ssrc-routing", Version: 1, Supported: true},
+		{Name: "source-loss", Version: 1, Supported: true},
+		{Name: "bitrate-allocation", Version: 1, Supported: true},
+		{Name: "rtcp-termination", Version: 1, Supported: true},
+		{Name: "keyframe-requests", Version: 1, Supported: true},
+		{Name: "drain", Version: 1, Supported: true},
+		{Name: "ice-paths", Version: 1, Supported: true},
+		{Name: "dominant-speaker", Version: 1, Supported: true},
+		{Name: "simulcast", Version: 1, Supported: true},
+		{Name: "last-n", Version: 1, Supported: true},
+		{Name: "recording"},
+		{Name: "cascade"},
+		{Name: "turn"},
+	} {
+		RegisterFeature(feature)
+	}
+}
+
+// Adds or replaces a feature in the capabilities list, so that subsystems
+// (including ones added by applications) can advertise themselves
+func RegisterFeature(feature Feature) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	features[feature.Name] = feature
+}
+
+func GetCapabilities() *Capabilities {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+
+	caps := &Capabilities{APIVersion: AdminAPIVersion, Features: []Feature{}}
+	for _, feature := range features {
+		caps.Features = append(caps.Features, feature)
+	}
+	sort.Slice(caps.Features, func(i, j int) bool {
+		return caps.Features[i].Name < caps.Features[j].Name
+	})
+	return caps
+}
+
+func (api *AdminAPI) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, GetCapabilities())
+}
@@ -0,0 +1,375 @@
+// Package client implements the endpoint side of PERC, both for automated
+// tests and for building native Go conferencing clients.
+//
+// A Client runs over a single datagram socket to the MD.  It does ICE
+// connectivity checks against the MD (which is ICE-lite), runs DTLS-SRTP
+// through the MD to the KD, and then protects media with the keys from the
+// handshake.  If a double profile is negotiated (RFC 8723), the keying
+// material holds both the inner (end-to-end) and outer (hop-by-hop) keys, and
+// media is protected with both layers.  With an MD in SFU mode, the MD is the
+// DTLS peer and media has one layer.
+//
+// DTLS is provided by pion/dtls, which doesn't yet accept the double profiles
+// in a server's use_srtp extension, so for now handshakes that select one
+// fail with an error.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bifurcation/percy"
+	"github.com/bifurcation/percy/internal/cryptoutil"
+	"github.com/fluffy/rtp"
+	"github.com/pion/dtls/v3"
+)
+
+const (
+	bufferSize        = 2048
+	stunRetransmit    = 100 * time.Millisecond
+	mediaQueueSize    = 64
+	dtlsExporterLabel = "EXTRACTOR-dtls_srtp"
+)
+
+// Key and salt lengths for each profile the client can use.  The double
+// profiles carry the inner key (salt) followed by the outer one.
+var profileParams = map[percy.ProtectionProfile]struct {
+	keyLen  int
+	saltLen int
+}{
+	percy.SRTP_AEAD_AES_128_GCM:                    {16, 12},
+	percy.SRTP_AEAD_AES_256_GCM:                    {32, 12},
+	percy.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM: {32, 24},
+	percy.DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM: {64, 24},
+}
+
+type Config struct {
+	// The MD's media address, and its ICE credentials from signaling
+	Server         net.Addr
+	RemoteUfrag    string
+	RemotePassword string
+	LocalUfrag     string
+
+	Certificate tls.Certificate
+
+	// SHA-256 fingerprint of the DTLS peer's certificate from signaling,
+	// e.g., "4E:53:20:...".  If empty, the certificate isn't checked.
+	Fingerprint string
+
+	// In order of preference; defaults to the double profiles
+	Profiles []percy.ProtectionProfile
+}
+
+type Client struct {
+	config Config
+	conn   net.PacketConn
+	dtls   *dtlsTransport
+	stun   chan *percy.STUNMessage
+	media  chan []byte
+	closed chan struct{}
+	once   sync.Once
+
+	mu      sync.Mutex
+	session *dtls.Conn
+	recv    *rtp.RTPSession
+	send    *rtp.RTPSession
+	profile percy.ProtectionProfile
+}
+
+// Creates a client that talks to the MD over conn.  The client takes
+// ownership of conn, and closes it when the client is closed.
+func New(conn net.PacketConn, config Config) *Client {
+	if len(config.Profiles) == 0 {
+		config.Profiles = []percy.ProtectionProfile{
+			percy.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM,
+			percy.DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM,
+		}
+	}
+
+	c := &Client{
+		config: config,
+		conn:   conn,
+		stun:   make(chan *percy.STUNMessage, 1),
+		media:  make(chan []byte, mediaQueueSize),
+		closed: make(chan struct{}),
+	}
+	c.dtls = newDTLSTransport(c)
+
+	go c.readLoop()
+	return c
+}
+
+// Checks connectivity to the MD, then runs the DTLS handshake and sets up
+// SRTP.  Media can be sent and received once this returns without error.
+func (c *Client) Connect(ctx context.Context) error {
+	err := c.checkConnectivity(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.handshake(ctx)
+}
+
+// The protection profile negotiated by Connect
+func (c *Client) Profile() percy.ProtectionProfile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.profile
+}
+
+// Protects and sends an RTP packet
+func (c *Client) WriteRTP(msg []byte) error {
+	c.mu.Lock()
+	send := c.send
+	c.mu.Unlock()
+
+	if send == nil {
+		return fmt.Errorf("Not connected")
+	}
+
+	out, err := send.Encode(&rtp.RTPPacket{Buffer: msg})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.conn.WriteTo(out, c.config.Server)
+	return err
+}
+
+// Returns the next RTP packet received, with protection removed
+func (c *Client) ReadRTP(ctx context.Context) ([]byte, error) {
+	select {
+	case msg := <-c.media:
+		return msg, nil
+	case <-c.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) Close() error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		session := c.session
+		c.mu.Unlock()
+		if session != nil {
+			session.Close()
+		}
+
+		close(c.closed)
+		c.conn.Close()
+	})
+	return nil
+}
+
+func (c *Client) readLoop() {
+	buf := make([]byte, bufferSize)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.Close()
+			return
+		}
+
+		if n == 0 || addr.String() != c.config.Server.String() {
+			continue
+		}
+
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+
+		// https://tools.ietf.org/html/rfc5764#section-5.1.2
+		switch B := msg[0]; {
+		case B < 2:
+			c.receiveSTUN(msg)
+		case 19 < B && B < 64:
+			c.dtls.deliver(msg)
+		case 127 < B && B < 192 && n > 1 && (msg[1] < 200 || msg[1] > 205):
+			c.receiveSRTP(msg)
+		}
+	}
+}
+
+func (c *Client) receiveSTUN(msg []byte) {
+	message, err := percy.ParseSTUN(msg)
+	if err != nil {
+		return
+	}
+
+	select {
+	case c.stun <- message:
+	default:
+	}
+}
+
+func (c *Client) receiveSRTP(msg []byte) {
+	c.mu.Lock()
+	recv := c.recv
+	c.mu.Unlock()
+
+	if recv == nil {
+		return
+	}
+
+	pkt, err := recv.Decode(msg)
+	if err != nil {
+		return
+	}
+
+	select {
+	case c.media <- pkt.Buffer:
+	default:
+		// Nobody is reading; drop, as a socket buffer would
+	}
+}
+
+// Sends Binding requests to the MD until one succeeds
+func (c *Client) checkConnectivity(ctx context.Context) error {
+	tieBreaker := make([]byte, 8)
+	rand.Read(tieBreaker)
+
+	for {
+		var txnID percy.TransactionID
+		rand.Read(txnID[:])
+
+		request := percy.NewBindingRequest(txnID, c.config.RemotePassword)
+		request.Add(percy.ATTR_USERNAME, []byte(c.config.RemoteUfrag+":"+c.config.LocalUfrag))
+		request.Add(percy.ATTR_ICE_CONTROLLING, tieBreaker)
+		request.Add(percy.ATTR_USE_CANDIDATE, []byte{})
+		request.AddMessageIntegrity()
+		request.AddFingerprint()
+
+		msg, err := request.Serialize()
+		if err != nil {
+			return err
+		}
+
+		_, err = c.conn.WriteTo(msg, c.config.Server)
+		if err != nil {
+			return err
+		}
+
+		timeout := time.After(stunRetransmit)
+		for waiting := true; waiting; {
+			select {
+			case response := <-c.stun:
+				if response.TransactionID() != txnID {
+					continue
+				}
+				if response.Type() != percy.MSG_TYPE_SUCCESS {
+					return fmt.Errorf("ICE connectivity check failed: %v", response)
+				}
+				return nil
+			case <-timeout:
+				waiting = false
+			case <-c.closed:
+				return net.ErrClosed
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func (c *Client) handshake(ctx context.Context) error {
+	profiles := make([]dtls.SRTPProtectionProfile, len(c.config.Profiles))
+	for i, profile := range c.config.Profiles {
+		profiles[i] = dtls.SRTPProtectionProfile(profile)
+	}
+
+	conn, err := dtls.ClientWithOptions(c.dtls, c.config.Server,
+		dtls.WithCertificates(c.config.Certificate),
+		dtls.WithSRTPProtectionProfiles(profiles...),
+		dtls.WithExtendedMasterSecret(dtls.RequireExtendedMasterSecret),
+		// Peers use self-signed certificates, which are checked against
+		// signaling instead
+		dtls.WithInsecureSkipVerify(true),
+		dtls.WithVerifyPeerCertificate(c.verifyFingerprint))
+	if err != nil {
+		return err
+	}
+
+	err = conn.HandshakeContext(ctx)
+	if err == nil {
+		err = c.setKeys(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	c.session = conn
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) verifyFingerprint(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(c.config.Fingerprint) == 0 {
+		return nil
+	}
+
+	fingerprint := percy.CertificateFingerprint(&tls.Certificate{Certificate: rawCerts})
+	if !cryptoutil.EqualString(fingerprint, strings.ToUpper(c.config.Fingerprint)) {
+		return fmt.Errorf("Certificate fingerprint mismatch: %s != %s", fingerprint, c.config.Fingerprint)
+	}
+	return nil
+}
+
+// Derives SRTP keys from the DTLS session, as in RFC 5764
+func (c *Client) setKeys(conn *dtls.Conn) error {
+	srtpProfile, ok := conn.SelectedSRTPProtectionProfile()
+	if !ok {
+		return fmt.Errorf("No SRTP protection profile negotiated")
+	}
+
+	profile := percy.ProtectionProfile(srtpProfile)
+	params, ok := profileParams[profile]
+	if !ok {
+		return fmt.Errorf("Unsupported SRTP protection profile %v", profile)
+	}
+
+	state, ok := conn.ConnectionState()
+	if !ok {
+		return fmt.Errorf("DTLS connection state unavailable")
+	}
+
+	keyLen, saltLen := params.keyLen, params.saltLen
+	material, err := state.ExportKeyingMaterial(dtlsExporterLabel, nil, 2*(keyLen+saltLen))
+	if err != nil {
+		return err
+	}
+
+	// client key | server key | client salt | server salt
+	clientKey := material[:keyLen]
+	serverKey := material[keyLen : 2*keyLen]
+	clientSalt := material[2*keyLen : 2*keyLen+saltLen]
+	serverSalt := material[2*keyLen+saltLen:]
+
+	recv := rtp.NewRTPSession(false)
+	err = recv.SetSRTP(rtp.CipherID(profile), true, serverKey, serverSalt)
+	if err != nil {
+		return err
+	}
+
+	send := rtp.NewRTPSession(false)
+	err = send.SetSRTP(rtp.CipherID(profile), true, clientKey, clientSalt)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recv = recv
+	c.send = send
+	c.profile = profile
+	return nil
+}
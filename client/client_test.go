@@ -0,0 +1,137 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy"
+	"github.com/bifurcation/percy/testnet"
+)
+
+const (
+	mddAddr     = "10.0.0.100:4430"
+	mddUfrag    = "fedcbafe"
+	mddPassword = "abcdefabcdefabcdefabcdefabcdefab"
+)
+
+// Starts an MD in SFU mode, so that it is the client's DTLS peer
+func newSFUModeMDD(t *testing.T, network *testnet.Network, cert *tls.Certificate) *percy.MDD {
+	auth := percy.NewMemoryAuthProvider()
+	auth.SetICEPassword(mddUfrag, mddPassword)
+
+	mdd := percy.NewMDD()
+	mdd.Auth = auth
+	mdd.DTLSCertificate = cert
+	mdd.SetConferenceMode(percy.DefaultConfID, percy.ModeSFU)
+	err := mdd.ListenTransport(func() (percy.Transport, error) {
+		return network.Listen(mddAddr)
+	})
+	if err != nil {
+		t.Fatalf("Error starting MDD: %v", err)
+	}
+	return mdd
+}
+
+func TestMediaThroughSFUMode(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../static/cert.pem", "../static/key.pem")
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+
+	network := testnet.NewNetwork()
+	mdd := newSFUModeMDD(t, network, &cert)
+	defer mdd.Stop()
+	mdd.SetRemoteFingerprintForUfrag("client", percy.CertificateFingerprint(&cert))
+
+	server, _ := net.ResolveUDPAddr("udp", mddAddr)
+	config := Config{
+		Server:         server,
+		RemoteUfrag:    mddUfrag,
+		RemotePassword: mddPassword,
+		LocalUfrag:     "client",
+		Certificate:    cert,
+		Fingerprint:    percy.CertificateFingerprint(&cert),
+		Profiles:       []percy.ProtectionProfile{percy.SRTP_AEAD_AES_128_GCM},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clients := []*Client{}
+	for _, addr := range []string{"10.0.0.1:5000", "10.0.0.2:5000"} {
+		conn, err := network.Listen(addr)
+		if err != nil {
+			t.Fatalf("Error creating socket: %v", err)
+		}
+
+		client := New(conn, config)
+		defer client.Close()
+
+		err = client.Connect(ctx)
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		if client.Profile() != percy.SRTP_AEAD_AES_128_GCM {
+			t.Fatalf("Wrong profile: %v", client.Profile())
+		}
+		clients = append(clients, client)
+	}
+
+	// The MD keys the second client just after its side of the handshake
+	// finishes, so retry until the packet gets through
+	rtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	for {
+		err = clients[0].WriteRTP(rtpPacket)
+		if err != nil {
+			t.Fatalf("Error sending RTP: %v", err)
+		}
+
+		readCtx, readCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		msg, err := clients[1].ReadRTP(readCtx)
+		readCancel()
+		if err == nil {
+			if !bytes.Equal(msg, rtpPacket) {
+				t.Fatalf("Incorrect RTP packet: %x != %x", msg, rtpPacket)
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("RTP packet was not forwarded")
+		}
+	}
+}
+
+func TestBadFingerprint(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../static/cert.pem", "../static/key.pem")
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+
+	network := testnet.NewNetwork()
+	mdd := newSFUModeMDD(t, network, &cert)
+	defer mdd.Stop()
+
+	conn, _ := network.Listen("10.0.0.1:5000")
+	server, _ := net.ResolveUDPAddr("udp", mddAddr)
+	client := New(conn, Config{
+		Server:         server,
+		RemoteUfrag:    mddUfrag,
+		RemotePassword: mddPassword,
+		LocalUfrag:     "client",
+		Certificate:    cert,
+		Fingerprint:    "00:11:22",
+		Profiles:       []percy.ProtectionProfile{percy.SRTP_AEAD_AES_128_GCM},
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err == nil {
+		t.Fatalf("Connected despite a fingerprint mismatch")
+	}
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"net"
+	"time"
+
+	"github.com/pion/transport/v5/deadline"
+)
+
+const (
+	dtlsQueueSize = 64
+)
+
+// dtlsTransport is the net.PacketConn that the DTLS client runs over.  It
+// receives the DTLS records that the read loop demultiplexes from the socket,
+// and writes straight to the socket.
+type dtlsTransport struct {
+	client       *Client
+	inbox        chan []byte
+	readDeadline *deadline.Deadline
+}
+
+func newDTLSTransport(client *Client) *dtlsTransport {
+	return &dtlsTransport{
+		client:       client,
+		inbox:        make(chan []byte, dtlsQueueSize),
+		readDeadline: deadline.New(),
+	}
+}
+
+func (dt *dtlsTransport) deliver(msg []byte) {
+	select {
+	case dt.inbox <- msg:
+	default:
+	}
+}
+
+func (dt *dtlsTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-dt.client.closed:
+		return 0, nil, net.ErrClosed
+	case <-dt.readDeadline.Done():
+		return 0, nil, dt.readDeadline.Err()
+	case msg := <-dt.inbox:
+		return copy(b, msg), dt.client.config.Server, nil
+	}
+}
+
+func (dt *dtlsTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return dt.client.conn.WriteTo(b, dt.client.config.Server)
+}
+
+// The socket is closed by the client
+func (dt *dtlsTransport) Close() error {
+	return nil
+}
+
+func (dt *dtlsTransport) LocalAddr() net.Addr {
+	return dt.client.conn.LocalAddr()
+}
+
+func (dt *dtlsTransport) SetDeadline(t time.Time) error {
+	return dt.SetReadDeadline(t)
+}
+
+func (dt *dtlsTransport) SetReadDeadline(t time.Time) error {
+	dt.readDeadline.Set(t)
+	return nil
+}
+
+func (dt *dtlsTransport) SetWriteDeadline(t time.Time) error {
+	return nil
+}
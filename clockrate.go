@@ -0,0 +1,90 @@
+package percy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Jitter (RFC 3550, Appendix A.8) and the RTP timestamps in the MD's sender
+// reports are in units of each stream's RTP clock, which depends on its
+// payload type.  Static payload types have fixed rates (RFC 3551), and
+// dynamic ones get theirs from the SDP's rtpmap lines, so applications
+// should add those to MDD.ClockRates (ClockRatesFromSDP does this).
+// Payload types that aren't listed fall back to 48kHz for audio (by
+// SlowReceivers.AudioPayloadTypes) and 90kHz for video.
+
+const (
+	defaultAudioClockRate = 48000
+	defaultVideoClockRate = 90000
+)
+
+// Clock rates for the static audio payload types, and the dynamic ones the
+// example server uses
+func DefaultClockRates() map[uint8]uint32 {
+	return map[uint8]uint32{
+		0:   8000,  // PCMU
+		8:   8000,  // PCMA
+		9:   8000,  // G.722, which keeps an 8kHz clock for historical reasons
+		109: 48000, // Opus
+		111: 48000, // Opus
+		120: 90000, // VP8
+	}
+}
+
+// Parses a list of clock rates of the form "0=8000,111=48000"
+func ParseClockRates(rates string) (map[uint8]uint32, error) {
+	parsed := map[uint8]uint32{}
+	for _, entry := range strings.Split(rates, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed clock rate %q", entry)
+		}
+		payloadType, err := strconv.ParseUint(parts[0], 10, 7)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid payload type in %q", entry)
+		}
+		rate, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil || rate == 0 {
+			return nil, fmt.Errorf("Invalid clock rate in %q", entry)
+		}
+		parsed[uint8(payloadType)] = uint32(rate)
+	}
+	return parsed, nil
+}
+
+// Collects the clock rates from the codecs' rtpmap values, e.g.,
+// "opus/48000/2".  Codecs without a usable rate are left out.
+func ClockRatesFromSDP(media []SDPMedia) map[uint8]uint32 {
+	rates := map[uint8]uint32{}
+	for _, section := range media {
+		for _, codec := range section.Codecs {
+			parts := strings.Split(codec.RTPMap, "/")
+			if len(parts) < 2 {
+				continue
+			}
+			rate, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil || rate == 0 {
+				continue
+			}
+			rates[codec.PayloadType] = uint32(rate)
+		}
+	}
+	return rates
+}
+
+// The RTP clock rate for a payload type
+func (mdd *MDD) clockRate(payloadType uint8) uint32 {
+	if rate, ok := mdd.ClockRates[payloadType]; ok {
+		return rate
+	}
+	if mdd.SlowReceivers.isAudioPayloadType(payloadType) {
+		return defaultAudioClockRate
+	}
+	return defaultVideoClockRate
+}
@@ -0,0 +1,34 @@
+package percy
+
+import (
+	"testing"
+)
+
+func TestClockRates(t *testing.T) {
+	mdd := NewMDD()
+	if mdd.clockRate(0) != 8000 || mdd.clockRate(111) != 48000 || mdd.clockRate(96) != 90000 {
+		t.Fatalf("Incorrect default clock rates")
+	}
+
+	rates, err := ParseClockRates("96=16000, 97=90000")
+	if err != nil || len(rates) != 2 || rates[96] != 16000 || rates[97] != 90000 {
+		t.Fatalf("Incorrect parsed clock rates: %v %v", rates, err)
+	}
+	for _, bad := range []string{"96", "128=8000", "96=fast", "96=0"} {
+		if _, err := ParseClockRates(bad); err == nil {
+			t.Fatalf("Invalid clock rate %q accepted", bad)
+		}
+	}
+
+	media := DefaultSDPMedia()
+	media[0].Codecs = append(media[0].Codecs, SDPCodec{PayloadType: 98, RTPMap: "ISAC/16000"}, SDPCodec{PayloadType: 99})
+	rates = ClockRatesFromSDP(media)
+	if len(rates) != 3 || rates[109] != 48000 || rates[120] != 90000 || rates[98] != 16000 {
+		t.Fatalf("Incorrect clock rates from SDP: %v", rates)
+	}
+
+	mdd.ClockRates[98] = rates[98]
+	if mdd.clockRate(98) != 16000 {
+		t.Fatalf("Configured clock rate not used")
+	}
+}
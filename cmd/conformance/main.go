@@ -0,0 +1,58 @@
+// Command conformance runs percy's interop conformance cases against an
+// external MD and/or KD, and prints a pass/fail report.  It exits non-zero if
+// any case fails.
+//
+// To test an MD's tunnel and keying, point the MD's KD at -kd-listen first.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bifurcation/percy/conformance"
+)
+
+var (
+	config = conformance.Config{
+		ICEUfrag:    "fedcbafe",
+		ICEPassword: "abcdefabcdefabcdefabcdefabcdefab",
+		Timeout:     500 * time.Millisecond,
+	}
+	jsonOutput = false
+)
+
+func main() {
+	flag.StringVar(&config.MDD, "mdd", config.MDD, "Media address of the MD under test (e.g., 10.0.0.1:4430)")
+	flag.StringVar(&config.ICEUfrag, "ice-ufrag", config.ICEUfrag, "The MD's ICE ufrag")
+	flag.StringVar(&config.ICEPassword, "ice-pwd", config.ICEPassword, "The MD's ICE password")
+	flag.StringVar(&config.KDListen, "kd-listen", config.KDListen, "Address to act as the MD's KD on (enables tunnel and keying cases)")
+	flag.StringVar(&config.KD, "kd", config.KD, "Address of the KD under test")
+	flag.DurationVar(&config.Timeout, "timeout", config.Timeout, "How long to wait for each expected packet")
+	flag.BoolVar(&jsonOutput, "json", jsonOutput, "Print the report as JSON")
+	flag.Parse()
+
+	report, err := conformance.Run(config, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "conformance:", err)
+		os.Exit(2)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "conformance:", err)
+		os.Exit(2)
+	}
+
+	if !report.Passed() {
+		os.Exit(1)
+	}
+}
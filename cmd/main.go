@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bifurcation/percy"
 	"github.com/gorilla/websocket"
@@ -16,18 +23,72 @@ import (
 )
 
 var (
-	port         = 4430
-	keyFilename  = "../static/key.pem"
-	certFilename = "../static/cert.pem"
-	htmlFilename = "../static/index.html"
-	jsFilename   = "../static/index.js"
-	portField    = "RELAY_PORT_FROM_GO_SERVER"
-	kdServer     = "localhost:4433"
-	sdp_offer    = []byte("{\"type\": \"sdp\", \"data\":\"v=0\\r\\n" +
+	port          = 4430
+	keyFilename   = "../static/key.pem"
+	certFilename  = "../static/cert.pem"
+	htmlFilename  = "../static/index.html"
+	jsFilename    = "../static/index.js"
+	portField     = "RELAY_PORT_FROM_GO_SERVER"
+	kdServer      = "localhost:4433"
+	kdCodecs      = ""
+	kdQueue       = 16
+	kdTunnelKey   = ""
+	stateFile     = ""
+	stateInterval = 5 * time.Second
+	tlsMediaAddr  = ""
+	adminToken    = ""
+	statsInterval = time.Duration(0)
+	acmeHosts     = ""
+	acmeCacheDir  = "acme-cache"
+	acmeEmail     = ""
+	acmeHTTPAddr  = ""
+	iceUfrag      = "fedcbafe"
+	icePwd        = "abcdefabcdefabcdefabcdefabcdefab"
+	mode          = percy.ModePERC
+	dataChannels  = percy.DataChannelDrop
+	tuning        = percy.DefaultRuntimeConfig()
+	reportDir     = ""
+	maxClients    = 0
+	rtcpShaping   = percy.RTCPShaping{MinInterval: time.Second}
+	ifaceInterval = 5 * time.Second
+	slowReceivers = percy.DefaultSlowReceiverPolicy()
+	reconnect     = 10 * time.Second
+	sourceLoss    = 2 * time.Second
+	maxKeyframe   = time.Duration(0)
+	keyframeReq   = percy.KeyframeRequestPLI
+	audioLevelID  = uint(0)
+	transportCCID = uint(0)
+	remb          = false
+	dedup         = false
+	probe         = false
+	originChecks  = false
+	minPoll       = 2 * time.Millisecond
+	maxPoll       = 50 * time.Millisecond
+	ridID         = uint(0)
+	midID         = uint(0)
+	backfill      = 32
+	lastN         = 0
+	sendQueue     = 0
+	assocTimeout  = 5 * time.Minute
+	strictParsing = false
+	clockRates    = ""
+	fecTypes      = ""
+	allowedTypes  = ""
+	turnNetworks  = ""
+	readerCPUs    = ""
+	processorCPUs = ""
+	stunCPUs      = ""
+	idleSaving    = true
+	keyAuditFile  = ""
+	nodeName, _   = os.Hostname()
+	region        = ""
+	capacity      = 0
+	kdFingerprint = "4E:53:20:94:6D:C6:7E:58:7C:8E:F1:08:2A:38:74:59:BF:73:48:56:AB:4D:3F:48:F1:B4:9F:B4:AF:2E:76:75"
+	sdp_offer     = []byte("{\"type\": \"sdp\", \"data\":\"v=0\\r\\n" +
 		"o=percy0.3 2633292546686233323 0 IN IP4 0.0.0.0\\r\\n" +
 		"s=-\\r\\n" +
 		"t=0 0\\r\\n" +
-		"a=fingerprint:sha-256 4E:53:20:94:6D:C6:7E:58:7C:8E:F1:08:2A:38:74:59:BF:73:48:56:AB:4D:3F:48:F1:B4:9F:B4:AF:2E:76:75\\r\\n" +
+		"a=fingerprint:sha-256 " + kdFingerprint + "\\r\\n" +
 		"a=group:BUNDLE sdparta_0 sdparta_1\\r\\n" +
 		"a=ice-options:trickle\\r\\n" +
 		"a=ice-lite\\r\\n" +
@@ -101,7 +162,7 @@ func localIP() string {
 
 var upgrader = websocket.Upgrader{} // use default options
 
-func httpServer() *http.Server {
+func httpServer(md *percy.MDD) *http.Server {
 	// Read HTML file
 	file, err := os.Open(htmlFilename)
 	panicOnError(err)
@@ -120,7 +181,6 @@ func httpServer() *http.Server {
 
 	js := string(jsData)
 
-	hostVal := localIP()
 	portVal := fmt.Sprintf("%d", port)
 
 	js = strings.Replace(js, portField, portVal, -1)
@@ -152,6 +212,8 @@ func httpServer() *http.Server {
 			return
 		}
 
+		// Looked up per client, since the host's addresses can change
+		hostVal := localIP()
 		ice_candidate_answer := []byte("{\"type\": \"ice\", \"data\":{\"candidate\": \"candidate:0 1 UDP 2122121471 " + hostVal + " " + portVal + " typ host\",\"sdpMid\": \"sdparta_0\",\"sdpMLineIndex\": 0}}")
 
 		err = c.WriteMessage(websocket.TextMessage, ice_candidate_answer)
@@ -201,11 +263,28 @@ func httpServer() *http.Server {
 			ice_ufrag := m.Medias[0].Attributes["ice-ufrag"][0]
 			fmt.Println("Media[0].ice-pwd: ", ice_pwd)
 			fmt.Println("Media[0].ice-ufrag: ", ice_ufrag)
+
+			// In SFU mode, the client's DTLS certificate has to match
+			md.SetRemoteFingerprintForUfrag(ice_ufrag, fingerprint_hash)
 		}
 	})
 
+	httpsConfig := percy.HTTPSConfig{
+		CertFile:     certFilename,
+		KeyFile:      keyFilename,
+		ACMECacheDir: acmeCacheDir,
+		ACMEEmail:    acmeEmail,
+		ACMEHTTPAddr: acmeHTTPAddr,
+	}
+	if len(acmeHosts) > 0 {
+		httpsConfig.ACMEHosts = strings.Split(acmeHosts, ",")
+	}
+
 	go func() {
-		srv.ListenAndServeTLS(certFilename, keyFilename)
+		err := percy.ListenAndServeTLS(srv, httpsConfig)
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println("https:", err)
+		}
 	}()
 
 	return srv
@@ -214,12 +293,83 @@ func httpServer() *http.Server {
 //////////
 
 func main() {
-	// Process commandline (currently, just an optional port #)
-	args := os.Args
-	if len(args) >= 2 {
-		val, err := strconv.Atoi(args[1])
+	// Process commandline (flags, then an optional port #)
+	flag.StringVar(&acmeHosts, "acme-hosts", acmeHosts, "Comma-separated host names to get ACME certificates for")
+	flag.StringVar(&acmeCacheDir, "acme-cache", acmeCacheDir, "Directory to cache ACME certificates in")
+	flag.StringVar(&acmeEmail, "acme-email", acmeEmail, "Contact email for the ACME account")
+	flag.StringVar(&acmeHTTPAddr, "acme-http", acmeHTTPAddr, "Address to answer ACME HTTP-01 challenges on (e.g., :80)")
+	flag.StringVar(&tlsMediaAddr, "tls-media", tlsMediaAddr, "TCP address to accept media over TLS on, for clients without UDP (e.g., :443)")
+	flag.DurationVar(&statsInterval, "stats-interval", statsInterval, "How often to log a stats snapshot (0 to disable)")
+	flag.DurationVar(&sourceLoss, "source-loss-timeout", sourceLoss, "How long a stream can be silent before a source-lost event (0 to disable)")
+	flag.StringVar(&clockRates, "clock-rates", clockRates, "Comma-separated RTP clock rates for payload types the defaults don't cover (e.g., 96=90000,97=16000)")
+	flag.StringVar(&allowedTypes, "payload-types", allowedTypes, "Comma-separated payload types forwarded in the default conference (empty for any)")
+	flag.StringVar(&fecTypes, "fec-payload-types", fecTypes, "Comma-separated payload types of FEC streams, which are forwarded only as budgets allow (e.g., 116,127)")
+	flag.StringVar(&turnNetworks, "turn-networks", turnNetworks, "Comma-separated CIDR blocks of the TURN relays clients use, for counting relayed clients in the stats (e.g., 192.0.2.0/24)")
+	flag.BoolVar(&strictParsing, "strict-parsing", strictParsing, "Drop packets that violate the specs, instead of only counting them")
+	flag.DurationVar(&assocTimeout, "association-timeout", assocTimeout, "How long a client can be silent before its association is evicted (0 to disable)")
+	flag.UintVar(&audioLevelID, "audio-level-id", audioLevelID, "Header extension ID of the client-to-mixer audio level, for dominant speaker detection (0 to disable)")
+	flag.UintVar(&transportCCID, "transport-cc-id", transportCCID, "Header extension ID of the transport-wide sequence number, for congestion control feedback on each leg (0 to disable)")
+	flag.BoolVar(&remb, "remb", remb, "Estimate each sender's bandwidth, and send it REMB messages (for senders without transport-wide feedback)")
+	flag.BoolVar(&dedup, "dedup", dedup, "Drop packets already forwarded to a receiver, and report forwarding loops")
+	flag.BoolVar(&probe, "probe", probe, "Probe receivers' legs with padding before moving them up a simulcast layer")
+	flag.BoolVar(&originChecks, "ice-origin-checks", originChecks, "Drop Binding requests whose USERNAME doesn't pair the association's ICE ufrags")
+	flag.DurationVar(&minPoll, "min-poll-interval", minPoll, "Shortest interval the processing loop polls at between packets, whatever the legs' RTT")
+	flag.DurationVar(&maxPoll, "max-poll-interval", maxPoll, "Longest interval the processing loop polls at between packets, used under heavy load")
+	flag.UintVar(&ridID, "rid-extension-id", ridID, "Header extension ID of the RTP stream ID, for telling simulcast layers apart by RID (0 if layers are only given by SSRC)")
+	flag.UintVar(&midID, "mid-extension-id", midID, "Header extension ID of the MID, for telling apart the media sections bundled on each client's transport (0 to disable)")
+	flag.IntVar(&backfill, "backfill-packets", backfill, "SRTP packets to hold per client until its keys arrive (0 to drop them)")
+	flag.IntVar(&sendQueue, "send-queue", sendQueue, "Packets that can wait to be sent to each client, each client with its own writer goroutine (0 to send from the processing loop)")
+	flag.IntVar(&lastN, "last-n", lastN, "Forward video only from this many recent speakers in each conference (0 for everyone; needs -audio-level-id)")
+	flag.DurationVar(&maxKeyframe, "max-keyframe-interval", maxKeyframe, "Request a keyframe from video sources that go this long without one (0 to disable)")
+	flag.TextVar(&keyframeReq, "keyframe-requests", keyframeReq, "How to ask video sources for keyframes: pli, fir (for senders that ignore PLIs), or none (only relay the receivers' requests)")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "Bearer token for the admin API at /admin/ (disabled if empty)")
+	flag.TextVar(&mode, "mode", mode, "Forwarding mode: perc, sfu (terminate DTLS locally, for clients without PERC support), or relay (forward blindly, no keys)")
+	flag.IntVar(&kdQueue, "kd-queue", kdQueue, "DTLS records to hold per client while its KD tunnel is down")
+	flag.StringVar(&kdTunnelKey, "kd-tunnel-key", kdTunnelKey, "Hex key shared with the KD, which authenticates messages under +seq codecs (at least 16 bytes)")
+	flag.StringVar(&kdCodecs, "kd-codecs", kdCodecs, "Comma-separated tunnel codecs to offer the KD, in order of preference (standard, protobuf, cbor, or any of them with +deflate for compression, then +seq for replay protection)")
+	flag.StringVar(&stateFile, "state-file", stateFile, "File to snapshot conference state to, and restore it from at startup (disabled if empty)")
+	flag.DurationVar(&stateInterval, "state-interval", stateInterval, "How often to snapshot conference state")
+	flag.TextVar(&dataChannels, "data-channels", dataChannels, "What to do with data channel traffic: drop, relay (point-to-point, between two participants), or fanout (to all participants)")
+	flag.IntVar(&tuning.MaxProcs, "max-procs", tuning.MaxProcs, "GOMAXPROCS (0 for one per CPU)")
+	flag.IntVar(&tuning.GCPercent, "gc-percent", tuning.GCPercent, "GC percent; higher values mean fewer collections and fewer latency spikes (0 to keep GOGC)")
+	flag.Int64Var(&tuning.MemoryLimit, "memory-limit", tuning.MemoryLimit, "Soft memory limit in bytes (0 for none)")
+	flag.IntVar(&tuning.Readers, "readers", tuning.Readers, "Goroutines reading the media socket")
+	flag.IntVar(&tuning.PacketQueue, "packet-queue", tuning.PacketQueue, "Packets queued between the socket readers and the processing loop")
+	flag.IntVar(&tuning.STUNWorkers, "stun-workers", tuning.STUNWorkers, "Goroutines answering STUN connectivity checks")
+	flag.IntVar(&tuning.STUNQueue, "stun-queue", tuning.STUNQueue, "STUN messages queued for the STUN workers")
+	flag.BoolVar(&tuning.ECN, "ecn", tuning.ECN, "Mark media ECN-capable and count congestion marks (Linux only)")
+	flag.BoolVar(&tuning.KernelTimestamps, "kernel-timestamps", tuning.KernelTimestamps, "Stamp packets with the kernel's receive time (Linux only)")
+	flag.StringVar(&reportDir, "report-dir", reportDir, "Directory for heap reports requested through the admin API (disabled if empty)")
+	flag.IntVar(&maxClients, "max-participants", maxClients, "Maximum participants in the conference (0 for no limit)")
+	flag.DurationVar(&rtcpShaping.MinInterval, "rtcp-interval", rtcpShaping.MinInterval, "Minimum interval between RTCP sends to each client (0 to forward immediately)")
+	flag.Float64Var(&rtcpShaping.Bandwidth, "rtcp-bandwidth", rtcpShaping.Bandwidth, "RTCP bits per second to each client (0 for no cap)")
+	flag.DurationVar(&ifaceInterval, "interface-check", ifaceInterval, "How often to check for host address changes, re-binding the media socket when they change (0 to disable)")
+	flag.DurationVar(&slowReceivers.WriteTimeout, "write-timeout", slowReceivers.WriteTimeout, "Deadline for each write to a client; clients whose writes keep timing out lose video, then everything (0 for no deadline)")
+	flag.DurationVar(&reconnect, "reconnect-grace", reconnect, "How long a client that changes address has to come back without rekeying (0 to disable)")
+	flag.StringVar(&readerCPUs, "reader-cpus", readerCPUs, "CPUs to pin the socket readers to, e.g., 0-3 (Linux only)")
+	flag.StringVar(&processorCPUs, "processor-cpus", processorCPUs, "CPUs to pin the processing loop to (Linux only)")
+	flag.StringVar(&stunCPUs, "stun-cpus", stunCPUs, "CPUs to pin the STUN workers to (Linux only)")
+	flag.BoolVar(&idleSaving, "idle-saving", idleSaving, "Slow down timers and STUN workers while there are no clients")
+	flag.StringVar(&keyAuditFile, "key-audit", keyAuditFile, "File to log key handling to for audits, without key material (- for the main log)")
+	flag.StringVar(&nodeName, "node", nodeName, "Name of this node, as reported to signaling")
+	flag.StringVar(&region, "region", region, "Region this node runs in, as reported to signaling")
+	flag.IntVar(&capacity, "capacity", capacity, "Clients this node takes before asking signaling to place them elsewhere (0 for no limit)")
+	flag.Parse()
+	tuning.Apply()
+
+	var err error
+	tuning.Affinity.Readers, err = percy.ParseCPUList(readerCPUs)
+	panicOnError(err)
+	tuning.Affinity.Processor, err = percy.ParseCPUList(processorCPUs)
+	panicOnError(err)
+	tuning.Affinity.STUN, err = percy.ParseCPUList(stunCPUs)
+	panicOnError(err)
+
+	args := flag.Args()
+	if len(args) >= 1 {
+		val, err := strconv.Atoi(args[0])
 		if err != nil {
-			fmt.Printf("Could not parse '%s' as a port number\n", args[1])
+			fmt.Printf("Could not parse '%s' as a port number\n", args[0])
 			panic(err)
 		}
 		port = val
@@ -229,22 +379,140 @@ func main() {
 	// Instantiate the interface to the KD
 	kd, err := percy.NewUDPForwarder(kdServer)
 	panicOnError(err)
+	kd.Codecs, err = percy.ParseTunnelCodecs(kdCodecs)
+	panicOnError(err)
+	kd.QueueLimit = kdQueue
+	kd.TunnelKey, err = hex.DecodeString(kdTunnelKey)
+	panicOnError(err)
 
-	// Instantiate the MD
+	// Instantiate the MD, with the ICE credentials from our SDP offer
 	md := percy.NewMDD()
+	md.Tune(tuning)
+	md.RTCPShaping = rtcpShaping
+	md.SlowReceivers = slowReceivers
+	md.ReconnectGrace = reconnect
+	md.SourceLossTimeout = sourceLoss
+	md.MaxKeyframeInterval = maxKeyframe
+	md.KeyframeRequests = keyframeReq
+	md.AudioLevelID = uint8(audioLevelID)
+	md.TransportCCID = uint8(transportCCID)
+	md.REMB = remb
+	md.Deduplicate = dedup
+	md.BandwidthProbing = probe
+	md.ICEOriginChecks = originChecks
+	md.MinPollInterval = minPoll
+	md.MaxPollInterval = maxPoll
+	md.RIDExtensionID = uint8(ridID)
+	md.MIDExtensionID = uint8(midID)
+	md.BackfillPackets = backfill
+	md.SendQueueLength = sendQueue
+	md.LastN = lastN
+	md.AssociationTimeout = assocTimeout
+	md.StrictParsing = strictParsing
+	rates, err := percy.ParseClockRates(clockRates)
+	panicOnError(err)
+	for payloadType, rate := range rates {
+		md.ClockRates[payloadType] = rate
+	}
+	md.FECPayloadTypes, err = percy.ParsePayloadTypes(fecTypes)
+	panicOnError(err)
+	md.RelayNetworks, err = percy.ParseNetworks(turnNetworks)
+	panicOnError(err)
+	md.IdleSaving = idleSaving
+	md.Node, md.Region, md.Capacity = nodeName, region, capacity
+	switch keyAuditFile {
+	case "":
+	case "-":
+		md.KeyAudit = log.New(log.Writer(), "", log.LstdFlags)
+	default:
+		auditFile, err := os.OpenFile(keyAuditFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		panicOnError(err)
+		md.KeyAudit = log.New(auditFile, "", log.LstdFlags)
+	}
+	auth := percy.NewMemoryAuthProvider()
+	auth.SetICEPassword(iceUfrag, icePwd)
+	md.Auth = auth
+	if len(adminToken) > 0 {
+		auth.AddAdminToken(adminToken)
+	}
 
 	// Wire the two together
 	kd.MD = md
 	md.KD = kd
 
+	// Pick up where we left off if we crashed.  The -mode flag still
+	// applies to the default conference.
+	if len(stateFile) > 0 {
+		err = md.LoadState(stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			panicOnError(err)
+		}
+	}
+
+	// In SFU mode, the MD answers DTLS with the web server's certificate,
+	// so the offer has to carry its fingerprint instead of the KD's
+	md.SetConferenceMode(percy.DefaultConfID, mode)
+	md.SetConferenceDataChannels(percy.DefaultConfID, dataChannels)
+	md.SetConferenceParticipantLimit(percy.DefaultConfID, maxClients)
+	allowed, err := percy.ParsePayloadTypes(allowedTypes)
+	panicOnError(err)
+	md.SetConferencePayloadTypes(percy.DefaultConfID, allowed)
+	if mode == percy.ModeSFU {
+		cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+		panicOnError(err)
+
+		md.DTLSCertificate = &cert
+		sdp_offer = bytes.Replace(sdp_offer, []byte(kdFingerprint), []byte(percy.CertificateFingerprint(&cert)), 1)
+	}
+
 	// Start up the MD
 	err = md.Listen(port)
 	panicOnError(err)
 
-	// Start up the web server
-	srv := httpServer()
+	if len(tlsMediaAddr) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+		panicOnError(err)
+
+		err = md.ListenTLS(tlsMediaAddr, &tls.Config{Certificates: []tls.Certificate{cert}})
+		panicOnError(err)
+	}
+
+	if len(stateFile) > 0 {
+		md.SnapshotState(stateFile, stateInterval)
+	}
+
+	// New clients get the new addresses; connected ones need an ICE restart,
+	// which this example's signaling can't do
+	if ifaceInterval > 0 {
+		md.OnEvent(func(evt percy.Event) {
+			if evt.Type == percy.EventInterfacesChanged {
+				fmt.Printf("Host addresses changed to %s; clients must reconnect\n", evt.Detail)
+			}
+		})
+		md.WatchInterfaces(ifaceInterval)
+	}
+
+	if statsInterval > 0 {
+		go func() {
+			for range time.Tick(statsInterval) {
+				snap, err := json.Marshal(md.StatsSnapshot())
+				panicOnError(err)
+				fmt.Println("stats:", string(snap))
+			}
+		}()
+	}
 
-	fmt.Printf("Now connect to https://localhost:%d/ with a PERC web browser\n", port)
+	// Start up the web server, including the admin API
+	admin := percy.NewAdminAPI(md)
+	admin.ReportDir = reportDir
+	http.Handle("/admin/", http.StripPrefix("/admin", admin))
+	srv := httpServer(md)
+
+	if mode != percy.ModePERC {
+		fmt.Printf("Now connect to https://localhost:%d/ with any WebRTC browser\n", port)
+	} else {
+		fmt.Printf("Now connect to https://localhost:%d/ with a PERC web browser\n", port)
+	}
 	fmt.Println("Listening, press <enter> to stop")
 	var input string
 	fmt.Scanln(&input)
@@ -0,0 +1,348 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// Associations that have not been assigned to a conference land here
+const DefaultConfID ConfID = 0
+
+// State shared by all the associations in a conference.  Each conference can
+// be served by its own KD, can restrict the SRTP profiles it offers, can run
+// in SFU or relay mode instead of PERC mode, and decides what happens to data
+// channel traffic.
+type conference struct {
+	id       ConfID
+	tunnel   KMFTunnel // If nil, the MDD's KD is used
+	profiles []ProtectionProfile
+	mode     ForwardingMode
+
+	dataChannels DataChannelPolicy
+	tenant       TenantID // Empty if the conference is not limited
+
+	maxParticipants int  // Zero if unlimited
+	paused          bool // Media is not distributed
+
+	expires time.Time // Zero if the conference doesn't expire
+	warned  bool      // The expiry warning has been raised
+
+	egressRules []EgressRule
+
+	// Downstream bits per second, and how it was last divided
+	budget     float64 // Zero for no limit
+	allocation []ReceiverAllocation
+
+	terminateRTCP bool // The MD sends its own reports on each leg
+
+	// Recent speakers, the dominant one first, and how many of them get
+	// their video forwarded (zero for everyone)
+	speakers     []AssociationID
+	speakerSince time.Time // When the dominant speaker took over
+	speakerCheck time.Time
+	lastN        int
+
+	simulcast SimulcastPolicy
+
+	socket *confSocket // Nil if the conference uses the shared socket
+
+	rewriteSSRCs bool // Receivers see stable SSRCs (SFU mode only)
+
+	requirePERC bool // Media is only forwarded with double encryption
+
+	payloadTypes map[uint8]bool // Nil if any payload type is forwarded
+}
+
+// State for a single client association
+type association struct {
+	id       AssociationID
+	addr     net.Addr // nil until we have heard from the client
+	conf     ConfID
+	recv     *rtp.RTPSession
+	send     *rtp.RTPSession
+	profile  ProtectionProfile
+	keys     *HBHKeys      // Only in PERC mode
+	keyEpoch int           // How many times keys have been installed
+	dtls     *dtlsEndpoint // Only in SFU mode
+	loopback bool
+	role     string    // For egress rules
+	created  time.Time // When the association was added
+	injector *Injector // If the MD generates this association's media
+	stats    assocCounters
+	rtcp     rtcpShaper // RTCP waiting to be sent to the client
+	health   receiverHealth
+
+	// Local ICE credentials; if empty, the MD's AuthProvider is used
+	iceUfrag    string
+	icePassword string
+
+	// The client's ICE ufrag, if signaling gave it
+	iceRemoteUfrag string
+
+	// USERNAME of the last successful Binding request
+	iceUsername string
+
+	// SHA-256 fingerprint of the client's DTLS certificate, if signaling
+	// gave it
+	remoteFingerprint string
+
+	// From the application; guarded by the registry's lock
+	labels map[string]string
+
+	// SSRCs to forward to the client; nil for all
+	subscriptions map[uint32]bool
+	withheld      map[uint32]bool // Video the conference's budget has no room for
+
+	speech speechState
+
+	// The receive context that the last keys replaced, kept for a rollover
+	// until prevRecvUntil
+	prevRecv      *rtp.RTPSession
+	prevRecvUntil time.Time
+
+	// SRTP that arrived before the first keys
+	early []packet
+
+	// SSRCs presented to the client, if its conference rewrites them
+	rewriter *ssrcRewriter
+
+	// Packets waiting to be sent, if SendQueueLength is set
+	queue *sendQueue
+
+	// Addresses it has passed ICE checks from, other than the first
+	candidates map[string]net.Addr
+
+	// The kind of path it's on (see network.go), and the address that was
+	// classified
+	network     string
+	networkAddr net.Addr
+
+	// Transport-wide congestion control: arrivals from it as a sender, and
+	// the last sequence number sent to it
+	transportCC  transportCCState
+	transportSeq uint16
+
+	// Receive-side bandwidth estimate of its leg, for REMB
+	bwe bandwidthEstimator
+
+	// Smoothed round-trip time of its leg, where the MD can measure it
+	rtt time.Duration
+
+	// As a receiver, the sequence numbers recently forwarded to it from each
+	// source SSRC
+	forwarded map[uint32]*dedupWindow
+
+	// It doesn't want FEC streams
+	noFEC bool
+
+	// Its media is refused by its conference's encryption policy
+	downgraded bool
+
+	// Payload types it sent that its conference doesn't allow
+	disallowed map[uint8]bool
+
+	// The media section and RTP stream of each SSRC it sent, by MID and RID
+	bundle map[uint32]*BundleStream
+
+	// The header extension IDs it negotiated, and the same by URI
+	extmap map[uint8]string
+	extIDs map[string]uint8
+
+	// Media the moderator has stopped forwarding
+	mutedAudio bool
+	mutedVideo bool
+
+	// Simulcast: the sender's layers, and as a receiver, the highest layer
+	// it wants, the SSRC it gets from each simulcast sender, and its
+	// budget for each video stream (zero for no limit)
+	simulcast  *simulcastLayers
+	maxLayer   SimulcastLayer
+	layers     map[AssociationID]uint32
+	videoShare float64
+
+	// The layer switch its leg is being probed for, the sequence number of
+	// the last padding packet, and when it can next be probed
+	probe        *bandwidthProbe
+	probeSeq     uint16
+	probeBackoff time.Time
+}
+
+func newAssociation(assocID AssociationID) *association {
+	return &association{
+		id:      assocID,
+		conf:    DefaultConfID,
+		recv:    rtp.NewRTPSession(false),
+		send:    rtp.NewRTPSession(false),
+		created: time.Now(),
+
+		maxLayer: LayerHigh,
+	}
+}
+
+// Returns the conference with the given ID, creating it if necessary
+func (mdd *MDD) conference(confID ConfID) *conference {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	return mdd.findOrAddConference(confID)
+}
+
+// As conference, for callers that hold mdd.mu
+func (mdd *MDD) findOrAddConference(confID ConfID) *conference {
+	conf, ok := mdd.conferences[confID]
+	if !ok {
+		conf = &conference{id: confID, profiles: []ProtectionProfile{}, lastN: mdd.LastN}
+		mdd.conferences[confID] = conf
+	}
+	return conf
+}
+
+// Returns the association with the given ID, creating it if necessary
+func (mdd *MDD) association(assocID AssociationID) *association {
+	assoc, _ := mdd.assocs.getOrAdd(assocID, func() *association {
+		return newAssociation(assocID)
+	})
+	return assoc
+}
+
+// Returns the other reachable associations in the sender's conference,
+// leaving out any in loopback and any its egress rules exclude
+func (mdd *MDD) peers(sender *association) []*association {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	return mdd.conferencePeers(sender)
+}
+
+// As peers, for callers that hold mdd.mu
+func (mdd *MDD) conferencePeers(sender *association) []*association {
+	var rules []EgressRule
+	if conf, ok := mdd.conferences[sender.conf]; ok {
+		rules = conf.egressRules
+	}
+
+	peers := []*association{}
+	for _, assoc := range mdd.assocs.snapshot() {
+		if assoc == sender || assoc.conf != sender.conf || assoc.addr == nil || assoc.loopback {
+			continue
+		}
+		if excluded(rules, sender, assoc) {
+			continue
+		}
+		peers = append(peers, assoc)
+	}
+	return peers
+}
+
+// Returns the KMF tunnel that serves an association's conference
+func (mdd *MDD) tunnel(assoc *association) KMFTunnel {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if conf, ok := mdd.conferences[assoc.conf]; ok && conf.tunnel != nil {
+		return conf.tunnel
+	}
+	return mdd.KD
+}
+
+// Routes DTLS for the given conference to its own KD instead of the MDD's
+// default one.  Passing nil reverts to the default.
+func (mdd *MDD) SetConferenceTunnel(confID ConfID, tunnel KMFTunnel) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.tunnel = tunnel
+}
+
+func (mdd *MDD) SetConferenceProfiles(confID ConfID, profiles []ProtectionProfile) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.profiles = profiles
+}
+
+// Places an association in a conference.  This can be done before the client
+// has sent any packets.  Fails if the conference is full, or its tenant is at
+// its participant quota.
+func (mdd *MDD) SetAssociationConference(assocID AssociationID, confID ConfID) error {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	assoc, known := mdd.assocs.get(assocID)
+	if !known {
+		assoc = newAssociation(assocID)
+	}
+	err := mdd.checkParticipantLimits(assoc, known, conf)
+	joined := err == nil && (!known || assoc.conf != confID)
+	if err == nil {
+		assoc.conf = confID
+		mdd.assocs.add(assoc)
+		delete(mdd.rejected, assocID)
+	}
+	mdd.mu.Unlock()
+
+	if err != nil {
+		mdd.rejectParticipant(assocID, confID, err)
+	}
+	if joined {
+		mdd.record(confID, assocID, "Joined", "")
+	}
+	return err
+}
+
+// Creates an empty conference.  Conferences are also created implicitly by
+// the setters above; this is for applications that manage them explicitly.
+func (mdd *MDD) CreateConference(confID ConfID) error {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if _, exists := mdd.conferences[confID]; exists {
+		return fmt.Errorf("Conference %v already exists", confID)
+	}
+	if mdd.draining {
+		return fmt.Errorf("Node is draining; conference %v can't be created", confID)
+	}
+
+	mdd.findOrAddConference(confID)
+	return nil
+}
+
+// Ends a conference now, removing its associations and wiping their keys
+func (mdd *MDD) DestroyConference(confID ConfID) error {
+	if confID == DefaultConfID {
+		return fmt.Errorf("The default conference cannot be destroyed")
+	}
+
+	mdd.mu.Lock()
+	conf, ok := mdd.conferences[confID]
+	mdd.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("Unknown conference %v", confID)
+	}
+
+	removed := mdd.removeConference(conf)
+	log.Printf("Conference %v destroyed; removed %d associations", confID, removed)
+	mdd.emit(Event{Type: EventConferenceDestroyed, Conf: confID})
+	mdd.timelines.end(confID, time.Now())
+	return nil
+}
+
+// Returns the IDs of all conferences, in order
+func (mdd *MDD) Conferences() []ConfID {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	ids := make([]ConfID, 0, len(mdd.conferences))
+	for confID := range mdd.conferences {
+		ids = append(ids, confID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
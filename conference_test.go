@@ -0,0 +1,88 @@
+package percy
+
+import (
+	"testing"
+)
+
+func TestConferenceLifecycle(t *testing.T) {
+	mdd := NewMDD()
+
+	destroyed := []Event{}
+	mdd.OnEvent(func(evt Event) {
+		if evt.Type == EventConferenceDestroyed {
+			destroyed = append(destroyed, evt)
+		}
+	})
+
+	for _, confID := range []ConfID{7, 3} {
+		err := mdd.CreateConference(confID)
+		if err != nil {
+			t.Fatalf("Error creating conference %v: %v", confID, err)
+		}
+	}
+	if mdd.CreateConference(7) == nil {
+		t.Fatalf("Created a conference twice")
+	}
+
+	confs := mdd.Conferences()
+	if len(confs) != 3 || confs[0] != DefaultConfID || confs[1] != 3 || confs[2] != 7 {
+		t.Fatalf("Incorrect conferences: %v", confs)
+	}
+
+	mdd.SetAssociationConference(0x0001, 7)
+	mdd.SetAssociationConference(0x0002, 3)
+	err := mdd.DestroyConference(7)
+	if err != nil {
+		t.Fatalf("Error destroying conference: %v", err)
+	}
+	if _, ok := mdd.assocs.get(0x0001); ok {
+		t.Fatalf("Association in destroyed conference not removed")
+	}
+	if _, ok := mdd.assocs.get(0x0002); !ok {
+		t.Fatalf("Association in another conference removed")
+	}
+	if len(destroyed) != 1 || destroyed[0].Conf != 7 {
+		t.Fatalf("Incorrect events: %+v", destroyed)
+	}
+
+	if mdd.DestroyConference(7) == nil || mdd.DestroyConference(DefaultConfID) == nil {
+		t.Fatalf("Destroyed an unknown or the default conference")
+	}
+}
+
+func TestConcurrentConferenceCreation(t *testing.T) {
+	mdd := NewMDD()
+
+	// Settings applied through one caller's conference must not be lost to
+	// another caller creating it at the same time
+	const callers = 8
+	confs := make(chan *conference, callers)
+	for i := 0; i < callers; i++ {
+		go func() { confs <- mdd.conference(7) }()
+	}
+	first := <-confs
+	for i := 1; i < callers; i++ {
+		if conf := <-confs; conf != first {
+			t.Fatalf("Conference created twice")
+		}
+	}
+}
+
+func TestConcurrentCreateConference(t *testing.T) {
+	mdd := NewMDD()
+
+	const callers = 8
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() { errs <- mdd.CreateConference(7) }()
+	}
+	created := 0
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err == nil {
+			created += 1
+		}
+	}
+	if created != 1 {
+		t.Fatalf("Conference created %d times", created)
+	}
+}
@@ -0,0 +1,256 @@
+// Package conformance exercises an external MD or KD over the wire, to check
+// interop with other PERC implementations.  Each case sends real packets to
+// the implementation under test and checks its responses, and the results are
+// collected into a pass/fail report.
+//
+// MD cases cover STUN handling, the KD tunnel, and hop-by-hop keying
+// (including rekeying).  For the tunnel and keying cases, the runner acts as
+// the MD's KD, so the MD has to be configured to reach its KD at
+// Config.KDListen.  KD cases act as an MD towards the KD under test.
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	defaultTimeout = 500 * time.Millisecond
+)
+
+type Config struct {
+	// Media address of the MD under test, and its ICE credentials
+	MDD         string
+	ICEUfrag    string
+	ICEPassword string
+
+	// Address to act as the MD's KD on
+	KDListen string
+
+	// Address of the KD under test
+	KD string
+
+	// How long to wait for each expected packet
+	Timeout time.Duration
+}
+
+type Status int
+
+const (
+	Pass Status = iota
+	Fail
+	Skip
+)
+
+func (status Status) String() string {
+	switch status {
+	case Pass:
+		return "PASS"
+	case Fail:
+		return "FAIL"
+	case Skip:
+		return "SKIP"
+	default:
+		return fmt.Sprintf("<%d>", int(status))
+	}
+}
+
+func (status Status) MarshalText() ([]byte, error) {
+	return []byte(status.String()), nil
+}
+
+type Case struct {
+	Name   string
+	Target string // "mdd" or "kd"
+	Run    func(env *env) error
+}
+
+type Result struct {
+	Name     string        `json:"name"`
+	Target   string        `json:"target"`
+	Status   Status        `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// True if no case failed
+func (report *Report) Passed() bool {
+	for _, result := range report.Results {
+		if result.Status == Fail {
+			return false
+		}
+	}
+	return true
+}
+
+func (report *Report) WriteText(w io.Writer) error {
+	counts := map[Status]int{}
+	for _, result := range report.Results {
+		counts[result.Status] += 1
+		_, err := fmt.Fprintf(w, "%v  %-4s %-32s %s (%v)\n", result.Status, result.Target,
+			result.Name, result.Detail, result.Duration.Round(time.Millisecond))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", counts[Pass], counts[Fail], counts[Skip])
+	return err
+}
+
+// Returned by a case that can't run with the given configuration
+type skipError string
+
+func (reason skipError) Error() string {
+	return string(reason)
+}
+
+// All the cases, in the order they are run
+func Cases() []Case {
+	cases := []Case{}
+	cases = append(cases, stunCases...)
+	cases = append(cases, tunnelCases...)
+	cases = append(cases, keyingCases...)
+	cases = append(cases, kdCases...)
+	return cases
+}
+
+// Runs the given cases (or all of them, if nil) and reports the results
+func Run(config Config, cases []Case) (*Report, error) {
+	if cases == nil {
+		cases = Cases()
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	env, err := newEnv(config)
+	if err != nil {
+		return nil, err
+	}
+	defer env.close()
+
+	report := &Report{}
+	for _, c := range cases {
+		start := time.Now()
+		err := c.Run(env)
+
+		result := Result{Name: c.Name, Target: c.Target, Duration: time.Since(start)}
+		var skip skipError
+		switch {
+		case err == nil:
+			result.Status = Pass
+		case errors.As(err, &skip):
+			result.Status = Skip
+			result.Detail = err.Error()
+		default:
+			result.Status = Fail
+			result.Detail = err.Error()
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	return report, nil
+}
+
+// State shared by the cases in a run
+type env struct {
+	config Config
+	mdd    net.Addr
+	kd     net.Addr
+	fakeKD *fakeKD
+}
+
+func newEnv(config Config) (*env, error) {
+	env := &env{config: config}
+
+	var err error
+	if len(config.MDD) > 0 {
+		env.mdd, err = net.ResolveUDPAddr("udp", config.MDD)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.KD) > 0 {
+		env.kd, err = net.ResolveUDPAddr("udp", config.KD)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.KDListen) > 0 {
+		env.fakeKD, err = newFakeKD(config.KDListen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return env, nil
+}
+
+func (env *env) close() {
+	if env.fakeKD != nil {
+		env.fakeKD.close()
+	}
+}
+
+func (env *env) needMDD() error {
+	if env.mdd == nil {
+		return skipError("no MD address configured")
+	}
+	return nil
+}
+
+func (env *env) needTunnel() error {
+	if env.mdd == nil || env.fakeKD == nil {
+		return skipError("needs an MD address and a KD listen address")
+	}
+	return nil
+}
+
+func (env *env) needKD() error {
+	if env.kd == nil {
+		return skipError("no KD address configured")
+	}
+	return nil
+}
+
+// Opens a socket to act as a client (or an MD) from
+func (env *env) socket() (*net.UDPConn, error) {
+	return net.ListenUDP("udp", nil)
+}
+
+// Waits for a packet from the given address, ignoring any from elsewhere
+func (env *env) recv(conn *net.UDPConn, from net.Addr) ([]byte, error) {
+	buf := make([]byte, 2048)
+	deadline := time.Now().Add(env.config.Timeout)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if from == nil || sameAddr(addr, from) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// Compares addresses by IP and port, so that e.g. 127.0.0.1 matches ::ffff:127.0.0.1
+func sameAddr(a, b net.Addr) bool {
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	if !ok1 || !ok2 {
+		return a.String() == b.String()
+	}
+	return ua.Port == ub.Port && ua.IP.Equal(ub.IP)
+}
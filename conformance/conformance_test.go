@@ -0,0 +1,69 @@
+package conformance
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bifurcation/percy"
+)
+
+const (
+	mddPort     = 2200
+	kdListen    = "127.0.0.1:2201"
+	iceUfrag    = "fedcbafe"
+	icePassword = "abcdefabcdefabcdefabcdefabcdefab"
+)
+
+// Runs the cases that don't depend on the SRTP implementation against
+// percy's own MD
+func TestPercyConformance(t *testing.T) {
+	kd, err := percy.NewUDPForwarder(kdListen)
+	if err != nil {
+		t.Fatalf("Error creating forwarder: %v", err)
+	}
+
+	auth := percy.NewMemoryAuthProvider()
+	auth.SetICEPassword(iceUfrag, icePassword)
+
+	mdd := percy.NewMDD()
+	mdd.Auth = auth
+	mdd.KD = kd
+	kd.MD = mdd
+
+	err = mdd.Listen(mddPort)
+	if err != nil {
+		t.Fatalf("Error starting MDD: %v", err)
+	}
+	defer mdd.Stop()
+
+	config := Config{
+		MDD:         "127.0.0.1:2200",
+		ICEUfrag:    iceUfrag,
+		ICEPassword: icePassword,
+		KDListen:    kdListen,
+	}
+
+	cases := append(append([]Case{}, stunCases...), tunnelCases...)
+	cases = append(cases, kdCases...)
+	report, err := Run(config, cases)
+	if err != nil {
+		t.Fatalf("Error running cases: %v", err)
+	}
+
+	var text bytes.Buffer
+	report.WriteText(&text)
+	if !report.Passed() {
+		t.Fatalf("Conformance failures:\n%s", text.String())
+	}
+
+	// No KD was configured, so its cases are skipped
+	for _, result := range report.Results {
+		if result.Target == "kd" && result.Status != Skip {
+			t.Fatalf("KD case %s was not skipped", result.Name)
+		}
+	}
+	if !strings.Contains(text.String(), "7 passed, 0 failed, 2 skipped") {
+		t.Fatalf("Unexpected summary:\n%s", text.String())
+	}
+}
@@ -0,0 +1,113 @@
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bifurcation/percy"
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/crypto/selfsign"
+)
+
+// KD cases act as an MD towards the KD under test, sending DTLS as it would
+// arrive through the tunnel.  pion/dtls can't complete a handshake that
+// selects a double profile, so these only check that the KD starts one.
+
+var kdCases = []Case{
+	{"kd-answers-client-hello", "kd", kdAnswersClientHello},
+	{"kd-survives-garbage", "kd", kdSurvivesGarbage},
+}
+
+// Records whether a DTLS handshake record arrives from the KD
+type tapConn struct {
+	*net.UDPConn
+	kd        net.Addr
+	handshake chan struct{}
+}
+
+func (tap *tapConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := tap.UDPConn.ReadFrom(b)
+	if err == nil && n > 0 && b[0] == 0x16 && sameAddr(addr, tap.kd) {
+		select {
+		case tap.handshake <- struct{}{}:
+		default:
+		}
+	}
+	return n, addr, err
+}
+
+// Starts a DTLS handshake offering the double profiles, and waits for the KD
+// to answer the ClientHello
+func (env *env) helloKD() error {
+	conn, err := env.socket()
+	if err != nil {
+		return err
+	}
+	tap := &tapConn{UDPConn: conn, kd: env.kd, handshake: make(chan struct{}, 1)}
+	defer tap.Close()
+
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		return err
+	}
+
+	client, err := dtls.ClientWithOptions(tap, env.kd,
+		dtls.WithCertificates(cert),
+		dtls.WithSRTPProtectionProfiles(
+			dtls.SRTPProtectionProfile(percy.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM),
+			dtls.SRTPProtectionProfile(percy.DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM)),
+		dtls.WithInsecureSkipVerify(true))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), env.config.Timeout)
+	defer cancel()
+	go client.HandshakeContext(ctx)
+
+	select {
+	case <-tap.handshake:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("KD did not answer the ClientHello")
+	}
+}
+
+func kdAnswersClientHello(env *env) error {
+	if err := env.needKD(); err != nil {
+		return err
+	}
+	return env.helloKD()
+}
+
+// Malformed records must not take the KD down
+func kdSurvivesGarbage(env *env) error {
+	if err := env.needKD(); err != nil {
+		return err
+	}
+
+	conn, err := env.socket()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	garbage := [][]byte{
+		{0x16},
+		{0x16, 0xfe, 0xfd, 0xff, 0xff},
+		dtlsRecord(randomToken()),
+		append([]byte{0x17, 0xfe, 0xfd}, randomToken()...),
+	}
+	for _, msg := range garbage {
+		_, err = conn.WriteTo(msg, env.kd)
+		if err != nil {
+			return err
+		}
+	}
+
+	time.Sleep(env.config.Timeout / 4)
+	return env.helloKD()
+}
@@ -0,0 +1,202 @@
+package conformance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// Keying cases check that the MD protects media with the hop-by-hop keys it
+// gets from the KD, and switches to new keys when the KD rekeys.  The runner
+// only applies the outer (hop-by-hop) layer; the MD can't tell the difference.
+
+var keyingCases = []Case{
+	{"srtp-forwarding", "mdd", srtpForwarding},
+	{"hbh-rekey", "mdd", hbhRekey},
+}
+
+// A pair of tunneled clients, keyed by the fake KD, with one sending to the
+// other
+type keyedPair struct {
+	env      *env
+	sender   *tunneledClient
+	receiver *tunneledClient
+	send     *rtp.RTPSession
+	recv     *rtp.RTPSession
+	seq      uint16
+	ssrc     uint32
+}
+
+func (env *env) keyedPair() (*keyedPair, error) {
+	sender, err := env.tunneledClient()
+	if err != nil {
+		return nil, err
+	}
+
+	receiver, err := env.tunneledClient()
+	if err != nil {
+		sender.conn.Close()
+		return nil, err
+	}
+
+	pair := &keyedPair{env: env, sender: sender, receiver: receiver}
+	binary.Read(rand.Reader, binary.BigEndian, &pair.ssrc)
+	return pair, nil
+}
+
+func (pair *keyedPair) close() {
+	pair.sender.conn.Close()
+	pair.receiver.conn.Close()
+}
+
+// Gives the MD new keys for both clients, and keys the clients to match
+func (pair *keyedPair) rekey() error {
+	senderKeys := newHBHKeys()
+	receiverKeys := newHBHKeys()
+
+	err := pair.env.fakeKD.sendKeys(pair.sender.tunnel, senderKeys)
+	if err != nil {
+		return err
+	}
+	err = pair.env.fakeKD.sendKeys(pair.receiver.tunnel, receiverKeys)
+	if err != nil {
+		return err
+	}
+
+	// The MD decrypts with the sender's client write key, and encrypts for
+	// the receiver with its server write key
+	pair.send = rtp.NewRTPSession(false)
+	err = pair.send.SetSRTP(rtp.SRTP_AEAD_AES_128_GCM, true, senderKeys.ClientWriteKey, senderKeys.MasterSalt)
+	if err != nil {
+		return err
+	}
+
+	pair.recv = rtp.NewRTPSession(false)
+	return pair.recv.SetSRTP(rtp.SRTP_AEAD_AES_128_GCM, true, receiverKeys.ServerWriteKey, receiverKeys.MasterSalt)
+}
+
+// Sends an RTP packet carrying a fresh token, with the given session
+func (pair *keyedPair) sendPacket(session *rtp.RTPSession) ([]byte, error) {
+	token := randomToken()
+	pair.seq += 1
+
+	header := make([]byte, 12)
+	header[0] = 0x80
+	header[1] = 111
+	binary.BigEndian.PutUint16(header[2:], pair.seq)
+	binary.BigEndian.PutUint32(header[4:], uint32(pair.seq)*960)
+	binary.BigEndian.PutUint32(header[8:], pair.ssrc)
+
+	msg, err := session.Encode(&rtp.RTPPacket{Buffer: append(header, token...)})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = pair.sender.conn.WriteTo(msg, pair.env.mdd)
+	return token, err
+}
+
+// Waits for the receiver to get a packet carrying the token.  Packets that
+// don't decrypt (e.g., ones sent under keys that were just replaced) are
+// ignored.
+func (pair *keyedPair) received(token []byte, timeout time.Duration) error {
+	conn := pair.receiver.conn
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if !sameAddr(addr, pair.env.mdd) || n == 0 || buf[0] < 128 || buf[0] > 191 {
+			continue
+		}
+
+		pkt, err := pair.recv.Decode(buf[:n])
+		if err == nil && bytes.Contains(pkt.Buffer, token) {
+			return nil
+		}
+	}
+}
+
+// The MD applies keys asynchronously, so keep sending until a packet gets
+// through
+func (pair *keyedPair) sendUntilReceived(session *rtp.RTPSession) error {
+	deadline := time.Now().Add(4 * pair.env.config.Timeout)
+	for time.Now().Before(deadline) {
+		token, err := pair.sendPacket(session)
+		if err != nil {
+			return err
+		}
+
+		if pair.received(token, pair.env.config.Timeout/4) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Media was not forwarded")
+}
+
+func srtpForwarding(env *env) error {
+	if err := env.needTunnel(); err != nil {
+		return err
+	}
+
+	pair, err := env.keyedPair()
+	if err != nil {
+		return err
+	}
+	defer pair.close()
+
+	err = pair.rekey()
+	if err != nil {
+		return err
+	}
+
+	return pair.sendUntilReceived(pair.send)
+}
+
+// After the KD rekeys, media under the new keys is forwarded, and media
+// under the old keys is not
+func hbhRekey(env *env) error {
+	if err := env.needTunnel(); err != nil {
+		return err
+	}
+
+	pair, err := env.keyedPair()
+	if err != nil {
+		return err
+	}
+	defer pair.close()
+
+	err = pair.rekey()
+	if err != nil {
+		return err
+	}
+	err = pair.sendUntilReceived(pair.send)
+	if err != nil {
+		return fmt.Errorf("Before rekey: %v", err)
+	}
+
+	oldSend := pair.send
+	err = pair.rekey()
+	if err != nil {
+		return err
+	}
+	err = pair.sendUntilReceived(pair.send)
+	if err != nil {
+		return fmt.Errorf("After rekey: %v", err)
+	}
+
+	token, err := pair.sendPacket(oldSend)
+	if err != nil {
+		return err
+	}
+	if pair.received(token, env.config.Timeout) == nil {
+		return fmt.Errorf("MD still accepts media under the old keys")
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package conformance
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/bifurcation/percy"
+)
+
+var stunCases = []Case{
+	{"stun-binding-success", "mdd", stunBindingSuccess},
+	{"stun-binding-integrity", "mdd", stunBindingIntegrity},
+	{"stun-binding-unauthorized", "mdd", stunBindingUnauthorized},
+}
+
+// Sends a Binding request with the given local ufrag, and returns the raw and
+// parsed response
+func (env *env) binding(ufrag string) ([]byte, *percy.STUNMessage, error) {
+	conn, err := env.socket()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	var txnID percy.TransactionID
+	rand.Read(txnID[:])
+
+	tieBreaker := make([]byte, 8)
+	rand.Read(tieBreaker)
+
+	request := percy.NewBindingRequest(txnID, env.config.ICEPassword)
+	request.Add(percy.ATTR_USERNAME, []byte(ufrag+":conformance"))
+	request.Add(percy.ATTR_ICE_CONTROLLING, tieBreaker)
+	request.AddMessageIntegrity()
+	request.AddFingerprint()
+
+	msg, err := request.Serialize()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = conn.WriteTo(msg, env.mdd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw, err := env.recv(conn, env.mdd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("No response: %v", err)
+	}
+
+	response, err := percy.ParseSTUN(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Malformed response: %v", err)
+	}
+
+	if response.TransactionID() != txnID {
+		return nil, nil, fmt.Errorf("Response has the wrong transaction ID")
+	}
+
+	return raw, response, nil
+}
+
+func stunBindingSuccess(env *env) error {
+	if err := env.needMDD(); err != nil {
+		return err
+	}
+
+	_, response, err := env.binding(env.config.ICEUfrag)
+	if err != nil {
+		return err
+	}
+
+	if response.Type() != percy.MSG_TYPE_SUCCESS {
+		return fmt.Errorf("Expected a success response, got %v", response.Type())
+	}
+
+	if _, ok := response.Get(percy.ATTR_XOR_MAPPED_ADDRESS); !ok {
+		return fmt.Errorf("No XOR-MAPPED-ADDRESS in response")
+	}
+	return nil
+}
+
+// ICE requires success responses to be signed with the MD's password, and to
+// carry a FINGERPRINT (RFC 8445, section 7.3)
+func stunBindingIntegrity(env *env) error {
+	if err := env.needMDD(); err != nil {
+		return err
+	}
+
+	raw, response, err := env.binding(env.config.ICEUfrag)
+	if err != nil {
+		return err
+	}
+
+	if response.Type() != percy.MSG_TYPE_SUCCESS {
+		return fmt.Errorf("Expected a success response, got %v", response.Type())
+	}
+	if !percy.CheckMessageIntegrity(raw, env.config.ICEPassword) {
+		return fmt.Errorf("Missing or invalid MESSAGE-INTEGRITY")
+	}
+	if !percy.CheckFingerprint(raw) {
+		return fmt.Errorf("Missing or invalid FINGERPRINT")
+	}
+	return nil
+}
+
+func stunBindingUnauthorized(env *env) error {
+	if err := env.needMDD(); err != nil {
+		return err
+	}
+
+	_, response, err := env.binding(env.config.ICEUfrag + "-bogus")
+	if err != nil {
+		return err
+	}
+
+	if response.Type() != percy.MSG_TYPE_ERROR {
+		return fmt.Errorf("Expected an error response, got %v", response.Type())
+	}
+
+	code, ok := response.Get(percy.ATTR_ERROR_CODE)
+	if !ok || len(code) < 4 {
+		return fmt.Errorf("No ERROR-CODE in response")
+	}
+	if status := int(code[2])*100 + int(code[3]); status != 401 {
+		return fmt.Errorf("Expected error 401, got %d", status)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package conformance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bifurcation/percy"
+)
+
+var tunnelCases = []Case{
+	{"tunnel-dtls-to-kd", "mdd", tunnelDTLSToKD},
+	{"tunnel-dtls-to-client", "mdd", tunnelDTLSToClient},
+	{"tunnel-association-separation", "mdd", tunnelAssociationSeparation},
+	{"tunnel-hbh-keys-consumed", "mdd", tunnelHBHKeysConsumed},
+}
+
+type kdPacket struct {
+	from net.Addr
+	msg  []byte
+}
+
+// fakeKD stands in for the KD of the MD under test.  It queues everything it
+// receives, so that cases can pick out the packets they sent.
+type fakeKD struct {
+	conn    *net.UDPConn
+	packets chan kdPacket
+}
+
+func newFakeKD(addr string) (*fakeKD, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	kd := &fakeKD{conn: conn, packets: make(chan kdPacket, 64)}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			pkt := kdPacket{from: addr, msg: append([]byte{}, buf[:n]...)}
+			select {
+			case kd.packets <- pkt:
+			default:
+			}
+		}
+	}()
+
+	return kd, nil
+}
+
+// Waits for a packet containing the given bytes, discarding any others
+func (kd *fakeKD) expect(token []byte, timeout time.Duration) (kdPacket, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case pkt := <-kd.packets:
+			if bytes.Contains(pkt.msg, token) {
+				return pkt, nil
+			}
+		case <-deadline:
+			return kdPacket{}, fmt.Errorf("Packet did not reach the KD")
+		}
+	}
+}
+
+func (kd *fakeKD) send(msg []byte, to net.Addr) error {
+	_, err := kd.conn.WriteTo(msg, to)
+	return err
+}
+
+func (kd *fakeKD) close() {
+	kd.conn.Close()
+}
+
+func randomToken() []byte {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return token
+}
+
+// Wraps a payload in a DTLS 1.2 handshake record header.  The MD only looks
+// at the first byte, so the contents don't need to be a real handshake.
+func dtlsRecord(payload []byte) []byte {
+	header := []byte{0x16, 0xfe, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, byte(len(payload) >> 8), byte(len(payload))}
+	return append(header, payload...)
+}
+
+// A client whose DTLS has been seen by the fake KD, along with the address of
+// its association's tunnel
+type tunneledClient struct {
+	conn   *net.UDPConn
+	tunnel net.Addr
+}
+
+// Opens a client socket and sends DTLS through the MD, returning the address
+// the MD uses to reach the KD for this association
+func (env *env) tunneledClient() (*tunneledClient, error) {
+	conn, err := env.socket()
+	if err != nil {
+		return nil, err
+	}
+
+	token := randomToken()
+	_, err = conn.WriteTo(dtlsRecord(token), env.mdd)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pkt, err := env.fakeKD.expect(token, env.config.Timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &tunneledClient{conn: conn, tunnel: pkt.from}, nil
+}
+
+func tunnelDTLSToKD(env *env) error {
+	if err := env.needTunnel(); err != nil {
+		return err
+	}
+
+	conn, err := env.socket()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	record := dtlsRecord(randomToken())
+	_, err = conn.WriteTo(record, env.mdd)
+	if err != nil {
+		return err
+	}
+
+	pkt, err := env.fakeKD.expect(record[13:], env.config.Timeout)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pkt.msg, record) {
+		return fmt.Errorf("DTLS record was modified in the tunnel")
+	}
+	return nil
+}
+
+func tunnelDTLSToClient(env *env) error {
+	if err := env.needTunnel(); err != nil {
+		return err
+	}
+
+	client, err := env.tunneledClient()
+	if err != nil {
+		return err
+	}
+	defer client.conn.Close()
+
+	record := dtlsRecord(randomToken())
+	err = env.fakeKD.send(record, client.tunnel)
+	if err != nil {
+		return err
+	}
+
+	msg, err := env.recv(client.conn, env.mdd)
+	if err != nil {
+		return fmt.Errorf("DTLS record did not reach the client: %v", err)
+	}
+	if !bytes.Equal(msg, record) {
+		return fmt.Errorf("DTLS record was modified in the tunnel")
+	}
+	return nil
+}
+
+// DTLS from the KD must only go to the association it was sent for
+func tunnelAssociationSeparation(env *env) error {
+	if err := env.needTunnel(); err != nil {
+		return err
+	}
+
+	client1, err := env.tunneledClient()
+	if err != nil {
+		return err
+	}
+	defer client1.conn.Close()
+
+	client2, err := env.tunneledClient()
+	if err != nil {
+		return err
+	}
+	defer client2.conn.Close()
+
+	record := dtlsRecord(randomToken())
+	err = env.fakeKD.send(record, client1.tunnel)
+	if err != nil {
+		return err
+	}
+
+	_, err = env.recv(client1.conn, env.mdd)
+	if err != nil {
+		return fmt.Errorf("DTLS record did not reach the client: %v", err)
+	}
+
+	_, err = env.recv(client2.conn, env.mdd)
+	if err == nil {
+		return fmt.Errorf("DTLS record for one association reached another")
+	}
+	return nil
+}
+
+// Hop-by-hop keys are for the MD alone, and must never reach the client
+func tunnelHBHKeysConsumed(env *env) error {
+	if err := env.needTunnel(); err != nil {
+		return err
+	}
+
+	client, err := env.tunneledClient()
+	if err != nil {
+		return err
+	}
+	defer client.conn.Close()
+
+	err = env.fakeKD.sendKeys(client.tunnel, newHBHKeys())
+	if err != nil {
+		return err
+	}
+
+	msg, err := env.recv(client.conn, env.mdd)
+	if err == nil {
+		return fmt.Errorf("MD forwarded a %d-byte packet from the KD to the client", len(msg))
+	}
+	return nil
+}
+
+func newHBHKeys() percy.HBHKeys {
+	keys := percy.HBHKeys{
+		Marker:         0xFF,
+		Profile:        percy.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM,
+		ClientWriteKey: make([]byte, 16),
+		ServerWriteKey: make([]byte, 16),
+		MasterSalt:     make([]byte, 12),
+	}
+	rand.Read(keys.ClientWriteKey)
+	rand.Read(keys.ServerWriteKey)
+	rand.Read(keys.MasterSalt)
+	return keys
+}
+
+func (kd *fakeKD) sendKeys(to net.Addr, keys percy.HBHKeys) error {
+	msg, err := percy.StandardCodec.Encode(percy.TunnelMessage{Keys: &keys})
+	if err != nil {
+		return err
+	}
+	return kd.send(msg, to)
+}
@@ -0,0 +1,166 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pion/dtls/v3"
+)
+
+// Data channels (SCTP over DTLS) show up at the MD as DTLS application data
+// records once the handshake is done.  Each conference decides what happens
+// to them:
+//
+//   - Drop: they go nowhere (the default)
+//   - Relay: they go point-to-point to the other participant, when there is
+//     exactly one
+//   - Fan-out: they go to all the other participants, like SRTP does, so
+//     that chat and metadata can be distributed through the MD
+//
+// Where a record can be relayed depends on who holds the client's DTLS
+// session.  In relay mode, the clients' DTLS is end to end, so records are
+// forwarded as they are.  In SFU mode, the MD terminates DTLS, so it decrypts
+// the data and re-sends it over the peer's session.  In PERC mode, only the KD
+// can decrypt the records, so "relay" and "fan-out" tunnel them to the KD as
+// before.
+
+type DataChannelPolicy uint8
+
+const (
+	DataChannelDrop DataChannelPolicy = iota
+	DataChannelRelay
+	DataChannelFanOut
+)
+
+const (
+	dtlsContentTypeApplicationData = 23
+)
+
+func (policy DataChannelPolicy) String() string {
+	switch policy {
+	case DataChannelDrop:
+		return "drop"
+	case DataChannelRelay:
+		return "relay"
+	case DataChannelFanOut:
+		return "fanout"
+	default:
+		return fmt.Sprintf("<%d>", int(policy))
+	}
+}
+
+func ParseDataChannelPolicy(val string) (DataChannelPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "drop":
+		return DataChannelDrop, nil
+	case "relay":
+		return DataChannelRelay, nil
+	case "fanout":
+		return DataChannelFanOut, nil
+	default:
+		return 0, fmt.Errorf("Unknown data channel policy '%s'", val)
+	}
+}
+
+func (policy DataChannelPolicy) MarshalText() ([]byte, error) {
+	return []byte(policy.String()), nil
+}
+
+func (policy *DataChannelPolicy) UnmarshalText(text []byte) error {
+	parsed, err := ParseDataChannelPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*policy = parsed
+	return nil
+}
+
+func isApplicationData(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == dtlsContentTypeApplicationData
+}
+
+// Sets what happens to data channel traffic in a conference
+func (mdd *MDD) SetConferenceDataChannels(confID ConfID, policy DataChannelPolicy) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.dataChannels = policy
+}
+
+// Returns the data channel policy of an association's conference
+func (mdd *MDD) dataChannelPolicy(assoc *association) DataChannelPolicy {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	return mdd.confDataChannelPolicy(assoc.conf)
+}
+
+// As dataChannelPolicy, for a conference.  The caller holds mdd.mu.
+func (mdd *MDD) confDataChannelPolicy(confID ConfID) DataChannelPolicy {
+	if conf, ok := mdd.conferences[confID]; ok {
+		return conf.dataChannels
+	}
+	return DataChannelDrop
+}
+
+// Returns the participants that data channel traffic from the sender goes
+// to under the given policy.  The caller holds mdd.mu.
+func (mdd *MDD) dataChannelPeers(sender *association, policy DataChannelPolicy) []*association {
+	peers := mdd.conferencePeers(sender)
+	if policy == DataChannelRelay && len(peers) != 1 {
+		return nil
+	}
+	return peers
+}
+
+// Handles an application data record in PERC or relay mode.  Returns false
+// if the record should take the usual DTLS path (to the KD) instead.
+func (mdd *MDD) handleDataChannel(sender *association, msg []byte, trace *packetTrace) bool {
+	policy := mdd.dataChannelPolicy(sender)
+	if policy == DataChannelDrop {
+		trace.log("route", "dropped data channel record")
+		return true
+	}
+
+	if mdd.mode(sender) == ModePERC {
+		return false
+	}
+
+	mdd.mu.Lock()
+	peers := mdd.dataChannelPeers(sender, policy)
+	mdd.mu.Unlock()
+
+	trace.log("route", "data channel %v to %d receivers", policy, len(peers))
+	for _, peer := range peers {
+		err := mdd.sendTo(peer, msg)
+		trace.log("egress", "data channel to [%04x] at %v: %v", peer.id, peer.addr, err)
+	}
+	return true
+}
+
+// Relays data that the local DTLS server decrypted for an SFU-mode
+// association.  This runs on the association's DTLS goroutine, so it looks
+// up the peers under the lock.
+func (mdd *MDD) relayDataChannel(sender *association, data []byte) {
+	mdd.mu.Lock()
+	policy := mdd.confDataChannelPolicy(sender.conf)
+	conns := map[AssociationID]*dtls.Conn{}
+	if policy != DataChannelDrop {
+		for _, peer := range mdd.dataChannelPeers(sender, policy) {
+			if peer.dtls != nil && peer.dtls.conn != nil {
+				conns[peer.id] = peer.dtls.conn
+			} else {
+				log.Printf("No DTLS session to relay data channel from [%04x] to [%04x]", sender.id, peer.id)
+			}
+		}
+	}
+	mdd.mu.Unlock()
+
+	for peerID, conn := range conns {
+		_, err := conn.Write(data)
+		if err != nil {
+			log.Printf("Error relaying data channel from [%04x] to [%04x]: %v", sender.id, peerID, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package percy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A cascade that's wired in a circle, or a sender whose packets reach the MD
+// twice, would have each receiver get the same packet more than once.  With
+// Deduplicate set, the MD remembers the last dedupSlots sequence numbers it
+// forwarded from each source SSRC to each receiver, and drops repeats,
+// counting them in the `duplicate_dropped` stat.  A receiver that NACKs a
+// packet gets its retransmission, though: NACKed sequence numbers are
+// forgotten.  Relay mode is left alone, since the MD can't read NACKs there.
+//
+// A few duplicates are normal on a lossy network, but when at least one in
+// dedupLoopShare of the packets from a source to a receiver is a repeat, media
+// is probably looping, and an EventForwardingLoop event names the
+// association the repeats come from.  It is raised again if the repeats stop
+// for a period and then come back.
+
+const (
+	dedupSlots      = 256
+	dedupPeriod     = 256 // Fresh packets between loop checks
+	dedupLoopShare  = 4
+	dedupSlotsWords = dedupSlots / 64
+)
+
+type dedupWindow struct {
+	started bool
+	highest uint16
+	seen    [dedupSlotsWords]uint64 // Indexed by sequence number mod dedupSlots
+
+	fresh   int
+	repeats int
+	looping bool
+}
+
+func (w *dedupWindow) set(seq uint16, on bool) {
+	word, bit := seq%dedupSlots/64, uint64(1)<<(seq%64)
+	if on {
+		w.seen[word] |= bit
+	} else {
+		w.seen[word] &^= bit
+	}
+}
+
+func (w *dedupWindow) has(seq uint16) bool {
+	return w.seen[seq%dedupSlots/64]&(uint64(1)<<(seq%64)) != 0
+}
+
+// Records a sequence number, reporting whether it was already recorded.
+// Packets too old for the window can't be told apart, so they pass.
+func (w *dedupWindow) repeat(seq uint16) bool {
+	if !w.started {
+		w.started = true
+		w.highest = seq
+		w.set(seq, true)
+		return false
+	}
+
+	ahead := int(int16(seq - w.highest))
+	switch {
+	case ahead > 0:
+		if ahead >= dedupSlots {
+			w.seen = [dedupSlotsWords]uint64{}
+		} else {
+			for i := 1; i <= ahead; i++ {
+				w.set(w.highest+uint16(i), false)
+			}
+		}
+		w.highest = seq
+	case -ahead >= dedupSlots:
+		return false
+	case w.has(seq):
+		return true
+	}
+	w.set(seq, true)
+	return false
+}
+
+// Forgets a sequence number, so that it can be forwarded again
+func (w *dedupWindow) forget(seq uint16) {
+	if age := int(int16(w.highest - seq)); age >= 0 && age < dedupSlots {
+		w.set(seq, false)
+	}
+}
+
+// Reports whether a packet has already been forwarded to a receiver, raising
+// the alarm if its source looks like it's looping.  Runs on the processing
+// loop.
+func (mdd *MDD) duplicate(sender, receiver *association, msg []byte, trace *packetTrace) bool {
+	if !mdd.Deduplicate || len(msg) < rtpFixedHeaderSize {
+		return false
+	}
+	seq := binary.BigEndian.Uint16(msg[2:4])
+	ssrc := binary.BigEndian.Uint32(msg[8:12])
+
+	mdd.mu.Lock()
+	if receiver.forwarded == nil {
+		receiver.forwarded = map[uint32]*dedupWindow{}
+	}
+	w, ok := receiver.forwarded[ssrc]
+	if !ok {
+		w = &dedupWindow{}
+		receiver.forwarded[ssrc] = w
+	}
+
+	repeat := w.repeat(seq)
+	if repeat {
+		w.repeats += 1
+		mdd.stats.duplicates += 1
+	} else {
+		w.fresh += 1
+	}
+
+	report := false
+	if w.fresh >= dedupPeriod {
+		looping := w.repeats*dedupLoopShare >= w.fresh
+		report = looping && !w.looping
+		w.looping = looping
+		w.fresh, w.repeats = 0, 0
+	}
+	mdd.mu.Unlock()
+
+	if repeat {
+		trace.log("route", "dropped repeat of %04x/%d to [%04x]", ssrc, seq, receiver.id)
+	}
+	if report {
+		detail := fmt.Sprintf("ssrc %08x to [%04x]", ssrc, receiver.id)
+		log.Printf("Media from %s is looping: %s", mdd.describe(sender), detail)
+		mdd.emit(Event{Type: EventForwardingLoop, Time: time.Now(), Assoc: sender.id, Conf: sender.conf, Detail: detail})
+	}
+	return repeat
+}
+
+// Forgets the packets a receiver NACKs, so that their retransmissions reach
+// it.  Expects feedback already mapped back to the original streams.
+func (mdd *MDD) forgetNACKed(receiver *association, headers []RTCPHeader, msg []byte) {
+	if !mdd.Deduplicate {
+		return
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	offset := 0
+	for _, header := range headers {
+		w, ok := receiver.forwarded[header.MediaSSRC]
+		if ok && header.PacketType == RTCPTypeRTPFB && header.Count == rtcpFormatNACK {
+			for fci := offset + 12; fci+4 <= offset+header.Size; fci += 4 {
+				pid := binary.BigEndian.Uint16(msg[fci:])
+				blp := binary.BigEndian.Uint16(msg[fci+2:])
+				w.forget(pid)
+				for i := uint16(0); i < 16; i++ {
+					if blp&(1<<i) != 0 {
+						w.forget(pid + i + 1)
+					}
+				}
+			}
+		}
+		offset += header.Size
+	}
+}
@@ -0,0 +1,90 @@
+package percy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestDedupWindow(t *testing.T) {
+	var w dedupWindow
+	for _, seq := range []uint16{65530, 65535, 3, 1} {
+		if w.repeat(seq) {
+			t.Fatalf("Fresh packet %d taken for a repeat", seq)
+		}
+	}
+	for _, seq := range []uint16{65530, 65535, 3, 1} {
+		if !w.repeat(seq) {
+			t.Fatalf("Repeat of %d not caught", seq)
+		}
+	}
+
+	// Packets older than the window pass, and jumps past it clear it
+	seq := uint16(3)
+	if w.repeat(seq - dedupSlots) {
+		t.Fatalf("Packet older than the window taken for a repeat")
+	}
+	if w.repeat(seq+dedupSlots) || w.repeat(seq+dedupSlots-2) {
+		t.Fatalf("Window not cleared by a jump")
+	}
+
+	w.forget(seq + dedupSlots)
+	if w.repeat(seq + dedupSlots) {
+		t.Fatalf("Forgotten packet taken for a repeat")
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.Deduplicate = true
+
+	loops := make(chan Event, 10)
+	mdd.OnEvent(func(evt Event) {
+		if evt.Type == EventForwardingLoop {
+			loops <- evt
+		}
+	})
+
+	clients := newKeyedClients(t, network, mdd, "10.0.0.1:5000", "10.0.0.2:5000")
+	sender, receiver := clients[0], clients[1]
+
+	media := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	sender.Write(media)
+	AssertRecvPacket(t, receiver, media, "Media not forwarded")
+	sender.Write(media)
+	AssertNotRecvPacket(t, receiver, "Repeat forwarded")
+	if duplicates := mdd.StatsSnapshot().Global.Duplicates; duplicates != 1 {
+		t.Fatalf("Incorrect duplicate count: %d", duplicates)
+	}
+
+	// A NACKed packet can be retransmitted
+	nack := []byte{
+		0x81, 0xcd, 0x00, 0x03, 0x05, 0x06, 0x07, 0x08,
+		0x01, 0x02, 0x03, 0x04, 0x00, 0x01, 0x00, 0x00,
+	}
+	receiver.Write(nack)
+	AssertRecvPacket(t, sender, nack, "NACK not forwarded")
+	sender.Write(media)
+	AssertRecvPacket(t, receiver, media, "NACKed packet not retransmitted")
+
+	// A stream that keeps repeating is looping
+	for seq := 2; seq < 2+dedupPeriod; seq++ {
+		media[2], media[3] = byte(seq>>8), byte(seq)
+		sender.Write(media)
+		sender.Write(media)
+		AssertRecvPacket(t, receiver, media, "Media not forwarded")
+	}
+	select {
+	case evt := <-loops:
+		if evt.Assoc != sender.Assoc() || evt.Detail != fmt.Sprintf("ssrc 01020304 to [%04x]", receiver.Assoc()) {
+			t.Fatalf("Incorrect loop event: %+v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No loop event")
+	}
+	AssertNotRecvPacket(t, receiver, "Repeat forwarded")
+}
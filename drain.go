@@ -0,0 +1,71 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Before maintenance, a node can be drained.  It stops taking new
+// conferences: placement turns participants away unless their conference
+// already has participants here, and associations can't be added to a
+// conference that has none.  Conferences already here carry on, and an
+// EventConferenceMigrating is raised for each of them, so that signaling can
+// move them to another node (e.g., by having clients reconnect there).  Once
+// the last association is gone, EventNodeDrained is raised, and NodeInfo
+// shows the node as drained, so it can be stopped.
+
+// Starts draining the node.  Does nothing if it's already draining.
+func (mdd *MDD) Drain() {
+	mdd.mu.Lock()
+	if mdd.draining {
+		mdd.mu.Unlock()
+		return
+	}
+	mdd.draining = true
+	mdd.drained = false
+
+	hosted := map[ConfID]int{}
+	for _, assoc := range mdd.assocs.snapshot() {
+		hosted[assoc.conf] += 1
+	}
+	mdd.mu.Unlock()
+
+	log.Printf("Draining; %d conferences to move", len(hosted))
+	for confID, participants := range hosted {
+		mdd.emit(Event{Type: EventConferenceMigrating, Conf: confID, Detail: fmt.Sprintf("participants=%d", participants)})
+	}
+}
+
+// Stops draining, so the node takes new conferences again
+func (mdd *MDD) StopDraining() {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	mdd.draining = false
+	mdd.drained = false
+}
+
+// Refuses new conferences while draining.  The caller holds mdd.mu.
+func (mdd *MDD) checkDraining(confID ConfID) error {
+	if mdd.draining && mdd.conferenceParticipants(confID) == 0 {
+		return fmt.Errorf("Node is draining; conference %d is not hosted here", confID)
+	}
+	return nil
+}
+
+// Reports when a draining node has no associations left.  Runs on the
+// processing loop.
+func (mdd *MDD) checkDrained(now time.Time) {
+	mdd.mu.Lock()
+	empty := mdd.draining && !mdd.drained && mdd.assocs.len() == 0
+	if empty {
+		mdd.drained = true
+	}
+	mdd.mu.Unlock()
+
+	if empty {
+		log.Printf("Drained")
+		mdd.emit(Event{Type: EventNodeDrained, Time: now})
+	}
+}
@@ -0,0 +1,57 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	mdd := NewMDD()
+
+	events := []Event{}
+	mdd.OnEvent(func(evt Event) {
+		if evt.Type == EventConferenceMigrating || evt.Type == EventNodeDrained {
+			events = append(events, evt)
+		}
+	})
+
+	mdd.SetAssociationConference(0x0001, 7)
+	mdd.Drain()
+	if len(events) != 1 || events[0].Type != EventConferenceMigrating || events[0].Conf != 7 {
+		t.Fatalf("Incorrect migration events: %+v", events)
+	}
+
+	// Conferences already here can grow, but new ones aren't taken
+	if err := mdd.SetAssociationConference(0x0002, 7); err != nil {
+		t.Fatalf("Participant refused in a hosted conference: %v", err)
+	}
+	if mdd.SetAssociationConference(0x0003, 8) == nil || mdd.CreateConference(9) == nil {
+		t.Fatalf("New conference taken while draining")
+	}
+	if decision := mdd.Place(PlacementRequest{Conference: 8}); decision.Accept {
+		t.Fatalf("Placement accepted while draining")
+	}
+	if decision := mdd.Place(PlacementRequest{Conference: 7}); !decision.Accept {
+		t.Fatalf("Placement refused in a hosted conference: %+v", decision)
+	}
+
+	mdd.checkDrained(time.Now())
+	if mdd.NodeInfo().Drained {
+		t.Fatalf("Drained with associations left")
+	}
+
+	mdd.DestroyConference(7)
+	mdd.checkDrained(time.Now())
+	mdd.checkDrained(time.Now())
+	if info := mdd.NodeInfo(); !info.Draining || !info.Drained {
+		t.Fatalf("Incorrect node state: %+v", info)
+	}
+	if len(events) != 2 || events[1].Type != EventNodeDrained {
+		t.Fatalf("Incorrect drained events: %+v", events)
+	}
+
+	mdd.StopDraining()
+	if err := mdd.CreateConference(9); err != nil {
+		t.Fatalf("Conference refused after draining stopped: %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package percy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bifurcation/percy/internal/cryptoutil"
+	"github.com/fluffy/rtp"
+	"github.com/pion/dtls/v3"
+	"github.com/pion/transport/v5/deadline"
+)
+
+const (
+	dtlsInboxSize         = 64
+	dtlsHandshakeTimeout  = 30 * time.Second
+	dtlsSRTPExporterLabel = "EXTRACTOR-dtls_srtp"
+)
+
+// Returns the SHA-256 fingerprint of a certificate in the form used by the
+// SDP fingerprint attribute, e.g., "4E:53:20:...".
+func CertificateFingerprint(cert *tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+
+	return fingerprint(cert.Certificate[0])
+}
+
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// Accepts a fingerprint as in the SDP attribute, with or without its
+// "sha-256" hash function
+func normalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	if parts := strings.Fields(fp); len(parts) == 2 && strings.EqualFold(parts[0], "sha-256") {
+		fp = parts[1]
+	}
+	return strings.ToUpper(fp)
+}
+
+// In SFU mode, the MD behaves like a conventional DTLS-SRTP SFU for clients
+// that support neither double encryption nor EKT: it terminates DTLS itself,
+// derives the SRTP keys from the handshake (RFC 5764), and forwards media
+// with only one layer of encryption.
+//
+// The client's certificate has to match the fingerprint from its offer or
+// answer, set with SetRemoteFingerprint, or, for signaling that doesn't know
+// the client's association, SetRemoteFingerprintForUfrag, which is looked
+// up by the client's ufrag in its last successful Binding request.  Without
+// either, the handshake is refused, since anyone who got to the port first
+// would otherwise get the association's keys.
+
+// Key and salt lengths for the single-layer profiles that can be negotiated
+// in SFU mode
+var sfuProfiles = map[dtls.SRTPProtectionProfile]struct {
+	cipher  rtp.CipherID
+	keyLen  int
+	saltLen int
+}{
+	dtls.SRTP_AEAD_AES_128_GCM: {rtp.SRTP_AEAD_AES_128_GCM, 16, 12},
+	dtls.SRTP_AEAD_AES_256_GCM: {rtp.SRTP_AEAD_AES_256_GCM, 32, 12},
+}
+
+// dtlsEndpoint is a net.PacketConn that carries one association's DTLS
+// records between the processing loop and a local DTLS server
+type dtlsEndpoint struct {
+	mdd          *MDD
+	assoc        *association
+	addr         net.Addr
+	inbox        chan []byte
+	closed       chan struct{}
+	once         sync.Once
+	readDeadline *deadline.Deadline
+	conn         *dtls.Conn // Set once the handshake is done
+}
+
+func newDTLSEndpoint(mdd *MDD, assoc *association) *dtlsEndpoint {
+	return &dtlsEndpoint{
+		mdd:          mdd,
+		assoc:        assoc,
+		addr:         assoc.addr,
+		inbox:        make(chan []byte, dtlsInboxSize),
+		closed:       make(chan struct{}),
+		readDeadline: deadline.New(),
+	}
+}
+
+func (ep *dtlsEndpoint) deliver(msg []byte) {
+	select {
+	case <-ep.closed:
+	case ep.inbox <- msg:
+	default:
+		log.Printf("DTLS inbox full for [%04x]; dropping record", ep.assoc.id)
+	}
+}
+
+func (ep *dtlsEndpoint) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-ep.closed:
+		return 0, nil, net.ErrClosed
+	case <-ep.readDeadline.Done():
+		return 0, nil, ep.readDeadline.Err()
+	case msg := <-ep.inbox:
+		return copy(b, msg), ep.addr, nil
+	}
+}
+
+func (ep *dtlsEndpoint) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-ep.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	n, err := ep.mdd.writeTo(b, ep.addr)
+	ep.mdd.countOut(ep.assoc, len(b), err)
+	return n, err
+}
+
+func (ep *dtlsEndpoint) Close() error {
+	ep.once.Do(func() { close(ep.closed) })
+	return nil
+}
+
+func (ep *dtlsEndpoint) LocalAddr() net.Addr {
+	return ep.mdd.transport().LocalAddr()
+}
+
+func (ep *dtlsEndpoint) SetDeadline(t time.Time) error {
+	return ep.SetReadDeadline(t)
+}
+
+func (ep *dtlsEndpoint) SetReadDeadline(t time.Time) error {
+	ep.readDeadline.Set(t)
+	return nil
+}
+
+// Writes go straight to the media socket and never block
+func (ep *dtlsEndpoint) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Feeds a DTLS record to the association's local DTLS server, starting one if
+// this is the first record
+func (mdd *MDD) terminateDTLS(assoc *association, msg []byte, trace *packetTrace) {
+	if mdd.DTLSCertificate == nil {
+		log.Printf("No DTLS certificate; dropping DTLS from [%04x]", assoc.id)
+		trace.log("route", "dropped: no DTLS certificate for SFU mode")
+		return
+	}
+
+	mdd.mu.Lock()
+	ep := assoc.dtls
+	created := ep == nil
+	if created {
+		ep = newDTLSEndpoint(mdd, assoc)
+		assoc.dtls = ep
+	}
+	mdd.mu.Unlock()
+
+	if created {
+		go mdd.serveDTLS(ep)
+	}
+
+	trace.log("route", "to local DTLS server")
+	ep.deliver(msg)
+}
+
+// Sets the SHA-256 fingerprint of the certificate an association's client
+// does DTLS with, as in its SDP
+func (mdd *MDD) SetRemoteFingerprint(assocID AssociationID, fingerprint string) {
+	assoc := mdd.association(assocID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.remoteFingerprint = normalizeFingerprint(fingerprint)
+}
+
+// Sets the fingerprint for the client with the given ICE ufrag; an empty
+// fingerprint removes it
+func (mdd *MDD) SetRemoteFingerprintForUfrag(ufrag, fingerprint string) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if len(fingerprint) == 0 {
+		delete(mdd.fingerprints, ufrag)
+		return
+	}
+	mdd.fingerprints[ufrag] = normalizeFingerprint(fingerprint)
+}
+
+// Checks a client's certificate against the fingerprint from signaling
+func (mdd *MDD) verifyFingerprint(assoc *association, rawCerts [][]byte) error {
+	mdd.mu.Lock()
+	expected := assoc.remoteFingerprint
+	if parts := strings.SplitN(assoc.iceUsername, ":", 2); len(expected) == 0 && len(parts) == 2 {
+		expected = mdd.fingerprints[parts[1]]
+	}
+	mdd.mu.Unlock()
+
+	if len(expected) == 0 {
+		return fmt.Errorf("No fingerprint from signaling for [%04x]", assoc.id)
+	}
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("No client certificate from [%04x]", assoc.id)
+	}
+	if actual := fingerprint(rawCerts[0]); !cryptoutil.EqualString(actual, expected) {
+		return fmt.Errorf("Certificate fingerprint %s from [%04x] doesn't match %s", actual, assoc.id, expected)
+	}
+	return nil
+}
+
+func (mdd *MDD) serveDTLS(ep *dtlsEndpoint) {
+	defer mdd.dropDTLS(ep)
+
+	conn, err := dtls.ServerWithOptions(ep, ep.addr,
+		dtls.WithCertificates(*mdd.DTLSCertificate),
+		dtls.WithSRTPProtectionProfiles(dtls.SRTP_AEAD_AES_128_GCM, dtls.SRTP_AEAD_AES_256_GCM),
+		dtls.WithExtendedMasterSecret(dtls.RequireExtendedMasterSecret),
+		dtls.WithClientAuth(dtls.RequireAnyClientCert),
+		dtls.WithVerifyPeerCertificate(func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return mdd.verifyFingerprint(ep.assoc, rawCerts)
+		}))
+	if err != nil {
+		log.Printf("Error creating DTLS server for [%04x]: %v", ep.assoc.id, err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+	err = conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("DTLS handshake with [%04x] failed: %v", ep.assoc.id, err)
+		return
+	}
+
+	err = mdd.setDTLSKeys(ep.assoc, conn)
+	if err != nil {
+		log.Printf("Error setting SRTP keys for [%04x]: %v", ep.assoc.id, err)
+		return
+	}
+
+	mdd.mu.Lock()
+	ep.conn = conn
+	mdd.mu.Unlock()
+
+	// Keep reading so that alerts are processed, and data channel traffic
+	// can be relayed, until the client goes away or the MD stops
+	buf := make([]byte, kdBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			log.Printf("DTLS session with [%04x] ended: %v", ep.assoc.id, err)
+			return
+		}
+
+		mdd.relayDataChannel(ep.assoc, append([]byte{}, buf[:n]...))
+	}
+}
+
+func (mdd *MDD) dropDTLS(ep *dtlsEndpoint) {
+	ep.Close()
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if ep.assoc.dtls == ep {
+		ep.assoc.dtls = nil
+	}
+}
+
+// Derives an association's SRTP keys from its DTLS session, as in RFC 5764
+func (mdd *MDD) setDTLSKeys(assoc *association, conn *dtls.Conn) error {
+	srtpProfile, ok := conn.SelectedSRTPProtectionProfile()
+	if !ok {
+		return fmt.Errorf("No SRTP protection profile negotiated")
+	}
+
+	params, ok := sfuProfiles[srtpProfile]
+	if !ok {
+		return fmt.Errorf("Unsupported SRTP protection profile %v", ProtectionProfile(srtpProfile))
+	}
+
+	state, ok := conn.ConnectionState()
+	if !ok {
+		return fmt.Errorf("DTLS connection state unavailable")
+	}
+
+	keyLen, saltLen := params.keyLen, params.saltLen
+	material, err := state.ExportKeyingMaterial(dtlsSRTPExporterLabel, nil, 2*(keyLen+saltLen))
+	if err != nil {
+		return err
+	}
+
+	// client key | server key | client salt | server salt
+	clientKey := material[:keyLen]
+	serverKey := material[keyLen : 2*keyLen]
+	clientSalt := material[2*keyLen : 2*keyLen+saltLen]
+	serverSalt := material[2*keyLen+saltLen:]
+
+	err = mdd.setSRTP(assoc, params.cipher, clientKey, clientSalt, serverKey, serverSalt)
+	if err != nil {
+		mdd.auditKey(keyAuditRecord{action: keyRejected, assoc: assoc.id, conf: assoc.conf, epoch: assoc.keyEpoch, profile: ProtectionProfile(srtpProfile), source: keySourceDTLS, err: err})
+		return err
+	}
+
+	mdd.mu.Lock()
+	assoc.profile = ProtectionProfile(srtpProfile)
+	mdd.mu.Unlock()
+
+	mdd.keysInstalled(assoc, assoc.profile, keySourceDTLS)
+	mdd.escrowKeys(assoc, assoc.profile, keySourceDTLS, clientKey, clientSalt, serverKey, serverSalt)
+
+	log.Printf(" --- MD terminated DTLS for [%04x] with %v", assoc.id, assoc.profile)
+	return nil
+}
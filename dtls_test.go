@@ -0,0 +1,146 @@
+package percy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+	"github.com/pion/dtls/v3"
+)
+
+func TestSFUModeDTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("static/cert.pem", "static/key.pem")
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	mdd.DTLSCertificate = &cert
+	mdd.SetConferenceMode(DefaultConfID, ModeSFU)
+
+	conn, err := network.Listen("10.0.0.1:5000")
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	defer conn.Close()
+
+	mdd.SetRemoteFingerprint(addrToAssoc(conn.LocalAddr()), "sha-256 "+CertificateFingerprint(&cert))
+
+	server, _ := net.ResolveUDPAddr("udp", mddAddr)
+	client, err := dtls.ClientWithOptions(conn, server,
+		dtls.WithCertificates(cert),
+		dtls.WithSRTPProtectionProfiles(dtls.SRTP_AEAD_AES_128_GCM),
+		dtls.WithInsecureSkipVerify(true))
+	if err != nil {
+		t.Fatalf("Error creating DTLS client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = client.HandshakeContext(ctx)
+	if err != nil {
+		t.Fatalf("DTLS handshake failed: %v", err)
+	}
+
+	// The MD sets its keys just after its side of the handshake finishes
+	assocID := addrToAssoc(conn.LocalAddr())
+	for i := 0; i < 100; i += 1 {
+		for _, assoc := range mdd.StatsSnapshot().Associations {
+			if assoc.ID == assocID && assoc.Keyed {
+				if assoc.Profile != SRTP_AEAD_AES_128_GCM {
+					t.Fatalf("Wrong profile: %v", assoc.Profile)
+				}
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("MD never keyed the association")
+}
+
+func TestSFUModeDTLSFingerprint(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("static/cert.pem", "static/key.pem")
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	mdd.DTLSCertificate = &cert
+	mdd.SetConferenceMode(DefaultConfID, ModeSFU)
+
+	handshake := func(addr string, fingerprint string) error {
+		conn, err := network.Listen(addr)
+		if err != nil {
+			t.Fatalf("Error creating client: %v", err)
+		}
+		defer conn.Close()
+		if len(fingerprint) > 0 {
+			mdd.SetRemoteFingerprint(addrToAssoc(conn.LocalAddr()), fingerprint)
+		}
+
+		server, _ := net.ResolveUDPAddr("udp", mddAddr)
+		client, err := dtls.ClientWithOptions(conn, server,
+			dtls.WithCertificates(cert),
+			dtls.WithSRTPProtectionProfiles(dtls.SRTP_AEAD_AES_128_GCM),
+			dtls.WithInsecureSkipVerify(true))
+		if err != nil {
+			t.Fatalf("Error creating DTLS client: %v", err)
+		}
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return client.HandshakeContext(ctx)
+	}
+
+	if err := handshake("10.0.0.1:5000", ""); err == nil {
+		t.Fatalf("Handshake accepted without a fingerprint from signaling")
+	}
+	wrong := strings.Repeat("00:", 31) + "00"
+	if err := handshake("10.0.0.2:5000", wrong); err == nil {
+		t.Fatalf("Handshake accepted with the wrong fingerprint")
+	}
+	if err := handshake("10.0.0.3:5000", strings.ToLower(CertificateFingerprint(&cert))); err != nil {
+		t.Fatalf("Handshake with the right fingerprint failed: %v", err)
+	}
+}
+
+func TestVerifyFingerprintByUfrag(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("static/cert.pem", "static/key.pem")
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	assoc := mdd.association(0x0001)
+	mdd.SetRemoteFingerprintForUfrag("client", "sha-256 "+CertificateFingerprint(&cert))
+	if err := mdd.verifyFingerprint(assoc, cert.Certificate); err == nil {
+		t.Fatalf("Fingerprint found before the client's ufrag was known")
+	}
+
+	mdd.mu.Lock()
+	assoc.iceUsername = "local:client"
+	mdd.mu.Unlock()
+	if err := mdd.verifyFingerprint(assoc, cert.Certificate); err != nil {
+		t.Fatalf("Fingerprint not found by ufrag: %v", err)
+	}
+
+	mdd.SetRemoteFingerprintForUfrag("client", "")
+	if err := mdd.verifyFingerprint(assoc, cert.Certificate); err == nil {
+		t.Fatalf("Fingerprint not removed")
+	}
+}
@@ -0,0 +1,50 @@
+package percy
+
+// With ECN on, the MD marks the packets it sends ECT(1), as L4S senders do,
+// so that routers along the way can signal congestion by marking packets CE
+// instead of dropping them, and reads the ECN bits of the packets it
+// receives.  The MD doesn't generate congestion feedback itself (clients'
+// RTCP goes end to end), so the marks are counted per association, where
+// they show which clients' paths to the MD are congested.  Only Linux
+// sockets report ECN bits.
+
+const (
+	ecnMask   = 0x03
+	ecnNotECT = 0x00
+	ecnECT1   = 0x01
+	ecnECT0   = 0x02
+	ecnCE     = 0x03
+)
+
+type ECNStats struct {
+	ECT0 uint64 `json:"ect0"`
+	ECT1 uint64 `json:"ect1"`
+	CE   uint64 `json:"ce"`
+}
+
+// Asks the kernel to report ECN bits on a transport, and to mark what it
+// sends ECT(1).  Returns false if the transport or platform doesn't
+// support it.
+func enableECN(conn Transport) bool {
+	return setSocketOptions(conn, setECNOptions)
+}
+
+// Counts the ECN bits of a received packet.  The caller holds mdd.mu.
+func (stats *ECNStats) count(ecn uint8) {
+	switch ecn {
+	case ecnECT0:
+		stats.ECT0 += 1
+	case ecnECT1:
+		stats.ECT1 += 1
+	case ecnCE:
+		stats.CE += 1
+	}
+}
+
+// Returns nil if no packets were ECN-capable
+func (stats ECNStats) orNil() *ECNStats {
+	if stats == (ECNStats{}) {
+		return nil
+	}
+	return &stats
+}
@@ -0,0 +1,47 @@
+package percy
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestECN(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ECN is only supported on Linux")
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer conn.Close()
+
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer sender.Close()
+
+	// Both ends mark what they send ECT(1)
+	if !enableECN(conn) || !enableECN(sender) {
+		t.Fatalf("Error enabling ECN")
+	}
+
+	sender.Write([]byte{1, 2, 3})
+	pkt, err := readPacket(conn, make([]byte, 2048), make([]byte, 128), true)
+	if err != nil || pkt.ecn != ecnECT1 {
+		t.Fatalf("Incorrect ECN bits: %02x %v", pkt.ecn, err)
+	}
+
+	var stats ECNStats
+	stats.count(pkt.ecn)
+	stats.count(ecnCE)
+	stats.count(ecnNotECT)
+	if stats.orNil() == nil || stats.ECT1 != 1 || stats.CE != 1 || stats.ECT0 != 0 {
+		t.Fatalf("Incorrect ECN counts: %+v", stats)
+	}
+	if (ECNStats{}).orNil() != nil {
+		t.Fatalf("ECN stats reported without ECN-capable packets")
+	}
+}
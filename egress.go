@@ -0,0 +1,49 @@
+package percy
+
+// Every conference forwards each packet to all of its participants except
+// the sender.  Some participants need more exclusions than that: a recorder
+// that injects a stream shouldn't get it back on its recording leg, and two
+// gateway legs into the same PSTN call shouldn't hear each other.  So each
+// association can be given a role, and each conference a list of rules, each
+// of which stops forwarding from associations with one role to those with
+// another.  "*" matches any role, and "" associations without one.
+
+const AnyRole = "*"
+
+type EgressRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (rule EgressRule) matches(from, to string) bool {
+	return (rule.From == AnyRole || rule.From == from) && (rule.To == AnyRole || rule.To == to)
+}
+
+// Sets an association's role, for the egress rules of its conference
+func (mdd *MDD) SetAssociationRole(assocID AssociationID, role string) {
+	assoc := mdd.association(assocID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.role = role
+}
+
+// Replaces a conference's egress rules; nil forwards to everyone
+func (mdd *MDD) SetConferenceEgressRules(confID ConfID, rules []EgressRule) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.egressRules = rules
+}
+
+// Reports whether a conference's rules stop forwarding from one association
+// to another
+func excluded(rules []EgressRule, from, to *association) bool {
+	for _, rule := range rules {
+		if rule.matches(from.role, to.role) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package percy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEgressRules(t *testing.T) {
+	mdd := NewMDD()
+
+	roles := map[AssociationID]string{
+		0x0001: "",
+		0x0002: "recorder",
+		0x0003: "injector",
+		0x0004: "gateway",
+		0x0005: "gateway",
+	}
+	for assocID, role := range roles {
+		mdd.SetAssociationConference(assocID, 5)
+		mdd.SetAssociationRole(assocID, role)
+		mdd.association(assocID).addr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(assocID)), Port: 5000}
+	}
+
+	mdd.SetConferenceEgressRules(5, []EgressRule{
+		{From: "injector", To: "recorder"},
+		{From: "gateway", To: "gateway"},
+		{From: AnyRole, To: "injector"},
+	})
+
+	receivers := func(assocID AssociationID) map[AssociationID]bool {
+		ids := map[AssociationID]bool{}
+		assoc, _ := mdd.assocs.get(assocID)
+		for _, peer := range mdd.peers(assoc) {
+			ids[peer.id] = true
+		}
+		return ids
+	}
+
+	cases := map[AssociationID][]AssociationID{
+		0x0001: {0x0002, 0x0004, 0x0005},
+		0x0003: {0x0001, 0x0004, 0x0005},
+		0x0004: {0x0001, 0x0002},
+	}
+	for sender, expected := range cases {
+		got := receivers(sender)
+		if len(got) != len(expected) {
+			t.Fatalf("Incorrect receivers for [%04x]: %v", sender, got)
+		}
+		for _, assocID := range expected {
+			if !got[assocID] {
+				t.Fatalf("Incorrect receivers for [%04x]: %v", sender, got)
+			}
+		}
+	}
+
+	mdd.SetConferenceEgressRules(5, nil)
+	if got := receivers(0x0004); len(got) != 4 {
+		t.Fatalf("Rules not cleared: %v", got)
+	}
+}
@@ -0,0 +1,56 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// PERC's promise is that the MD never sees the media, but a conference in SFU
+// or relay mode, or a client whose keys only cover one layer, quietly loses
+// it.  A conference can instead require double encryption: media is only
+// forwarded from clients whose hop-by-hop keys are for a double profile, and
+// anything else (SFU clients, relayed media the MD can't vouch for) is
+// dropped, counted in the `downgrade_dropped` stat, and reported once per
+// client with an EventEncryptionDowngraded event.  PERC clients that haven't
+// got their keys yet are let through, so that their media can be backfilled.
+
+// Requires or stops requiring double encryption of media in a conference
+func (mdd *MDD) SetConferencePERCRequired(confID ConfID, required bool) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	conf.requirePERC = required
+	mdd.mu.Unlock()
+}
+
+func isDoubleProfile(profile ProtectionProfile) bool {
+	return profile == DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM || profile == DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM
+}
+
+// Reports whether media from an association has to be refused under its
+// conference's encryption policy.  Runs on the processing loop.
+func (mdd *MDD) downgraded(assoc *association) bool {
+	mode := mdd.mode(assoc)
+
+	mdd.mu.Lock()
+	conf, ok := mdd.conferences[assoc.conf]
+	refused := false
+	if ok && conf.requirePERC {
+		refused = mode != ModePERC || (assoc.profile != 0 && !isDoubleProfile(assoc.profile))
+	}
+	report := refused && !assoc.downgraded
+	assoc.downgraded = refused
+	if refused {
+		mdd.stats.downgraded += 1
+	}
+	profile := assoc.profile
+	mdd.mu.Unlock()
+
+	if report {
+		detail := fmt.Sprintf("%v mode, profile %v", mode, profile)
+		log.Printf("Refusing media from %s without double encryption: %s", mdd.describe(assoc), detail)
+		mdd.emit(Event{Type: EventEncryptionDowngraded, Time: time.Now(), Assoc: assoc.id, Conf: assoc.conf, Detail: detail})
+	}
+	return refused
+}
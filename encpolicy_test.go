@@ -0,0 +1,65 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestEncryptionPolicy(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+	mdd.SetConferencePERCRequired(DefaultConfID, true)
+
+	downgrades := make(chan Event, 10)
+	mdd.OnEvent(func(evt Event) {
+		if evt.Type == EventEncryptionDowngraded {
+			downgrades <- evt
+		}
+	})
+
+	sender, _ := NewClient(network, "10.0.0.1:5000")
+	defer sender.Stop()
+	receiver, _ := NewClient(network, "10.0.0.2:5000")
+	defer receiver.Stop()
+
+	// Relayed media can't be vouched for
+	media := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	receiver.Write(media)
+	sender.Write(media)
+	sender.Write(media)
+	AssertNotRecvPacket(t, receiver, "Media forwarded without double encryption")
+
+	for _, client := range []*Client{receiver, sender} {
+		if evt := <-downgrades; evt.Assoc != client.Assoc() || evt.Detail != "relay mode, profile <0x0000>" {
+			t.Fatalf("Incorrect downgrade event: %+v", evt)
+		}
+	}
+	if len(downgrades) > 0 {
+		t.Fatalf("Downgrade reported more than once")
+	}
+
+	stats := mdd.StatsSnapshot()
+	if stats.Global.Downgraded != 3 || !stats.Conferences[0].RequirePERC {
+		t.Fatalf("Incorrect stats: %+v", stats.Global)
+	}
+
+	mdd.SetConferencePERCRequired(DefaultConfID, false)
+	sender.Write(media)
+	AssertRecvPacket(t, receiver, media, "Media not forwarded once the policy was lifted")
+}
+
+func TestDoubleProfiles(t *testing.T) {
+	for profile, double := range map[ProtectionProfile]bool{
+		DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM: true,
+		DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM: true,
+		SRTP_AEAD_AES_128_GCM:                    false,
+		SRTP_AES128_CM_HMAC_SHA1_80:              false,
+	} {
+		if isDoubleProfile(profile) != double {
+			t.Fatalf("Incorrect double encryption for %v", profile)
+		}
+	}
+}
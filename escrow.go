@@ -0,0 +1,70 @@
+package percy
+
+import (
+	"log"
+	"time"
+)
+
+// Some regulated deployments have to keep the hop-by-hop keys, so that
+// recorded traffic between clients and the MD can be decrypted later (under
+// PERC, that only exposes the hop-by-hop layer; the media stays end-to-end
+// encrypted).  An application that must do this sets MDD.KeyEscrow, and the
+// MD hands it a copy of each set of keys it installs, from the KD or from
+// DTLS.  There is no default escrow, and nothing turns it on but the
+// application.
+//
+// Escrow is never silent: every delivery is logged to the MD's log,
+// whether or not KeyAudit is set, and to the key audit log and the
+// conference's timeline as an "escrowed" step.  Escrow runs where the keys
+// are installed, on the processing loop or the KD tunnel, so it should hand
+// the keys off rather than block.
+
+// The keys an association was given, as delivered to escrow
+type EscrowedKeys struct {
+	Time    time.Time
+	Assoc   AssociationID
+	Conf    ConfID
+	Epoch   int // Which install this is for the association
+	Profile ProtectionProfile
+	Source  string // "kd" or "dtls"
+
+	ClientWriteKey []byte
+	ClientSalt     []byte
+	ServerWriteKey []byte
+	ServerSalt     []byte
+}
+
+type KeyEscrow interface {
+	Escrow(keys EscrowedKeys) error
+}
+
+// Delivers the keys just installed on an association to escrow, if there is
+// one
+func (mdd *MDD) escrowKeys(assoc *association, profile ProtectionProfile, source string, clientKey, clientSalt, serverKey, serverSalt []byte) {
+	if mdd.KeyEscrow == nil {
+		return
+	}
+
+	mdd.mu.Lock()
+	epoch := assoc.keyEpoch
+	mdd.mu.Unlock()
+
+	keys := EscrowedKeys{
+		Time:           time.Now(),
+		Assoc:          assoc.id,
+		Conf:           assoc.conf,
+		Epoch:          epoch,
+		Profile:        profile,
+		Source:         source,
+		ClientWriteKey: append([]byte{}, clientKey...),
+		ClientSalt:     append([]byte{}, clientSalt...),
+		ServerWriteKey: append([]byte{}, serverKey...),
+		ServerSalt:     append([]byte{}, serverSalt...),
+	}
+	err := mdd.KeyEscrow.Escrow(keys)
+
+	rec := keyAuditRecord{action: keyEscrowed, assoc: assoc.id, conf: assoc.conf, epoch: epoch, profile: profile, source: source, err: err}
+	log.Printf("Key escrow: %v", rec)
+	mdd.auditKey(rec)
+	mdd.record(assoc.conf, assoc.id, "KeysEscrowed", "epoch=%d profile=%v source=%s", epoch, profile, source)
+}
@@ -0,0 +1,96 @@
+package percy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+type testEscrow struct {
+	keys []EscrowedKeys
+	err  error
+}
+
+func (escrow *testEscrow) Escrow(keys EscrowedKeys) error {
+	escrow.keys = append(escrow.keys, keys)
+	return escrow.err
+}
+
+func TestKeyEscrow(t *testing.T) {
+	mdd := NewMDD()
+	audit := &bytes.Buffer{}
+	mdd.KeyAudit = log.New(audit, "", 0)
+
+	mdd.SetAssociationConference(0x0001, 5)
+	secret := []byte{0xde, 0xad, 0xbe, 0xef}
+	keys := HBHKeys{
+		Profile:        DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM,
+		ClientWriteKey: secret,
+		ServerWriteKey: secret,
+		MasterSalt:     secret,
+	}
+
+	// Nothing is escrowed by default
+	if err := mdd.SetKeys(0x0001, keys); err != nil {
+		t.Fatalf("Error setting keys: %v", err)
+	}
+	if strings.Contains(audit.String(), "escrowed") {
+		t.Fatalf("Keys escrowed without an escrow: %s", audit)
+	}
+
+	escrow := &testEscrow{}
+	mdd.KeyEscrow = escrow
+	if err := mdd.SetKeys(0x0001, keys); err != nil {
+		t.Fatalf("Error setting keys: %v", err)
+	}
+	escrow.err = fmt.Errorf("Escrow unavailable")
+	mdd.SetKeys(0x0001, keys)
+
+	if len(escrow.keys) != 2 {
+		t.Fatalf("Incorrect escrow deliveries: %+v", escrow.keys)
+	}
+	got := escrow.keys[0]
+	if got.Assoc != 0x0001 || got.Conf != 5 || got.Epoch != 2 || got.Source != keySourceKD ||
+		!bytes.Equal(got.ClientWriteKey, secret) || !bytes.Equal(got.ServerSalt, secret) {
+		t.Fatalf("Incorrect escrowed keys: %+v", got)
+	}
+	secret[0] = 0x00
+	if got.ClientWriteKey[0] != 0xde {
+		t.Fatalf("Escrowed keys share memory with the MD's")
+	}
+
+	// Each delivery is audited, without key material
+	expected := []string{
+		"key action=escrowed assoc=0001 conf=5 epoch=2 profile=DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM source=kd",
+		"key action=escrowed assoc=0001 conf=5 epoch=3 profile=DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM source=kd error=\"Escrow unavailable\"",
+	}
+	escrowed := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		if strings.Contains(line, "action=escrowed") {
+			escrowed = append(escrowed, line)
+		}
+	}
+	if strings.Join(escrowed, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Incorrect audit log: %s", audit)
+	}
+	if strings.Contains(audit.String(), hex.EncodeToString([]byte{0xde, 0xad, 0xbe, 0xef})) {
+		t.Fatalf("Key material in audit log: %s", audit)
+	}
+
+	timeline, err := mdd.Timeline(5)
+	if err != nil {
+		t.Fatalf("No timeline: %v", err)
+	}
+	count := 0
+	for _, entry := range timeline.Entries {
+		if entry.Kind == "KeysEscrowed" {
+			count += 1
+		}
+	}
+	if count != 2 {
+		t.Fatalf("Incorrect timeline: %+v", timeline.Entries)
+	}
+}
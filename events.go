@@ -0,0 +1,154 @@
+package percy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Events let applications (signaling, monitoring) react to things that happen
+// inside the MD.  Handlers are called synchronously from whichever goroutine
+// raised the event, so they must not block or call back into the MD.
+
+type EventType int
+
+const (
+	EventSocketError EventType = iota
+	EventSocketRebinding
+	EventSocketRebound
+	EventParticipantRejected
+	EventInterfacesChanged
+	EventReceiverCongested
+	EventReceiverFailed
+	EventReceiverRecovered
+	EventSendError
+	EventConferencePaused
+	EventConferenceResumed
+	EventConferenceExpiring
+	EventConferenceExpired
+	EventAssociationResumed
+	EventConferenceDestroyed
+	EventSourceLost
+	EventSourceRestored
+	EventConferenceMigrating
+	EventNodeDrained
+	EventPathChanged
+	EventAssociationEvicted
+	EventDominantSpeakerChanged
+	EventAssociationMuted
+	EventAssociationUnmuted
+	EventPeerReflexiveCandidate
+	EventEncryptionDowngraded
+	EventForwardingLoop
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventSocketError:
+		return "SocketError"
+	case EventSocketRebinding:
+		return "SocketRebinding"
+	case EventSocketRebound:
+		return "SocketRebound"
+	case EventParticipantRejected:
+		return "ParticipantRejected"
+	case EventInterfacesChanged:
+		return "InterfacesChanged"
+	case EventReceiverCongested:
+		return "ReceiverCongested"
+	case EventReceiverFailed:
+		return "ReceiverFailed"
+	case EventReceiverRecovered:
+		return "ReceiverRecovered"
+	case EventSendError:
+		return "SendError"
+	case EventConferencePaused:
+		return "ConferencePaused"
+	case EventConferenceResumed:
+		return "ConferenceResumed"
+	case EventConferenceExpiring:
+		return "ConferenceExpiring"
+	case EventConferenceExpired:
+		return "ConferenceExpired"
+	case EventAssociationResumed:
+		return "AssociationResumed"
+	case EventConferenceDestroyed:
+		return "ConferenceDestroyed"
+	case EventSourceLost:
+		return "SourceLost"
+	case EventSourceRestored:
+		return "SourceRestored"
+	case EventConferenceMigrating:
+		return "ConferenceMigrating"
+	case EventNodeDrained:
+		return "NodeDrained"
+	case EventPathChanged:
+		return "PathChanged"
+	case EventAssociationEvicted:
+		return "AssociationEvicted"
+	case EventDominantSpeakerChanged:
+		return "DominantSpeakerChanged"
+	case EventAssociationMuted:
+		return "AssociationMuted"
+	case EventAssociationUnmuted:
+		return "AssociationUnmuted"
+	case EventPeerReflexiveCandidate:
+		return "PeerReflexiveCandidate"
+	case EventEncryptionDowngraded:
+		return "EncryptionDowngraded"
+	case EventForwardingLoop:
+		return "ForwardingLoop"
+	default:
+		return fmt.Sprintf("<%d>", int(et))
+	}
+}
+
+func (et EventType) MarshalText() ([]byte, error) {
+	return []byte(et.String()), nil
+}
+
+type Event struct {
+	Type   EventType     `json:"type"`
+	Time   time.Time     `json:"time"`
+	Assoc  AssociationID `json:"assoc,omitempty"`
+	Conf   ConfID        `json:"conf,omitempty"`
+	Detail string        `json:"detail,omitempty"`
+
+	// The association's labels, if it has any
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type EventHandler func(Event)
+
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers []EventHandler
+}
+
+// Registers a handler to be called for every event
+func (mdd *MDD) OnEvent(handler EventHandler) {
+	mdd.events.mu.Lock()
+	defer mdd.events.mu.Unlock()
+	mdd.events.handlers = append(mdd.events.handlers, handler)
+}
+
+func (mdd *MDD) emit(evt Event) {
+	if evt.Time.IsZero() {
+		evt.Time = time.Now()
+	}
+	if evt.Assoc != 0 && evt.Labels == nil {
+		if assoc, ok := mdd.assocs.get(evt.Assoc); ok {
+			evt.Labels = mdd.assocs.labelsOf(assoc)
+		}
+	}
+
+	if evt.Conf != DefaultConfID || evt.Assoc != 0 {
+		mdd.timelines.record(evt.Conf, TimelineEntry{Time: evt.Time, Kind: evt.Type.String(), Assoc: evt.Assoc, Detail: evt.Detail})
+	}
+
+	mdd.events.mu.RLock()
+	defer mdd.events.mu.RUnlock()
+	for _, handler := range mdd.events.handlers {
+		handler(evt)
+	}
+}
@@ -0,0 +1,157 @@
+// Command endpoint is a reference WebRTC endpoint built on pion/webrtc.  It
+// signals with percy's example server the same way the browser page in
+// static/ does, establishes DTLS-SRTP through the MD, sends a stream of Opus
+// silence, and counts the RTP packets it receives from other participants.
+//
+// Run two of these against the same server to check interop end to end; the
+// exit status is non-zero if fewer than -min-packets packets arrive, so it
+// can serve as an integration test peer.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+var (
+	server     = "wss://localhost:4430/ws"
+	insecure   = true
+	duration   = 10 * time.Second
+	minPackets = 1
+)
+
+// Opus frame that decodes to 20ms of silence
+var opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+type signal struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func panicOnError(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+	flag.StringVar(&server, "server", server, "WebSocket URL of percy's signaling server")
+	flag.BoolVar(&insecure, "insecure", insecure, "Skip verification of the server's certificate")
+	flag.DurationVar(&duration, "duration", duration, "How long to send and receive media")
+	flag.IntVar(&minPackets, "min-packets", minPackets, "Fail unless at least this many RTP packets arrive")
+	flag.Parse()
+
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}}
+	ws, _, err := dialer.Dial(server, nil)
+	panicOnError(err)
+	defer ws.Close()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	panicOnError(err)
+	defer pc.Close()
+
+	audio, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "percy-endpoint")
+	panicOnError(err)
+	_, err = pc.AddTrack(audio)
+	panicOnError(err)
+
+	var received int64
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Printf("Receiving %s track with SSRC %d", track.Codec().MimeType, track.SSRC())
+		for {
+			_, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&received, 1)
+		}
+	})
+
+	connected := make(chan struct{})
+	var once sync.Once
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("ICE connection state: %v", state)
+		if state == webrtc.ICEConnectionStateConnected {
+			once.Do(func() { close(connected) })
+		}
+	})
+
+	// percy sends its offer, then its (only) ICE candidate
+	var offer string
+	for len(offer) == 0 {
+		var msg signal
+		panicOnError(ws.ReadJSON(&msg))
+
+		switch msg.Type {
+		case "sdp":
+			panicOnError(json.Unmarshal(msg.Data, &offer))
+		default:
+			log.Printf("Ignoring %s message before offer", msg.Type)
+		}
+	}
+
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	panicOnError(err)
+
+	answer, err := pc.CreateAnswer(nil)
+	panicOnError(err)
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+	panicOnError(pc.SetLocalDescription(answer))
+	<-gathered
+
+	// percy expects the bare answer SDP
+	err = ws.WriteMessage(websocket.TextMessage, []byte(pc.LocalDescription().SDP))
+	panicOnError(err)
+
+	var msg signal
+	panicOnError(ws.ReadJSON(&msg))
+	if msg.Type != "ice" {
+		panic(fmt.Sprintf("Expected an ICE candidate, got %s", msg.Type))
+	}
+
+	var candidate webrtc.ICECandidateInit
+	panicOnError(json.Unmarshal(msg.Data, &candidate))
+	panicOnError(pc.AddICECandidate(candidate))
+
+	select {
+	case <-connected:
+	case <-time.After(duration):
+		log.Printf("ICE did not connect within %v", duration)
+		os.Exit(1)
+	}
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(duration)
+
+	for sending := true; sending; {
+		select {
+		case <-ticker.C:
+			err = audio.WriteSample(media.Sample{Data: opusSilence, Duration: 20 * time.Millisecond})
+			if err != nil {
+				log.Printf("Error sending audio: %v", err)
+			}
+		case <-deadline:
+			sending = false
+		}
+	}
+
+	count := atomic.LoadInt64(&received)
+	log.Printf("Received %d RTP packets in %v", count, duration)
+	if count < int64(minPackets) {
+		os.Exit(1)
+	}
+}
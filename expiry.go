@@ -0,0 +1,131 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Conferences can be given an end time, after which the MD tears them down:
+// their associations are removed, the hop-by-hop keys it holds for them are
+// wiped, and their DTLS sessions and KD tunnels are closed.  A warning event
+// is raised ExpiryWarning beforehand, so that signaling can let participants
+// know the call is about to end.  Expiry runs on the processing loop, since
+// that is where the maps are read without locking.
+
+const (
+	defaultExpiryWarning = time.Minute
+	expiryCheckInterval  = time.Second
+)
+
+// Tunnels that hold resources for each association (like UDPForwarder's
+// sockets) can release them when an association is removed
+type closableTunnel interface {
+	Close(assoc AssociationID) error
+}
+
+// Sets when a conference ends; the zero time means never
+func (mdd *MDD) SetConferenceExpiry(confID ConfID, expires time.Time) error {
+	if confID == DefaultConfID && !expires.IsZero() {
+		return fmt.Errorf("The default conference cannot expire")
+	}
+
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.expires = expires
+	conf.warned = false
+	return nil
+}
+
+// Sets a conference to end after the given time from now
+func (mdd *MDD) SetConferenceTTL(confID ConfID, ttl time.Duration) error {
+	return mdd.SetConferenceExpiry(confID, time.Now().Add(ttl))
+}
+
+// Warns about and tears down conferences whose time is up
+func (mdd *MDD) checkExpiry(now time.Time) {
+	for _, conf := range mdd.conferences {
+		switch {
+		case conf.expires.IsZero():
+			continue
+
+		case !now.Before(conf.expires):
+			mdd.expireConference(conf)
+
+		case !conf.warned && !now.Add(mdd.ExpiryWarning).Before(conf.expires):
+			mdd.mu.Lock()
+			conf.warned = true
+			mdd.mu.Unlock()
+
+			log.Printf("Conference %v expires at %v", conf.id, conf.expires)
+			mdd.emit(Event{Type: EventConferenceExpiring, Conf: conf.id, Detail: conf.expires.Format(time.RFC3339)})
+		}
+	}
+}
+
+func (mdd *MDD) expireConference(conf *conference) {
+	removed := mdd.removeConference(conf)
+	log.Printf("Conference %v expired; removed %d associations", conf.id, removed)
+	mdd.emit(Event{Type: EventConferenceExpired, Conf: conf.id})
+	mdd.timelines.end(conf.id, time.Now())
+}
+
+// Removes a conference and its associations, releasing what they hold.
+// Returns the number of associations removed.
+func (mdd *MDD) removeConference(conf *conference) int {
+	mdd.mu.Lock()
+	tunnel := mdd.KD
+	if conf.tunnel != nil {
+		tunnel = conf.tunnel
+	}
+	removed := mdd.assocs.removeIf(func(assoc *association) bool {
+		return assoc.conf == conf.id
+	})
+	for _, assoc := range removed {
+		mdd.forgetPaths(assoc.id)
+		delete(mdd.rtcpPending, assoc.id)
+	}
+	delete(mdd.conferences, conf.id)
+	sock := conf.socket
+	conf.socket = nil
+	mdd.mu.Unlock()
+
+	if sock != nil {
+		mdd.closeSocket(sock)
+	}
+
+	for _, assoc := range removed {
+		mdd.teardown(assoc, tunnel)
+	}
+	return len(removed)
+}
+
+// Releases what an association that has been removed was holding.  The SRTP
+// sessions can't be wiped, but nothing refers to them any more.
+func (mdd *MDD) teardown(assoc *association, tunnel KMFTunnel) {
+	mdd.record(assoc.conf, assoc.id, "Left", "")
+	mdd.closeQueue(assoc)
+
+	if assoc.dtls != nil {
+		assoc.dtls.Close()
+	}
+
+	if assoc.keys != nil {
+		for _, key := range [][]byte{assoc.keys.ClientWriteKey, assoc.keys.ServerWriteKey, assoc.keys.MasterSalt} {
+			clear(key)
+		}
+		assoc.keys = nil
+	}
+	if assoc.keyEpoch > 0 {
+		mdd.auditKey(keyAuditRecord{action: keyDestroyed, assoc: assoc.id, conf: assoc.conf, epoch: assoc.keyEpoch, profile: assoc.profile})
+	}
+
+	if closable, ok := tunnel.(closableTunnel); ok {
+		err := closable.Close(assoc.id)
+		if err != nil {
+			log.Printf("Error closing KD tunnel for [%04x]: %v", assoc.id, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConferenceExpiry(t *testing.T) {
+	mdd := NewMDD()
+	mdd.ExpiryWarning = time.Minute
+
+	events := []Event{}
+	mdd.OnEvent(func(evt Event) {
+		events = append(events, evt)
+	})
+
+	err := mdd.SetConferenceTTL(DefaultConfID, time.Hour)
+	if err == nil {
+		t.Fatalf("Default conference allowed to expire")
+	}
+
+	now := time.Now()
+	mdd.SetConferenceExpiry(5, now.Add(time.Hour))
+	mdd.SetAssociationConference(0x0001, 5)
+	mdd.SetAssociationConference(0x0002, DefaultConfID)
+	key := []byte{1, 2, 3, 4}
+	mdd.association(0x0001).keys = &HBHKeys{ClientWriteKey: key}
+
+	mdd.checkExpiry(now)
+	if len(events) != 0 {
+		t.Fatalf("Events raised too early: %+v", events)
+	}
+
+	// The warning is only raised once
+	mdd.checkExpiry(now.Add(time.Hour - time.Minute))
+	mdd.checkExpiry(now.Add(time.Hour - time.Second))
+	if len(events) != 1 || events[0].Type != EventConferenceExpiring || events[0].Conf != 5 {
+		t.Fatalf("Incorrect warning events: %+v", events)
+	}
+
+	mdd.checkExpiry(now.Add(time.Hour))
+	if len(events) != 2 || events[1].Type != EventConferenceExpired {
+		t.Fatalf("Conference did not expire: %+v", events)
+	}
+	if _, ok := mdd.conferences[5]; ok {
+		t.Fatalf("Expired conference not removed")
+	}
+	if _, ok := mdd.assocs.get(0x0001); ok {
+		t.Fatalf("Association in expired conference not removed")
+	}
+	if _, ok := mdd.assocs.get(0x0002); !ok {
+		t.Fatalf("Association in another conference removed")
+	}
+	if key[0] != 0 {
+		t.Fatalf("Keys not wiped")
+	}
+}
@@ -0,0 +1,195 @@
+package percy
+
+import (
+	"encoding/binary"
+
+	"github.com/fluffy/rtp"
+)
+
+// Each endpoint numbers RTP header extensions as its own offer or answer
+// says (a=extmap), and a browser that got ID 3 for the MID won't read it
+// under ID 4.  Given each leg's numbering (SetHeaderExtensions), the MD
+// remaps the elements in every packet it forwards, from the sender's IDs to
+// the receiver's, by URI.  Elements the receiver didn't negotiate are
+// stripped, and the one-byte or two-byte format (RFC 8285) is picked to fit
+// the IDs.  Packets between legs that haven't both been given a numbering
+// are forwarded as they are.
+//
+// PERC allows this: the end-to-end transform authenticates the header with
+// the extension removed (RFC 8723, Section 5.1), and the Original Header
+// Block only restores the payload type, sequence number and marker, so the
+// payload, OHB included, is carried over untouched.  The MD's own extension
+// IDs (TransportCCID, AudioLevelID, RIDExtensionID) are the senders'
+// numbering; transport-wide sequence numbers are written before remapping.
+
+// One element of a header extension
+type extensionElement struct {
+	id   uint8
+	data []byte
+}
+
+// Sets the header extension IDs an association negotiated, by URI, e.g.,
+// from ExtensionMapFromSDP.  A nil map stops remapping for it.
+func (mdd *MDD) SetHeaderExtensions(assocID AssociationID, extmap map[uint8]string) {
+	assoc := mdd.association(assocID)
+
+	var ids map[string]uint8
+	if extmap != nil {
+		ids = map[string]uint8{}
+		for id, uri := range extmap {
+			ids[uri] = id
+		}
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.extmap = extmap
+	assoc.extIDs = ids
+}
+
+// Collects the header extension IDs of media sections, numbered from 1 as
+// in the MD's answer.  Sections on one transport share IDs, so where they
+// disagree, the later section's wins.
+func ExtensionMapFromSDP(media []SDPMedia) map[uint8]string {
+	extmap := map[uint8]string{}
+	for _, section := range media {
+		for i, uri := range section.Extensions {
+			extmap[uint8(i+1)] = uri
+		}
+	}
+	return extmap
+}
+
+// Lists the elements of a header extension.  Returns false if its profile
+// isn't one of RFC 8285's, or it is malformed.
+func extensionElements(header *RTPHeader) ([]extensionElement, bool) {
+	data := header.ExtensionData
+	elements := []extensionElement{}
+	switch {
+	case header.ExtensionProfile == 0xbede:
+		for i := 0; i < len(data); {
+			if data[i] == 0 {
+				i += 1 // Padding
+				continue
+			}
+
+			id, length := data[i]>>4, int(data[i]&0x0f)+1
+			if id == 15 {
+				break
+			}
+			if i+1+length > len(data) {
+				return nil, false
+			}
+			elements = append(elements, extensionElement{id, data[i+1 : i+1+length]})
+			i += 1 + length
+		}
+
+	case header.ExtensionProfile&0xfff0 == 0x1000:
+		for i := 0; i < len(data); {
+			if data[i] == 0 {
+				i += 1
+				continue
+			}
+			if i+1 >= len(data) {
+				return nil, false
+			}
+
+			id, length := data[i], int(data[i+1])
+			if i+2+length > len(data) {
+				return nil, false
+			}
+			elements = append(elements, extensionElement{id, data[i+2 : i+2+length]})
+			i += 2 + length
+		}
+
+	default:
+		return nil, false
+	}
+	return elements, true
+}
+
+// Serializes elements as a header extension, profile and length included,
+// in the one-byte format where they fit it
+func buildExtension(elements []extensionElement) []byte {
+	oneByte := true
+	for _, element := range elements {
+		if element.id > 14 || len(element.data) == 0 || len(element.data) > 16 {
+			oneByte = false
+		}
+	}
+
+	ext := []byte{0xbe, 0xde, 0, 0}
+	if !oneByte {
+		ext = []byte{0x10, 0x00, 0, 0}
+	}
+	for _, element := range elements {
+		if oneByte {
+			ext = append(ext, element.id<<4|uint8(len(element.data)-1))
+		} else {
+			ext = append(ext, element.id, uint8(len(element.data)))
+		}
+		ext = append(ext, element.data...)
+	}
+	for len(ext)%4 != 0 {
+		ext = append(ext, 0)
+	}
+	binary.BigEndian.PutUint16(ext[2:4], uint16(len(ext)/4-1))
+	return ext
+}
+
+// Rewrites a packet's header extension from one numbering to another,
+// returning the new packet and the number of elements stripped.  The
+// packet is returned as it is if nothing changes.
+func remapExtensions(msg []byte, from map[uint8]string, to map[string]uint8) ([]byte, int) {
+	header, err := ParseRTPHeader(msg)
+	if err != nil || !header.Extension {
+		return msg, 0
+	}
+	elements, ok := extensionElements(header)
+	if !ok {
+		return msg, 0
+	}
+
+	changed := false
+	kept := make([]extensionElement, 0, len(elements))
+	for _, element := range elements {
+		id, ok := to[from[element.id]]
+		if _, known := from[element.id]; !known || !ok {
+			changed = true
+			continue
+		}
+		changed = changed || id != element.id
+		kept = append(kept, extensionElement{id, element.data})
+	}
+	if !changed {
+		return msg, 0
+	}
+
+	fixed := rtpFixedHeaderSize + 4*len(header.CSRCs)
+	out := make([]byte, 0, len(msg)+4*len(kept))
+	out = append(out, msg[:fixed]...)
+	if len(kept) > 0 {
+		out = append(out, buildExtension(kept)...)
+	} else {
+		out[0] &^= 0x10
+	}
+	out = append(out, msg[header.Size:]...)
+	return out, len(elements) - len(kept)
+}
+
+// Remaps the header extension of a packet for a receiver, if both legs'
+// numberings are known.  Runs on the processing loop.
+func (mdd *MDD) remapHeaderExtensions(sender, receiver *association, pkt *rtp.RTPPacket, trace *packetTrace) {
+	mdd.mu.Lock()
+	from, to := sender.extmap, receiver.extIDs
+	mdd.mu.Unlock()
+	if from == nil || to == nil {
+		return
+	}
+
+	msg, stripped := remapExtensions(pkt.Buffer, from, to)
+	pkt.Buffer = msg
+	if stripped > 0 {
+		trace.log("route", "stripped %d header extension elements for [%04x]", stripped, receiver.id)
+	}
+}
@@ -0,0 +1,116 @@
+package percy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+const (
+	testMIDURI    = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	testLevelURI  = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	testOffsetURI = "urn:ietf:params:rtp-hdrext:toffset"
+)
+
+func extensionIDs(extmap map[uint8]string) map[string]uint8 {
+	ids := map[string]uint8{}
+	for id, uri := range extmap {
+		ids[uri] = id
+	}
+	return ids
+}
+
+func TestRemapExtensions(t *testing.T) {
+	// MID "a" as 3, audio level as 1, then the payload and an OHB-like trailer
+	msg := []byte{
+		0x90, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0xbe, 0xde, 0x00, 0x01, 0x30, 'a', 0x10, 0x7f,
+		0xaa, 0xbb, 0x00,
+	}
+	from := map[uint8]string{1: testLevelURI, 3: testMIDURI}
+
+	// Same numbering, nothing to do
+	out, stripped := remapExtensions(msg, from, extensionIDs(from))
+	if !bytes.Equal(out, msg) || stripped != 0 {
+		t.Fatalf("Packet changed without a remapping: %x", out)
+	}
+
+	// The MID moves to 9, and the audio level isn't negotiated
+	out, stripped = remapExtensions(msg, from, map[string]uint8{testMIDURI: 9})
+	expected := []byte{
+		0x90, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0xbe, 0xde, 0x00, 0x01, 0x90, 'a', 0x00, 0x00,
+		0xaa, 0xbb, 0x00,
+	}
+	if !bytes.Equal(out, expected) || stripped != 1 {
+		t.Fatalf("Incorrect remapping (%d stripped):\n%x\n%x", stripped, out, expected)
+	}
+
+	// IDs past 14 need the two-byte format
+	out, _ = remapExtensions(msg, from, map[string]uint8{testMIDURI: 20, testLevelURI: 1})
+	expected = []byte{
+		0x90, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0x10, 0x00, 0x00, 0x02, 0x14, 0x01, 'a', 0x01, 0x01, 0x7f, 0x00, 0x00,
+		0xaa, 0xbb, 0x00,
+	}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("Incorrect two-byte remapping:\n%x\n%x", out, expected)
+	}
+	header, err := ParseRTPHeader(out)
+	if err != nil {
+		t.Fatalf("Error parsing remapped packet: %v", err)
+	}
+	if mid, ok := header.ExtensionElement(20); !ok || string(mid) != "a" {
+		t.Fatalf("MID not found after remapping: %x", mid)
+	}
+
+	// With nothing left, the extension goes, and the payload is untouched
+	out, stripped = remapExtensions(msg, from, map[string]uint8{testOffsetURI: 2})
+	expected = []byte{
+		0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0xaa, 0xbb, 0x00,
+	}
+	if !bytes.Equal(out, expected) || stripped != 2 {
+		t.Fatalf("Incorrect stripping (%d stripped):\n%x\n%x", stripped, out, expected)
+	}
+
+	// Elements the sender's numbering doesn't have are stripped too
+	out, stripped = remapExtensions(msg, map[uint8]string{3: testMIDURI}, map[string]uint8{testMIDURI: 3})
+	if stripped != 1 || len(out) != len(msg) || out[18] != 0 {
+		t.Fatalf("Unknown element not stripped: %x", out)
+	}
+}
+
+func TestExtensionMapFromSDP(t *testing.T) {
+	extmap := ExtensionMapFromSDP(DefaultSDPMedia()[:1])
+	if len(extmap) != 2 || extmap[1] != testLevelURI || extmap[2] != testMIDURI {
+		t.Fatalf("Incorrect extension map: %v", extmap)
+	}
+}
+
+func TestHeaderExtensionRemapping(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	clients := newKeyedClients(t, network, mdd, "10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000")
+
+	// The third client's numbering isn't known, so it gets the packet as sent
+	sender, remapped, unknown := clients[0], clients[1], clients[2]
+	mdd.SetHeaderExtensions(sender.Assoc(), map[uint8]string{1: testLevelURI, 3: testMIDURI})
+	mdd.SetHeaderExtensions(remapped.Assoc(), map[uint8]string{4: testMIDURI})
+
+	audio := []byte{
+		0x90, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0xbe, 0xde, 0x00, 0x01, 0x30, 'a', 0x10, 0x7f,
+		0xaa,
+	}
+	sender.Write(audio)
+	AssertRecvPacket(t, remapped, []byte{
+		0x90, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0xbe, 0xde, 0x00, 0x01, 0x40, 'a', 0x00, 0x00,
+		0xaa,
+	}, "Header extensions not remapped")
+	AssertRecvPacket(t, unknown, audio, "Packet changed for a receiver without a numbering")
+}
@@ -0,0 +1,82 @@
+package percy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Forward error correction streams (ULPFEC, RFC 5109, and FlexFEC, RFC
+// 8627) are only worth their bandwidth to receivers that lose packets and
+// can use them.  So the MD tells them apart by FECPayloadTypes (which
+// FECPayloadTypesFromSDP finds in the SDP), and:
+//
+//   - Doesn't forward them to receivers that have turned them off
+//     (SetAssociationFEC), e.g., because they didn't negotiate FEC
+//   - Under a conference budget, only gives them what is left once audio and
+//     video have been allocated (see allocation.go)
+//   - Sheds them with video from congested receivers, and doesn't ask them
+//     for keyframes
+//
+// The MD doesn't recover lost packets from FEC itself: in PERC mode the
+// protected payloads are end-to-end encrypted, so recovery is left to the
+// receivers.
+
+// Reports whether an SRTP packet belongs to an FEC stream
+func (mdd *MDD) isFEC(msg []byte) bool {
+	if len(msg) < 2 {
+		return false
+	}
+	return mdd.isFECPayloadType(msg[1] & 0x7f)
+}
+
+func (mdd *MDD) isFECPayloadType(pt uint8) bool {
+	for _, fec := range mdd.FECPayloadTypes {
+		if pt == fec {
+			return true
+		}
+	}
+	return false
+}
+
+// Turns forwarding of FEC streams to a receiver on or off
+func (mdd *MDD) SetAssociationFEC(assocID AssociationID, enabled bool) {
+	assoc := mdd.association(assocID)
+
+	mdd.mu.Lock()
+	assoc.noFEC = !enabled
+	mdd.mu.Unlock()
+}
+
+// Parses a comma-separated list of payload types, e.g., "116,127"
+func ParsePayloadTypes(val string) ([]uint8, error) {
+	payloadTypes := []uint8{}
+	for _, field := range strings.Split(val, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		pt, err := strconv.ParseUint(field, 10, 7)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid payload type %q", field)
+		}
+		payloadTypes = append(payloadTypes, uint8(pt))
+	}
+	return payloadTypes, nil
+}
+
+// Collects the payload types of the FEC codecs in an SDP's rtpmap values,
+// e.g., "ulpfec/90000" or "flexfec-03/90000"
+func FECPayloadTypesFromSDP(media []SDPMedia) []uint8 {
+	payloadTypes := []uint8{}
+	for _, section := range media {
+		for _, codec := range section.Codecs {
+			name := strings.ToLower(strings.SplitN(codec.RTPMap, "/", 2)[0])
+			if name == "ulpfec" || strings.HasPrefix(name, "flexfec") {
+				payloadTypes = append(payloadTypes, codec.PayloadType)
+			}
+		}
+	}
+	return payloadTypes
+}
@@ -0,0 +1,74 @@
+package percy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFECForwarding(t *testing.T) {
+	mdd := NewMDD()
+	mdd.FECPayloadTypes = []uint8{127}
+
+	sender := mdd.association(0x0001)
+	for _, assocID := range []AssociationID{0x0001, 0x0002, 0x0003} {
+		mdd.SetAssociationConference(assocID, 5)
+	}
+	mdd.association(0x0002).addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5002}
+	mdd.association(0x0003).addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5003}
+
+	video := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06, 0x07, 0x08}
+	fec := []byte{0x80, 0x7f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06, 0x07, 0x09}
+	if mdd.isFEC(video) || !mdd.isFEC(fec) {
+		t.Fatalf("Incorrect FEC classification")
+	}
+
+	mdd.SetAssociationFEC(0x0003, false)
+	if len(mdd.subscribers(sender, video)) != 2 {
+		t.Fatalf("Video not forwarded to every receiver")
+	}
+	if receivers := mdd.subscribers(sender, fec); len(receivers) != 1 || receivers[0].id != 0x0002 {
+		t.Fatalf("Incorrect FEC receivers: %v", receivers)
+	}
+}
+
+func TestFECAllocation(t *testing.T) {
+	streams := []StreamAllocation{
+		{SSRC: 1, Audio: true, Rate: 100},
+		{SSRC: 2, Rate: 400},
+		{SSRC: 3, FEC: true, Rate: 300},
+		{SSRC: 4, FEC: true, Rate: 100},
+	}
+
+	// 300 is left after audio and video, enough for the smaller FEC stream
+	alloc := divideShare(0x0001, 800, streams)
+	forwarded := map[uint32]bool{}
+	for _, stream := range alloc.Streams {
+		forwarded[stream.SSRC] = stream.Forwarded
+	}
+	if !forwarded[1] || !forwarded[2] || forwarded[3] || !forwarded[4] {
+		t.Fatalf("Incorrect allocation: %+v", alloc.Streams)
+	}
+
+	// FEC doesn't take from video's share
+	if share := videoShare(alloc); share != 700 {
+		t.Fatalf("Incorrect video share: %v", share)
+	}
+}
+
+func TestFECPayloadTypesFromSDP(t *testing.T) {
+	media := []SDPMedia{{Codecs: []SDPCodec{
+		{PayloadType: 96, RTPMap: "VP8/90000"},
+		{PayloadType: 116, RTPMap: "ULPFEC/90000"},
+		{PayloadType: 118, RTPMap: "flexfec-03/90000"},
+	}}}
+	if pts := FECPayloadTypesFromSDP(media); len(pts) != 2 || pts[0] != 116 || pts[1] != 118 {
+		t.Fatalf("Incorrect FEC payload types: %v", pts)
+	}
+
+	if pts, err := ParsePayloadTypes("116, 127"); err != nil || len(pts) != 2 || pts[1] != 127 {
+		t.Fatalf("Error parsing payload types: %v %v", pts, err)
+	}
+	if _, err := ParsePayloadTypes("128"); err == nil {
+		t.Fatalf("Parsed an invalid payload type")
+	}
+}
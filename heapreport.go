@@ -0,0 +1,159 @@
+package percy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Heap reports help diagnose leaks on long-running nodes.  Each report is a
+// heap profile (for `go tool pprof`), plus a text summary that attributes
+// allocations to the innermost function in the media path, so that the usual
+// suspects can be checked without a Go toolchain on the node.
+
+const (
+	heapReportTopN = 25
+)
+
+// Packages whose functions count as the media path
+var mediaPathPrefixes = []string{
+	"github.com/bifurcation/percy.",
+	"github.com/fluffy/rtp.",
+}
+
+type HeapReport struct {
+	Profile string `json:"profile"`
+	Summary string `json:"summary"`
+}
+
+type allocSite struct {
+	function     string
+	allocBytes   int64
+	allocObjects int64
+	inUseBytes   int64
+}
+
+// Returns the innermost media path function in a stack, if any
+func mediaPathFunction(stack []uintptr) string {
+	frames := runtime.CallersFrames(stack)
+	for {
+		frame, more := frames.Next()
+		for _, prefix := range mediaPathPrefixes {
+			if strings.HasPrefix(frame.Function, prefix) {
+				return frame.Function
+			}
+		}
+		if !more {
+			return "(outside the media path)"
+		}
+	}
+}
+
+func allocSites() []*allocSite {
+	var records []runtime.MemProfileRecord
+	n, _ := runtime.MemProfile(nil, true)
+	for {
+		records = make([]runtime.MemProfileRecord, n+50)
+		var ok bool
+		n, ok = runtime.MemProfile(records, true)
+		if ok {
+			records = records[:n]
+			break
+		}
+	}
+
+	sites := map[string]*allocSite{}
+	for _, record := range records {
+		function := mediaPathFunction(record.Stack())
+		site, ok := sites[function]
+		if !ok {
+			site = &allocSite{function: function}
+			sites[function] = site
+		}
+		site.allocBytes += record.AllocBytes
+		site.allocObjects += record.AllocObjects
+		site.inUseBytes += record.InUseBytes()
+	}
+
+	sorted := []*allocSite{}
+	for _, site := range sites {
+		sorted = append(sorted, site)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].allocBytes > sorted[j].allocBytes
+	})
+	return sorted
+}
+
+func writeAllocSummary(w io.Writer) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	_, err := fmt.Fprintf(w, "heap in use: %d bytes in %d objects\ntotal allocated: %d bytes in %d objects\ngoroutines: %d\nGC cycles: %d\n\n",
+		mem.HeapInuse, mem.HeapObjects, mem.TotalAlloc, mem.Mallocs, runtime.NumGoroutine(), mem.NumGC)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%14s %12s %14s  %s\n", "alloc bytes", "alloc objs", "in-use bytes", "function")
+	if err != nil {
+		return err
+	}
+
+	sites := allocSites()
+	if len(sites) > heapReportTopN {
+		sites = sites[:heapReportTopN]
+	}
+	for _, site := range sites {
+		_, err = fmt.Fprintf(w, "%14d %12d %14d  %s\n", site.allocBytes, site.allocObjects, site.inUseBytes, site.function)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Writes a heap profile and an allocation summary to the given directory
+func WriteHeapReport(dir string) (*HeapReport, error) {
+	// The heap profile is as of the last GC, so make it current
+	runtime.GC()
+
+	stamp := time.Now().UTC().Format("20060102-150405")
+	report := &HeapReport{
+		Profile: filepath.Join(dir, "heap-"+stamp+".pprof"),
+		Summary: filepath.Join(dir, "allocs-"+stamp+".txt"),
+	}
+
+	err := writeFile(report.Profile, func(w io.Writer) error {
+		return pprof.Lookup("heap").WriteTo(w, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFile(report.Summary, writeAllocSummary)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,44 @@
+package percy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHeapReport(t *testing.T) {
+	auth := NewMemoryAuthProvider()
+	auth.AddAdminToken("secret")
+
+	mdd := NewMDD()
+	mdd.Auth = auth
+	api := NewAdminAPI(mdd)
+	api.ReportDir = t.TempDir()
+
+	req := httptest.NewRequest("POST", "/heap", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Heap report request failed: %d %s", resp.Code, resp.Body.String())
+	}
+
+	var report HeapReport
+	err := json.Unmarshal(resp.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("Error parsing report: %v", err)
+	}
+
+	profile, err := os.Stat(report.Profile)
+	if err != nil || profile.Size() == 0 {
+		t.Fatalf("Heap profile not written: %v", err)
+	}
+
+	summary, err := os.ReadFile(report.Summary)
+	if err != nil || !strings.Contains(string(summary), "heap in use") {
+		t.Fatalf("Allocation summary not written: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package percy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// HTTPSConfig describes where an HTTP frontend (signaling WebSocket, admin
+// API) gets its certificate from.  Either a static certificate/key pair is
+// used, or, if ACMEHosts is set, certificates for those hosts are obtained
+// and renewed automatically from an ACME CA.
+type HTTPSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	ACMEHosts        []string
+	ACMECacheDir     string
+	ACMEEmail        string
+	ACMEDirectoryURL string // Defaults to Let's Encrypt
+
+	// If set, also answer HTTP-01 challenges on this address (e.g., ":80").
+	// Otherwise only TLS-ALPN-01 challenges on the TLS port are supported.
+	ACMEHTTPAddr string
+}
+
+func (cfg HTTPSConfig) acmeManager() *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEHosts...),
+		Email:      cfg.ACMEEmail,
+	}
+
+	if len(cfg.ACMECacheDir) > 0 {
+		manager.Cache = autocert.DirCache(cfg.ACMECacheDir)
+	}
+
+	if len(cfg.ACMEDirectoryURL) > 0 {
+		manager.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+	}
+
+	return manager
+}
+
+// Serves srv over TLS according to cfg.  Like http.Server.ListenAndServeTLS,
+// this blocks until the server is closed.
+func ListenAndServeTLS(srv *http.Server, cfg HTTPSConfig) error {
+	if len(cfg.ACMEHosts) == 0 {
+		if len(cfg.CertFile) == 0 || len(cfg.KeyFile) == 0 {
+			return fmt.Errorf("No certificate configured for %s", srv.Addr)
+		}
+		return srv.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+	}
+
+	manager := cfg.acmeManager()
+
+	if len(cfg.ACMEHTTPAddr) > 0 {
+		go func() {
+			err := http.ListenAndServe(cfg.ACMEHTTPAddr, manager.HTTPHandler(nil))
+			if err != nil {
+				log.Printf("Error serving ACME HTTP challenges: %v", err)
+			}
+		}()
+	}
+
+	srv.TLSConfig = manager.TLSConfig()
+	if len(cfg.CertFile) > 0 && len(cfg.KeyFile) > 0 {
+		// Fall back to the static certificate for names ACME doesn't cover
+		static, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		srv.TLSConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := manager.GetCertificate(hello)
+			if err != nil {
+				return &static, nil
+			}
+			return cert, nil
+		}
+	}
+
+	return srv.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,140 @@
+package percy
+
+import (
+	"strings"
+	"time"
+)
+
+// ICE credentials can be set per association, so that each client's
+// connectivity checks are verified with the password from its own offer or
+// answer.  Associations without their own credentials fall back to the MD's
+// AuthProvider, which looks passwords up by ufrag.
+//
+// Many sessions can share one port, and a check that lands on the wrong
+// association would otherwise be answered (or refused, which a client takes
+// as a failed pair).  With ICEOriginChecks set, the MD silently drops Binding
+// requests whose USERNAME doesn't pair the association's ufrags as signaling
+// gave them: the local one from SetICECredentials, and the client's own from
+// SetRemoteICEUfrag.  Ufrags that weren't given aren't checked.
+
+// Sets the local ICE ufrag and password for an association.  This can be done
+// before the client has sent any packets.
+func (mdd *MDD) SetICECredentials(assocID AssociationID, ufrag, password string) {
+	assoc := mdd.association(assocID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.iceUfrag = ufrag
+	assoc.icePassword = password
+}
+
+// Sets the client's ICE ufrag for an association, from its offer or answer
+func (mdd *MDD) SetRemoteICEUfrag(assocID AssociationID, ufrag string) {
+	assoc := mdd.association(assocID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.iceRemoteUfrag = ufrag
+}
+
+// Reports whether a Binding request's USERNAME, "<local ufrag>:<remote
+// ufrag>", is for an association.  Counts the ones that aren't.
+func (mdd *MDD) iceOrigin(assoc *association, username string) bool {
+	if !mdd.ICEOriginChecks {
+		return true
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	parts := strings.SplitN(username, ":", 2)
+	ok := len(parts) == 2 &&
+		(len(assoc.iceUfrag) == 0 || parts[0] == assoc.iceUfrag) &&
+		(len(assoc.iceRemoteUfrag) == 0 || parts[1] == assoc.iceRemoteUfrag)
+	if !ok {
+		assoc.stats.ice.mismatched += 1
+	}
+	return ok
+}
+
+// Returns the local ICE password for a check that names the given local
+// ufrag
+func (mdd *MDD) icePassword(assoc *association, ufrag string) (string, bool) {
+	mdd.mu.Lock()
+	assocUfrag, assocPassword := assoc.iceUfrag, assoc.icePassword
+	mdd.mu.Unlock()
+
+	if len(assocUfrag) > 0 {
+		return assocPassword, ufrag == assocUfrag
+	}
+	return mdd.Auth.ICEPassword(ufrag)
+}
+
+// To help triage one-way media, each association counts the connectivity
+// checks it has sent and whether they succeeded.  Clients keep checking the
+// selected pair for consent (RFC 7675), and give up on it 30 seconds after
+// the last successful check, so the time left until then shows whether a
+// client still considers its path to the MD usable.
+
+const consentTimeout = 30 * time.Second
+
+type ICEStats struct {
+	Checks           uint64        `json:"checks"`
+	Succeeded        uint64        `json:"succeeded"`
+	Failed           uint64        `json:"failed"`
+	SuccessRate      float64       `json:"success_rate"`
+	LastSuccess      time.Time     `json:"last_success,omitempty"`
+	LastFailure      string        `json:"last_failure,omitempty"`
+	ConsentExpiresIn time.Duration `json:"consent_expires_in"` // Zero once consent has expired
+
+	// Requests dropped by ICEOriginChecks, which aren't counted as checks
+	Mismatched uint64 `json:"mismatched,omitempty"`
+}
+
+// Guarded by mdd.mu
+type iceCounters struct {
+	checks      uint64
+	succeeded   uint64
+	lastSuccess time.Time
+	lastFailure string
+	mismatched  uint64 // Dropped for a USERNAME that isn't the association's
+}
+
+// Counts a Binding request from an association; failure is empty if it
+// succeeded
+func (mdd *MDD) countCheck(assoc *association, failure string, now time.Time) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assoc.stats.ice.checks += 1
+	if len(failure) == 0 {
+		assoc.stats.ice.succeeded += 1
+		assoc.stats.ice.lastSuccess = now
+	} else {
+		assoc.stats.ice.lastFailure = failure
+	}
+}
+
+func (ic *iceCounters) stats(now time.Time) *ICEStats {
+	if ic.checks == 0 && ic.mismatched == 0 {
+		return nil
+	}
+
+	stats := &ICEStats{
+		Checks:      ic.checks,
+		Succeeded:   ic.succeeded,
+		Failed:      ic.checks - ic.succeeded,
+		LastSuccess: ic.lastSuccess,
+		LastFailure: ic.lastFailure,
+		Mismatched:  ic.mismatched,
+	}
+	if ic.checks > 0 {
+		stats.SuccessRate = float64(ic.succeeded) / float64(ic.checks)
+	}
+	if !ic.lastSuccess.IsZero() {
+		if left := ic.lastSuccess.Add(consentTimeout).Sub(now); left > 0 {
+			stats.ConsentExpiresIn = left
+		}
+	}
+	return stats
+}
@@ -0,0 +1,60 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestICEOriginChecks(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.ICEOriginChecks = true
+
+	client, _ := NewClient(network, "10.0.0.1:5000")
+	defer client.Stop()
+	assocID := client.Assoc()
+	mdd.SetICECredentials(assocID, "local", "0123456789abcdef01234567")
+
+	txn := byte(0)
+	check := func(username string) ([]byte, error) {
+		txn += 1
+		request := NewBindingRequest(TransactionID{txn, 8, 9}, "0123456789abcdef01234567")
+		request.Add(ATTR_USERNAME, []byte(username))
+		request.AddMessageIntegrity()
+		msg, _ := request.Serialize()
+		client.Write(msg)
+		return client.Recv()
+	}
+
+	// Until signaling gives the client's ufrag, only the MD's is checked
+	if _, err := check("local:client"); err != nil {
+		t.Fatalf("Check with no remote ufrag dropped: %v", err)
+	}
+	if msg, err := check("other:client"); err == nil {
+		t.Fatalf("Check for another local ufrag answered: %x", msg)
+	}
+
+	mdd.SetRemoteICEUfrag(assocID, "client")
+	if msg, err := check("local:client"); err != nil {
+		t.Fatalf("Check dropped: %v", err)
+	} else if response, err := ParseSTUN(msg); err != nil || response.msgType != MSG_TYPE_SUCCESS {
+		t.Fatalf("Check failed: %v", err)
+	}
+	for _, username := range []string{"local:another", "local", "client:local"} {
+		if msg, err := check(username); err == nil {
+			t.Fatalf("Check as [%s] answered: %x", username, msg)
+		}
+	}
+
+	var stats *ICEStats
+	for _, assoc := range mdd.StatsSnapshot().Associations {
+		if assoc.ID == assocID {
+			stats = assoc.ICE
+		}
+	}
+	if stats == nil || stats.Checks != 2 || stats.Mismatched != 4 {
+		t.Fatalf("Incorrect ICE stats: %+v", stats)
+	}
+}
@@ -0,0 +1,55 @@
+package percy
+
+import (
+	"log"
+	"time"
+)
+
+// With no associations there is nothing to forward, but the processing loop
+// would still wake up every few milliseconds to flush RTCP.  When IdleSaving
+// is on and the last association goes away (or none has arrived yet), the
+// MD idles: the loop polls once a second, expiry is checked less often, and
+// the STUN pool shrinks to one worker.  The first packet from a new client
+// brings everything back, before that packet is handled further.
+
+const (
+	idlePollInterval   = time.Second
+	idleExpiryInterval = 10 * time.Second
+)
+
+// How long the processing loop waits for a packet before doing periodic work
+func (mdd *MDD) pollInterval() time.Duration {
+	if mdd.idle {
+		return idlePollInterval
+	}
+	return mdd.timeout
+}
+
+func (mdd *MDD) expiryInterval() time.Duration {
+	if mdd.idle {
+		return idleExpiryInterval
+	}
+	return expiryCheckInterval
+}
+
+// Enters or leaves idle mode to match the associations.  Returns true if it
+// changed.  Runs on the processing loop.
+func (mdd *MDD) updateIdle() bool {
+	idle := mdd.IdleSaving && mdd.assocs.len() == 0
+	if idle == mdd.idle {
+		return false
+	}
+
+	mdd.mu.Lock()
+	mdd.idle = idle
+	mdd.mu.Unlock()
+
+	if idle {
+		log.Printf("No associations; idling")
+		mdd.shrinkSTUNWorkers()
+	} else {
+		log.Printf("Association arrived; leaving idle mode")
+		mdd.growSTUNWorkers()
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package percy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func waitForIdle(mdd *MDD, idle bool) bool {
+	for i := 0; i < 100; i++ {
+		if mdd.StatsSnapshot().Global.Idle == idle {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestIdleSaving(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	if !waitForIdle(mdd, true) {
+		t.Fatalf("MD without associations did not idle")
+	}
+
+	client, _ := NewClient(network, "10.0.0.1:5000")
+	defer client.Stop()
+	client.Write([]byte{0x10, 0x00})
+
+	if !waitForIdle(mdd, false) {
+		t.Fatalf("MD did not wake for a new association")
+	}
+}
@@ -0,0 +1,177 @@
+package percy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/fluffy/rtp"
+)
+
+// Applications can play media of their own into a conference, e.g.,
+// announcements, ringback, or test tones for IVR-like features.  Each
+// Injector is a synthetic association in the conference: it has no address,
+// so nothing is sent to it, but the other participants get its packets like
+// any other sender's, subject to the conference's pause state and egress
+// rules (its role is "injector").  It gets an SSRC no one else in the
+// conference is using.
+//
+// With Protect set, packets are encrypted with each receiver's hop-by-hop
+// keys, as in SFU mode.  In PERC mode, clients also expect end-to-end
+// encryption, which the MD can't add, so injected media is only useful there
+// if the application does that itself.  Without Protect, packets are sent as
+// plain RTP, e.g., to gateways in relay-mode conferences.
+
+const InjectorRole = "injector"
+
+type Injector struct {
+	mdd         *MDD
+	assoc       *association
+	payloadType uint8
+	ssrc        uint32
+	seq         uint16
+	Protect     bool
+}
+
+func randomUint32() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
+}
+
+// Adds an injector to a conference, sending with the given payload type.
+// The MD must be listening.
+func (mdd *MDD) NewInjector(confID ConfID, payloadType uint8) (*Injector, error) {
+	conf := mdd.conference(confID)
+	inj := &Injector{mdd: mdd, payloadType: payloadType, seq: uint16(randomUint32())}
+
+	// The association is added on the processing loop, which reads the
+	// maps without locking
+	done := make(chan error, 1)
+	err := mdd.runOnLoop(func() {
+		done <- mdd.addInjector(inj, conf)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = <-done
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Injector [%04x] with SSRC %08x added to conference %v", inj.assoc.id, inj.ssrc, confID)
+	return inj, nil
+}
+
+// Gives an injector an unused association ID and SSRC, and adds it to a
+// conference
+func (mdd *MDD) addInjector(inj *Injector, conf *conference) error {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	var assocID AssociationID
+	for {
+		assocID = AssociationID(randomUint32())
+		if _, used := mdd.assocs.get(assocID); !used {
+			break
+		}
+	}
+
+	assoc := newAssociation(assocID)
+	assoc.conf = conf.id
+	assoc.role = InjectorRole
+	err := mdd.checkParticipantLimits(assoc, false, conf)
+	if err != nil {
+		return err
+	}
+
+	used := map[uint32]bool{}
+	for _, other := range mdd.assocs.snapshot() {
+		if other.conf != conf.id {
+			continue
+		}
+		for ssrc := range other.stats.ssrcs {
+			used[ssrc] = true
+		}
+		if other.injector != nil {
+			used[other.injector.ssrc] = true
+		}
+	}
+	for inj.ssrc == 0 || used[inj.ssrc] {
+		inj.ssrc = randomUint32()
+	}
+
+	inj.assoc = assoc
+	assoc.injector = inj
+	mdd.assocs.add(assoc)
+	return nil
+}
+
+func (inj *Injector) Assoc() AssociationID {
+	return inj.assoc.id
+}
+
+func (inj *Injector) SSRC() uint32 {
+	return inj.ssrc
+}
+
+// Sends a packet with the given payload and RTP timestamp to the rest of the
+// conference
+func (inj *Injector) Send(payload []byte, timestamp uint32, marker bool) error {
+	buf := make([]byte, 12+len(payload))
+	buf[0] = 0x80
+	buf[1] = inj.payloadType & 0x7f
+	if marker {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:4], inj.seq)
+	binary.BigEndian.PutUint32(buf[4:8], timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], inj.ssrc)
+	copy(buf[12:], payload)
+	inj.seq += 1
+
+	pkt := &rtp.RTPPacket{Buffer: buf}
+	protect := inj.Protect
+	return inj.mdd.runOnLoop(func() {
+		inj.mdd.inject(inj.assoc, pkt, protect)
+	})
+}
+
+// Removes the injector from its conference
+func (inj *Injector) Close() error {
+	return inj.mdd.RemoveClient(inj.assoc.id)
+}
+
+// Sends an injected packet to the injector's peers.  Runs on the processing
+// loop.
+func (mdd *MDD) inject(sender *association, pkt *rtp.RTPPacket, protect bool) {
+	if _, ok := mdd.assocs.get(sender.id); !ok || mdd.holdMedia(sender, nil) {
+		return
+	}
+
+	for _, assoc := range mdd.peers(sender) {
+		msg := pkt.Buffer
+		if protect {
+			var err error
+			msg, err = assoc.send.Encode(pkt.Clone())
+			if err != nil {
+				log.Printf("Error encoding injected packet for [%04x]: %v", assoc.id, err)
+				mdd.countEncodeError(assoc)
+				continue
+			}
+		}
+		mdd.sendTo(assoc, msg)
+	}
+}
+
+// Runs a function on the processing loop, which has to be running
+func (mdd *MDD) runOnLoop(task func()) error {
+	select {
+	case mdd.tasks <- task:
+		return nil
+	case <-mdd.quit:
+		return fmt.Errorf("The MD is stopped")
+	}
+}
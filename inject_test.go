@@ -0,0 +1,59 @@
+package percy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestInjector(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	clients := []*Client{}
+	for _, addr := range []string{"10.0.0.1:5000", "10.0.0.2:5000"} {
+		client, _ := NewClient(network, addr)
+		defer client.Stop()
+		client.Write([]byte{0x10, 0x00})
+		clients = append(clients, client)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	inj, err := mdd.NewInjector(DefaultConfID, 0)
+	if err != nil {
+		t.Fatalf("Error creating injector: %v", err)
+	}
+
+	payload := []byte{0xd5, 0xd5, 0xd5, 0xd5}
+	for i := 0; i < 2; i++ {
+		err = inj.Send(payload, uint32(160*i), i == 0)
+		if err != nil {
+			t.Fatalf("Error injecting packet: %v", err)
+		}
+
+		for _, client := range clients {
+			msg, err := client.Recv()
+			if err != nil {
+				t.Fatalf("Injected packet not received: %v", err)
+			}
+			if len(msg) != 12+len(payload) || !bytes.Equal(msg[12:], payload) {
+				t.Fatalf("Incorrect injected packet: %x", msg)
+			}
+			if binary.BigEndian.Uint32(msg[8:12]) != inj.SSRC() || binary.BigEndian.Uint32(msg[4:8]) != uint32(160*i) {
+				t.Fatalf("Incorrect SSRC or timestamp: %x", msg)
+			}
+			if marker := msg[1]&0x80 != 0; marker != (i == 0) {
+				t.Fatalf("Incorrect marker: %x", msg)
+			}
+		}
+	}
+
+	inj.Close()
+	if _, ok := mdd.assocs.get(inj.Assoc()); ok {
+		t.Fatalf("Injector not removed")
+	}
+}
@@ -0,0 +1,131 @@
+package percy
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hosts change addresses: laptops move between networks, VPNs come and go,
+// and cloud instances get re-assigned.  When the MD's addresses change, the
+// media socket may be bound to an address that no longer exists, or routed
+// out of an interface that is gone, and the host candidates that signaling
+// gave to clients are stale.  WatchInterfaces polls the host's addresses, and
+// when they change it re-binds the media socket and raises an
+// EventInterfacesChanged, so that signaling can send the new addresses to
+// clients with an ICE restart.
+//
+// STUN responses need no special handling: XOR-MAPPED-ADDRESS is the
+// client's address as seen on whichever socket the request arrived on.
+
+// Returns the host's addresses that are worth advertising to clients
+func hostAddresses() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		var ip net.IP
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+
+	sort.Slice(ips, func(i, j int) bool { return ips[i].String() < ips[j].String() })
+	return ips, nil
+}
+
+func sameAddresses(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func joinAddresses(ips []net.IP) string {
+	strs := make([]string, len(ips))
+	for i, ip := range ips {
+		strs[i] = ip.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+// Returns the host addresses as of the last check by WatchInterfaces, or the
+// current ones if it isn't running
+func (mdd *MDD) AdvertisedAddresses() []net.IP {
+	mdd.mu.Lock()
+	ips := mdd.hostAddrs
+	mdd.mu.Unlock()
+
+	if ips == nil {
+		ips, _ = hostAddresses()
+	}
+	return ips
+}
+
+// Checks the host's addresses every interval, until the MD is stopped
+func (mdd *MDD) WatchInterfaces(interval time.Duration) {
+	mdd.watchInterfaces(interval, hostAddresses)
+}
+
+func (mdd *MDD) watchInterfaces(interval time.Duration, addresses func() ([]net.IP, error)) {
+	current, err := addresses()
+	if err != nil {
+		log.Printf("Error listing host addresses: %v", err)
+	}
+	mdd.mu.Lock()
+	mdd.hostAddrs = current
+	mdd.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-mdd.quit:
+				return
+			}
+
+			ips, err := addresses()
+			if err != nil {
+				log.Printf("Error listing host addresses: %v", err)
+				continue
+			}
+			if sameAddresses(ips, current) {
+				continue
+			}
+
+			log.Printf("Host addresses changed from [%s] to [%s]", joinAddresses(current), joinAddresses(ips))
+			current = ips
+			mdd.mu.Lock()
+			mdd.hostAddrs = ips
+			mdd.mu.Unlock()
+
+			// Closing the socket makes the read loop re-bind it
+			if conn := mdd.transport(); conn != nil {
+				conn.Close()
+			}
+
+			mdd.emit(Event{Type: EventInterfacesChanged, Detail: joinAddresses(ips)})
+		}
+	}()
+}
@@ -0,0 +1,28 @@
+// Package cryptoutil holds the comparison helpers that percy uses for
+// anything derived from a secret (MACs, checksums over authenticated
+// messages, credentials), so that none of them leak timing information.
+package cryptoutil
+
+import (
+	"crypto/subtle"
+)
+
+// Reports whether a and b are equal, in time that depends only on their
+// lengths
+func Equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+func EqualString(a, b string) bool {
+	return Equal([]byte(a), []byte(b))
+}
+
+// Reports whether val is one of the candidates, comparing against every one
+// of them so that the time taken doesn't reveal which (if any) matched
+func OneOf(val string, candidates []string) bool {
+	found := 0
+	for _, candidate := range candidates {
+		found |= subtle.ConstantTimeCompare([]byte(val), []byte(candidate))
+	}
+	return found == 1
+}
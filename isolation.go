@@ -0,0 +1,226 @@
+package percy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// High-value conferences can be given a UDP socket of their own (e.g., a
+// port signaling only hands to their participants), read by reader
+// goroutines of their own.  A flood on the shared port then can't fill their
+// socket buffer or hold up their reads, and their packets are taken ahead of
+// the shared port's by the processing loop.  Everything sent to a client that
+// was heard from on a conference's socket goes out of that socket.
+//
+// Only associations already placed in the conference are served on its
+// socket; anything else arriving there is dropped and counted, so a
+// conference's port can't be used to get into the default conference.
+
+const defaultConferenceReaders = 1
+
+type confSocket struct {
+	conf ConfID
+	conn Transport
+}
+
+// Gives a conference its own socket on the given UDP port (zero for any),
+// read by the given number of goroutines.  Returns the socket's address.
+func (mdd *MDD) BindConference(confID ConfID, port int, readers int) (net.Addr, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	err = mdd.BindConferenceTransport(confID, conn, readers)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn.LocalAddr(), nil
+}
+
+// Gives a conference its own transport, read by the given number of
+// goroutines.  The MD closes it when the conference is unbound or removed.
+func (mdd *MDD) BindConferenceTransport(confID ConfID, conn Transport, readers int) error {
+	if readers < 1 {
+		readers = defaultConferenceReaders
+	}
+
+	conf := mdd.conference(confID)
+	sock := &confSocket{conf: confID, conn: conn}
+
+	mdd.mu.Lock()
+	if conf.socket != nil {
+		mdd.mu.Unlock()
+		return fmt.Errorf("Conference %v already has a socket on %v", confID, conf.socket.conn.LocalAddr())
+	}
+	conf.socket = sock
+	mdd.mu.Unlock()
+
+	mdd.workers.Add(readers)
+	for i := 0; i < readers; i++ {
+		go mdd.readConferenceSocket(sock)
+	}
+	log.Printf("Conference %v bound to %v with %d readers", confID, conn.LocalAddr(), readers)
+	return nil
+}
+
+// Closes a conference's own socket.  Its clients have to be signaled to
+// move back to the shared port.
+func (mdd *MDD) UnbindConference(confID ConfID) error {
+	mdd.mu.Lock()
+	conf, ok := mdd.conferences[confID]
+	var sock *confSocket
+	if ok {
+		sock, conf.socket = conf.socket, nil
+	}
+	mdd.mu.Unlock()
+
+	if sock == nil {
+		return fmt.Errorf("Conference %v has no socket of its own", confID)
+	}
+	mdd.closeSocket(sock)
+	log.Printf("Conference %v unbound from %v", confID, sock.conn.LocalAddr())
+	return nil
+}
+
+// Returns the address of a conference's own socket, if it has one
+func (mdd *MDD) ConferenceSocket(confID ConfID) (net.Addr, bool) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	conf, ok := mdd.conferences[confID]
+	if !ok || conf.socket == nil {
+		return nil, false
+	}
+	return conf.socket.conn.LocalAddr(), true
+}
+
+func (mdd *MDD) closeSocket(sock *confSocket) {
+	mdd.connMu.Lock()
+	for addr, other := range mdd.sockets {
+		if other == sock {
+			delete(mdd.sockets, addr)
+		}
+	}
+	mdd.connMu.Unlock()
+
+	sock.conn.Close()
+}
+
+func (mdd *MDD) readConferenceSocket(sock *confSocket) {
+	defer mdd.workers.Done()
+	pinGoroutine("reader", mdd.affinity.Readers)
+
+	buf := make([]byte, 2048)
+	oob := make([]byte, 128)
+	control := mdd.setSocketOptions(sock.conn)
+
+	for {
+		pkt, err := readPacket(sock.conn, buf, oob, control)
+		if err != nil {
+			if mdd.stopping() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			class := mdd.countReadError(err)
+			log.Printf("Error reading socket of conference %v (%v): %v", sock.conf, class, err)
+			continue
+		}
+
+		pkt.socket = sock
+		select {
+		case mdd.isolated <- pkt:
+		case <-mdd.quit:
+			return
+		}
+	}
+}
+
+// Checks that a packet that arrived on a conference's socket is from one of
+// its associations, and if so sends replies to its address out of that
+// socket
+func (mdd *MDD) fromMember(assocID AssociationID, pkt packet) bool {
+	mdd.mu.Lock()
+	assoc, ok := mdd.assocs.get(assocID)
+	member := ok && assoc.conf == pkt.socket.conf
+	if !member {
+		mdd.stats.strayed += 1
+	}
+	mdd.mu.Unlock()
+	if !member {
+		return false
+	}
+
+	key := pkt.addr.String()
+	mdd.connMu.RLock()
+	known := mdd.sockets[key] == pkt.socket
+	mdd.connMu.RUnlock()
+	if !known {
+		mdd.connMu.Lock()
+		mdd.sockets[key] = pkt.socket
+		mdd.connMu.Unlock()
+	}
+	return true
+}
+
+// Returns the socket of the conference a client was heard from on, or nil
+// for the shared one
+func (mdd *MDD) socketFor(addr net.Addr) Transport {
+	mdd.connMu.RLock()
+	defer mdd.connMu.RUnlock()
+
+	if sock, ok := mdd.sockets[addr.String()]; ok {
+		return sock.conn
+	}
+	return nil
+}
+
+// POST with port=<n> (zero or absent for any) and readers=<n> gives a
+// conference its own socket, and returns its address.  DELETE closes it.
+func (api *AdminAPI) handleBind(w http.ResponseWriter, r *http.Request) {
+	confID, err := strconv.ParseUint(r.FormValue("conf"), 0, 32)
+	if err != nil {
+		http.Error(w, "Invalid conference ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		port, readers := 0, defaultConferenceReaders
+		if value := r.FormValue("port"); len(value) > 0 {
+			port, err = strconv.Atoi(value)
+			if err != nil || port < 0 || port > 0xffff {
+				http.Error(w, "Invalid port", http.StatusBadRequest)
+				return
+			}
+		}
+		if value := r.FormValue("readers"); len(value) > 0 {
+			readers, err = strconv.Atoi(value)
+			if err != nil || readers < 1 {
+				http.Error(w, "Invalid reader count", http.StatusBadRequest)
+				return
+			}
+		}
+
+		addr, err := api.mdd.BindConference(ConfID(confID), port, readers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, map[string]string{"addr": addr.String()})
+
+	case http.MethodDelete:
+		if err := api.mdd.UnbindConference(ConfID(confID)); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
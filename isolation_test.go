@@ -0,0 +1,73 @@
+package percy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestConferenceSocket(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(7, ModeRelay)
+
+	conn, err := network.Listen("10.0.0.100:5000")
+	if err != nil {
+		t.Fatalf("Error opening conference socket: %v", err)
+	}
+	if err := mdd.BindConferenceTransport(7, conn, 2); err != nil {
+		t.Fatalf("Error binding conference: %v", err)
+	}
+	if err := mdd.BindConferenceTransport(7, conn, 1); err == nil {
+		t.Fatalf("Conference bound twice")
+	}
+
+	clients := []*Client{}
+	for _, addr := range []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000"} {
+		client, _ := NewClient(network, addr)
+		defer client.Stop()
+		client.server = conn.LocalAddr()
+		clients = append(clients, client)
+	}
+	mdd.SetAssociationConference(clients[0].Assoc(), 7)
+	mdd.SetAssociationConference(clients[1].Assoc(), 7)
+
+	// Members are relayed to each other, from the conference's socket
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	clients[0].Write(hello)
+	clients[1].Write(hello)
+
+	buf := make([]byte, 2048)
+	clients[0].conn.SetReadDeadline(time.Now().Add(packetTimeout))
+	_, from, err := clients[0].conn.ReadFrom(buf)
+	if err != nil || from.String() != conn.LocalAddr().String() {
+		t.Fatalf("Packet not relayed from the conference socket: %v %v", from, err)
+	}
+
+	// Anyone else is turned away
+	clients[2].Write(hello)
+	AssertNotRecvPacket(t, clients[0], "Packet relayed from outside the conference")
+	AssertNotRecvPacket(t, clients[1], "Packet relayed from outside the conference")
+	if strayed := mdd.StatsSnapshot().Global.Strayed; strayed != 1 {
+		t.Fatalf("Incorrect stray packet count: %d", strayed)
+	}
+
+	if addr, ok := mdd.ConferenceSocket(7); !ok || addr.String() != conn.LocalAddr().String() {
+		t.Fatalf("Incorrect conference socket: %v", addr)
+	}
+	if err := mdd.UnbindConference(7); err != nil {
+		t.Fatalf("Error unbinding conference: %v", err)
+	}
+	if _, ok := mdd.ConferenceSocket(7); ok {
+		t.Fatalf("Conference socket still reported after unbinding")
+	}
+	if mdd.socketFor(clients[0].conn.LocalAddr()) != nil {
+		t.Fatalf("Client still sent to from a closed socket")
+	}
+	if _, err := conn.WriteTo(hello, &net.UDPAddr{}); err == nil {
+		t.Fatalf("Conference socket not closed")
+	}
+}
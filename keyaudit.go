@@ -0,0 +1,86 @@
+package percy
+
+import (
+	"fmt"
+)
+
+// For audits of key hygiene, the MD can log every step in the life of the
+// hop-by-hop keys it holds: when they are received from the KD (or derived
+// from DTLS in SFU mode), installed, replaced by newer ones, handed to a
+// reconnected association, rejected, and destroyed.  Each line names the
+// association, conference, key epoch (which install this is for the
+// association) and protection profile, and never any key material.  The
+// log is off unless KeyAudit is set, so it can go to its own file.  Keys
+// handed to escrow (see escrow.go) are logged here too.
+
+type keyAuditAction string
+
+const (
+	keyReceived    keyAuditAction = "received"
+	keyInstalled   keyAuditAction = "installed"
+	keyRotated     keyAuditAction = "rotated"
+	keyRejected    keyAuditAction = "rejected"
+	keyTransferred keyAuditAction = "transferred"
+	keyDestroyed   keyAuditAction = "destroyed"
+	keyEscrowed    keyAuditAction = "escrowed"
+)
+
+const (
+	keySourceKD   = "kd"
+	keySourceDTLS = "dtls"
+)
+
+type keyAuditRecord struct {
+	action  keyAuditAction
+	assoc   AssociationID
+	conf    ConfID
+	epoch   int
+	profile ProtectionProfile
+	source  string
+	from    AssociationID // For transfers
+	err     error
+}
+
+func (rec keyAuditRecord) String() string {
+	line := fmt.Sprintf("key action=%s assoc=%04x conf=%v epoch=%d profile=%v",
+		rec.action, rec.assoc, rec.conf, rec.epoch, rec.profile)
+	if len(rec.source) > 0 {
+		line += " source=" + rec.source
+	}
+	if rec.action == keyTransferred {
+		line += fmt.Sprintf(" from=%04x", rec.from)
+	}
+	if rec.err != nil {
+		line += fmt.Sprintf(" error=%q", rec.err.Error())
+	}
+	return line
+}
+
+func (mdd *MDD) auditKey(rec keyAuditRecord) {
+	if mdd.KeyAudit != nil {
+		mdd.KeyAudit.Print(rec)
+	}
+}
+
+// Records that new keys have been installed on an association, and audits
+// it as an install or a rotation
+func (mdd *MDD) keysInstalled(assoc *association, profile ProtectionProfile, source string) {
+	mdd.mu.Lock()
+	assoc.keyEpoch += 1
+	epoch := assoc.keyEpoch
+	mdd.mu.Unlock()
+
+	action := keyInstalled
+	if epoch > 1 {
+		action = keyRotated
+	}
+	mdd.auditKey(keyAuditRecord{action: action, assoc: assoc.id, conf: assoc.conf, epoch: epoch, profile: profile, source: source})
+	kind := "KeysInstalled"
+	if action == keyRotated {
+		kind = "KeysRotated"
+	}
+	mdd.record(assoc.conf, assoc.id, kind, "epoch=%d profile=%v source=%s", epoch, profile, source)
+	if epoch == 1 {
+		mdd.receiverJoined(assoc)
+	}
+}
@@ -0,0 +1,56 @@
+package percy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestKeyAudit(t *testing.T) {
+	mdd := NewMDD()
+	audit := &bytes.Buffer{}
+	mdd.KeyAudit = log.New(audit, "", 0)
+
+	mdd.SetAssociationConference(0x0001, 5)
+	secret := []byte{0xde, 0xad, 0xbe, 0xef}
+	secretHex := hex.EncodeToString(secret)
+	keys := HBHKeys{
+		Profile:        DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM,
+		ClientWriteKey: secret,
+		ServerWriteKey: secret,
+		MasterSalt:     secret,
+	}
+
+	for i := 0; i < 2; i++ {
+		err := mdd.SetKeys(0x0001, keys)
+		if err != nil {
+			t.Fatalf("Error setting keys: %v", err)
+		}
+	}
+	mdd.SetKeys(0x0002, keys)
+	mdd.expireConference(mdd.conference(5))
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	expected := []string{
+		"key action=received assoc=0001 conf=5 epoch=0",
+		"key action=installed assoc=0001 conf=5 epoch=1",
+		"key action=received assoc=0001 conf=5 epoch=1",
+		"key action=rotated assoc=0001 conf=5 epoch=2",
+		"key action=rejected assoc=0002",
+		"key action=destroyed assoc=0001 conf=5 epoch=2",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Incorrect audit log: %s", audit)
+	}
+	for i := range expected {
+		if !strings.HasPrefix(lines[i], expected[i]) {
+			t.Fatalf("Incorrect audit line %d: %s", i, lines[i])
+		}
+	}
+
+	if strings.Contains(audit.String(), secretHex) {
+		t.Fatalf("Key material in audit log: %s", audit)
+	}
+}
@@ -0,0 +1,217 @@
+package percy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// A receiver can't show a video stream until it gets a keyframe, and senders
+// may go many seconds between them.  So the MD keeps track of when each video
+// source last sent one, and asks the sender for a new one (with a Picture
+// Loss Indication, RFC 4585) when a receiver's keys are installed, and when a
+// source has gone longer than MaxKeyframeInterval without one.  Requests to a
+// source are at least KeyframeRequestGap apart, so a burst of joins costs the
+// sender one keyframe.  Senders that only honor Full Intra Requests (RFC 5104)
+// can be asked with a FIR instead, and KeyframeRequestNone leaves it to the
+// receivers, whose own PLIs and FIRs are relayed to the source they name.
+//
+// Keyframes are found from the frame marking extension (draft-ietf-avtext-
+// framemarking) if FrameMarkingID is set.  Otherwise a frame several times
+// the size of the average is taken to be a keyframe, which is right often
+// enough for the codecs in use, since the payload is encrypted end to end.
+
+const (
+	defaultKeyframeRequestGap = time.Second
+	keyframeSizeRatio         = 3
+
+	frameMarkingStart       = 0x80
+	frameMarkingIndependent = 0x20
+)
+
+type KeyframeRequest uint8
+
+const (
+	KeyframeRequestPLI KeyframeRequest = iota
+	KeyframeRequestFIR
+	KeyframeRequestNone
+)
+
+func (req KeyframeRequest) String() string {
+	switch req {
+	case KeyframeRequestPLI:
+		return "pli"
+	case KeyframeRequestFIR:
+		return "fir"
+	case KeyframeRequestNone:
+		return "none"
+	default:
+		return fmt.Sprintf("<%d>", int(req))
+	}
+}
+
+func ParseKeyframeRequest(val string) (KeyframeRequest, error) {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "pli":
+		return KeyframeRequestPLI, nil
+	case "fir":
+		return KeyframeRequestFIR, nil
+	case "none":
+		return KeyframeRequestNone, nil
+	default:
+		return 0, fmt.Errorf("Unknown keyframe request '%s'", val)
+	}
+}
+
+func (req KeyframeRequest) MarshalText() ([]byte, error) {
+	return []byte(req.String()), nil
+}
+
+func (req *KeyframeRequest) UnmarshalText(text []byte) error {
+	parsed, err := ParseKeyframeRequest(string(text))
+	if err != nil {
+		return err
+	}
+	*req = parsed
+	return nil
+}
+
+type keyframeState struct {
+	last       time.Time // Arrival of the last keyframe
+	requested  time.Time // When the MD last asked for one
+	timestamp  uint32    // Of the current frame
+	frameBytes int       // Received so far of the current frame
+	frameSize  float64   // Smoothed size of the frames between keyframes
+	firSeq     uint8     // Command sequence number of the last FIR
+}
+
+// Updates the state with a packet of a video stream
+func (ks *keyframeState) update(header *RTPHeader, size int, now time.Time, frameMarkingID uint8) {
+	if marking, ok := header.ExtensionElement(frameMarkingID); ok && len(marking) > 0 {
+		if marking[0]&(frameMarkingStart|frameMarkingIndependent) == frameMarkingStart|frameMarkingIndependent {
+			ks.last = now
+		}
+		return
+	}
+
+	if header.Timestamp != ks.timestamp && ks.frameBytes > 0 {
+		switch {
+		case ks.last.IsZero():
+			// Streams start with a keyframe, but its size says little
+			// about the frames that follow
+			ks.last = now
+		case ks.frameSize == 0:
+			ks.frameSize = float64(ks.frameBytes)
+		case float64(ks.frameBytes) > keyframeSizeRatio*ks.frameSize:
+			ks.last = now
+		default:
+			ks.frameSize += (float64(ks.frameBytes) - ks.frameSize) / 16
+		}
+		ks.frameBytes = 0
+	}
+	ks.timestamp = header.Timestamp
+	ks.frameBytes += size
+}
+
+// Sends a PLI or FIR for each active video source that passes the filter,
+// and hasn't been asked for a keyframe recently.  Runs on the processing loop.
+func (mdd *MDD) requestKeyframes(now time.Time, want func(sender *association, counters *ssrcCounters) bool) {
+	type request struct {
+		sender *association
+		ssrc   uint32
+		seq    uint8
+	}
+
+	if mdd.KeyframeRequests == KeyframeRequestNone {
+		return
+	}
+
+	mdd.mu.Lock()
+	requests := []request{}
+	for _, sender := range mdd.assocs.snapshot() {
+		if sender.addr == nil || sender.profile == 0 {
+			continue
+		}
+		for ssrc, counters := range sender.stats.ssrcs {
+			keyframes := &counters.keyframes
+			if now.Sub(counters.last) > ssrcRateWindow || mdd.SlowReceivers.isAudioPayloadType(counters.source.payloadType) || mdd.isFECPayloadType(counters.source.payloadType) {
+				continue
+			}
+			if now.Sub(keyframes.requested) < mdd.KeyframeRequestGap || !want(sender, counters) {
+				continue
+			}
+			keyframes.requested = now
+			keyframes.firSeq++
+			requests = append(requests, request{sender, ssrc, keyframes.firSeq})
+		}
+	}
+	mdd.mu.Unlock()
+
+	for _, req := range requests {
+		var msg []byte
+		if mdd.KeyframeRequests == KeyframeRequestFIR {
+			msg = keyframeFIR(mdd.rtcpSSRC, req.ssrc, req.seq)
+		} else {
+			msg = keyframePLI(mdd.rtcpSSRC, req.ssrc)
+		}
+		mdd.sendRTCP(req.sender, &rtp.RTCPPacket{Buffer: msg}, nil)
+	}
+}
+
+func keyframePLI(senderSSRC, mediaSSRC uint32) []byte {
+	pli := make([]byte, 12)
+	pli[0] = 0x80 | rtcpFormatPLI
+	pli[1] = RTCPTypePSFB
+	binary.BigEndian.PutUint16(pli[2:4], 2)
+	binary.BigEndian.PutUint32(pli[4:8], senderSSRC)
+	binary.BigEndian.PutUint32(pli[8:12], mediaSSRC)
+	return pli
+}
+
+// The media SSRC of a FIR is unused; the source is named in its FCI, with a
+// sequence number that tells a new request from a repeat of the last one
+func keyframeFIR(senderSSRC, mediaSSRC uint32, seq uint8) []byte {
+	fir := make([]byte, 20)
+	fir[0] = 0x80 | rtcpFormatFIR
+	fir[1] = RTCPTypePSFB
+	binary.BigEndian.PutUint16(fir[2:4], 4)
+	binary.BigEndian.PutUint32(fir[4:8], senderSSRC)
+	binary.BigEndian.PutUint32(fir[12:16], mediaSSRC)
+	fir[16] = seq
+	return fir
+}
+
+// Asks for keyframes from the video sources in a conference a receiver has
+// just joined
+func (mdd *MDD) receiverJoined(receiver *association) {
+	confID := receiver.conf
+	task := func() {
+		mdd.requestKeyframes(time.Now(), func(sender *association, counters *ssrcCounters) bool {
+			return sender != receiver && sender.conf == confID
+		})
+	}
+
+	// Keys can be installed on the processing loop, which mustn't block on
+	// its own queue; if it's full, the interval check will catch up
+	select {
+	case mdd.tasks <- task:
+	default:
+		log.Printf("Keyframe request for association %v dropped", receiver.id)
+	}
+}
+
+// Asks for keyframes from video sources that have gone too long without one.
+// Runs on the processing loop.
+func (mdd *MDD) checkKeyframes(now time.Time) {
+	if mdd.MaxKeyframeInterval <= 0 {
+		return
+	}
+
+	mdd.requestKeyframes(now, func(sender *association, counters *ssrcCounters) bool {
+		return now.Sub(counters.keyframes.last) > mdd.MaxKeyframeInterval
+	})
+}
@@ -0,0 +1,161 @@
+package percy
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestKeyframeDetection(t *testing.T) {
+	var ks keyframeState
+	now := time.Now()
+	frame := func(timestamp uint32, size int) {
+		now = now.Add(33 * time.Millisecond)
+		ks.update(&RTPHeader{Timestamp: timestamp}, size, now, 0)
+	}
+
+	// The first frame and any much larger than the average are keyframes
+	frame(0, 5000)
+	frame(1, 500)
+	first := ks.last
+	for ts := uint32(2); ts < 10; ts++ {
+		frame(ts, 500)
+	}
+	if first.IsZero() || !ks.last.Equal(first) {
+		t.Fatalf("Incorrect initial keyframe: %v", ks.last)
+	}
+	frame(10, 5000)
+	frame(11, 500)
+	if !ks.last.Equal(now) {
+		t.Fatalf("Large frame not taken as a keyframe: %v", ks.last)
+	}
+
+	// Frame marking overrides the guess
+	marked := &RTPHeader{
+		Timestamp:        12,
+		Extension:        true,
+		ExtensionProfile: 0xbede,
+		ExtensionData:    []byte{0x30, frameMarkingStart | frameMarkingIndependent, 0x00, 0x00},
+	}
+	later := now.Add(time.Second)
+	ks.update(marked, 100, later, 3)
+	if !ks.last.Equal(later) {
+		t.Fatalf("Marked keyframe not detected: %v", ks.last)
+	}
+}
+
+func TestKeyframeRequestOnJoin(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.RTCPShaping = RTCPShaping{}
+
+	kd := make(MDDChan, 10)
+	mdd.KD = kd
+
+	keys := HBHKeys{Profile: DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM}
+	join := func(addr string) *Client {
+		client, _ := NewClient(network, addr)
+		client.Write([]byte{0x16, 0xfe, 0xfd, 0x00})
+		<-kd
+
+		done := make(chan error)
+		mdd.runOnLoop(func() { done <- mdd.SetKeys(client.Assoc(), keys) })
+		if err := <-done; err != nil {
+			t.Fatalf("Error setting keys: %v", err)
+		}
+		return client
+	}
+
+	sender := join("10.0.0.1:5000")
+	defer sender.Stop()
+	video := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	sender.Write(video)
+
+	receiver := join("10.0.0.2:5000")
+	defer receiver.Stop()
+
+	msg, err := sender.Recv()
+	if err != nil {
+		t.Fatalf("No keyframe request: %v", err)
+	}
+	headers, err := ParseRTCPCompound(msg)
+	if err != nil || len(headers) != 1 || headers[0].PacketType != RTCPTypePSFB || headers[0].Count != rtcpFormatPLI {
+		t.Fatalf("Incorrect keyframe request: %+v %v", headers, err)
+	}
+	if ssrc := binary.BigEndian.Uint32(msg[8:12]); ssrc != 0x01020304 {
+		t.Fatalf("Keyframe requested for the wrong source: %08x", ssrc)
+	}
+
+	// Another join right away doesn't ask again
+	other := join("10.0.0.3:5000")
+	defer other.Stop()
+	AssertNotRecvPacket(t, sender, "Keyframe requested too soon")
+}
+
+func TestKeyframeRequestMethods(t *testing.T) {
+	for _, method := range []KeyframeRequest{KeyframeRequestFIR, KeyframeRequestNone} {
+		network := testnet.NewNetwork()
+		mdd := newTestMDD(t, network)
+		mdd.RTCPShaping = RTCPShaping{}
+		mdd.KeyframeRequests = method
+
+		kd := make(MDDChan, 10)
+		mdd.KD = kd
+
+		keys := HBHKeys{Profile: DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM}
+		join := func(addr string) *Client {
+			client, _ := NewClient(network, addr)
+			client.Write([]byte{0x16, 0xfe, 0xfd, 0x00})
+			<-kd
+
+			done := make(chan error)
+			mdd.runOnLoop(func() { done <- mdd.SetKeys(client.Assoc(), keys) })
+			if err := <-done; err != nil {
+				t.Fatalf("Error setting keys: %v", err)
+			}
+			return client
+		}
+
+		sender := join("10.0.0.1:5000")
+		video := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+		sender.Write(video)
+		receiver := join("10.0.0.2:5000")
+
+		if method == KeyframeRequestNone {
+			AssertNotRecvPacket(t, sender, "Keyframe requested when disabled")
+		} else {
+			msg, err := sender.Recv()
+			if err != nil {
+				t.Fatalf("No FIR: %v", err)
+			}
+			headers, err := ParseRTCPCompound(msg)
+			if err != nil || len(headers) != 1 || headers[0].PacketType != RTCPTypePSFB || headers[0].Count != rtcpFormatFIR {
+				t.Fatalf("Incorrect FIR: %+v %v", headers, err)
+			}
+			if headers[0].MediaSSRC != 0x01020304 || msg[16] != 1 {
+				t.Fatalf("Incorrect FIR request: %08x seq %d", headers[0].MediaSSRC, msg[16])
+			}
+		}
+
+		receiver.Stop()
+		sender.Stop()
+		mdd.Stop()
+	}
+
+	for _, name := range []string{"pli", "FIR", "none"} {
+		var method KeyframeRequest
+		if err := method.UnmarshalText([]byte(name)); err != nil {
+			t.Fatalf("Error parsing %q: %v", name, err)
+		}
+		if method.String() != strings.ToLower(name) {
+			t.Fatalf("Parsed %q as %v", name, method)
+		}
+	}
+	if _, err := ParseKeyframeRequest("nack"); err == nil {
+		t.Fatalf("Parsed an unknown keyframe request")
+	}
+}
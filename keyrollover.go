@@ -0,0 +1,104 @@
+package percy
+
+import (
+	"log"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// When the KD rekeys an association, packets the client protected with the
+// old keys are still in flight, and without an MKI or EKT SPI in them the MD
+// can't tell which key a packet needs.  So the receive context that new keys
+// replace is kept for keyRolloverWindow, and a packet that fails to decrypt
+// with the current context is tried once more against it.  Only the one
+// previous context is kept, so no packet costs more than two attempts.
+// Both outcomes are counted in /stats and /metrics: a steady stream of
+// previous-key decrypts means clients are slow to switch, and failures
+// during a rollover mean the window is too short or the keys are wrong.
+
+const keyRolloverWindow = 10 * time.Second
+
+// Installs new keys for an association: its receive session gets the
+// client's write key, and its send session ours.  The old receive context
+// is kept for the rollover.
+func (mdd *MDD) setSRTP(assoc *association, cipher rtp.CipherID, recvKey, recvSalt, sendKey, sendSalt []byte) error {
+	recv := rtp.NewRTPSession(false)
+	err := recv.SetSRTP(cipher, true, recvKey, recvSalt)
+	if err != nil {
+		log.Printf("Error setting session read key: %v", err)
+		return err
+	}
+
+	err = assoc.send.SetSRTP(cipher, true, sendKey, sendSalt)
+	if err != nil {
+		log.Printf("Error setting session write key: %v", err)
+		return err
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if assoc.keyEpoch > 0 {
+		assoc.prevRecv = assoc.recv
+		assoc.prevRecvUntil = time.Now().Add(keyRolloverWindow)
+	}
+	assoc.recv = recv
+	return nil
+}
+
+// Returns an association's receive contexts: the current one, and the
+// previous one while a rollover is under way
+func (mdd *MDD) recvContexts(assoc *association, now time.Time) (*rtp.RTPSession, *rtp.RTPSession) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if assoc.prevRecv != nil && now.After(assoc.prevRecvUntil) {
+		assoc.prevRecv = nil
+	}
+	return assoc.recv, assoc.prevRecv
+}
+
+func (mdd *MDD) countTrialDecrypt(ok bool) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if ok {
+		mdd.stats.rolloverDecrypts += 1
+	} else {
+		mdd.stats.rolloverFailures += 1
+	}
+}
+
+// Decrypts an SRTP packet, trying the previous keys during a rollover
+func (mdd *MDD) decodeRTP(sender *association, msg []byte, now time.Time, trace *packetTrace) (*rtp.RTPPacket, error) {
+	recv, prev := mdd.recvContexts(sender, now)
+	pkt, err := recv.Decode(msg)
+	if err == nil || prev == nil {
+		return pkt, err
+	}
+
+	pkt, prevErr := prev.Decode(msg)
+	mdd.countTrialDecrypt(prevErr == nil)
+	if prevErr != nil {
+		return nil, err
+	}
+	trace.log("decrypt", "with the keys from before the rekey")
+	return pkt, nil
+}
+
+// Decrypts an SRTCP packet, trying the previous keys during a rollover
+func (mdd *MDD) decodeRTCP(sender *association, msg []byte, now time.Time, trace *packetTrace) (*rtp.RTCPPacket, error) {
+	recv, prev := mdd.recvContexts(sender, now)
+	pkt, err := recv.DecodeRTCP(msg)
+	if err == nil || prev == nil {
+		return pkt, err
+	}
+
+	pkt, prevErr := prev.DecodeRTCP(msg)
+	mdd.countTrialDecrypt(prevErr == nil)
+	if prevErr != nil {
+		return nil, err
+	}
+	trace.log("decrypt", "with the keys from before the rekey")
+	return pkt, nil
+}
@@ -0,0 +1,50 @@
+package percy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+func TestKeyRollover(t *testing.T) {
+	mdd := NewMDD()
+	assoc := mdd.association(0x0001)
+
+	key, salt := make([]byte, 16), make([]byte, 12)
+	if err := mdd.setSRTP(assoc, rtp.SRTP_AEAD_AES_128_GCM, key, salt, key, salt); err != nil {
+		t.Fatalf("Error setting keys: %v", err)
+	}
+	mdd.keysInstalled(assoc, DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM, keySourceKD)
+	if _, prev := mdd.recvContexts(assoc, time.Now()); prev != nil {
+		t.Fatalf("Previous context kept for the first keys")
+	}
+
+	first := assoc.recv
+	if err := mdd.setSRTP(assoc, rtp.SRTP_AEAD_AES_128_GCM, key, salt, key, salt); err != nil {
+		t.Fatalf("Error rotating keys: %v", err)
+	}
+	now := time.Now()
+	if current, prev := mdd.recvContexts(assoc, now); prev != first || current == first {
+		t.Fatalf("Previous context not kept across a rekey")
+	}
+
+	// A context without keys stands in for one with the wrong keys: the
+	// packet is decrypted with the previous context, and counted
+	assoc.recv = rtp.NewRTPSession(false)
+	msg := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	if _, err := mdd.decodeRTP(assoc, msg, now, nil); err != nil {
+		t.Fatalf("Packet not decrypted with the previous keys: %v", err)
+	}
+	if stats := mdd.StatsSnapshot().Global; stats.RolloverDecrypts != 1 || stats.RolloverFailures != 0 {
+		t.Fatalf("Incorrect rollover counts: %d %d", stats.RolloverDecrypts, stats.RolloverFailures)
+	}
+
+	// Once the window is over, only the current context is tried
+	if _, err := mdd.decodeRTP(assoc, msg, now.Add(keyRolloverWindow+time.Second), nil); err == nil {
+		t.Fatalf("Previous keys used after the rollover window")
+	}
+	if stats := mdd.StatsSnapshot().Global; stats.RolloverDecrypts != 1 || stats.RolloverFailures != 0 {
+		t.Fatalf("Trial decryption after the rollover window")
+	}
+}
@@ -0,0 +1,74 @@
+package percy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Signaling knows who is behind each association (user ID, display name,
+// device type); the MD only knows addresses.  Applications can attach labels
+// to an association when they provision it, and the MD carries them through
+// to the events about it, its /stats entry and the log lines that name it,
+// so that both sides can be correlated without a lookup table.
+//
+// Labels are kept with the association in the registry, under its lock, so
+// that events raised from any goroutine can read them.
+
+// Replaces an association's labels.  This can be done before the client has
+// sent any packets.
+func (mdd *MDD) SetAssociationLabels(assocID AssociationID, labels map[string]string) {
+	assoc := mdd.association(assocID)
+	mdd.assocs.setLabels(assoc, labels)
+}
+
+// Returns a copy of an association's labels
+func (mdd *MDD) AssociationLabels(assocID AssociationID) (map[string]string, error) {
+	assoc, ok := mdd.assocs.get(assocID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown client [%04x]", assocID)
+	}
+	return mdd.assocs.labelsOf(assoc), nil
+}
+
+func (reg *assocRegistry) setLabels(assoc *association, labels map[string]string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	assoc.labels = copyLabels(labels)
+}
+
+// Returns a copy of an association's labels, or nil if it has none
+func (reg *assocRegistry) labelsOf(assoc *association) map[string]string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	return copyLabels(assoc.labels)
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	copied := make(map[string]string, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Names an association in log lines, e.g., "[1a2b] {user=alice}"
+func (mdd *MDD) describe(assoc *association) string {
+	labels := mdd.assocs.labelsOf(assoc)
+	if len(labels) == 0 {
+		return fmt.Sprintf("[%04x]", assoc.id)
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return fmt.Sprintf("[%04x] {%s}", assoc.id, strings.Join(pairs, " "))
+}
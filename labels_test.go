@@ -0,0 +1,45 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAssociationLabels(t *testing.T) {
+	mdd := NewMDD()
+	mdd.AssociationTimeout = time.Minute
+	mdd.KD = &closeRecorder{}
+
+	events := []Event{}
+	mdd.OnEvent(func(evt Event) {
+		events = append(events, evt)
+	})
+
+	labels := map[string]string{"user": "alice", "device": "web"}
+	mdd.SetAssociationLabels(0x0001, labels)
+	labels["user"] = "mallory"
+
+	stored, err := mdd.AssociationLabels(0x0001)
+	if err != nil || stored["user"] != "alice" || stored["device"] != "web" {
+		t.Fatalf("Incorrect labels: %v %v", stored, err)
+	}
+	if _, err := mdd.AssociationLabels(0x0002); err == nil {
+		t.Fatalf("Labels returned for unknown association")
+	}
+
+	assoc, _ := mdd.assocs.get(0x0001)
+	if desc := mdd.describe(assoc); desc != "[0001] {device=web user=alice}" {
+		t.Fatalf("Incorrect description: %s", desc)
+	}
+
+	mdd.SetAssociationConference(0x0001, 5)
+	stats := mdd.StatsSnapshot()
+	if len(stats.Associations) != 1 || stats.Associations[0].Labels["user"] != "alice" {
+		t.Fatalf("Labels missing from stats: %+v", stats.Associations)
+	}
+
+	mdd.reapIdle(time.Now().Add(2 * time.Minute))
+	if len(events) != 1 || events[0].Labels["user"] != "alice" {
+		t.Fatalf("Labels missing from event: %+v", events)
+	}
+}
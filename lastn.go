@@ -0,0 +1,127 @@
+package percy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Large meetings can't send everyone's video to everyone.  With last-N
+// forwarding, the MD forwards video only from the N participants who spoke
+// most recently (from the dominant speaker detection in speaker.go), and
+// keeps everyone else's paused; audio is always forwarded.  Until N
+// participants have spoken, all video is forwarded.  When a speaker moves
+// into the last N, the MD asks them for a keyframe, so that receivers don't
+// wait for one to show their video.
+//
+// New conferences take MDD.LastN, and SetConferenceLastN (or POST
+// /admin/lastn) changes it for a conference.  Zero forwards all video.
+
+// Limits the video forwarded in a conference to its n most recent speakers;
+// zero forwards all video
+func (mdd *MDD) SetConferenceLastN(confID ConfID, n int) error {
+	if n < 0 {
+		return fmt.Errorf("Invalid last-N count %d", n)
+	}
+
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.lastN = n
+	return nil
+}
+
+// Returns the senders whose video a conference forwards under its last-N
+// limit, or nil if all video is forwarded
+func (mdd *MDD) LastNSenders(confID ConfID) []AssociationID {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	conf, ok := mdd.conferences[confID]
+	if !ok {
+		return nil
+	}
+	return mdd.lastNSenders(conf)
+}
+
+// The caller holds mdd.mu
+func (mdd *MDD) lastNSenders(conf *conference) []AssociationID {
+	if conf.lastN == 0 {
+		return nil
+	}
+
+	speakers := mdd.liveSpeakers(conf, conf.lastN)
+	if len(speakers) < conf.lastN {
+		return nil
+	}
+	return speakers
+}
+
+// Whether a sender's video is forwarded under its conference's last-N
+// limit.  The caller holds mdd.mu.
+func (mdd *MDD) inLastN(conf *conference, senderID AssociationID) bool {
+	senders := mdd.lastNSenders(conf)
+	if senders == nil {
+		return true
+	}
+	for _, id := range senders {
+		if id == senderID {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a video packet from a sender is left out by its conference's
+// last-N limit
+func (mdd *MDD) outsideLastN(sender *association, msg []byte) bool {
+	header, err := ParseRTPHeader(msg)
+	if err != nil || mdd.SlowReceivers.isAudioPayloadType(header.PayloadType) {
+		return false
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	conf, ok := mdd.conferences[sender.conf]
+	return ok && !mdd.inLastN(conf, sender.id)
+}
+
+// Asks a speaker whose video has just started being forwarded for a
+// keyframe.  Runs on the processing loop.
+func (mdd *MDD) lastNEntered(speaker *association, now time.Time) {
+	mdd.requestKeyframes(now, func(sender *association, counters *ssrcCounters) bool {
+		return sender == speaker
+	})
+}
+
+// POST sets a conference's last-N limit to "n", and GET returns the senders
+// whose video is forwarded (null for everyone)
+func (api *AdminAPI) handleLastN(w http.ResponseWriter, r *http.Request) {
+	confID, err := strconv.ParseUint(r.FormValue("conf"), 0, 32)
+	if err != nil {
+		http.Error(w, "Invalid conference ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, api.mdd.LastNSenders(ConfID(confID)))
+
+	case http.MethodPost:
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err == nil {
+			err = api.mdd.SetConferenceLastN(ConfID(confID), n)
+		}
+		if err != nil {
+			http.Error(w, "Invalid last-N count", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
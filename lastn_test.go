@@ -0,0 +1,49 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastNForwarding(t *testing.T) {
+	mdd := NewMDD()
+	mdd.AudioLevelID = 1
+	mdd.LastN = 1
+
+	assocs := []*association{}
+	for _, id := range []AssociationID{0x0001, 0x0002} {
+		mdd.SetAssociationConference(id, 5)
+		assocs = append(assocs, mdd.association(id))
+	}
+	if mdd.LastNSenders(5) != nil {
+		t.Fatalf("Video limited before anyone has spoken")
+	}
+
+	// The second participant speaks, and is the only one whose video is
+	// forwarded
+	now := time.Now()
+	assocs[1].speech.update(audioLevelPacket(t, 20), now, mdd.AudioLevelID)
+	mdd.checkSpeaker(5, now)
+	if senders := mdd.LastNSenders(5); len(senders) != 1 || senders[0] != 0x0002 {
+		t.Fatalf("Incorrect last-N senders: %v", senders)
+	}
+
+	video := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06, 0x07, 0x08}
+	if !mdd.outsideLastN(assocs[0], video) || mdd.outsideLastN(assocs[1], video) {
+		t.Fatalf("Incorrect last-N filtering")
+	}
+
+	for _, conf := range mdd.StatsSnapshot().Conferences {
+		if conf.ID == 5 && len(conf.LastN) != 1 {
+			t.Fatalf("Last-N senders missing from stats: %+v", conf)
+		}
+	}
+
+	mdd.SetConferenceLastN(5, 0)
+	if mdd.LastNSenders(5) != nil || mdd.outsideLastN(assocs[0], video) {
+		t.Fatalf("Video still limited with last-N off")
+	}
+	if err := mdd.SetConferenceLastN(5, -1); err == nil {
+		t.Fatalf("Negative last-N accepted")
+	}
+}
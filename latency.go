@@ -0,0 +1,95 @@
+package percy
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The latency watchdog samples how long packets take from socket read to the
+// last egress write, to catch GC pauses or lock stalls on media nodes.
+
+const (
+	latencySampleRate    = 16   // Measure one in this many packets
+	latencyWindow        = 1024 // Samples kept for computing percentiles
+	latencyCheckInterval = 10 * time.Second
+	defaultLatencyBudget = 20 * time.Millisecond
+)
+
+type LatencyStats struct {
+	Samples int           `json:"samples"`
+	P50     time.Duration `json:"p50"`
+	P90     time.Duration `json:"p90"`
+	P99     time.Duration `json:"p99"`
+	Max     time.Duration `json:"max"`
+}
+
+type latencyMonitor struct {
+	mu      sync.Mutex
+	count   uint64
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyMonitor() *latencyMonitor {
+	return &latencyMonitor{
+		samples: make([]time.Duration, 0, latencyWindow),
+	}
+}
+
+// Reports whether the current packet should be measured.  Only called from
+// the processing loop.
+func (lm *latencyMonitor) sample() bool {
+	lm.count += 1
+	return lm.count%latencySampleRate == 0
+}
+
+func (lm *latencyMonitor) record(d time.Duration) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if len(lm.samples) < latencyWindow {
+		lm.samples = append(lm.samples, d)
+		return
+	}
+
+	lm.samples[lm.next] = d
+	lm.next = (lm.next + 1) % latencyWindow
+}
+
+func (lm *latencyMonitor) stats() LatencyStats {
+	lm.mu.Lock()
+	sorted := make([]time.Duration, len(lm.samples))
+	copy(sorted, lm.samples)
+	lm.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return LatencyStats{}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+
+	return LatencyStats{
+		Samples: len(sorted),
+		P50:     percentile(50),
+		P90:     percentile(90),
+		P99:     percentile(99),
+		Max:     sorted[len(sorted)-1],
+	}
+}
+
+func (mdd *MDD) checkLatency() {
+	if mdd.LatencyBudget == 0 {
+		return
+	}
+
+	stats := mdd.latency.stats()
+	if stats.P99 > mdd.LatencyBudget {
+		log.Printf("Forwarding latency over budget: p99=%v (budget %v, p50=%v, max=%v, %d samples)",
+			stats.P99, mdd.LatencyBudget, stats.P50, stats.Max, stats.Samples)
+	}
+}
@@ -0,0 +1,69 @@
+package percy
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/fluffy/rtp"
+)
+
+// In loopback mode, an association's RTP is reflected back to it instead of
+// being forwarded to the rest of its conference (and it receives nothing from
+// the conference), so that support staff can have a user run a self-test
+// against the MD to isolate network problems.
+// The SSRC is rewritten, since a client that saw its own SSRC arrive from the
+// network would treat it as a collision (RFC 3550, section 8.2).
+//
+// Loopback applies to conferences in PERC and SFU mode.  In PERC mode, the
+// inner (end-to-end) layer still covers the original SSRC, so the client has
+// to map the echoed SSRC back before decrypting.
+
+// The raw bytes of a decoded packet, which fluffy/rtp keeps in a buffer that
+// can be edited in place
+func rtpBytes(pkt *rtp.RTPPacket) []byte {
+	return pkt.Buffer
+}
+
+// Maps an SSRC to the one its echo is sent with (and back again)
+func loopbackSSRC(ssrc uint32) uint32 {
+	return ^ssrc
+}
+
+// Turns loopback on or off for an association.  This can be done before the
+// client has sent any packets.
+func (mdd *MDD) SetLoopback(assocID AssociationID, on bool) {
+	assoc := mdd.association(assocID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.loopback = on
+}
+
+func (mdd *MDD) reflect(sender *association, pkt *rtp.RTPPacket, trace *packetTrace) {
+	outPkt := pkt.Clone()
+	err := rewriteSSRC(rtpBytes(outPkt))
+	if err != nil {
+		trace.log("route", "loopback failed: %v", err)
+		return
+	}
+
+	msg, err := sender.send.Encode(outPkt)
+	if err != nil {
+		mdd.countEncodeError(sender)
+		trace.log("encrypt", "for loopback failed: %v", err)
+		return
+	}
+
+	err = mdd.sendTo(sender, msg)
+	trace.log("egress", "loopback to [%04x] at %v: %v", sender.id, sender.addr, err)
+}
+
+func rewriteSSRC(buf []byte) error {
+	if len(buf) < 12 {
+		return fmt.Errorf("RTP packet too short [%d]", len(buf))
+	}
+
+	ssrc := binary.BigEndian.Uint32(buf[8:12])
+	binary.BigEndian.PutUint32(buf[8:12], loopbackSSRC(ssrc))
+	return nil
+}
@@ -2,9 +2,12 @@ package percy
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fluffy/rtp"
@@ -34,8 +37,9 @@ func packetClass(msg []byte) dtlsSRTPPacketClass {
 	B := msg[0]
 	switch {
 	case 127 < B && B < 192:
-		PT := msg[1]
-		if PT >= 200 && PT <= 205 {
+		// RTCP packet types are in 192-223, which RTP payload types don't
+		// use with the marker bit set (RFC 5761, Section 4)
+		if len(msg) > 1 && msg[1] >= 192 && msg[1] <= 223 {
 			return packetClassSRTCP
 		}
 
@@ -52,11 +56,15 @@ func packetClass(msg []byte) dtlsSRTPPacketClass {
 }
 
 type packet struct {
-	addr *net.UDPAddr
-	msg  []byte
+	addr     net.Addr
+	msg      []byte
+	recvTime time.Time
+	ecn      uint8 // ECN bits, if the socket reports them
+
+	socket *confSocket // The conference socket it arrived on; nil for the shared one
 }
 
-func addrToAssoc(addr *net.UDPAddr) AssociationID {
+func addrToAssoc(addr net.Addr) AssociationID {
 	h := sha256.New()
 	h.Write([]byte(addr.String()))
 	sum := h.Sum(nil)
@@ -64,70 +72,296 @@ func addrToAssoc(addr *net.UDPAddr) AssociationID {
 }
 
 type MDD struct {
-	name         string
-	addr         *net.UDPAddr
-	conn         *net.UDPConn
-	clients      map[AssociationID]*net.UDPAddr
-	recvSessions map[AssociationID]*rtp.RTPSession
-	sendSessions map[AssociationID]*rtp.RTPSession
-	stopChan     chan bool
-	doneChan     chan bool
-	packetChan   chan packet
-	timeout      time.Duration
-
-	KD       KMFTunnel
-	keys     map[AssociationID]HBHKeys
-	profile  ProtectionProfile
-	profiles []ProtectionProfile
-	// TODO add some mutexes
+	name        string
+	bind        func() (Transport, error)
+	conn        Transport
+	assocs      *assocRegistry
+	conferences map[ConfID]*conference
+	tenants     map[TenantID]*tenant
+	rejected    map[AssociationID]bool         // Clients turned away from a full conference
+	rtcpPending map[AssociationID]*association // Receivers with queued RTCP
+	routes      map[uint32]AssociationID       // Sender of each SSRC
+	paths       map[string]AssociationID       // Addresses that passed ICE checks, or got a rehashed ID
+	sockets     map[string]*confSocket         // Conference sockets clients were heard on, by address
+	fillers     map[uint8]*Placeholder         // Sent on lost streams, by payload type
+	hostAddrs   []net.IP                       // As of the last interface check
+	connMu      sync.RWMutex                   // Guards conn, which is replaced on re-bind, and sockets
+	rebindMu    sync.Mutex                     // Lets one reader re-bind while the others wait
+	stopChan    chan bool
+	quit        chan struct{}
+	doneChan    chan bool
+	workers     sync.WaitGroup // Readers, STUN workers and the processing loop
+	packetChan  chan packet
+	isolated    chan packet  // From conferences' own sockets, which go first
+	tasks       chan func()  // Work for the processing loop from other goroutines
+	readers     int          // Goroutines reading the media socket
+	stunQueue   chan stunJob // Checks waiting for the STUN workers
+	stunWorkers int
+	stunRetire  chan struct{} // Stops STUN workers when the MD goes idle
+	stunCache   *stunCache    // Responses to recent Binding requests
+	affinity    CPUAffinity
+	kernelTime  bool // Read receive times from the kernel where possible
+	ecn         bool // Mark sent packets ECT(1) and count received marks
+	timeout     time.Duration
+	idle        bool // Only changed on the processing loop
+	streams     *streamListener
+	rtcpSSRC    uint32 // Sender of the MD's own RTCP reports
+	draining    bool   // No new conferences are taken
+	drained     bool   // Draining, and the last association is gone
+
+	// Guards the maps above and all counters against readers outside the
+	// processing loop
+	mu    sync.Mutex
+	stats globalCounters
+
+	tracer  *tracer
+	unknown *unknownTraffic
+	latency *latencyMonitor
+	events  eventBus
+
+	timelines *timelines
+
+	// Client DTLS fingerprints by the client's ICE ufrag, for associations
+	// signaling couldn't name
+	fingerprints map[string]string
+
+	// Packets the processing loop has handled since loopSince, and the
+	// rate over the last period; only the loop touches the first two
+	loopPackets int
+	loopSince   time.Time
+	loopRate    float64
+
+	// Warn when the p99 time from socket read to last egress write exceeds
+	// this; zero disables the warning
+	LatencyBudget time.Duration
+
+	// Limits the RTCP forwarded to each receiver
+	RTCPShaping RTCPShaping
+
+	// How receivers that can't keep up are handled
+	SlowReceivers SlowReceiverPolicy
+
+	// RTP clock rates by payload type, for jitter and sender reports
+	ClockRates map[uint8]uint32
+
+	// How long before a conference expires to warn about it
+	ExpiryWarning time.Duration
+
+	// How long a client that changes address can take to come back and
+	// resume its SRTP state; zero disables resumption
+	ReconnectGrace time.Duration
+
+	// How long a stream can be silent before it's considered lost; zero
+	// disables detection
+	SourceLossTimeout time.Duration
+
+	// How long a client can be silent before its association is evicted;
+	// zero keeps associations until they're removed
+	AssociationTimeout time.Duration
+
+	// Keyframes: the frame marking extension's ID (zero to guess from frame
+	// sizes), how long a video source can go without one before the MD asks
+	// for one (zero to only ask when receivers join), and the least time
+	// between requests to a source
+	FrameMarkingID      uint8
+	MaxKeyframeInterval time.Duration
+	KeyframeRequestGap  time.Duration
+
+	// How the MD asks senders for keyframes: with a PLI, a FIR, or not at
+	// all, leaving it to the receivers
+	KeyframeRequests KeyframeRequest
+
+	// Payload types of FEC streams, which are forwarded only as receivers
+	// want and budgets allow
+	FECPayloadTypes []uint8
+
+	// Addresses of the TURN relays clients use, for telling relayed paths
+	// apart in the stats
+	RelayNetworks []*net.IPNet
+
+	// The transport-wide sequence number extension's ID, for congestion
+	// control feedback on each leg; zero disables it
+	TransportCCID uint8
+
+	// Whether to estimate each sender's bandwidth and tell it with REMB,
+	// for senders without transport-wide feedback
+	REMB bool
+
+	// Whether to drop packets already forwarded to a receiver, e.g., media
+	// looped back by a cascade
+	Deduplicate bool
+
+	// Whether to probe a receiver's leg with padding before moving it up a
+	// simulcast layer
+	BandwidthProbing bool
+
+	// Whether to drop Binding requests whose USERNAME isn't for the
+	// association they arrive on
+	ICEOriginChecks bool
+
+	// Bounds on the processing loop's poll interval, which is adapted to
+	// the load and the legs' RTT
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+
+	// How many packets can wait to be sent to each receiver, each queue
+	// with a goroutine writing it; zero writes them from the processing
+	// loop
+	SendQueueLength int
+
+	// How many SRTP packets to hold for each association until its keys
+	// are installed; zero drops them
+	BackfillPackets int
+
+	// The audio level extension's ID, for dominant speaker detection; zero
+	// disables it
+	AudioLevelID uint8
+
+	// How many recent speakers' video new conferences forward; zero for
+	// everyone's
+	LastN int
+
+	// The RTP stream ID extension's ID, for telling simulcast layers apart
+	// by RID; zero if layers are only given by SSRC
+	RIDExtensionID uint8
+
+	// The MID extension's ID, for telling apart the media sections bundled
+	// on each client's transport; zero disables it
+	MIDExtensionID uint8
+
+	// Slow down while there are no associations
+	IdleSaving bool
+
+	// Whether clients are added by their first packet, or only by AddClient
+	Admission AdmissionMode
+
+	// Drop packets that violate the specs in ways the MD could tolerate,
+	// instead of just counting them
+	StrictParsing bool
+
+	// Derives association IDs from client addresses; nil for
+	// HashAssociationID
+	AssociationIDs AssociationIDFunc
+
+	// Where key handling is logged for audits; nil disables it
+	KeyAudit *log.Logger
+
+	// Where installed keys are delivered for escrow, in deployments that
+	// must keep them; nil (the default) keeps them in the MD only
+	KeyEscrow KeyEscrow
+
+	// How this node describes itself to signaling, and decides whether to
+	// take participants
+	Node      string
+	Region    string
+	Capacity  int // Associations; zero for no limit
+	Placement PlacementFunc
+
+	KD   KMFTunnel // Default tunnel for conferences without their own
+	Auth AuthProvider
+
+	// Realm and nonces for long-term credentials; disabled if Realm is empty
+	Realm  string
+	Nonces *NonceManager
+
+	// Presented to clients in conferences that run in SFU mode
+	DTLSCertificate *tls.Certificate
 }
 
 func NewMDD() *MDD {
 	mdd := new(MDD)
 	mdd.name = "mdd"
-	mdd.clients = map[AssociationID]*net.UDPAddr{}
-	mdd.recvSessions = map[AssociationID]*rtp.RTPSession{}
-	mdd.sendSessions = map[AssociationID]*rtp.RTPSession{}
-	mdd.timeout = 10 * time.Millisecond
+	mdd.assocs = newAssocRegistry()
+	mdd.fingerprints = map[string]string{}
+	mdd.conferences = map[ConfID]*conference{}
+	mdd.tenants = map[TenantID]*tenant{}
+	mdd.rejected = map[AssociationID]bool{}
+	mdd.rtcpPending = map[AssociationID]*association{}
+	mdd.routes = map[uint32]AssociationID{}
+	mdd.paths = map[string]AssociationID{}
+	mdd.sockets = map[string]*confSocket{}
+	mdd.rtcpSSRC = randomUint32()
+	mdd.fillers = map[uint8]*Placeholder{}
+	mdd.timeout = defaultPollInterval
+	mdd.MinPollInterval = defaultMinPollInterval
+	mdd.MaxPollInterval = defaultMaxPollInterval
+	mdd.stats.start = time.Now()
+	mdd.stats.violations = map[ParseViolation]uint64{}
+	mdd.tracer = newTracer()
+	mdd.unknown = newUnknownTraffic()
+	mdd.stunCache = newSTUNCache()
+	mdd.latency = newLatencyMonitor()
+	mdd.timelines = newTimelines()
+	mdd.LatencyBudget = defaultLatencyBudget
+	mdd.RTCPShaping = RTCPShaping{MinInterval: defaultRTCPMinInterval}
+	mdd.SlowReceivers = DefaultSlowReceiverPolicy()
+	mdd.ClockRates = DefaultClockRates()
+	mdd.ExpiryWarning = defaultExpiryWarning
+	mdd.ReconnectGrace = defaultReconnectGrace
+	mdd.SourceLossTimeout = defaultSourceLossTimeout
+	mdd.AssociationTimeout = defaultAssociationTimeout
+	mdd.KeyframeRequestGap = defaultKeyframeRequestGap
+	mdd.IdleSaving = true
 
 	mdd.stopChan = make(chan bool)
+	mdd.quit = make(chan struct{})
 	mdd.doneChan = make(chan bool)
-	mdd.packetChan = make(chan packet)
-
-	// TODO Add some defaults
-	mdd.profiles = []ProtectionProfile{}
-	mdd.keys = map[AssociationID]HBHKeys{}
+	mdd.packetChan = make(chan packet, 10)
+	mdd.isolated = make(chan packet, 10)
+	mdd.tasks = make(chan func(), 16)
+	mdd.readers = 1
+	mdd.kernelTime = true
+	mdd.stunQueue = make(chan stunJob, defaultSTUNQueue)
+	mdd.stunWorkers = defaultSTUNWorkers
+	mdd.stunRetire = make(chan struct{})
+
+	// TODO Add some default profiles
+	mdd.conference(DefaultConfID)
+	mdd.Auth = NewMemoryAuthProvider()
+	mdd.Nonces = NewNonceManager()
 
 	return mdd
 }
 
-func (mdd *MDD) handleDTLS(assocID AssociationID, msg []byte) {
+func (mdd *MDD) handleDTLS(assoc *association, msg []byte, trace *packetTrace) {
+	if mdd.mode(assoc) == ModeSFU {
+		mdd.terminateDTLS(assoc, msg, trace)
+		return
+	}
+
+	if isApplicationData(msg) && mdd.handleDataChannel(assoc, msg, trace) {
+		return
+	}
+
 	// TODO Notify the KD of supported SRTP profiles
-	mdd.KD.Send(assocID, msg)
+	err := mdd.tunnel(assoc).Send(assoc.id, msg)
+	trace.log("route", "to KD for conference %v: %v", assoc.conf, err)
 }
 
+// Logs an HBH key message from the KMF.  The message holds key material, so
+// only its length is logged.
 func (mdd *MDD) handleHBHKey(assocID AssociationID, msg []byte) {
-	log.Printf("Received HBH key from KMF: %v", msg)
+	log.Printf("Received HBH key from KMF for [%04x] (%d bytes)", assocID, len(msg))
 }
 
-func (mdd *MDD) broadcast(assocID AssociationID, msg []byte) {
-	// Send the packet out to all the clients except
+func (mdd *MDD) broadcast(sender *association, msg []byte, trace *packetTrace) {
+	// Send the packet out to all the clients in the conference except
 	// the one that sent it
-	for client, addr := range mdd.clients {
-		if client == assocID {
-			continue
-		}
+	mdd.forward(sender, mdd.peers(sender), msg, trace)
+}
 
-		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes", client, addr, len(msg))
+// Sends a packet unchanged to the given receivers
+func (mdd *MDD) forward(sender *association, peers []*association, msg []byte, trace *packetTrace) {
+	trace.log("route", "%d receivers in conference %v", len(peers), sender.conf)
+	for _, assoc := range peers {
+		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes", assoc.id, assoc.addr, len(msg))
 
-		_, err := mdd.conn.WriteToUDP(msg, addr)
-		if err != nil {
-			log.Printf("Error forwarding packet")
-		}
+		err := mdd.sendTo(assoc, msg)
+		trace.log("egress", "to [%04x] at %v: %v", assoc.id, assoc.addr, err)
 	}
 }
 
-func (mdd *MDD) handleSTUN(addr *net.UDPAddr, msg []byte) {
+func (mdd *MDD) handleSTUN(assoc *association, addr net.Addr, msg []byte) {
 	message, err := ParseSTUN(msg)
 	if err != nil {
 		log.Println("Error parsing STUN message", err, msg)
@@ -138,29 +372,93 @@ func (mdd *MDD) handleSTUN(addr *net.UDPAddr, msg []byte) {
 
 	switch message.msgType {
 	case MSG_TYPE_REQUEST:
+		binding := message.header.Type == MSG_BINDING
+		if binding {
+			if cached, ok := mdd.stunCache.get(addr, message.header.TxnID, msg, time.Now()); ok {
+				mdd.mu.Lock()
+				mdd.stats.stunCached += 1
+				mdd.mu.Unlock()
+
+				_, err = mdd.writeTo(cached, addr)
+				mdd.countOut(nil, len(cached), err)
+				return
+			}
+		}
+
 		response := STUNMessage{header: message.header}
+		failure := ""
 		switch message.header.Type {
 		case MSG_BINDING:
+			// USERNAME is "<local ufrag>:<remote ufrag>"; requests are
+			// signed with the password that goes with our (local) ufrag,
+			// and so are our responses
+			username, ok := message.Get(ATTR_USERNAME)
+			if _, signed := message.Get(ATTR_MESSAGE_INTEGRITY); !ok || !signed {
+				log.Printf("Binding request from %v without USERNAME or MESSAGE-INTEGRITY", addr)
+				response.msgType = MSG_TYPE_ERROR
+				response.AddErrorCode(400, "Bad Request")
+				failure = "missing USERNAME or MESSAGE-INTEGRITY"
+				break
+			}
+			if !mdd.iceOrigin(assoc, string(username)) {
+				log.Printf("Dropping Binding request from %v for [%s]", addr, username)
+				return
+			}
+
+			ufrag := strings.SplitN(string(username), ":", 2)[0]
+			password, ok := mdd.icePassword(assoc, ufrag)
+			if !ok {
+				log.Printf("No ICE password for ufrag [%s]", ufrag)
+				response.msgType = MSG_TYPE_ERROR
+				response.AddErrorCode(401, "Unauthorized")
+				failure = "unknown ufrag " + ufrag
+				break
+			}
+
+			if !CheckMessageIntegrity(msg, password) {
+				log.Printf("Invalid MESSAGE-INTEGRITY on Binding request from %v", addr)
+				response.msgType = MSG_TYPE_ERROR
+				response.AddErrorCode(401, "Unauthorized")
+				failure = "invalid MESSAGE-INTEGRITY"
+				break
+			}
+
+			_, nominated := message.Get(ATTR_USE_CANDIDATE)
+			mdd.notePath(assoc, addr, nominated)
+			mdd.noteICEUsername(assoc, string(username), time.Now())
+
 			response.msgType = MSG_TYPE_SUCCESS
-			// 22 to 256 alphanumeric characters
-			response.icePassword = "abcdefabcdefabcdefabcdefabcdefab"
+			response.icePassword = password
 			response.AddXorMappedAddress(addr)
 			response.AddMessageIntegrity()
 			response.AddFingerprint()
 		default:
+			// Requests other than Binding use long-term credentials
+			if len(mdd.Realm) > 0 && !mdd.checkLongTermCredentials(addr, message, msg, &response) {
+				break
+			}
+
 			log.Printf("Unhandled STUN message type: %v", message)
 			response.msgType = MSG_TYPE_ERROR
 			response.AddErrorCode(500, "Unimplemented")
 		}
 
+		if binding {
+			mdd.countCheck(assoc, failure, time.Now())
+		}
+
 		responseBytes, err := response.Serialize()
 		if err != nil {
 			log.Println("Error serializing response:", err)
 			return
 		}
 		log.Println("Sending", response.header)
+		if binding {
+			mdd.stunCache.put(addr, message.header.TxnID, msg, responseBytes, time.Now())
+		}
 
-		_, err = mdd.conn.WriteToUDP(responseBytes, addr)
+		_, err = mdd.writeTo(responseBytes, addr)
+		mdd.countOut(nil, len(responseBytes), err)
 		if err != nil {
 			log.Println("Error replying to STUN request:", err)
 		}
@@ -173,148 +471,204 @@ func (mdd *MDD) handleSTUN(addr *net.UDPAddr, msg []byte) {
 	}
 }
 
-func (mdd *MDD) handleSRTP(assocID AssociationID, msg []byte) {
-	if msg[len(msg)-1] != 0x00 && msg[len(msg)-1] != 0x02 {
+func (mdd *MDD) handleSRTP(sender *association, msg []byte, arrival time.Time, trace *packetTrace) {
+	if mdd.mode(sender) == ModePERC && msg[len(msg)-1] != 0x00 && msg[len(msg)-1] != 0x02 {
 		log.Printf("Got non-EKT SRTP packet: %x", msg)
 	}
 
-	// Decode the packet
-	sendSession, ok := mdd.recvSessions[assocID]
-	if !ok {
-		log.Printf("Got an SRTP packet with no RTP session set up")
+	// Packets that came before the keys go first
+	now := time.Now()
+	mdd.backfill(sender, now)
+	if mdd.holdForKeys(sender, msg, now, trace) {
 		return
 	}
 
-	pkt, err := sendSession.Decode(msg)
+	// Decode the packet
+	pkt, err := mdd.decodeRTP(sender, msg, now, trace)
 	if err != nil {
 		log.Printf("Error decoding RTP packet: %v", err)
+		mdd.countDecodeError(sender)
+		trace.log("decrypt", "failed: %v", err)
 		return
 	}
+	trace.log("decrypt", "ok")
+	mdd.recordTransportSeq(sender, pkt, arrival, now, trace)
 
-	// Re-encode the packet for each recipient and send
-	for receiver, addr := range mdd.clients {
-		if receiver == assocID {
-			continue
-		}
+	if sender.loopback {
+		mdd.reflect(sender, pkt, trace)
+		return
+	}
+
+	if mdd.holdMedia(sender, trace) {
+		return
+	}
 
-		recvSession, ok := mdd.sendSessions[receiver]
-		if !ok {
-			log.Printf("No SRTP session for recipient [%v]", receiver)
+	// Re-encode the packet for each recipient in the conference and send
+	peers := mdd.subscribers(sender, msg)
+	trace.log("route", "%d receivers in conference %v", len(peers), sender.conf)
+	mdd.mu.Lock()
+	rewrite := mdd.rewritesSSRCs(sender)
+	mdd.mu.Unlock()
+	for _, assoc := range peers {
+		if mdd.duplicate(sender, assoc, pkt.Buffer, trace) {
 			continue
 		}
-
 		outPkt := pkt.Clone()
-		msg, err := recvSession.Encode(outPkt)
+		if rewrite {
+			mdd.rewriteSSRC(assoc, sender, outPkt, now)
+		}
+		mdd.sequenceTransport(assoc, outPkt)
+		mdd.remapHeaderExtensions(sender, assoc, outPkt, trace)
+		msg, err := assoc.send.Encode(outPkt)
 		if err != nil {
-			log.Printf("Error encoding packet for [%v] [%v]", receiver, err)
+			log.Printf("Error encoding packet for [%v] [%v]", assoc.id, err)
+			mdd.countEncodeError(assoc)
+			trace.log("encrypt", "for [%04x] failed: %v", assoc.id, err)
 			continue
 		}
 
-		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes: %x", receiver, addr, len(msg), msg)
+		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes: %x", assoc.id, assoc.addr, len(msg), msg)
 
-		_, err = mdd.conn.WriteToUDP(msg, addr)
-		if err != nil {
-			log.Printf("Error forwarding packet to [%v] [%v]", receiver, err)
-			continue
-		}
+		err = mdd.sendTo(assoc, msg)
+		trace.log("egress", "to [%04x] at %v: %v", assoc.id, assoc.addr, err)
 	}
 }
 
-func (mdd *MDD) handleSRTCP(assocID AssociationID, msg []byte) {
+func (mdd *MDD) handleSRTCP(sender *association, msg []byte, trace *packetTrace) {
 	log.Printf("Received SRTCP")
 
 	// Decode the packet
-	sendSession, ok := mdd.recvSessions[assocID]
-	if !ok {
-		log.Printf("Got an SRTP packet with no RTP session set up")
-		return
-	}
-
-	pkt, err := sendSession.DecodeRTCP(msg)
+	now := time.Now()
+	pkt, err := mdd.decodeRTCP(sender, msg, now, trace)
 	if err != nil {
 		log.Printf("Error decoding RTP packet: %v", err)
+		mdd.countDecodeError(sender)
+		trace.log("decrypt", "failed: %v", err)
 		return
 	}
+	trace.log("decrypt", "ok")
 
-	// Only send receiver reports
-	if pkt.GetHeader().GetPT() != rtp.RTCPTypeRR {
+	if mdd.holdMedia(sender, trace) {
 		return
 	}
 
-	log.Printf("Received RTCP Receiver Report")
+	headers, err := ParseRTCPCompound(pkt.Buffer)
+	if err != nil {
+		log.Printf("Error parsing RTCP packet: %v", err)
+		trace.log("route", "dropped malformed RTCP: %v", err)
+		return
+	}
+	if !mdd.conforms(rtcpViolations(pkt.Buffer, headers), trace) {
+		return
+	}
 
-	// Re-encode the packet for each recipient and send
-	for receiver, addr := range mdd.clients {
-		if receiver == assocID {
-			continue
-		}
+	mdd.recordSenderReports(sender, headers, pkt.Buffer, now)
+	mdd.recordRTT(sender, headers, pkt.Buffer, now)
 
-		recvSession, ok := mdd.sendSessions[receiver]
-		if !ok {
-			log.Printf("No SRTCP session for recipient [%v]", receiver)
-			continue
-		}
+	if mdd.TransportCCID != 0 && transportFeedbackOnly(headers) {
+		trace.log("route", "terminated transport-wide feedback")
+		return
+	}
 
-		outPkt := pkt.Clone()
-		msg, err := recvSession.EncodeRTCP(outPkt)
-		if err != nil {
-			log.Printf("Error encoding packet for [%v] [%v]", receiver, err)
-			continue
+	// Feedback goes straight to the senders of the media it is about
+	mdd.restoreFeedback(sender, headers, pkt.Buffer)
+	mdd.forgetNACKed(sender, headers, pkt.Buffer)
+	if targets := mdd.feedbackTargets(sender, headers); len(targets) > 0 {
+		trace.log("route", "feedback to %d senders in conference %v", len(targets), sender.conf)
+		for _, assoc := range targets {
+			mdd.sendRTCP(assoc, pkt.Clone(), trace)
 		}
+		return
+	}
 
-		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes: %x", receiver, addr, len(msg), msg)
-
-		_, err = mdd.conn.WriteToUDP(msg, addr)
-		if err != nil {
-			log.Printf("Error forwarding packet to [%v] [%v]", receiver, err)
-			continue
-		}
+	if mdd.terminatesRTCP(sender) {
+		trace.log("route", "terminated RTCP")
+		return
 	}
 
+	// Queue the packet for each recipient in the conference, and send
+	// whatever their RTCP shaping allows
+	report := rtcpReport{ssrc: packetSSRC(packetClassSRTCP, msg), size: len(msg)}
+	peers := mdd.reportReceivers(sender, headers, pkt.Buffer)
+	trace.log("route", "%d receivers in conference %v", len(peers), sender.conf)
+	for _, assoc := range peers {
+		report.pkt = pkt.Clone()
+		mdd.shapeRTCP(assoc, report, now, trace)
+	}
 }
 
+// Listens for media on the given UDP port
 func (mdd *MDD) Listen(port int) error {
+	return mdd.ListenTransport(func() (Transport, error) {
+		return net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	})
+}
+
+// Listens for media on a transport created by bind.  If the transport fails,
+// bind is called again to replace it.
+func (mdd *MDD) ListenTransport(bind func() (Transport, error)) error {
 	var err error
 
-	mdd.addr = &net.UDPAddr{Port: port}
-	mdd.conn, err = net.ListenUDP("udp", mdd.addr)
+	mdd.bind = bind
+	mdd.conn, err = bind()
 	if err != nil {
 		return err
 	}
 
-	mdd.packetChan = make(chan packet, 10)
-
-	go func(packetChan chan packet) {
-		buf := make([]byte, 2048)
-
-		for {
-			n, addr, err := mdd.conn.ReadFromUDP(buf)
-
-			if err == nil {
-				pkt := packet{
-					addr: addr,
-					msg:  make([]byte, n),
-				}
-				copy(pkt.msg, buf[:n])
+	mdd.workers.Add(mdd.readers)
+	for i := 0; i < mdd.readers; i++ {
+		go mdd.readLoop(mdd.conn, mdd.packetChan)
+	}
+	mdd.startSTUNWorkers()
 
-				packetChan <- pkt
-			}
+	mdd.workers.Add(1)
+	go func(mdd *MDD) {
+		defer mdd.workers.Done()
+		pinGoroutine("processing loop", mdd.affinity.Processor)
 
-			// TODO log errors
-		}
-	}(mdd.packetChan)
+		watchdog := time.NewTicker(latencyCheckInterval)
+		defer watchdog.Stop()
+		expiry := time.NewTicker(expiryCheckInterval)
+		defer expiry.Stop()
 
-	go func(mdd *MDD) {
 		for {
 			var pkt packet
 
+			// Conferences with their own sockets go first
 			select {
-			case <-mdd.stopChan:
-				mdd.doneChan <- true
-				return
-			case <-time.After(mdd.timeout):
-				continue
-			case pkt = <-mdd.packetChan:
+			case pkt = <-mdd.isolated:
+			default:
+				select {
+				case <-mdd.stopChan:
+					mdd.doneChan <- true
+					return
+				case <-time.After(mdd.pollInterval()):
+					mdd.flushRTCP(time.Now())
+					if mdd.updateIdle() {
+						expiry.Reset(mdd.expiryInterval())
+					}
+					continue
+				case <-watchdog.C:
+					mdd.checkLatency()
+					continue
+				case now := <-expiry.C:
+					mdd.checkExpiry(now)
+					mdd.reapIdle(now)
+					mdd.checkSourceLoss(now)
+					mdd.allocate(now)
+					mdd.selectLayers(now)
+					mdd.sendReports(now)
+					mdd.sendREMB(now)
+					mdd.checkKeyframes(now)
+					mdd.checkDrained(now)
+					mdd.adaptTimers(now)
+					continue
+				case task := <-mdd.tasks:
+					task()
+					continue
+				case pkt = <-mdd.isolated:
+				case pkt = <-mdd.packetChan:
+				}
 			}
 
 			if err != nil {
@@ -322,43 +676,15 @@ func (mdd *MDD) Listen(port int) error {
 				continue
 			}
 
-			assocID := addrToAssoc(pkt.addr)
-
-			//log.Printf("Client --> MD for %v[%v] with [%d] bytes", assocID, pkt.addr, len(pkt.msg))
-
-			// Remember the client if it's new
-			// XXX: Could have an interface to add/remove clients, then
-			//      just filter unknown clients here.
-			if _, ok := mdd.clients[assocID]; !ok {
-				mdd.clients[assocID] = pkt.addr
-				mdd.recvSessions[assocID] = rtp.NewRTPSession(false)
-				mdd.sendSessions[assocID] = rtp.NewRTPSession(false)
+			sampled := mdd.latency.sample()
+			mdd.process(pkt)
+			mdd.loopPackets += 1
+			if sampled {
+				mdd.latency.record(time.Since(pkt.recvTime))
 			}
-
-			// XXX: For now, all packets are re-broadcast, which means
-			// this will only really work in cases where there are only
-			// two clients.
-			//
-			// XXX: DTLS packets can be routed to a local DTLS stack as
-			// soon as we have one, and can get the keys out to
-			// re-encrypt.
-			//
-			// XXX: Handling STUN locally will require routing SDP
-			// offer/answer via the MD, so that it can grab the ICE ufrag
-			// and password and use them to synthesize STUN responses.
-			switch packetClass(pkt.msg) {
-			case packetClassDTLS:
-				mdd.handleDTLS(assocID, pkt.msg)
-			case packetClassSRTP:
-				mdd.handleSRTP(assocID, pkt.msg)
-			case packetClassSTUN:
-				mdd.handleSTUN(pkt.addr, pkt.msg)
-			case packetClassHBHKey:
-				mdd.handleHBHKey(assocID, pkt.msg)
-			case packetClassSRTCP:
-				mdd.handleSRTCP(assocID, pkt.msg)
-			default:
-				log.Printf("Unknown packet type received")
+			mdd.flushRTCP(time.Now())
+			if mdd.updateIdle() {
+				expiry.Reset(mdd.expiryInterval())
 			}
 		}
 	}(mdd)
@@ -366,17 +692,175 @@ func (mdd *MDD) Listen(port int) error {
 	return nil
 }
 
-func (mdd *MDD) Send(assocID AssociationID, msg []byte) error {
-	addr, ok := mdd.clients[assocID]
-	// log.Printf("Client <-- MD for %v[%v] with [%d] bytes", assocID, addr, len(msg))
+func (mdd *MDD) process(pkt packet) {
+	class := packetClass(pkt.msg)
+	assocID, err := mdd.pathAssoc(pkt.addr, class, pkt.msg, pkt.recvTime)
+	if err != nil {
+		log.Printf("Dropping packet from %v: %v", pkt.addr, err)
+		return
+	}
+	if pkt.socket != nil && !mdd.fromMember(assocID, pkt) {
+		return
+	}
+
+	//log.Printf("Client --> MD for %v[%v] with [%d] bytes", assocID, pkt.addr, len(pkt.msg))
+
+	// Remember the client if it's new, if there's room for it
+	assoc, ok := mdd.assocs.get(assocID)
 	if !ok {
-		return fmt.Errorf("Unknown client [%04x]", assocID)
+		assoc = mdd.admitClient(assocID)
+		if assoc == nil {
+			return
+		}
+	}
+	if assoc.addr == nil {
+		mdd.mu.Lock()
+		assoc.addr = pkt.addr
+		mdd.mu.Unlock()
+	} else if class != packetClassSTUN {
+		mdd.checkPath(assoc, pkt.addr)
+	}
+
+	mdd.countIn(assoc, class, pkt)
+	if class == packetClassSRTP {
+		mdd.checkSpeaker(assoc.conf, pkt.recvTime)
+	}
+
+	trace := mdd.startTrace(assocID, packetSSRC(class, pkt.msg))
+	trace.log("classify", "%v packet of %d bytes from %v", class, len(pkt.msg), pkt.addr)
+
+	if class != packetClassSTUN && !mdd.admitTenantTraffic(assoc, len(pkt.msg), pkt.recvTime) {
+		trace.log("route", "dropped over tenant bitrate quota")
+		return
+	}
+
+	if !mdd.conformsOnArrival(class, pkt.msg, trace) {
+		return
+	}
+
+	if class == packetClassSRTP && mdd.downgraded(assoc) {
+		trace.log("route", "dropped without double encryption")
+		return
+	}
+
+	if class == packetClassSRTP && mdd.disallowedPayloadType(assoc, pkt.msg) {
+		trace.log("route", "dropped for a payload type the conference doesn't allow")
+		return
+	}
+
+	if class != packetClassSTUN && mdd.mode(assoc) == ModeRelay {
+		mdd.relay(assoc, class, pkt.msg, trace)
+		return
+	}
+
+	// Media is fanned out per stream to the receivers in the sender's
+	// conference that want it (see subscribers), RTCP reports to the
+	// receivers and senders they concern, and feedback to the sender of
+	// the media it is about.
+	//
+	// XXX: DTLS packets can be routed to a local DTLS stack as
+	// soon as we have one, and can get the keys out to
+	// re-encrypt.
+	//
+	// STUN is answered here, by the STUN workers, with the ICE credentials
+	// signaling gave the MD (SetICECredentials) or its AuthProvider.
+	switch class {
+	case packetClassDTLS:
+		mdd.handleDTLS(assoc, pkt.msg, trace)
+	case packetClassSRTP:
+		mdd.handleSRTP(assoc, pkt.msg, pkt.recvTime, trace)
+	case packetClassSTUN:
+		mdd.dispatchSTUN(assoc, pkt.addr, pkt.msg)
+	case packetClassHBHKey:
+		mdd.handleHBHKey(assocID, pkt.msg)
+	case packetClassSRTCP:
+		mdd.handleSRTCP(assoc, pkt.msg, trace)
+	default:
+		mdd.unknown.record(pkt.addr, pkt.msg, pkt.recvTime)
+		trace.log("route", "dropped unknown packet")
+	}
+}
+
+// Sends a packet to a client over whichever transport it arrived on, giving
+// up at the write deadline
+func (mdd *MDD) writeTo(msg []byte, addr net.Addr) (int, error) {
+	deadline := mdd.writeDeadline()
+	if mdd.streams != nil {
+		if stream, ok := mdd.streams.lookup(addr); ok {
+			return stream.write(msg, deadline)
+		}
+	}
+
+	conn := mdd.socketFor(addr)
+	if conn == nil {
+		conn = mdd.transport()
+	}
+	if dc, ok := conn.(interface{ SetWriteDeadline(time.Time) error }); ok && !deadline.IsZero() {
+		dc.SetWriteDeadline(deadline)
+	}
+	return conn.WriteTo(msg, addr)
+}
+
+// Sends a packet to an association, keeping its counters and egress health
+// up to date.  Packets shed because the association is congested are not
+// errors; other failures are returned as a *SendError.
+func (mdd *MDD) sendTo(assoc *association, msg []byte) error {
+	now := time.Now()
+	mdd.mu.Lock()
+	shed := mdd.shed(assoc, msg, now)
+	if shed {
+		assoc.stats.shed += 1
+	}
+	mdd.mu.Unlock()
+	if shed {
+		return nil
 	}
 
-	_, err := mdd.conn.WriteToUDP(msg, addr)
+	if mdd.SendQueueLength > 0 {
+		mdd.mu.Lock()
+		mdd.enqueue(assoc, msg)
+		mdd.mu.Unlock()
+		return nil
+	}
+	return mdd.deliver(assoc, assoc.addr, msg)
+}
+
+// Writes a packet to an association, and accounts for it
+func (mdd *MDD) deliver(assoc *association, addr net.Addr, msg []byte) error {
+	now := time.Now()
+	_, err := mdd.writeTo(msg, addr)
+	mdd.countOut(assoc, len(msg), err)
+
+	mdd.mu.Lock()
+	state, changed, firstError := mdd.updateHealth(assoc, err, now)
+	if err == nil {
+		assoc.countSent(msg)
+	}
+	mdd.mu.Unlock()
+
+	if err != nil {
+		sendErr := &SendError{Assoc: assoc.id, Conf: assoc.conf, Err: err}
+		if firstError {
+			mdd.reportSendError(sendErr)
+		}
+		err = sendErr
+	}
+	if changed {
+		mdd.reportHealth(assoc, state)
+	}
 	return err
 }
 
+func (mdd *MDD) Send(assocID AssociationID, msg []byte) error {
+	assoc, ok := mdd.assocs.get(assocID)
+	// log.Printf("Client <-- MD for %v with [%d] bytes", assocID, len(msg))
+	if !ok || assoc.addr == nil {
+		return fmt.Errorf("Unknown client [%04x]", assocID)
+	}
+
+	return mdd.sendTo(assoc, msg)
+}
+
 func (mdd *MDD) SetKeys(assocID AssociationID, keys HBHKeys) error {
 	var cipher rtp.CipherID
 	switch rtp.CipherID(keys.Profile) {
@@ -385,49 +869,71 @@ func (mdd *MDD) SetKeys(assocID AssociationID, keys HBHKeys) error {
 	case rtp.DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM:
 		cipher = rtp.SRTP_AEAD_AES_256_GCM
 	default:
-		return fmt.Errorf("Unsupported SRTP protection profile")
-	}
-
-	// Set up receive session
-	recvSession, ok := mdd.recvSessions[assocID]
-	if !ok {
-		return fmt.Errorf("Got SetKeys without an RTP session")
-	}
-
-	log.Printf(" --- MD setting SRTP recv key for [%04x]: %x %x",
-		assocID, keys.ClientWriteKey, keys.MasterSalt)
-
-	err := recvSession.SetSRTP(cipher, true, keys.ClientWriteKey, keys.MasterSalt)
-	if err != nil {
-		log.Printf("Error setting session read key: %v", err)
+		err := fmt.Errorf("Unsupported SRTP protection profile %v", keys.Profile)
+		mdd.auditKey(keyAuditRecord{action: keyRejected, assoc: assocID, profile: keys.Profile, source: keySourceKD, err: err})
 		return err
 	}
 
-	// Set up send session
-	sendSession, ok := mdd.sendSessions[assocID]
+	assoc, ok := mdd.assocs.get(assocID)
 	if !ok {
-		return fmt.Errorf("Got SetKeys without an RTP session")
+		err := fmt.Errorf("Got SetKeys without an RTP session")
+		mdd.auditKey(keyAuditRecord{action: keyRejected, assoc: assocID, profile: keys.Profile, source: keySourceKD, err: err})
+		return err
 	}
 
-	log.Printf(" --- MD setting SRTP setnd key for [%04x]: %x %x",
-		assocID, keys.ServerWriteKey, keys.MasterSalt)
+	mdd.auditKey(keyAuditRecord{action: keyReceived, assoc: assocID, conf: assoc.conf, epoch: assoc.keyEpoch, profile: keys.Profile, source: keySourceKD})
+	log.Printf(" --- MD setting %v keys for [%04x]", keys.Profile, assocID)
 
-	err = sendSession.SetSRTP(cipher, true, keys.ServerWriteKey, keys.MasterSalt)
+	err := mdd.setSRTP(assoc, cipher, keys.ClientWriteKey, keys.MasterSalt, keys.ServerWriteKey, keys.MasterSalt)
 	if err != nil {
-		log.Printf("Error setting session read key: %v", err)
+		mdd.auditKey(keyAuditRecord{action: keyRejected, assoc: assocID, conf: assoc.conf, epoch: assoc.keyEpoch, profile: keys.Profile, source: keySourceKD, err: err})
 		return err
 	}
 
-	mdd.keys[assocID] = keys
+	mdd.mu.Lock()
+	assoc.profile = keys.Profile
+	assoc.keys = &keys
+	mdd.mu.Unlock()
+
+	mdd.keysInstalled(assoc, keys.Profile, keySourceKD)
+	mdd.escrowKeys(assoc, keys.Profile, keySourceKD, keys.ClientWriteKey, keys.MasterSalt, keys.ServerWriteKey, keys.MasterSalt)
 	return nil
 }
 
 func (mdd *MDD) Stop() {
+	close(mdd.quit)
 	mdd.stopChan <- true
 	<-mdd.doneChan
 
-	mdd.conn.Close()
+	mdd.mu.Lock()
+	assocs := mdd.assocs.snapshot()
+	sockets := []*confSocket{}
+	for _, conf := range mdd.conferences {
+		if conf.socket != nil {
+			sockets = append(sockets, conf.socket)
+		}
+	}
+	mdd.mu.Unlock()
+	for _, assoc := range assocs {
+		mdd.closeQueue(assoc)
+	}
+	for _, sock := range sockets {
+		mdd.closeSocket(sock)
+	}
+
+	mdd.transport().Close()
+	mdd.mu.Lock()
+	for _, assoc := range assocs {
+		if assoc.dtls != nil {
+			assoc.dtls.Close()
+		}
+	}
+	mdd.mu.Unlock()
+	if mdd.streams != nil {
+		mdd.streams.close()
+	}
 
-	// Avoid race conditions
-	<-time.After(10 * time.Millisecond)
+	// With the sockets closed, the readers return, and the STUN workers
+	// have seen quit
+	mdd.workers.Wait()
 }
@@ -1,332 +1,580 @@
 package percy
 
-// TODO Re-enable unit tests
-/*
 import (
-	"fmt"
+	"bytes"
+	"net"
 	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+const (
+	mddAddr       = "10.0.0.100:4430"
+	packetTimeout = 100 * time.Millisecond
 )
 
 type Client struct {
-	RecvChan chan []byte
-
-	name       string
-	clientAddr *net.UDPAddr
-	serverAddr *net.UDPAddr
-	conn       *net.UDPConn
-	stopChan   chan bool
-	doneChan   chan bool
-	packetChan chan packet
+	conn   *testnet.Conn
+	server net.Addr
 }
 
-func NewClient(name string, clientPort, serverPort int) (*Client, error) {
-	c := new(Client)
-	c.RecvChan = make(chan []byte, 10)
-	c.name = name
-	c.clientAddr = &net.UDPAddr{Port: clientPort}
-	c.serverAddr = &net.UDPAddr{Port: serverPort}
-
-	c.stopChan = make(chan bool, 1)
-	c.doneChan = make(chan bool, 1)
-
-	var err error
-	c.conn, err = net.DialUDP("udp", c.clientAddr, c.serverAddr)
+func NewClient(network *testnet.Network, addr string) (*Client, error) {
+	conn, err := network.Listen(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	return c, nil
+	server, _ := net.ResolveUDPAddr("udp", mddAddr)
+	return &Client{conn: conn, server: server}, nil
 }
 
-func (c *Client) Listen() error {
-
-	c.packetChan = make(chan packet, 10)
-
-	go func(packetChan chan packet) {
-		buf := make([]byte, 2048)
-
-		for {
-			n, addr, err := c.conn.ReadFromUDP(buf)
-
-			if err == nil {
-				packetChan <- packet{addr: addr, msg: buf[:n]}
-			}
-			// TODO log errors
-		}
-	}(c.packetChan)
-
-	go func(c *Client) {
-		for {
-			var pkt packet
-
-			select {
-			case <-c.stopChan:
-				c.doneChan <- true
-				return
-			case pkt = <-c.packetChan:
-				c.RecvChan <- pkt.msg
-			case <-time.After(pause):
-			}
-		}
-	}(c)
-
-	return nil
+func (c *Client) Assoc() AssociationID {
+	return addrToAssoc(c.conn.LocalAddr())
 }
 
 func (c *Client) Write(msg []byte) error {
-	_, err := c.conn.Write(msg)
+	_, err := c.conn.WriteTo(msg, c.server)
 	return err
 }
 
-func (c *Client) Stop() {
-	c.stopChan <- true
-	<-c.doneChan
-	c.conn.Close()
-}
-
-type CountTunnel struct {
-	sendCount             int
-	sendWithProfilesCount int
+func (c *Client) Recv() ([]byte, error) {
+	buf := make([]byte, 2048)
+	c.conn.SetReadDeadline(time.Now().Add(packetTimeout))
+	n, _, err := c.conn.ReadFrom(buf)
+	return buf[:n], err
 }
 
-func (tun *CountTunnel) Send(assoc AssociationID, msg []byte) error {
-	tun.sendCount += 1
-	return nil
+func (c *Client) Stop() {
+	c.conn.Close()
 }
 
-func (tun *CountTunnel) SendWithProfiles(assoc AssociationID, msg []byte, profiles []ProtectionProfile) error {
-	tun.sendWithProfilesCount += 1
-	return nil
+func newTestMDD(t *testing.T, network *testnet.Network) *MDD {
+	mdd := NewMDD()
+	err := mdd.ListenTransport(func() (Transport, error) {
+		return network.Listen(mddAddr)
+	})
+	if err != nil {
+		t.Fatalf("Error starting MDD: %v", err)
+	}
+	return mdd
 }
 
-/////
+// Joins a client at each address, as far as the KD hearing from it, and
+// gives them all keys.  The clients are stopped when the test ends.
+func newKeyedClients(t *testing.T, network *testnet.Network, mdd *MDD, addrs ...string) []*Client {
+	kd := make(MDDChan, 10)
+	mdd.KD = kd
+
+	clients := []*Client{}
+	for _, addr := range addrs {
+		client, err := NewClient(network, addr)
+		if err != nil {
+			t.Fatalf("Error creating client: %v", err)
+		}
+		t.Cleanup(client.Stop)
+		clients = append(clients, client)
 
-func caller() string {
-	_, file, line, _ := runtime.Caller(2)
-	splits := strings.Split(file, "/")
-	filename := splits[len(splits)-1]
-	return fmt.Sprintf("%s:%d:", filename, line)
-}
+		client.Write([]byte{0x16, 0xfe, 0xfd, 0x00})
+		<-kd
+	}
 
-func AssertNotNil(t *testing.T, obj interface{}, message string) {
-	if obj == nil {
-		t.Fatalf("%s %s", caller(), message)
+	keys := HBHKeys{Profile: DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM}
+	done := make(chan error, len(clients))
+	mdd.runOnLoop(func() {
+		for _, client := range clients {
+			done <- mdd.SetKeys(client.Assoc(), keys)
+		}
+	})
+	for range clients {
+		if err := <-done; err != nil {
+			t.Fatalf("Error setting keys: %v", err)
+		}
 	}
+	return clients
 }
 
-func AssertNotError(t *testing.T, err error, message string) {
+func AssertRecvPacket(t *testing.T, c *Client, msg []byte, message string) {
+	pkt, err := c.Recv()
 	if err != nil {
-		t.Fatalf("%s %s: %s", caller(), message, err)
+		t.Fatalf("%s: %v", message, err)
+	}
+	if !bytes.Equal(pkt, msg) {
+		t.Fatalf("%s: [%x] != [%x]", message, pkt, msg)
 	}
 }
 
-func AssertEquals(t *testing.T, one interface{}, two interface{}) {
-	if one != two {
-		t.Fatalf("%s [%v] != [%v]", caller(), one, two)
+func AssertNotRecvPacket(t *testing.T, c *Client, message string) {
+	pkt, err := c.Recv()
+	if err == nil {
+		t.Fatalf("%s: [%x]", message, pkt)
 	}
 }
 
-const packetTimeout = 1000 * time.Millisecond
+func TestDTLSForwarding(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	kd := make(MDDChan, 10)
+	mdd.KD = kd
+
+	client, err := NewClient(network, "10.0.0.1:5000")
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	defer client.Stop()
+
+	// Forward direction
+	dtlsPacket := []byte{0x16, 0xfe, 0xfd, 0x00}
+	client.Write(dtlsPacket)
 
-func AssertRecvPacket(t *testing.T, c *Client, msg []byte, message string) {
 	select {
-	case packet := <-c.RecvChan:
-		if cmp := bytes.Compare(msg, packet); cmp != 0 {
-			t.Fatalf("%s %s: [%x] != [%x] ~ [%d]", caller(), message, msg, packet, cmp)
+	case pkt := <-kd:
+		if pkt.assocID != client.Assoc() {
+			t.Fatalf("Incorrect association ID: %04x != %04x", pkt.assocID, client.Assoc())
+		}
+		if !bytes.Equal(pkt.msg, dtlsPacket) {
+			t.Fatalf("Incorrect DTLS packet: %x != %x", pkt.msg, dtlsPacket)
 		}
 	case <-time.After(packetTimeout):
-		t.Fatalf("%s %s: %s", caller(), message, "timeout")
+		t.Fatalf("DTLS packet was not forwarded to the KD")
 	}
-}
 
-func AssertNotRecvPacket(t *testing.T, c *Client, message string) {
-	select {
-	case <-c.RecvChan:
-		t.Fatalf("%s %s: %s", caller(), "Should not have received a packet")
-	case <-time.After(packetTimeout):
+	// Reverse direction
+	dtlsPacket = []byte{0x16, 0xfe, 0xfd, 0x01}
+	err = mdd.Send(client.Assoc(), dtlsPacket)
+	if err != nil {
+		t.Fatalf("Error sending to client: %v", err)
+	}
+	AssertRecvPacket(t, client, dtlsPacket, "DTLS packet was not forwarded to the client")
+
+	err = mdd.Send(client.Assoc()+1, dtlsPacket)
+	if err == nil {
+		t.Fatalf("Sent to an unknown association")
 	}
 }
 
-/////
+func TestDiscrimination(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
 
-var (
-	// XXX: If you make nClients too big, you run into race
-	// conditions with the n^2 tests
-	nClients       = 10
-	pause          = 10 * time.Millisecond
-	serverPort     = 8888
-	clientBasePort = 9999
-)
+	kd := make(MDDChan, 10)
+	mdd.KD = kd
 
-func TestRTPForwarding(t *testing.T) {
-	// Set up the server
-	mdd := NewMDD(&CountTunnel{})
-	err := mdd.Listen(serverPort)
-	AssertNotError(t, err, "Error creating MDD")
+	client1, _ := NewClient(network, "10.0.0.1:5000")
+	defer client1.Stop()
+	client2, _ := NewClient(network, "10.0.0.2:5000")
+	defer client2.Stop()
+
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	client1.Write(hello)
+	<-kd
+	client2.Write(hello)
+	<-kd
+
+	AssertNotRecvPacket(t, client1, "DTLS packet forwarded to other client")
+
+	dtlsPacket := []byte{0x16, 0xfe, 0xfd, 0x01}
+	mdd.Send(client1.Assoc(), dtlsPacket)
+	AssertRecvPacket(t, client1, dtlsPacket, "DTLS packet was not forwarded")
+	AssertNotRecvPacket(t, client2, "DTLS packet forwarded to other client")
+
+	dtlsPacket = []byte{0x16, 0xfe, 0xfd, 0x02}
+	mdd.Send(client2.Assoc(), dtlsPacket)
+	AssertRecvPacket(t, client2, dtlsPacket, "DTLS packet was not forwarded")
+	AssertNotRecvPacket(t, client1, "DTLS packet forwarded to other client")
+}
+
+func TestSTUNBinding(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
 	defer mdd.Stop()
 
-	// Start up a bunch of clients
-	clients := make([]*Client, nClients)
-	for i := range clients {
-		port := 9999 + i
-		clients[i], err = NewClient("c"+strconv.Itoa(i), port, serverPort)
-		AssertNotError(t, err, fmt.Sprintf("Error creating client %d", i))
-		clients[i].Listen()
-		defer clients[i].Stop()
+	auth := NewMemoryAuthProvider()
+	auth.SetICEPassword("local", "abcdefabcdefabcdefabcdef")
+	mdd.Auth = auth
+
+	client, _ := NewClient(network, "10.0.0.1:5000")
+	defer client.Stop()
+
+	for ufrag, expected := range map[string]MessageType{"local": MSG_TYPE_SUCCESS, "bogus": MSG_TYPE_ERROR} {
+		request := NewBindingRequest(TransactionID{1, 2, 3}, "abcdefabcdefabcdefabcdef")
+		request.Add(ATTR_USERNAME, []byte(ufrag+":remote"))
+		request.AddMessageIntegrity()
+		msg, _ := request.Serialize()
+		client.Write(msg)
+
+		msg, err := client.Recv()
+		if err != nil {
+			t.Fatalf("No STUN response for %s: %v", ufrag, err)
+		}
+
+		response, err := ParseSTUN(msg)
+		if err != nil {
+			t.Fatalf("Error parsing STUN response: %v", err)
+		}
+		if response.msgType != expected {
+			t.Fatalf("Incorrect response type for %s: %v", ufrag, response.msgType)
+		}
+		if expected == MSG_TYPE_SUCCESS {
+			if !CheckMessageIntegrity(msg, "abcdefabcdefabcdefabcdef") {
+				t.Fatalf("Invalid MESSAGE-INTEGRITY in response")
+			}
+			if !CheckFingerprint(msg) {
+				t.Fatalf("Invalid FINGERPRINT in response")
+			}
+		}
 	}
 
-	// Verify that previous clients hear new clients when they join
-	for i, sender := range clients {
-		srtpPacket := []byte{128, 0, byte(i)}
-		sender.Write(srtpPacket)
+	var ice *ICEStats
+	for _, assoc := range mdd.StatsSnapshot().Associations {
+		if assoc.ID == client.Assoc() {
+			ice = assoc.ICE
+		}
+	}
+	if ice == nil || ice.Checks != 2 || ice.Succeeded != 1 || ice.LastFailure != "unknown ufrag bogus" {
+		t.Fatalf("Incorrect ICE stats: %+v", ice)
+	}
+	if ice.ConsentExpiresIn <= 0 || ice.ConsentExpiresIn > consentTimeout {
+		t.Fatalf("Incorrect consent expiry: %v", ice.ConsentExpiresIn)
+	}
+}
 
-		for j := 0; j < i; j += 1 {
-			AssertRecvPacket(t, clients[j], srtpPacket,
-				fmt.Sprintf("Failed to forward c%d->c%d", i, j))
+func TestPerAssociationICECredentials(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	client, _ := NewClient(network, "10.0.0.1:5000")
+	defer client.Stop()
+	mdd.SetICECredentials(client.Assoc(), "assoc", "0123456789abcdef01234567")
+
+	cases := []struct {
+		ufrag    string
+		password string
+		expected MessageType
+	}{
+		{"assoc", "0123456789abcdef01234567", MSG_TYPE_SUCCESS},
+		{"assoc", "abcdefabcdefabcdefabcdef", MSG_TYPE_ERROR},
+		{"local", "abcdefabcdefabcdefabcdef", MSG_TYPE_ERROR},
+	}
+
+	for _, c := range cases {
+		request := NewBindingRequest(TransactionID{4, 5, 6}, c.password)
+		request.Add(ATTR_USERNAME, []byte(c.ufrag+":remote"))
+		request.AddMessageIntegrity()
+		msg, _ := request.Serialize()
+		client.Write(msg)
+
+		msg, err := client.Recv()
+		if err != nil {
+			t.Fatalf("No STUN response for %s: %v", c.ufrag, err)
+		}
+
+		response, err := ParseSTUN(msg)
+		if err != nil {
+			t.Fatalf("Error parsing STUN response: %v", err)
+		}
+		if response.msgType != c.expected {
+			t.Fatalf("Incorrect response type for %s/%s: %v", c.ufrag, c.password, response.msgType)
+		}
+		if c.expected == MSG_TYPE_SUCCESS && !CheckMessageIntegrity(msg, c.password) {
+			t.Fatalf("Response not signed with the association's password")
 		}
 	}
+}
 
-	// Verify that packets from joined clients broadcast to everyone
-	// but the sender
-	for i, sender := range clients {
-		srtpPacket := []byte{128, 1, byte(i)}
-		sender.Write(srtpPacket)
+func TestSTUNRetransmit(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
 
-		<-time.After(10 * time.Millisecond)
+	auth := NewMemoryAuthProvider()
+	auth.SetICEPassword("local", "abcdefabcdefabcdefabcdef")
+	mdd.Auth = auth
 
-		for j := 0; j < i; j += 1 {
-			if i == j {
-				AssertNotRecvPacket(t, clients[j], "Loopback detected")
-				continue
-			}
+	client, _ := NewClient(network, "10.0.0.1:5000")
+	defer client.Stop()
 
-			AssertRecvPacket(t, clients[j], srtpPacket,
-				fmt.Sprintf("Failed to broadcast c%d->c%d", i, j))
+	request := NewBindingRequest(TransactionID{7, 8, 9}, "abcdefabcdefabcdefabcdef")
+	request.Add(ATTR_USERNAME, []byte("local:remote"))
+	request.AddMessageIntegrity()
+	msg, _ := request.Serialize()
+
+	responses := [][]byte{}
+	for i := 0; i < 2; i++ {
+		client.Write(msg)
+		response, err := client.Recv()
+		if err != nil {
+			t.Fatalf("No STUN response to copy %d: %v", i, err)
 		}
+		responses = append(responses, response)
+	}
+
+	if !bytes.Equal(responses[0], responses[1]) {
+		t.Fatalf("Retransmit got a different response")
+	}
+	if cached := mdd.StatsSnapshot().Global.STUNCached; cached != 1 {
+		t.Fatalf("Incorrect cached response count: %d", cached)
 	}
 }
 
-func TestDTLSForwarding(t *testing.T) {
-	// Set up the server and a client
-	tun := &CountTunnel{sendCount: 0, sendWithProfilesCount: 0}
-	mdd := NewMDD(tun)
-	err := mdd.Listen(serverPort)
-	AssertNotError(t, err, "Error creating MDD")
+func TestRelayMode(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
 	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
 
-	client, err := NewClient("cDTLS", clientBasePort, serverPort)
-	AssertNotError(t, err, "Error creating Client")
-	client.Listen()
+	client1, _ := NewClient(network, "10.0.0.1:5000")
+	defer client1.Stop()
+	client2, _ := NewClient(network, "10.0.0.2:5000")
+	defer client2.Stop()
+
+	// Neither client has keys, and there is no KD; everything is relayed
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	client1.Write(hello)
+	AssertNotRecvPacket(t, client2, "Packet relayed before the receiver was known")
+
+	client2.Write(hello)
+	AssertRecvPacket(t, client1, hello, "DTLS packet was not relayed")
+
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	client1.Write(srtpPacket)
+	AssertRecvPacket(t, client2, srtpPacket, "SRTP packet was not relayed")
+	AssertNotRecvPacket(t, client1, "SRTP packet relayed back to the sender")
+}
+
+func TestModeWhileAddingConferences(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+
+	client1, _ := NewClient(network, "10.0.0.1:5000")
+	defer client1.Stop()
+	client2, _ := NewClient(network, "10.0.0.2:5000")
+	defer client2.Stop()
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	client1.Write(hello)
+	client2.Write(hello)
+	AssertRecvPacket(t, client1, hello, "DTLS packet was not relayed")
+
+	// The loop looks modes up for every packet while conferences are added
+	// (with -race, this caught unlocked reads of the conference map)
+	done := make(chan bool)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			mdd.SetConferenceMode(ConfID(i), ModePERC)
+		}
+		done <- true
+	}()
+
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	for i := 0; i < 20; i++ {
+		client1.Write(srtpPacket)
+		AssertRecvPacket(t, client2, srtpPacket, "SRTP packet was not relayed")
+	}
+	<-done
+}
+
+func TestTunnelWhileAddingConferences(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	kd := make(MDDChan, 10)
+	mdd.KD = kd
+
+	client, _ := NewClient(network, "10.0.0.1:5000")
 	defer client.Stop()
 
-	// Test forward direction (ClientHello)
-	dtlsPacket := bytes.Repeat([]byte{0}, 14)
-	dtlsPacket[0] = 0x16
-	dtlsPacket[13] = 0x01
-	err = client.Write(dtlsPacket)
-	AssertNotError(t, err, "Error sending DTLS packet")
-	<-time.After(pause)
-	AssertEquals(t, tun.sendWithProfilesCount, 1)
-
-	// Test forward direction (non-ClientHello)
-	dtlsPacket = []byte{0x16, 0x00}
-	err = client.Write(dtlsPacket)
-	AssertNotError(t, err, "Error sending DTLS packet")
-	<-time.After(pause)
-	AssertEquals(t, tun.sendCount, 1)
-
-	// Grab the association ID for our client
-	var assoc AssociationID
-	for clientID := range mdd.clients {
-		assoc, err = stringToAssoc(clientID)
-		AssertNotError(t, err, "MDD provisioned an invalid client ID")
+	// DTLS looks up the conference's tunnel while other conferences get
+	// their own
+	done := make(chan bool)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			mdd.SetConferenceTunnel(ConfID(i), make(MDDChan, 10))
+		}
+		done <- true
+	}()
+
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	for i := 0; i < 20; i++ {
+		client.Write(hello)
+		<-kd
 	}
+	<-done
+}
+
+func TestConferencePause(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+
+	client1, _ := NewClient(network, "10.0.0.1:5000")
+	defer client1.Stop()
+	client2, _ := NewClient(network, "10.0.0.2:5000")
+	defer client2.Stop()
+
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	client1.Write(hello)
+	client2.Write(hello)
+	AssertRecvPacket(t, client1, hello, "DTLS packet was not relayed")
 
-	// Test reverse direction (no keys)
-	dtlsPacket = []byte{0x16, 0x01}
-	mdd.Send(assoc, dtlsPacket)
-	AssertRecvPacket(t, client, dtlsPacket, "DTLS packet was not forwarded")
-
-	// Test reverse direction (keys)
-	dtlsPacket = []byte{0x16, 0x02}
-	keys := SRTPKeys{}
-	profile := ProtectionProfile(0xff)
-	mdd.SendWithKeys(assoc, dtlsPacket, profile, keys)
-	AssertRecvPacket(t, client, dtlsPacket, "DTLS packet was not forwarded with keys")
-	AssertEquals(t, mdd.profile, profile)
-	AssertNotNil(t, mdd.keys, "MDD failed to set keys")
+	// DTLS keeps flowing while media is held
+	mdd.PauseConference(DefaultConfID)
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	client1.Write(srtpPacket)
+	AssertNotRecvPacket(t, client2, "SRTP packet relayed while paused")
+	client2.Write(hello)
+	AssertRecvPacket(t, client1, hello, "DTLS packet was not relayed while paused")
+
+	mdd.ResumeConference(DefaultConfID)
+	client1.Write(srtpPacket)
+	AssertRecvPacket(t, client2, srtpPacket, "SRTP packet was not relayed after resuming")
 }
 
-func TestDiscrimination(t *testing.T) {
-	// Set up the server
-	tun := &CountTunnel{sendCount: 0, sendWithProfilesCount: 0}
-	mdd := NewMDD(tun)
-	err := mdd.Listen(serverPort)
-	AssertNotError(t, err, "Error creating MDD")
+func TestPauseWhileAddingConferences(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
 	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
 
-	// Set up first client
-	client1, err := NewClient("cDTLS", clientBasePort, serverPort)
-	AssertNotError(t, err, "Error creating Client")
-	client1.Listen()
+	client1, _ := NewClient(network, "10.0.0.1:5000")
 	defer client1.Stop()
+	client2, _ := NewClient(network, "10.0.0.2:5000")
+	defer client2.Stop()
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	client1.Write(hello)
+	client2.Write(hello)
+	AssertRecvPacket(t, client1, hello, "DTLS packet was not relayed")
+
+	// Every media packet checks whether its conference is paused while
+	// other conferences are added and paused
+	done := make(chan bool)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			mdd.PauseConference(ConfID(i))
+		}
+		done <- true
+	}()
 
-	// Have client send a ClientHello and verify that it goes through
-	clientHelloPacket := bytes.Repeat([]byte{0}, 14)
-	clientHelloPacket[0] = 0x16
-	clientHelloPacket[13] = 0x01
-	err = client1.Write(clientHelloPacket)
-	<-time.After(pause)
-	AssertEquals(t, tun.sendWithProfilesCount, 1)
-	AssertEquals(t, tun.sendCount, 0)
-
-	// Grab the association ID for client 1
-	var client1ID string
-	var client1Assoc AssociationID
-	for clientID := range mdd.clients {
-		client1ID = clientID
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	for i := 0; i < 20; i++ {
+		client1.Write(srtpPacket)
+		AssertRecvPacket(t, client2, srtpPacket, "SRTP packet was not relayed")
 	}
-	client1Assoc, err = stringToAssoc(client1ID)
-	AssertNotError(t, err, "MDD provisioned an invalid client ID")
+	<-done
+}
+
+func TestDataChannelPolicy(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
 
-	// Set up second client
-	client2, err := NewClient("cDTLS", clientBasePort+1, serverPort)
-	AssertNotError(t, err, "Error creating Client")
-	client2.Listen()
+	client1, _ := NewClient(network, "10.0.0.1:5000")
+	defer client1.Stop()
+	client2, _ := NewClient(network, "10.0.0.2:5000")
 	defer client2.Stop()
 
-	err = client2.Write(clientHelloPacket)
-	<-time.After(pause)
-	AssertEquals(t, tun.sendWithProfilesCount, 2)
-	AssertEquals(t, tun.sendCount, 0)
-	AssertNotRecvPacket(t, client1, "DTLS packet forwarded to other client")
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	client1.Write(hello)
+	client2.Write(hello)
+	AssertRecvPacket(t, client1, hello, "DTLS packet was not relayed")
+
+	data := []byte{0x17, 0xfe, 0xfd, 0x00, 0x01}
+	client1.Write(data)
+	AssertNotRecvPacket(t, client2, "Data channel record relayed by default")
+
+	mdd.SetConferenceDataChannels(DefaultConfID, DataChannelRelay)
+	client1.Write(data)
+	AssertRecvPacket(t, client2, data, "Data channel record was not relayed")
+
+	// With a third participant, point-to-point relay has nowhere to go,
+	// but fan-out reaches everyone
+	client3, _ := NewClient(network, "10.0.0.3:5000")
+	defer client3.Stop()
+	client3.Write(hello)
+	AssertRecvPacket(t, client1, hello, "DTLS packet was not relayed")
+	AssertRecvPacket(t, client2, hello, "DTLS packet was not relayed")
+
+	client1.Write(data)
+	AssertNotRecvPacket(t, client2, "Data channel record relayed with several peers")
+
+	mdd.SetConferenceDataChannels(DefaultConfID, DataChannelFanOut)
+	client1.Write(data)
+	AssertRecvPacket(t, client2, data, "Data channel record was not fanned out")
+	AssertRecvPacket(t, client3, data, "Data channel record was not fanned out")
+	AssertNotRecvPacket(t, client1, "Data channel record fanned out to the sender")
+}
 
-	var client2ID string
-	var client2Assoc AssociationID
-	for clientID := range mdd.clients {
-		if clientID != client1ID {
-			client2ID = clientID
+func TestDataChannelsWhileAddingConferences(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+	mdd.SetConferenceDataChannels(DefaultConfID, DataChannelRelay)
+
+	client1, _ := NewClient(network, "10.0.0.1:5000")
+	defer client1.Stop()
+	client2, _ := NewClient(network, "10.0.0.2:5000")
+	defer client2.Stop()
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	client1.Write(hello)
+	client2.Write(hello)
+	AssertRecvPacket(t, client1, hello, "DTLS packet was not relayed")
+
+	// Every data channel record looks its policy up while conferences are
+	// added
+	done := make(chan bool)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			mdd.SetConferenceDataChannels(ConfID(i), DataChannelFanOut)
 		}
+		done <- true
+	}()
+
+	data := []byte{0x17, 0xfe, 0xfd, 0x00, 0x01}
+	for i := 0; i < 20; i++ {
+		client1.Write(data)
+		AssertRecvPacket(t, client2, data, "Data channel record was not relayed")
 	}
-	client2Assoc, err = stringToAssoc(client2ID)
-	AssertNotError(t, err, "MDD provisioned an invalid client ID")
+	<-done
+}
 
-	// Test RTP forwarding
-	srtpPacket := []byte{128, 1, 0}
-	client1.Write(srtpPacket)
-	AssertRecvPacket(t, client2, srtpPacket, "SRTP packet not forwarded")
-	AssertNotRecvPacket(t, client1, "SRTP packet forwarded to sender")
+func TestLoopback(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
 
-	// Test DTLS to client 1
-	dtlsPacket := []byte{0x16, 0x01}
-	mdd.Send(client1Assoc, dtlsPacket)
-	AssertRecvPacket(t, client1, dtlsPacket, "DTLS packet was not forwarded")
-	AssertNotRecvPacket(t, client2, "DTLS packet forwarded to other client")
+	kd := make(MDDChan, 10)
+	mdd.KD = kd
 
-	// Test DTLS to client 2
-	dtlsPacket = []byte{0x16, 0x01}
-	mdd.Send(client2Assoc, dtlsPacket)
-	AssertRecvPacket(t, client2, dtlsPacket, "DTLS packet was not forwarded")
-	AssertNotRecvPacket(t, client1, "DTLS packet forwarded to other client")
+	client1, _ := NewClient(network, "10.0.0.1:5000")
+	defer client1.Stop()
+	client2, _ := NewClient(network, "10.0.0.2:5000")
+	defer client2.Stop()
+
+	keys := HBHKeys{Profile: DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM}
+	for _, client := range []*Client{client1, client2} {
+		mdd.SetLoopback(client.Assoc(), client == client1)
+		err := mdd.SetKeys(client.Assoc(), keys)
+		if err != nil {
+			t.Fatalf("Error setting keys: %v", err)
+		}
+		client.Write([]byte{0x16, 0xfe, 0xfd, 0x00})
+		<-kd
+	}
+
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	echo := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0xfe, 0xfd, 0xfc, 0xfb, 0xaa}
+	client1.Write(srtpPacket)
+	AssertRecvPacket(t, client1, echo, "SRTP packet was not reflected with a new SSRC")
+	AssertNotRecvPacket(t, client2, "Loopback packet forwarded to other client")
+
+	client2.Write(srtpPacket)
+	AssertNotRecvPacket(t, client1, "Packet forwarded to loopback client")
 }
-*/
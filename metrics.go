@@ -0,0 +1,139 @@
+package percy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Metrics are rendered from a stats snapshot in the Prometheus text
+// exposition format, so that they are always consistent with StatsSnapshot.
+
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricsWriter) header(name, kind, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
+
+func sortedKeys(counts map[string]uint64) []string {
+	keys := []string{}
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (mdd *MDD) WriteMetrics(w io.Writer) error {
+	snap := mdd.StatsSnapshot()
+	mw := &metricsWriter{w: w}
+
+	mw.header("percy_uptime_seconds", "gauge", "Time since the MD was created")
+	mw.printf("percy_uptime_seconds %f\n", snap.Global.Uptime.Seconds())
+
+	mw.header("percy_associations", "gauge", "Number of known associations")
+	mw.printf("percy_associations %d\n", snap.Global.Associations)
+
+	mw.header("percy_conferences", "gauge", "Number of conferences")
+	mw.printf("percy_conferences %d\n", snap.Global.Conferences)
+
+	mw.header("percy_packets_total", "counter", "Packets handled, by direction")
+	mw.printf("percy_packets_total{direction=\"in\"} %d\n", snap.Global.In.Packets)
+	mw.printf("percy_packets_total{direction=\"out\"} %d\n", snap.Global.Out.Packets)
+
+	mw.header("percy_bytes_total", "counter", "Bytes handled, by direction")
+	mw.printf("percy_bytes_total{direction=\"in\"} %d\n", snap.Global.In.Bytes)
+	mw.printf("percy_bytes_total{direction=\"out\"} %d\n", snap.Global.Out.Bytes)
+
+	mw.header("percy_received_packets_total", "counter", "Packets received, by class")
+	for _, class := range sortedKeys(snap.Global.Classes) {
+		mw.printf("percy_received_packets_total{class=%q} %d\n", class, snap.Global.Classes[class])
+	}
+
+	mw.header("percy_send_errors_total", "counter", "Packets that could not be sent")
+	mw.printf("percy_send_errors_total %d\n", snap.Global.SendErrors)
+
+	mw.header("percy_rollover_decrypts_total", "counter", "Packets that failed with the current keys during a rekey, by whether the previous keys worked")
+	mw.printf("percy_rollover_decrypts_total{result=\"previous\"} %d\n", snap.Global.RolloverDecrypts)
+	mw.printf("percy_rollover_decrypts_total{result=\"failed\"} %d\n", snap.Global.RolloverFailures)
+
+	networks := []string{}
+	for network := range snap.Global.Networks {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	mw.header("percy_network_associations", "gauge", "Associations by the transport and address family of their path")
+	for _, network := range networks {
+		transport, family, _ := strings.Cut(network, "/")
+		mw.printf("percy_network_associations{transport=%q,family=%q} %d\n", transport, family, snap.Global.Networks[network].Associations)
+	}
+	mw.header("percy_network_bytes_total", "counter", "Bytes handled, by the transport and address family of the path, and direction")
+	for _, network := range networks {
+		transport, family, _ := strings.Cut(network, "/")
+		stats := snap.Global.Networks[network]
+		mw.printf("percy_network_bytes_total{transport=%q,family=%q,direction=\"in\"} %d\n", transport, family, stats.In.Bytes)
+		mw.printf("percy_network_bytes_total{transport=%q,family=%q,direction=\"out\"} %d\n", transport, family, stats.Out.Bytes)
+	}
+
+	mw.header("percy_socket_errors_total", "counter", "Socket errors, by operation and class")
+	for _, class := range sortedKeys(snap.Global.ReadErrors) {
+		mw.printf("percy_socket_errors_total{op=\"read\",class=%q} %d\n", class, snap.Global.ReadErrors[class])
+	}
+	for _, class := range sortedKeys(snap.Global.SendClasses) {
+		mw.printf("percy_socket_errors_total{op=\"write\",class=%q} %d\n", class, snap.Global.SendClasses[class])
+	}
+
+	mw.header("percy_association_send_errors_total", "counter", "Packets that could not be sent, by association and class")
+	for _, assoc := range snap.Associations {
+		for _, class := range sortedKeys(assoc.SendClasses) {
+			mw.printf("percy_association_send_errors_total{assoc=\"%04x\",class=%q} %d\n", assoc.ID, class, assoc.SendClasses[class])
+		}
+	}
+
+	latency := snap.Global.Latency
+	mw.header("percy_forwarding_latency_seconds", "gauge", "Percentiles of the sampled time from socket read to last egress write")
+	mw.printf("percy_forwarding_latency_seconds{quantile=\"0.5\"} %f\n", latency.P50.Seconds())
+	mw.printf("percy_forwarding_latency_seconds{quantile=\"0.9\"} %f\n", latency.P90.Seconds())
+	mw.printf("percy_forwarding_latency_seconds{quantile=\"0.99\"} %f\n", latency.P99.Seconds())
+	mw.printf("percy_forwarding_latency_seconds{quantile=\"1\"} %f\n", latency.Max.Seconds())
+
+	mw.header("percy_stream_bitrate_bps", "gauge", "Rolling bitrate received, by association and SSRC")
+	for _, assoc := range snap.Associations {
+		for _, stream := range assoc.Streams {
+			mw.printf("percy_stream_bitrate_bps{assoc=\"%04x\",ssrc=\"%08x\"} %f\n", assoc.ID, stream.SSRC, stream.Bitrate)
+		}
+	}
+
+	mw.header("percy_stream_packet_rate", "gauge", "Rolling packets per second received, by association and SSRC")
+	for _, assoc := range snap.Associations {
+		for _, stream := range assoc.Streams {
+			mw.printf("percy_stream_packet_rate{assoc=\"%04x\",ssrc=\"%08x\"} %f\n", assoc.ID, stream.SSRC, stream.PacketRate)
+		}
+	}
+
+	mw.header("percy_stream_frame_rate", "gauge", "Rolling frames per second received (from the RTP marker bit), by association and SSRC")
+	for _, assoc := range snap.Associations {
+		for _, stream := range assoc.Streams {
+			mw.printf("percy_stream_frame_rate{assoc=\"%04x\",ssrc=\"%08x\"} %f\n", assoc.ID, stream.SSRC, stream.FrameRate)
+		}
+	}
+
+	return mw.err
+}
+
+func (api *AdminAPI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	api.mdd.WriteMetrics(w)
+}
@@ -0,0 +1,105 @@
+package percy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Each conference forwards media in one of these modes, so that PERC and
+// non-PERC conferences can share an MD:
+//
+//   - PERC: DTLS goes to the KD, and media is re-encrypted hop by hop with
+//     the keys it provides (the default)
+//   - SFU: the MD terminates DTLS itself, for clients without double
+//     encryption or EKT (see dtls.go)
+//   - Relay: the MD answers STUN, and forwards everything else to the other
+//     participants untouched.  No KD or keys are involved, so this works as a
+//     simple TURN-less relay, and as a baseline for performance comparisons.
+
+type ForwardingMode uint8
+
+const (
+	ModePERC ForwardingMode = iota
+	ModeSFU
+	ModeRelay
+)
+
+func (mode ForwardingMode) String() string {
+	switch mode {
+	case ModePERC:
+		return "perc"
+	case ModeSFU:
+		return "sfu"
+	case ModeRelay:
+		return "relay"
+	default:
+		return fmt.Sprintf("<%d>", int(mode))
+	}
+}
+
+func ParseForwardingMode(val string) (ForwardingMode, error) {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "perc":
+		return ModePERC, nil
+	case "sfu":
+		return ModeSFU, nil
+	case "relay":
+		return ModeRelay, nil
+	default:
+		return 0, fmt.Errorf("Unknown forwarding mode '%s'", val)
+	}
+}
+
+func (mode ForwardingMode) MarshalText() ([]byte, error) {
+	return []byte(mode.String()), nil
+}
+
+func (mode *ForwardingMode) UnmarshalText(text []byte) error {
+	parsed, err := ParseForwardingMode(string(text))
+	if err != nil {
+		return err
+	}
+	*mode = parsed
+	return nil
+}
+
+// Returns the forwarding mode of an association's conference.  Takes
+// mdd.mu, since conferences are added and changed from other goroutines.
+func (mdd *MDD) mode(assoc *association) ForwardingMode {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if conf, ok := mdd.conferences[assoc.conf]; ok {
+		return conf.mode
+	}
+	return ModePERC
+}
+
+// Sets the forwarding mode for a conference.  Associations that have already
+// completed DTLS keep the keys they have.
+func (mdd *MDD) SetConferenceMode(confID ConfID, mode ForwardingMode) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.mode = mode
+}
+
+// Forwards a packet blindly to the rest of a relay-mode conference
+func (mdd *MDD) relay(sender *association, class dtlsSRTPPacketClass, msg []byte, trace *packetTrace) {
+	switch {
+	case class == packetClassDTLS && isApplicationData(msg):
+		mdd.handleDataChannel(sender, msg, trace)
+	case class == packetClassSRTP:
+		if !mdd.holdMedia(sender, trace) {
+			mdd.forward(sender, mdd.subscribers(sender, msg), msg, trace)
+		}
+	case class == packetClassSRTCP:
+		if !mdd.holdMedia(sender, trace) {
+			mdd.broadcast(sender, msg, trace)
+		}
+	case class == packetClassDTLS:
+		mdd.broadcast(sender, msg, trace)
+	default:
+		trace.log("route", "dropped %v packet in relay mode", class)
+	}
+}
@@ -0,0 +1,136 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Moderators can mute a participant at the MD, without relying on the
+// participant's client to comply: its audio, video, or both stop being
+// forwarded to the rest of the conference.  As with a paused conference,
+// the media is still received and decrypted, so unmuting is instant, and
+// unmuting video asks the sender for a keyframe so that receivers can show
+// it straight away.  Audio and video are told apart by
+// SlowReceivers.AudioPayloadTypes.
+
+// Mutes or unmutes an association's audio
+func (mdd *MDD) SetAssociationAudioMuted(assocID AssociationID, muted bool) {
+	mdd.setMuted(assocID, "audio", muted)
+}
+
+// Mutes or unmutes an association's video
+func (mdd *MDD) SetAssociationVideoMuted(assocID AssociationID, muted bool) {
+	mdd.setMuted(assocID, "video", muted)
+}
+
+// Reports whether an association's audio and video are muted
+func (mdd *MDD) AssociationMuted(assocID AssociationID) (audio, video bool, err error) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assoc, ok := mdd.assocs.get(assocID)
+	if !ok {
+		return false, false, fmt.Errorf("Unknown client [%04x]", assocID)
+	}
+	return assoc.mutedAudio, assoc.mutedVideo, nil
+}
+
+func (mdd *MDD) setMuted(assocID AssociationID, kind string, muted bool) {
+	assoc := mdd.association(assocID)
+
+	mdd.mu.Lock()
+	flag := &assoc.mutedAudio
+	if kind == "video" {
+		flag = &assoc.mutedVideo
+	}
+	changed := *flag != muted
+	*flag = muted
+	mdd.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	evtType := EventAssociationUnmuted
+	if muted {
+		evtType = EventAssociationMuted
+	}
+	log.Printf("%v %s of %s", evtType, kind, mdd.describe(assoc))
+	mdd.emit(Event{Type: evtType, Assoc: assocID, Conf: assoc.conf, Detail: kind})
+
+	if kind == "video" && !muted {
+		task := func() {
+			mdd.requestKeyframes(time.Now(), func(sender *association, counters *ssrcCounters) bool {
+				return sender == assoc
+			})
+		}
+
+		select {
+		case mdd.tasks <- task:
+		default:
+			log.Printf("Keyframe request for association %v dropped", assocID)
+		}
+	}
+}
+
+// Whether an SRTP packet is of a kind its sender has had muted
+func (mdd *MDD) mutedMedia(sender *association, msg []byte) bool {
+	mdd.mu.Lock()
+	mutedAudio, mutedVideo := sender.mutedAudio, sender.mutedVideo
+	mdd.mu.Unlock()
+	if !mutedAudio && !mutedVideo {
+		return false
+	}
+
+	header, err := ParseRTPHeader(msg)
+	if err != nil {
+		return false
+	}
+	if mdd.SlowReceivers.isAudioPayloadType(header.PayloadType) {
+		return mutedAudio
+	}
+	return mutedVideo
+}
+
+// POST mutes ("true") or unmutes ("false") an association's "audio" and
+// "video"; either can be left out to leave it as it is.  GET returns both.
+func (api *AdminAPI) handleMute(w http.ResponseWriter, r *http.Request) {
+	assocID, err := strconv.ParseUint(r.FormValue("assoc"), 0, 16)
+	if err != nil {
+		http.Error(w, "Invalid association ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		audio, video, err := api.mdd.AssociationMuted(AssociationID(assocID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]bool{"audio": audio, "video": video})
+
+	case http.MethodPost:
+		settings := map[string]bool{}
+		for _, kind := range []string{"audio", "video"} {
+			if value := r.FormValue(kind); len(value) > 0 {
+				muted, err := strconv.ParseBool(value)
+				if err != nil {
+					http.Error(w, "Invalid "+kind+" setting", http.StatusBadRequest)
+					return
+				}
+				settings[kind] = muted
+			}
+		}
+		for kind, muted := range settings {
+			api.mdd.setMuted(AssociationID(assocID), kind, muted)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
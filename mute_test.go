@@ -0,0 +1,55 @@
+package percy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMute(t *testing.T) {
+	mdd := NewMDD()
+	auth := NewMemoryAuthProvider()
+	auth.AddAdminToken("secret")
+	mdd.Auth = auth
+
+	sender := mdd.association(0x0001)
+	mdd.SetAssociationConference(0x0001, 5)
+	mdd.SetAssociationConference(0x0002, 5)
+	mdd.association(0x0002).addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5002}
+
+	audio := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06, 0x07, 0x08}
+	video := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06, 0x07, 0x08}
+
+	mdd.SetAssociationAudioMuted(0x0001, true)
+	if !mdd.mutedMedia(sender, audio) || mdd.mutedMedia(sender, video) {
+		t.Fatalf("Incorrect filtering with audio muted")
+	}
+	if len(mdd.subscribers(sender, audio)) != 0 || len(mdd.subscribers(sender, video)) != 1 {
+		t.Fatalf("Incorrect subscribers with audio muted")
+	}
+
+	// Video is muted independently, through the admin API
+	api := NewAdminAPI(mdd)
+	req := httptest.NewRequest(http.MethodPost, "/mute?assoc=1&video=true", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Mute failed: %d %s", w.Code, w.Body.String())
+	}
+
+	audioMuted, videoMuted, err := mdd.AssociationMuted(0x0001)
+	if err != nil || !audioMuted || !videoMuted {
+		t.Fatalf("Incorrect mute state: %v %v %v", audioMuted, videoMuted, err)
+	}
+
+	mdd.SetAssociationAudioMuted(0x0001, false)
+	if mdd.mutedMedia(sender, audio) || !mdd.mutedMedia(sender, video) {
+		t.Fatalf("Incorrect filtering after unmuting audio")
+	}
+
+	if _, _, err := mdd.AssociationMuted(0x0003); err == nil {
+		t.Fatalf("Mute state returned for unknown association")
+	}
+}
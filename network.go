@@ -0,0 +1,120 @@
+package percy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Operators want to know how many clients get through on direct UDP, and
+// how many depend on the fallbacks: TLS over TCP (see stream.go), or a TURN
+// relay, which the MD knows by its address being in one of RelayNetworks.
+// Each association's current path is classified by transport ("udp",
+// "tcp", or "turn") and address family ("ipv4" or "ipv6"), e.g.,
+// "turn/ipv6", and the stats and metrics count the associations and
+// traffic on each.  Traffic is counted against the path the association
+// had when the packet was sent or received.
+
+type NetworkStats struct {
+	Associations int          `json:"associations"`
+	In           TrafficStats `json:"in"`
+	Out          TrafficStats `json:"out"`
+}
+
+type networkCounters struct {
+	in  TrafficStats
+	out TrafficStats
+}
+
+// Parses a comma-separated list of CIDR blocks, e.g., "192.0.2.0/24,2001:db8::/32"
+func ParseNetworks(val string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, field := range strings.Split(val, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q", field)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Classifies the path to an address
+func (mdd *MDD) classifyNetwork(addr net.Addr) string {
+	var ip net.IP
+	transport := "udp"
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip, transport = addr.IP, "tcp"
+	default:
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+
+	for _, relay := range mdd.RelayNetworks {
+		if relay.Contains(ip) {
+			transport = "turn"
+			break
+		}
+	}
+
+	family := "ipv6"
+	if ip == nil || ip.To4() != nil {
+		family = "ipv4"
+	}
+	return transport + "/" + family
+}
+
+// Returns the counters for an association's current path, or nil if it
+// doesn't have one yet.  The caller holds mdd.mu.
+func (mdd *MDD) networkCounters(assoc *association) *networkCounters {
+	if assoc.addr == nil {
+		return nil
+	}
+	if assoc.networkAddr != assoc.addr {
+		assoc.network = mdd.classifyNetwork(assoc.addr)
+		assoc.networkAddr = assoc.addr
+	}
+
+	if mdd.stats.networks == nil {
+		mdd.stats.networks = map[string]*networkCounters{}
+	}
+	counters, ok := mdd.stats.networks[assoc.network]
+	if !ok {
+		counters = &networkCounters{}
+		mdd.stats.networks[assoc.network] = counters
+	}
+	return counters
+}
+
+// Counts the associations on each kind of path, along with the traffic
+// there has been on each.  The caller holds mdd.mu.
+func (mdd *MDD) networkStats() map[string]NetworkStats {
+	for _, assoc := range mdd.assocs.snapshot() {
+		mdd.networkCounters(assoc)
+	}
+	if len(mdd.stats.networks) == 0 {
+		return nil
+	}
+
+	networks := map[string]NetworkStats{}
+	for network, counters := range mdd.stats.networks {
+		networks[network] = NetworkStats{In: counters.in, Out: counters.out}
+	}
+	for _, assoc := range mdd.assocs.snapshot() {
+		if assoc.addr != nil {
+			stats := networks[assoc.network]
+			stats.Associations += 1
+			networks[assoc.network] = stats
+		}
+	}
+	return networks
+}
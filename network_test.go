@@ -0,0 +1,70 @@
+package percy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNetworkClassification(t *testing.T) {
+	mdd := NewMDD()
+	var err error
+	mdd.RelayNetworks, err = ParseNetworks("192.0.2.0/24, 2001:db8::/32")
+	if err != nil || len(mdd.RelayNetworks) != 2 {
+		t.Fatalf("Error parsing networks: %v", err)
+	}
+	if _, err := ParseNetworks("192.0.2.1"); err == nil {
+		t.Fatalf("Parsed an address as a network")
+	}
+
+	for _, c := range []struct {
+		addr    net.Addr
+		network string
+	}{
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}, "udp/ipv4"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db9::1"), Port: 5000}, "udp/ipv6"},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, "tcp/ipv4"},
+		{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 5000}, "turn/ipv4"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 5000}, "turn/ipv6"},
+	} {
+		if network := mdd.classifyNetwork(c.addr); network != c.network {
+			t.Fatalf("%v classified as %s, not %s", c.addr, network, c.network)
+		}
+	}
+}
+
+func TestNetworkStats(t *testing.T) {
+	mdd := NewMDD()
+	mdd.RelayNetworks, _ = ParseNetworks("192.0.2.0/24")
+
+	direct := mdd.association(0x0001)
+	direct.addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	relayed := mdd.association(0x0002)
+	relayed.addr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 5000}
+
+	mdd.countIn(direct, packetClassSTUN, packet{addr: direct.addr, msg: make([]byte, 100)})
+	mdd.countOut(relayed, 200, nil)
+
+	networks := mdd.StatsSnapshot().Global.Networks
+	if networks["udp/ipv4"].Associations != 1 || networks["udp/ipv4"].In.Bytes != 100 {
+		t.Fatalf("Incorrect direct stats: %+v", networks)
+	}
+	if networks["turn/ipv4"].Associations != 1 || networks["turn/ipv4"].Out.Bytes != 200 {
+		t.Fatalf("Incorrect relayed stats: %+v", networks)
+	}
+
+	// Traffic already counted stays with the old path when a client moves
+	relayed.addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+	networks = mdd.StatsSnapshot().Global.Networks
+	if networks["udp/ipv4"].Associations != 2 || networks["turn/ipv4"].Associations != 0 || networks["turn/ipv4"].Out.Bytes != 200 {
+		t.Fatalf("Incorrect stats after a move: %+v", networks)
+	}
+
+	var metrics bytes.Buffer
+	mdd.WriteMetrics(&metrics)
+	if !strings.Contains(metrics.String(), `percy_network_associations{transport="udp",family="ipv4"} 2`) ||
+		!strings.Contains(metrics.String(), `percy_network_bytes_total{transport="turn",family="ipv4",direction="out"} 200`) {
+		t.Fatalf("Network metrics missing:\n%s", metrics.String())
+	}
+}
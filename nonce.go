@@ -0,0 +1,179 @@
+package percy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bifurcation/percy/internal/cryptoutil"
+)
+
+// Nonces for the long-term credential mechanism (RFC 8489, section 9.2).  Each
+// nonce is bound to the source it was issued to and expires after a while, so
+// a captured request can't be replayed from elsewhere or indefinitely.  Only
+// the latest nonce issued to a source is accepted.
+//
+// If any security features are enabled, nonces start with the "nonce cookie"
+// that advertises them (section 9.2), so that clients can detect bid-down
+// attacks.
+
+const (
+	nonceCookie          = "obMatJos2"
+	nonceRandomSize      = 16
+	defaultNonceLifetime = 10 * time.Minute
+	maxNonceSources      = 10000
+)
+
+// Security feature bits, numbered from the most significant of 24 bits
+const (
+	SecurityFeaturePasswordAlgorithms uint32 = 1 << 23
+	SecurityFeatureUsernameAnonymity  uint32 = 1 << 22
+)
+
+type NonceStatus uint8
+
+const (
+	NonceValid   NonceStatus = iota
+	NonceStale               // Issued to this source, but expired
+	NonceUnknown             // Not the latest nonce issued to this source
+)
+
+type issuedNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+type NonceManager struct {
+	Lifetime time.Duration
+	Features uint32
+
+	mu     sync.Mutex
+	issued map[string]issuedNonce // By source address
+}
+
+func NewNonceManager() *NonceManager {
+	return &NonceManager{
+		Lifetime: defaultNonceLifetime,
+		issued:   map[string]issuedNonce{},
+	}
+}
+
+func encodeSecurityFeatures(features uint32) string {
+	return base64.StdEncoding.EncodeToString([]byte{byte(features >> 16), byte(features >> 8), byte(features)})
+}
+
+// Returns the security features advertised by a nonce, if it carries the
+// nonce cookie
+func ParseSecurityFeatures(nonce string) (uint32, bool) {
+	if len(nonce) < len(nonceCookie)+4 || nonce[:len(nonceCookie)] != nonceCookie {
+		return 0, false
+	}
+
+	bits, err := base64.StdEncoding.DecodeString(nonce[len(nonceCookie) : len(nonceCookie)+4])
+	if err != nil || len(bits) != 3 {
+		return 0, false
+	}
+	return uint32(bits[0])<<16 | uint32(bits[1])<<8 | uint32(bits[2]), true
+}
+
+// Drops expired nonces, and if there are still too many sources, the one
+// closest to expiring.  The caller holds nm.mu.
+func (nm *NonceManager) prune(now time.Time) {
+	var oldest string
+	for source, issued := range nm.issued {
+		if now.After(issued.expires) {
+			delete(nm.issued, source)
+			continue
+		}
+		if len(oldest) == 0 || issued.expires.Before(nm.issued[oldest].expires) {
+			oldest = source
+		}
+	}
+
+	if len(nm.issued) >= maxNonceSources {
+		delete(nm.issued, oldest)
+	}
+}
+
+// Issues a new nonce to a source, replacing any it had before
+func (nm *NonceManager) Issue(source net.Addr) string {
+	random := make([]byte, nonceRandomSize)
+	_, err := rand.Read(random)
+	if err != nil {
+		log.Printf("Error generating nonce: %v", err)
+	}
+
+	nonce := base64.RawStdEncoding.EncodeToString(random)
+	if nm.Features != 0 {
+		nonce = nonceCookie + encodeSecurityFeatures(nm.Features) + nonce
+	}
+
+	now := time.Now()
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if len(nm.issued) >= maxNonceSources {
+		nm.prune(now)
+	}
+	nm.issued[source.String()] = issuedNonce{nonce: nonce, expires: now.Add(nm.Lifetime)}
+	return nonce
+}
+
+func (nm *NonceManager) Check(source net.Addr, nonce string) NonceStatus {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	issued, ok := nm.issued[source.String()]
+	if !ok || !cryptoutil.EqualString(issued.nonce, nonce) {
+		return NonceUnknown
+	}
+	if time.Now().After(issued.expires) {
+		return NonceStale
+	}
+	return NonceValid
+}
+
+// Authenticates a request with the long-term credential mechanism.  If that
+// fails, response is filled in as the error response to send (with a fresh
+// nonce where the client can retry), and false is returned.  On success,
+// response is set up to be signed with the user's key.
+func (mdd *MDD) checkLongTermCredentials(addr net.Addr, request *STUNMessage, raw []byte, response *STUNMessage) bool {
+	fail := func(code uint, reason string) bool {
+		response.msgType = MSG_TYPE_ERROR
+		response.AddErrorCode(code, reason)
+		if code != 400 {
+			response.Add(ATTR_REALM, []byte(mdd.Realm))
+			response.Add(ATTR_NONCE, []byte(mdd.Nonces.Issue(addr)))
+		}
+		return false
+	}
+
+	if _, ok := request.Get(ATTR_MESSAGE_INTEGRITY); !ok {
+		return fail(401, "Unauthorized")
+	}
+
+	username, ok1 := request.Get(ATTR_USERNAME)
+	realm, ok2 := request.Get(ATTR_REALM)
+	nonce, ok3 := request.Get(ATTR_NONCE)
+	if !ok1 || !ok2 || !ok3 {
+		return fail(400, "Bad Request")
+	}
+
+	switch mdd.Nonces.Check(addr, string(nonce)) {
+	case NonceStale:
+		return fail(438, "Stale Nonce")
+	case NonceUnknown:
+		log.Printf("Rejecting unknown or replayed nonce from %v", addr)
+		return fail(438, "Stale Nonce")
+	}
+
+	key, ok := mdd.Auth.TURNKey(string(username), string(realm))
+	if !ok || string(realm) != mdd.Realm || !checkMessageIntegrity(raw, key) {
+		return fail(401, "Unauthorized")
+	}
+
+	response.icePassword = string(key)
+	return true
+}
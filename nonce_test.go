@@ -0,0 +1,103 @@
+package percy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNonceLifecycle(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+
+	nm := NewNonceManager()
+	nm.Features = SecurityFeaturePasswordAlgorithms
+	nonce := nm.Issue(source)
+
+	features, ok := ParseSecurityFeatures(nonce)
+	if !ok || features != SecurityFeaturePasswordAlgorithms {
+		t.Fatalf("Incorrect security features in nonce %q: %06x", nonce, features)
+	}
+
+	if status := nm.Check(source, nonce); status != NonceValid {
+		t.Fatalf("Fresh nonce not accepted: %v", status)
+	}
+	if status := nm.Check(other, nonce); status != NonceUnknown {
+		t.Fatalf("Nonce accepted from another source: %v", status)
+	}
+
+	// Only the latest nonce for a source is accepted
+	latest := nm.Issue(source)
+	if status := nm.Check(source, nonce); status != NonceUnknown {
+		t.Fatalf("Replaced nonce accepted: %v", status)
+	}
+
+	nm.Lifetime = -time.Second
+	expired := nm.Issue(source)
+	if status := nm.Check(source, expired); status != NonceStale {
+		t.Fatalf("Expired nonce accepted: %v", status)
+	}
+	if status := nm.Check(source, latest); status != NonceUnknown {
+		t.Fatalf("Replaced nonce accepted: %v", status)
+	}
+}
+
+func TestLongTermCredentials(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+
+	auth := NewMemoryAuthProvider()
+	auth.SetTURNCredential("user", "percy", "secret")
+
+	mdd := NewMDD()
+	mdd.Auth = auth
+	mdd.Realm = "percy"
+
+	request := func(nonce []byte) ([]byte, *STUNMessage) {
+		msg := &STUNMessage{msgType: MSG_TYPE_REQUEST, icePassword: string(TURNLongTermKey("user", "percy", "secret"))}
+		msg.header.Type = MSG_ALLOCATE
+		if nonce != nil {
+			msg.Add(ATTR_USERNAME, []byte("user"))
+			msg.Add(ATTR_REALM, []byte("percy"))
+			msg.Add(ATTR_NONCE, nonce)
+			msg.AddMessageIntegrity()
+		}
+
+		raw, err := msg.Serialize()
+		if err != nil {
+			t.Fatalf("Error serializing request: %v", err)
+		}
+		parsed, err := ParseSTUN(raw)
+		if err != nil {
+			t.Fatalf("Error parsing request: %v", err)
+		}
+		return raw, parsed
+	}
+
+	// The first request gets a challenge with a nonce
+	raw, req := request(nil)
+	response := &STUNMessage{}
+	if mdd.checkLongTermCredentials(source, req, raw, response) {
+		t.Fatalf("Unauthenticated request accepted")
+	}
+	nonce, ok := response.Get(ATTR_NONCE)
+	if !ok {
+		t.Fatalf("No nonce in challenge")
+	}
+
+	raw, req = request(nonce)
+	response = &STUNMessage{}
+	if !mdd.checkLongTermCredentials(source, req, raw, response) {
+		t.Fatalf("Authenticated request rejected: %v", response)
+	}
+
+	// The same request replayed from elsewhere is rejected
+	response = &STUNMessage{}
+	if mdd.checkLongTermCredentials(other, req, raw, response) {
+		t.Fatalf("Replayed request accepted")
+	}
+	code, _ := response.Get(ATTR_ERROR_CODE)
+	if len(code) < 4 || code[2] != 4 || code[3] != 38 {
+		t.Fatalf("Replayed request did not get a stale nonce error: %v", response)
+	}
+}
@@ -0,0 +1,103 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+)
+
+// Conferences can be limited to a number of participants.  Once a conference
+// is full, further associations are refused with an error from
+// SetAssociationConference, and clients that show up unannounced (which land
+// in the default conference) have their packets dropped.  Either way, an
+// EventParticipantRejected is raised, so that signaling can tell the client
+// instead of letting it join a call that silently doesn't work.
+
+// Limits the number of participants in a conference; zero means unlimited.
+// Lowering the limit does not evict anyone.
+func (mdd *MDD) SetConferenceParticipantLimit(confID ConfID, max int) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.maxParticipants = max
+}
+
+// Counts the associations in a conference.  The caller holds mdd.mu.
+func (mdd *MDD) conferenceParticipants(confID ConfID) int {
+	count := 0
+	for _, assoc := range mdd.assocs.snapshot() {
+		if assoc.conf == confID {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Checks whether an association can join a conference.  The association is
+// not yet registered if known is false.  The caller holds mdd.mu.
+func (mdd *MDD) checkParticipantLimits(assoc *association, known bool, conf *conference) error {
+	if known && assoc.conf == conf.id {
+		return nil
+	}
+
+	if err := mdd.checkDraining(conf.id); err != nil {
+		return err
+	}
+
+	if conf.maxParticipants > 0 && mdd.conferenceParticipants(conf.id) >= conf.maxParticipants {
+		return fmt.Errorf("Conference %d is at its limit of %d participants", conf.id, conf.maxParticipants)
+	}
+
+	return mdd.checkParticipantQuota(assoc, known, conf)
+}
+
+// Adds a client that was first heard from on the media socket to the default
+// conference.  Returns nil if the conference is full, or if only clients
+// added with AddClient are admitted.
+func (mdd *MDD) admitClient(assocID AssociationID) *association {
+	if mdd.Admission == AdmitListed {
+		mdd.mu.Lock()
+		mdd.stats.notAdmitted += 1
+		mdd.mu.Unlock()
+		return nil
+	}
+
+	conf := mdd.conference(DefaultConfID)
+
+	mdd.mu.Lock()
+	if assoc, ok := mdd.assocs.get(assocID); ok {
+		mdd.mu.Unlock()
+		return assoc
+	}
+	assoc := newAssociation(assocID)
+	err := mdd.checkParticipantLimits(assoc, false, conf)
+	firstRejection := false
+	if err == nil {
+		mdd.assocs.add(assoc)
+		delete(mdd.rejected, assocID)
+	} else {
+		firstRejection = !mdd.rejected[assocID]
+		mdd.rejected[assocID] = true
+	}
+	mdd.mu.Unlock()
+
+	if err != nil {
+		// Only the first packet is reported; the client will keep trying
+		if firstRejection {
+			mdd.rejectParticipant(assocID, conf.id, err)
+		}
+		return nil
+	}
+	mdd.record(conf.id, assocID, "Joined", "admitted")
+	return assoc
+}
+
+func (mdd *MDD) rejectParticipant(assocID AssociationID, confID ConfID, err error) {
+	log.Printf("Rejected association [%04x]: %v", assocID, err)
+	mdd.emit(Event{
+		Type:   EventParticipantRejected,
+		Assoc:  assocID,
+		Conf:   confID,
+		Detail: err.Error(),
+	})
+}
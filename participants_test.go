@@ -0,0 +1,91 @@
+package percy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParticipantLimit(t *testing.T) {
+	mdd := NewMDD()
+	mdd.SetConferenceParticipantLimit(1, 1)
+
+	rejected := []Event{}
+	mdd.OnEvent(func(evt Event) {
+		if evt.Type == EventParticipantRejected {
+			rejected = append(rejected, evt)
+		}
+	})
+
+	err := mdd.SetAssociationConference(0x0001, 1)
+	if err != nil {
+		t.Fatalf("Error adding participant: %v", err)
+	}
+	err = mdd.SetAssociationConference(0x0001, 1)
+	if err != nil {
+		t.Fatalf("Existing participant rejected: %v", err)
+	}
+	err = mdd.SetAssociationConference(0x0002, 1)
+	if err == nil {
+		t.Fatalf("Participant limit not enforced")
+	}
+	if len(rejected) != 1 || rejected[0].Assoc != 0x0002 || rejected[0].Conf != 1 {
+		t.Fatalf("Incorrect rejection events: %+v", rejected)
+	}
+
+	// Unannounced clients are held to the default conference's limit
+	mdd.SetConferenceParticipantLimit(DefaultConfID, 1)
+	first := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	second := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5001}
+	for i := 0; i < 2; i++ {
+		mdd.process(packet{addr: first, msg: []byte{0xff}, recvTime: time.Now()})
+		mdd.process(packet{addr: second, msg: []byte{0xff}, recvTime: time.Now()})
+	}
+
+	if _, ok := mdd.assocs.get(addrToAssoc(first)); !ok {
+		t.Fatalf("First client not admitted")
+	}
+	if _, ok := mdd.assocs.get(addrToAssoc(second)); ok {
+		t.Fatalf("Second client admitted to a full conference")
+	}
+	if len(rejected) != 2 {
+		t.Fatalf("Repeated packets from a rejected client raised %d events", len(rejected)-1)
+	}
+}
+
+func TestClientAdmission(t *testing.T) {
+	mdd := NewMDD()
+	mdd.Admission = AdmitListed
+
+	listed := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+	unlisted := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5000}
+	assocID, err := mdd.AddClient(listed, 5)
+	if err != nil {
+		t.Fatalf("Error adding client: %v", err)
+	}
+
+	for _, addr := range []net.Addr{listed, unlisted} {
+		mdd.process(packet{addr: addr, msg: []byte{0x10, 0x00}, recvTime: time.Now()})
+	}
+
+	if assoc, ok := mdd.assocs.get(assocID); !ok || assoc.conf != 5 || assoc.addr != listed {
+		t.Fatalf("Listed client not admitted")
+	}
+	if _, ok := mdd.assocs.get(addrToAssoc(unlisted)); ok {
+		t.Fatalf("Unlisted client admitted")
+	}
+	if dropped := mdd.StatsSnapshot().Global.NotAdmitted; dropped != 1 {
+		t.Fatalf("Incorrect count of packets not admitted: %d", dropped)
+	}
+
+	err = mdd.RemoveClient(assocID)
+	if err != nil {
+		t.Fatalf("Error removing client: %v", err)
+	}
+	if _, ok := mdd.assocs.get(assocID); ok {
+		t.Fatalf("Client not removed")
+	}
+	if mdd.RemoveClient(assocID) == nil {
+		t.Fatalf("Removed an unknown client")
+	}
+}
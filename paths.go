@@ -0,0 +1,148 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Associations are found by hashing the client's address, which breaks when
+// a NAT rebinds its port or the client moves networks.  So once a client has
+// passed an ICE check, it is known by its ICE credentials as well: the local
+// ufrag set by signaling (SetICECredentials), or the USERNAME of its checks
+// once its old path has gone quiet.  A Binding request from an address the
+// MD hasn't seen is matched against these before a new association is made,
+// and the address becomes a path of the association once the check
+// succeeds.
+//
+// The association's current path, where the MD sends to, only changes when
+// the client nominates the new one (USE-CANDIDATE), or sends media on it.
+// Checks on the other candidate pairs don't move it.  In SFU mode the DTLS
+// session is bound to the first path, so SFU associations don't move.
+
+// Returns the association a packet belongs to: the one its address is a
+// path of, the one a check from a new address names, or else the one for
+// the address itself.  Runs on the processing loop.
+func (mdd *MDD) pathAssoc(addr net.Addr, class dtlsSRTPPacketClass, msg []byte, now time.Time) (AssociationID, error) {
+	key := addr.String()
+	mdd.mu.Lock()
+	assocID, ok := mdd.paths[key]
+	mdd.mu.Unlock()
+	if ok {
+		if _, known := mdd.assocs.get(assocID); known {
+			return assocID, nil
+		}
+
+		mdd.mu.Lock()
+		delete(mdd.paths, key)
+		mdd.mu.Unlock()
+	}
+
+	assocID, known, err := mdd.addressAssoc(addr)
+	if known || class != packetClassSTUN {
+		return assocID, err
+	}
+
+	if assoc := mdd.iceAssociation(msg, now); assoc != nil {
+		return assoc.id, nil
+	}
+	return assocID, err
+}
+
+// Returns the association whose ICE credentials a Binding request carries,
+// if any.  The request is not verified here; that happens when it's handled.
+// Clients can share a USERNAME when the MD's credentials come from its
+// AuthProvider, so a learned USERNAME only matches one association, and only
+// once its current path has gone quiet.
+func (mdd *MDD) iceAssociation(msg []byte, now time.Time) *association {
+	message, err := ParseSTUN(msg)
+	if err != nil || message.msgType != MSG_TYPE_REQUEST || message.header.Type != MSG_BINDING {
+		return nil
+	}
+	username, ok := message.Get(ATTR_USERNAME)
+	if !ok {
+		return nil
+	}
+	ufrag := strings.SplitN(string(username), ":", 2)[0]
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	var byUsername []*association
+	for _, assoc := range mdd.assocs.snapshot() {
+		switch {
+		case len(assoc.iceUfrag) > 0 && assoc.iceUfrag == ufrag:
+			return assoc
+		case assoc.iceUsername == string(username):
+			byUsername = append(byUsername, assoc)
+		}
+	}
+	if len(byUsername) == 1 && now.Sub(byUsername[0].stats.lastActivity) >= minReconnectSilence {
+		return byUsername[0]
+	}
+	return nil
+}
+
+// Records an address from which an association passed an ICE check, and
+// moves the association to it if the client nominated it.  Called by the
+// STUN workers.
+func (mdd *MDD) notePath(assoc *association, addr net.Addr, nominated bool) {
+	mdd.mu.Lock()
+	mdd.paths[addr.String()] = assoc.id
+	learned := mdd.learnCandidate(assoc, addr)
+	move := nominated && assoc.addr != nil && assoc.addr.String() != addr.String()
+	mdd.mu.Unlock()
+
+	if learned {
+		mdd.emit(Event{Type: EventPeerReflexiveCandidate, Time: time.Now(), Assoc: assoc.id, Conf: assoc.conf, Detail: addr.String()})
+	}
+
+	if move {
+		mdd.runOnLoop(func() { mdd.movePath(assoc, addr) })
+	}
+}
+
+// Moves an association to a verified path that media has arrived on.  Runs
+// on the processing loop.
+func (mdd *MDD) checkPath(assoc *association, addr net.Addr) {
+	if assoc.addr == nil || assoc.addr.String() == addr.String() {
+		return
+	}
+
+	mdd.mu.Lock()
+	verified := mdd.paths[addr.String()] == assoc.id
+	mdd.mu.Unlock()
+	if verified {
+		mdd.movePath(assoc, addr)
+	}
+}
+
+// Makes an address an association's current path.  Runs on the processing
+// loop.
+func (mdd *MDD) movePath(assoc *association, addr net.Addr) {
+	mdd.mu.Lock()
+	if _, ok := mdd.assocs.get(assoc.id); !ok || assoc.dtls != nil || assoc.addr.String() == addr.String() {
+		mdd.mu.Unlock()
+		return
+	}
+	previous := assoc.addr
+	assoc.addr = addr
+	mdd.paths[addr.String()] = assoc.id
+	mdd.stats.pathChanges += 1
+	mdd.mu.Unlock()
+
+	log.Printf("Association %s moved from %v to %v", mdd.describe(assoc), previous, addr)
+	mdd.emit(Event{Type: EventPathChanged, Time: time.Now(), Assoc: assoc.id, Conf: assoc.conf, Detail: fmt.Sprintf("from %v to %v", previous, addr)})
+}
+
+// Forgets the paths of an association that has been removed.  The caller
+// holds mdd.mu.
+func (mdd *MDD) forgetPaths(assocID AssociationID) {
+	for key, pathAssoc := range mdd.paths {
+		if pathAssoc == assocID {
+			delete(mdd.paths, key)
+		}
+	}
+}
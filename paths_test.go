@@ -0,0 +1,71 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestICEPaths(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+
+	changes := make(chan Event, 10)
+	mdd.OnEvent(func(evt Event) {
+		if evt.Type == EventPathChanged {
+			changes <- evt
+		}
+	})
+
+	peer, _ := NewClient(network, "10.0.0.1:5000")
+	defer peer.Stop()
+	client, _ := NewClient(network, "10.0.0.2:5000")
+	defer client.Stop()
+	assocID := client.Assoc()
+	mdd.SetICECredentials(assocID, "assoc", "0123456789abcdef01234567")
+
+	check := func(client *Client) {
+		request := NewBindingRequest(TransactionID{7, 8, 9}, "0123456789abcdef01234567")
+		request.Add(ATTR_USERNAME, []byte("assoc:remote"))
+		request.AddMessageIntegrity()
+		msg, _ := request.Serialize()
+		client.Write(msg)
+
+		msg, err := client.Recv()
+		if err != nil {
+			t.Fatalf("No STUN response: %v", err)
+		}
+		if response, err := ParseSTUN(msg); err != nil || response.msgType != MSG_TYPE_SUCCESS {
+			t.Fatalf("Check failed: %v", err)
+		}
+	}
+
+	media := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	check(client)
+	peer.Write(media)
+	AssertRecvPacket(t, client, media, "Media not sent on the first path")
+
+	// After a NAT rebinding, the client's checks are recognized by their
+	// credentials, but don't move it until media arrives
+	rebound, _ := NewClient(network, "10.0.0.2:6000")
+	defer rebound.Stop()
+	check(rebound)
+	if count := mdd.StatsSnapshot().Global.Associations; count != 2 {
+		t.Fatalf("New association made for a known client: %d", count)
+	}
+
+	peer.Write(media)
+	AssertRecvPacket(t, client, media, "Path moved by a check")
+
+	rebound.Write(media)
+	AssertRecvPacket(t, peer, media, "Media on the new path not forwarded")
+	if evt := <-changes; evt.Assoc != assocID {
+		t.Fatalf("Incorrect path change: %+v", evt)
+	}
+
+	peer.Write(media)
+	AssertRecvPacket(t, rebound, media, "Media not sent on the new path")
+	AssertNotRecvPacket(t, client, "Media sent on the old path")
+}
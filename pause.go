@@ -0,0 +1,59 @@
+package percy
+
+// A paused conference stops distributing media (SRTP and SRTCP) between its
+// participants, e.g., while they wait in a lobby or are on hold with music
+// played by something else.  Everything else carries on: STUN keeps the
+// associations alive, DTLS and the KD keep the keys current, and incoming
+// media is still decrypted so that the rollover counters stay in sync.  That
+// way, resuming is instant.
+
+// Pauses or resumes media distribution in a conference
+func (mdd *MDD) SetConferencePaused(confID ConfID, paused bool) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	changed := conf.paused != paused
+	conf.paused = paused
+	mdd.mu.Unlock()
+
+	if changed {
+		evtType := EventConferenceResumed
+		if paused {
+			evtType = EventConferencePaused
+		}
+		mdd.emit(Event{Type: evtType, Conf: confID})
+	}
+}
+
+func (mdd *MDD) PauseConference(confID ConfID) {
+	mdd.SetConferencePaused(confID, true)
+}
+
+func (mdd *MDD) ResumeConference(confID ConfID) {
+	mdd.SetConferencePaused(confID, false)
+}
+
+// Reports whether media from an association is being held back
+func (mdd *MDD) paused(assoc *association) bool {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if conf, ok := mdd.conferences[assoc.conf]; ok {
+		return conf.paused
+	}
+	return false
+}
+
+// Drops media from a paused conference.  Returns true if it was dropped.
+func (mdd *MDD) holdMedia(sender *association, trace *packetTrace) bool {
+	if !mdd.paused(sender) {
+		return false
+	}
+
+	mdd.mu.Lock()
+	sender.stats.held += 1
+	mdd.mu.Unlock()
+
+	trace.log("route", "held: conference %v is paused", sender.conf)
+	return true
+}
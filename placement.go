@@ -0,0 +1,78 @@
+package percy
+
+// When percy runs as a fleet, signaling decides which node each participant
+// joins.  Each node describes itself (its name, region, and how loaded it
+// is), and can be asked whether it will take a participant.  By default, a
+// node takes participants until it reaches its Capacity; a Placement hook
+// can decide otherwise, e.g., sending participants to a node in their own
+// region, or to wherever the rest of their conference is.
+
+type NodeInfo struct {
+	Node         string  `json:"node,omitempty"`
+	Region       string  `json:"region,omitempty"`
+	Associations int     `json:"associations"`
+	Conferences  int     `json:"conferences"`
+	Capacity     int     `json:"capacity,omitempty"`
+	Load         float64 `json:"load"` // Associations as a fraction of capacity; zero without one
+	Idle         bool    `json:"idle,omitempty"`
+	Draining     bool    `json:"draining,omitempty"`
+	Drained      bool    `json:"drained,omitempty"` // Draining, and empty
+}
+
+type PlacementRequest struct {
+	Conference ConfID `json:"conference"`
+	Region     string `json:"region,omitempty"` // The participant's, if signaling knows it
+}
+
+type PlacementDecision struct {
+	Accept   bool   `json:"accept"`
+	Redirect string `json:"redirect,omitempty"` // A node to try instead
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Decides whether this node takes a participant
+type PlacementFunc func(req PlacementRequest, node NodeInfo) PlacementDecision
+
+func (mdd *MDD) NodeInfo() NodeInfo {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	info := NodeInfo{
+		Node:         mdd.Node,
+		Region:       mdd.Region,
+		Associations: mdd.assocs.len(),
+		Conferences:  len(mdd.conferences),
+		Capacity:     mdd.Capacity,
+		Idle:         mdd.idle,
+		Draining:     mdd.draining,
+		Drained:      mdd.drained,
+	}
+	if info.Capacity > 0 {
+		info.Load = float64(info.Associations) / float64(info.Capacity)
+	}
+	return info
+}
+
+// Asks whether this node should take a participant, using the Placement
+// hook if there is one.  A draining node only takes participants in the
+// conferences it already hosts.
+func (mdd *MDD) Place(req PlacementRequest) PlacementDecision {
+	node := mdd.NodeInfo()
+	if node.Draining {
+		mdd.mu.Lock()
+		err := mdd.checkDraining(req.Conference)
+		mdd.mu.Unlock()
+		if err != nil {
+			return PlacementDecision{Reason: "Draining"}
+		}
+	}
+
+	if mdd.Placement != nil {
+		return mdd.Placement(req, node)
+	}
+
+	if node.Capacity > 0 && node.Associations >= node.Capacity {
+		return PlacementDecision{Reason: "At capacity"}
+	}
+	return PlacementDecision{Accept: true}
+}
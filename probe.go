@@ -0,0 +1,132 @@
+package percy
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// Moving a receiver up a simulcast layer can be more than its leg carries,
+// and by the time writes start failing, video is being shed (see
+// slowrecv.go).  With BandwidthProbing set, the MD checks first: it sends the
+// receiver a burst of RTP padding at the extra rate the higher layer needs,
+// for probeBurst, and only switches at the next layer selection if the leg
+// took it without a failed write.  Otherwise the receiver stays where it is,
+// and isn't probed again for probeBackoff.  One layer switch per receiver is
+// probed at a time.
+//
+// Padding goes out on the MD's own SSRC, so receivers drop it after
+// decryption, but it still counts in their transport-wide feedback.
+// Receivers without keys are switched without probing.
+
+const (
+	probeBurst      = 200 * time.Millisecond
+	probeBackoff    = 10 * time.Second
+	probePadding    = 255 // The most padding an RTP packet can say it has
+	probeMaxPackets = 500
+
+	probePayloadType = 127
+)
+
+// A layer switch being probed.  Guarded by mdd.mu.
+type bandwidthProbe struct {
+	sender AssociationID
+	ssrc   uint32
+	rate   float64 // Extra bits per second
+}
+
+// Decides whether a receiver can move up to a sender's higher layer, starting
+// a probe if it hasn't been tried.  Returns the rate to probe at, if a burst
+// is needed.  The caller holds mdd.mu.
+func (mdd *MDD) probed(receiver, sender *association, current, ssrc uint32, now time.Time) (bool, float64) {
+	if !mdd.BandwidthProbing || receiver.addr == nil || receiver.profile == 0 {
+		return true, 0
+	}
+	if sender.simulcast.index(ssrc) <= sender.simulcast.index(current) {
+		return true, 0
+	}
+
+	probe := receiver.probe
+	if probe != nil {
+		if probe.sender != sender.id {
+			return false, 0
+		}
+		receiver.probe = nil
+		if probe.ssrc == ssrc {
+			if receiver.health.state == receiverHealthy && !receiver.health.failing {
+				return true, 0
+			}
+			receiver.probeBackoff = now.Add(probeBackoff)
+			log.Printf("Probe of %.0f bps to %s failed", probe.rate, mdd.describe(receiver))
+			mdd.record(receiver.conf, receiver.id, "ProbeFailed", "from [%04x], ssrc %08x at %.0f bps", sender.id, ssrc, probe.rate)
+			return false, 0
+		}
+	}
+	if now.Before(receiver.probeBackoff) || receiver.health.state != receiverHealthy {
+		return false, 0
+	}
+
+	var rate float64
+	if counters, ok := sender.stats.ssrcs[ssrc]; ok {
+		rate = counters.stats(ssrc, now).Bitrate
+	}
+	if counters, ok := sender.stats.ssrcs[current]; ok {
+		rate -= counters.stats(current, now).Bitrate
+	}
+	if rate <= 0 {
+		return true, 0
+	}
+	receiver.probe = &bandwidthProbe{sender: sender.id, ssrc: ssrc, rate: rate}
+	return false, rate
+}
+
+// Builds a packet that is all padding, with a transport-wide sequence number
+// extension if those are on
+func (mdd *MDD) probePacket(ssrc uint32, seq uint16) *rtp.RTPPacket {
+	header := 12
+	if mdd.TransportCCID != 0 {
+		header += 8
+	}
+
+	buf := make([]byte, header+probePadding)
+	buf[0] = 0xa0
+	buf[1] = probePayloadType
+	binary.BigEndian.PutUint16(buf[2:4], seq)
+	binary.BigEndian.PutUint32(buf[8:12], ssrc)
+	if mdd.TransportCCID != 0 {
+		buf[0] |= 0x10
+		copy(buf[12:16], []byte{0xbe, 0xde, 0x00, 0x01})
+		buf[16] = mdd.TransportCCID<<4 | 0x01
+	}
+	buf[len(buf)-1] = probePadding
+	return &rtp.RTPPacket{Buffer: buf}
+}
+
+// Sends a receiver a burst of padding, probeBurst's worth at the given rate.
+// Runs on the processing loop.
+func (mdd *MDD) sendProbe(receiver *association, rate float64) {
+	size := len(mdd.probePacket(0, 0).Buffer)
+	count := int(math.Ceil(rate * probeBurst.Seconds() / 8 / float64(size)))
+	if count > probeMaxPackets {
+		count = probeMaxPackets
+	}
+
+	for i := 0; i < count; i++ {
+		mdd.mu.Lock()
+		receiver.probeSeq++
+		seq := receiver.probeSeq
+		mdd.mu.Unlock()
+
+		pkt := mdd.probePacket(mdd.rtcpSSRC, seq)
+		mdd.sequenceTransport(receiver, pkt)
+		msg, err := receiver.send.Encode(pkt)
+		if err != nil {
+			mdd.countEncodeError(receiver)
+			return
+		}
+		mdd.sendTo(receiver, msg)
+	}
+}
@@ -0,0 +1,124 @@
+package percy
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestBandwidthProbing(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.RIDExtensionID = 2
+	mdd.BandwidthProbing = true
+
+	clients := newKeyedClients(t, network, mdd, "10.0.0.1:5000", "10.0.0.2:5000")
+
+	sender, receiver := clients[0], clients[1]
+	mdd.SetSimulcastRIDs(sender.Assoc(), "q", "h")
+	mdd.SetReceiverLayer(receiver.Assoc(), LayerLow)
+
+	low := simulcastPacket(0x10, "q", time.Now()).msg
+	sender.Write(low)
+	AssertRecvPacket(t, receiver, low, "Low layer not forwarded")
+	high := append(simulcastPacket(0x20, "h", time.Now()).msg, make([]byte, 1000)...)
+	sender.Write(high)
+	AssertNotRecvPacket(t, receiver, "High layer forwarded over the limit")
+
+	selectLayers := func() uint32 {
+		done := make(chan uint32)
+		mdd.runOnLoop(func() {
+			mdd.selectLayers(time.Now())
+			ssrc, _ := mdd.SelectedLayer(receiver.Assoc(), sender.Assoc())
+			done <- ssrc
+		})
+		return <-done
+	}
+
+	// The receiver's leg is probed before it moves up...
+	mdd.SetReceiverLayer(receiver.Assoc(), LayerHigh)
+	if ssrc := selectLayers(); ssrc != 0x10 {
+		t.Fatalf("Receiver moved up without a probe: %08x", ssrc)
+	}
+	probes := 0
+	for {
+		msg, err := receiver.Recv()
+		if err != nil {
+			break
+		}
+		if msg[0]&0x20 == 0 || binary.BigEndian.Uint32(msg[8:12]) != mdd.rtcpSSRC || int(msg[len(msg)-1]) != probePadding {
+			t.Fatalf("Incorrect probe packet: %x", msg)
+		}
+		probes += 1
+	}
+	if probes == 0 {
+		t.Fatalf("No probe sent")
+	}
+
+	// ... and moved once the probe got through
+	if ssrc := selectLayers(); ssrc != 0x20 {
+		t.Fatalf("Receiver not moved up after a probe: %08x", ssrc)
+	}
+}
+
+func TestBandwidthProbeFailure(t *testing.T) {
+	mdd := NewMDD()
+	mdd.RIDExtensionID = 2
+	mdd.BandwidthProbing = true
+
+	for _, id := range []AssociationID{0x0001, 0x0002} {
+		mdd.SetAssociationConference(id, DefaultConfID)
+	}
+	sender, receiver := mdd.association(0x0001), mdd.association(0x0002)
+	receiver.addr = &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5000}
+	receiver.profile = DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM
+	mdd.SetSimulcastRIDs(sender.id, "q", "h")
+	mdd.SetReceiverLayer(receiver.id, LayerLow)
+
+	send := func(at time.Time) {
+		mdd.countIn(sender, packetClassSRTP, simulcastPacket(0x10, "q", at))
+		high := simulcastPacket(0x20, "h", at)
+		high.msg = append(high.msg, make([]byte, 1000)...)
+		mdd.countIn(sender, packetClassSRTP, high)
+	}
+
+	now := time.Now()
+	send(now)
+	mdd.selectLayers(now)
+	mdd.SetReceiverLayer(receiver.id, LayerHigh)
+	mdd.selectLayers(now)
+	if receiver.probe == nil || receiver.probe.ssrc != 0x20 || receiver.probe.rate <= 0 {
+		t.Fatalf("Incorrect probe: %+v", receiver.probe)
+	}
+
+	// Writes failed during the burst
+	receiver.health.failing = true
+	mdd.selectLayers(now)
+	if ssrc, _ := mdd.SelectedLayer(receiver.id, sender.id); ssrc != 0x10 {
+		t.Fatalf("Receiver moved up after a failed probe: %08x", ssrc)
+	}
+	timeline, err := mdd.Timeline(DefaultConfID)
+	if err != nil || len(timeline.Entries) == 0 || timeline.Entries[len(timeline.Entries)-1].Kind != "ProbeFailed" {
+		t.Fatalf("Failed probe not in the timeline: %+v %v", timeline, err)
+	}
+
+	// The receiver isn't probed again until the backoff is over
+	receiver.health.failing = false
+	later := now.Add(time.Second)
+	send(later)
+	mdd.selectLayers(later)
+	if receiver.probe != nil {
+		t.Fatalf("Receiver probed during the backoff")
+	}
+
+	later = now.Add(probeBackoff)
+	send(later)
+	mdd.selectLayers(later)
+	if receiver.probe == nil {
+		t.Fatalf("Receiver not probed after the backoff")
+	}
+}
@@ -0,0 +1,99 @@
+package percy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DTLS-SRTP protection profiles, as registered with IANA
+const (
+	SRTP_AES128_CM_HMAC_SHA1_80              ProtectionProfile = 0x0001
+	SRTP_AES128_CM_HMAC_SHA1_32              ProtectionProfile = 0x0002
+	SRTP_NULL_HMAC_SHA1_80                   ProtectionProfile = 0x0005
+	SRTP_NULL_HMAC_SHA1_32                   ProtectionProfile = 0x0006
+	SRTP_AEAD_AES_128_GCM                    ProtectionProfile = 0x0007
+	SRTP_AEAD_AES_256_GCM                    ProtectionProfile = 0x0008
+	DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM ProtectionProfile = 0x0009
+	DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM ProtectionProfile = 0x000A
+	SRTP_ARIA_128_CTR_HMAC_SHA1_80           ProtectionProfile = 0x000B
+	SRTP_ARIA_128_CTR_HMAC_SHA1_32           ProtectionProfile = 0x000C
+	SRTP_ARIA_256_CTR_HMAC_SHA1_80           ProtectionProfile = 0x000D
+	SRTP_ARIA_256_CTR_HMAC_SHA1_32           ProtectionProfile = 0x000E
+	SRTP_AEAD_ARIA_128_GCM                   ProtectionProfile = 0x000F
+	SRTP_AEAD_ARIA_256_GCM                   ProtectionProfile = 0x0010
+)
+
+var profileNames = map[ProtectionProfile]string{
+	SRTP_AES128_CM_HMAC_SHA1_80:              "SRTP_AES128_CM_HMAC_SHA1_80",
+	SRTP_AES128_CM_HMAC_SHA1_32:              "SRTP_AES128_CM_HMAC_SHA1_32",
+	SRTP_NULL_HMAC_SHA1_80:                   "SRTP_NULL_HMAC_SHA1_80",
+	SRTP_NULL_HMAC_SHA1_32:                   "SRTP_NULL_HMAC_SHA1_32",
+	SRTP_AEAD_AES_128_GCM:                    "SRTP_AEAD_AES_128_GCM",
+	SRTP_AEAD_AES_256_GCM:                    "SRTP_AEAD_AES_256_GCM",
+	DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM: "DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM",
+	DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM: "DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM",
+	SRTP_ARIA_128_CTR_HMAC_SHA1_80:           "SRTP_ARIA_128_CTR_HMAC_SHA1_80",
+	SRTP_ARIA_128_CTR_HMAC_SHA1_32:           "SRTP_ARIA_128_CTR_HMAC_SHA1_32",
+	SRTP_ARIA_256_CTR_HMAC_SHA1_80:           "SRTP_ARIA_256_CTR_HMAC_SHA1_80",
+	SRTP_ARIA_256_CTR_HMAC_SHA1_32:           "SRTP_ARIA_256_CTR_HMAC_SHA1_32",
+	SRTP_AEAD_ARIA_128_GCM:                   "SRTP_AEAD_ARIA_128_GCM",
+	SRTP_AEAD_ARIA_256_GCM:                   "SRTP_AEAD_ARIA_256_GCM",
+}
+
+func (profile ProtectionProfile) String() string {
+	if name, ok := profileNames[profile]; ok {
+		return name
+	}
+	return fmt.Sprintf("<0x%04x>", uint16(profile))
+}
+
+// Parses a protection profile from either its IANA name (case-insensitive)
+// or its number, in decimal or hex (e.g., "7" or "0x0007")
+func ParseProtectionProfile(val string) (ProtectionProfile, error) {
+	val = strings.TrimSpace(val)
+	for profile, name := range profileNames {
+		if strings.EqualFold(val, name) {
+			return profile, nil
+		}
+	}
+
+	num, err := strconv.ParseUint(val, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Unknown protection profile '%s'", val)
+	}
+	return ProtectionProfile(num), nil
+}
+
+// Parses a comma-separated list of protection profiles
+func ParseProtectionProfiles(val string) ([]ProtectionProfile, error) {
+	profiles := []ProtectionProfile{}
+	for _, field := range strings.Split(val, ",") {
+		if len(strings.TrimSpace(field)) == 0 {
+			continue
+		}
+
+		profile, err := ParseProtectionProfile(field)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func (profile ProtectionProfile) MarshalText() ([]byte, error) {
+	if name, ok := profileNames[profile]; ok {
+		return []byte(name), nil
+	}
+	return []byte(fmt.Sprintf("0x%04x", uint16(profile))), nil
+}
+
+func (profile *ProtectionProfile) UnmarshalText(text []byte) error {
+	parsed, err := ParseProtectionProfile(string(text))
+	if err != nil {
+		return err
+	}
+	*profile = parsed
+	return nil
+}
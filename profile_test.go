@@ -0,0 +1,56 @@
+package percy
+
+import (
+	"testing"
+)
+
+func TestParseProtectionProfile(t *testing.T) {
+	cases := map[string]ProtectionProfile{
+		"SRTP_AEAD_AES_128_GCM":                     SRTP_AEAD_AES_128_GCM,
+		"srtp_aead_aes_256_gcm":                     SRTP_AEAD_AES_256_GCM,
+		" DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM": DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM,
+		"0x0007": SRTP_AEAD_AES_128_GCM,
+		"9":      DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM,
+		"0xfeed": ProtectionProfile(0xfeed),
+	}
+
+	for val, expected := range cases {
+		profile, err := ParseProtectionProfile(val)
+		if err != nil {
+			t.Fatalf("Error parsing '%s': %v", val, err)
+		}
+		if profile != expected {
+			t.Fatalf("Incorrect profile for '%s': %v != %v", val, profile, expected)
+		}
+	}
+
+	for _, val := range []string{"", "SRTP_BOGUS", "0x10000"} {
+		_, err := ParseProtectionProfile(val)
+		if err == nil {
+			t.Fatalf("Parsed invalid profile '%s'", val)
+		}
+	}
+}
+
+func TestProtectionProfileText(t *testing.T) {
+	for _, profile := range []ProtectionProfile{SRTP_AEAD_AES_128_GCM, ProtectionProfile(0xfeed)} {
+		text, err := profile.MarshalText()
+		if err != nil {
+			t.Fatalf("Error marshaling %v: %v", profile, err)
+		}
+
+		var parsed ProtectionProfile
+		err = parsed.UnmarshalText(text)
+		if err != nil {
+			t.Fatalf("Error unmarshaling '%s': %v", text, err)
+		}
+		if parsed != profile {
+			t.Fatalf("Profile did not round-trip: %v != %v", parsed, profile)
+		}
+	}
+
+	profiles, err := ParseProtectionProfiles("SRTP_AEAD_AES_128_GCM, 0x0009")
+	if err != nil || len(profiles) != 2 || profiles[1] != DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM {
+		t.Fatalf("Error parsing profile list: %v %v", profiles, err)
+	}
+}
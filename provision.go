@@ -0,0 +1,172 @@
+package percy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Large scheduled conferences are set up ahead of time, with hundreds of
+// endpoints whose addresses and credentials signaling already knows.
+// ProvisionEndpoints installs a whole batch at once (also as POST
+// /admin/provision), and either all of it takes effect or none of it does:
+// if any endpoint is invalid, or would take its conference or tenant over
+// its participant limit, the associations already placed by the batch are
+// taken back out before the lock is released, so nothing ever sees a
+// half-provisioned conference.
+
+type Endpoint struct {
+	Addr        string            `json:"addr,omitempty"`  // host:port; if empty, Assoc is used
+	Assoc       AssociationID     `json:"assoc,omitempty"` // For endpoints without a known address
+	Conf        ConfID            `json:"conf"`
+	Role        string            `json:"role,omitempty"`
+	ICEUfrag    string            `json:"ice_ufrag,omitempty"`
+	ICEPassword string            `json:"ice_password,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// An endpoint of a batch, as it's being placed
+type provisioned struct {
+	endpoint *Endpoint
+	id       AssociationID
+	addr     net.Addr
+	assoc    *association
+	known    bool
+	prevConf ConfID
+}
+
+// Installs a batch of endpoints.  Returns their association IDs, in order,
+// or an error naming the first endpoint that couldn't be placed, in which
+// case none of them are.
+func (mdd *MDD) ProvisionEndpoints(endpoints []Endpoint) ([]AssociationID, error) {
+	batch := make([]provisioned, len(endpoints))
+	seen := map[AssociationID]int{}
+	for i := range endpoints {
+		entry := &batch[i]
+		entry.endpoint = &endpoints[i]
+		entry.id = endpoints[i].Assoc
+
+		if len(endpoints[i].Addr) > 0 {
+			addr, err := net.ResolveUDPAddr("udp", endpoints[i].Addr)
+			if err != nil {
+				return nil, fmt.Errorf("Endpoint %d: %v", i, err)
+			}
+			entry.addr = addr
+			entry.id, _, err = mdd.addressAssoc(addr)
+			if err != nil {
+				return nil, fmt.Errorf("Endpoint %d: %v", i, err)
+			}
+		} else if entry.id == 0 {
+			return nil, fmt.Errorf("Endpoint %d has neither an address nor an association ID", i)
+		}
+
+		if j, dup := seen[entry.id]; dup {
+			return nil, fmt.Errorf("Endpoints %d and %d map to the same association [%04x]", j, i, entry.id)
+		}
+		seen[entry.id] = i
+	}
+
+	// Conferences the batch creates are removed again if it fails
+	mdd.mu.Lock()
+	created := map[ConfID]bool{}
+	confs := map[ConfID]*conference{}
+	for _, entry := range batch {
+		confID := entry.endpoint.Conf
+		if _, ok := confs[confID]; ok {
+			continue
+		}
+		_, exists := mdd.conferences[confID]
+		created[confID] = !exists
+		confs[confID] = mdd.findOrAddConference(confID)
+	}
+
+	for i := range batch {
+		entry := &batch[i]
+		entry.assoc, entry.known = mdd.assocs.get(entry.id)
+		if !entry.known {
+			entry.assoc = newAssociation(entry.id)
+		}
+
+		err := mdd.checkParticipantLimits(entry.assoc, entry.known, confs[entry.endpoint.Conf])
+		if err != nil {
+			mdd.unprovision(batch[:i], created)
+			mdd.mu.Unlock()
+			mdd.rejectParticipant(entry.id, entry.endpoint.Conf, err)
+			return nil, fmt.Errorf("Endpoint %d: %v", i, err)
+		}
+
+		entry.prevConf = entry.assoc.conf
+		entry.assoc.conf = entry.endpoint.Conf
+		mdd.assocs.add(entry.assoc)
+	}
+
+	// Nothing past this point can fail
+	ids := make([]AssociationID, len(batch))
+	for i, entry := range batch {
+		ids[i] = entry.id
+		assoc, endpoint := entry.assoc, entry.endpoint
+		delete(mdd.rejected, entry.id)
+		if entry.addr != nil {
+			assoc.addr = entry.addr
+		}
+		if len(endpoint.Role) > 0 {
+			assoc.role = endpoint.Role
+		}
+		if len(endpoint.ICEUfrag) > 0 {
+			assoc.iceUfrag, assoc.icePassword = endpoint.ICEUfrag, endpoint.ICEPassword
+		}
+		if endpoint.Labels != nil {
+			mdd.assocs.setLabels(assoc, endpoint.Labels)
+		}
+	}
+	mdd.mu.Unlock()
+
+	for _, entry := range batch {
+		mdd.record(entry.endpoint.Conf, entry.id, "Joined", "provisioned")
+	}
+	log.Printf("Provisioned %d endpoints in %d conferences", len(batch), len(confs))
+	return ids, nil
+}
+
+// Takes the placed part of a failed batch back out.  The caller holds
+// mdd.mu.
+func (mdd *MDD) unprovision(placed []provisioned, created map[ConfID]bool) {
+	for _, entry := range placed {
+		if entry.known {
+			entry.assoc.conf = entry.prevConf
+		} else {
+			mdd.assocs.remove(entry.id)
+		}
+	}
+
+	for confID, isNew := range created {
+		if isNew && mdd.conferenceParticipants(confID) == 0 {
+			delete(mdd.conferences, confID)
+		}
+	}
+}
+
+// POST installs the JSON array of endpoints in the body, and returns their
+// association IDs
+func (api *AdminAPI) handleProvision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	endpoints := []Endpoint{}
+	err := json.NewDecoder(r.Body).Decode(&endpoints)
+	if err != nil {
+		http.Error(w, "Invalid endpoints", http.StatusBadRequest)
+		return
+	}
+
+	ids, err := api.mdd.ProvisionEndpoints(endpoints)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, ids)
+}
@@ -0,0 +1,92 @@
+package percy
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProvisionEndpoints(t *testing.T) {
+	mdd := NewMDD()
+	mdd.SetConferenceParticipantLimit(7, 2)
+
+	ids, err := mdd.ProvisionEndpoints([]Endpoint{
+		{Addr: "10.0.0.1:5000", Conf: 7, Role: "speaker", Labels: map[string]string{"user": "alice"}},
+		{Assoc: 0x0042, Conf: 8, ICEUfrag: "ufrag", ICEPassword: "password"},
+	})
+	if err != nil || len(ids) != 2 || ids[1] != 0x0042 {
+		t.Fatalf("Provisioning failed: %v %v", ids, err)
+	}
+
+	first, _ := mdd.assocs.get(ids[0])
+	if first.conf != 7 || first.role != "speaker" || first.addr.String() != "10.0.0.1:5000" {
+		t.Fatalf("Incorrect association: %+v", first)
+	}
+	if labels, _ := mdd.AssociationLabels(ids[0]); labels["user"] != "alice" {
+		t.Fatalf("Labels not set: %v", labels)
+	}
+	if second, _ := mdd.assocs.get(0x0042); second.conf != 8 || second.iceUfrag != "ufrag" {
+		t.Fatalf("Incorrect association: %+v", second)
+	}
+
+	// The third participant in conference 7 fails the whole batch
+	_, err = mdd.ProvisionEndpoints([]Endpoint{
+		{Assoc: 0x0043, Conf: 9},
+		{Assoc: 0x0042, Conf: 7},
+		{Assoc: 0x0044, Conf: 7},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "Endpoint 2:") {
+		t.Fatalf("Over-limit batch not refused: %v", err)
+	}
+	if _, ok := mdd.assocs.get(0x0043); ok {
+		t.Fatalf("Association left behind by a failed batch")
+	}
+	if second, _ := mdd.assocs.get(0x0042); second.conf != 8 {
+		t.Fatalf("Association moved by a failed batch")
+	}
+	if _, ok := mdd.conferences[9]; ok {
+		t.Fatalf("Conference left behind by a failed batch")
+	}
+
+	_, err = mdd.ProvisionEndpoints([]Endpoint{{Assoc: 0x0045, Conf: 9}, {Assoc: 0x0045, Conf: 9}})
+	if err == nil {
+		t.Fatalf("Duplicate endpoints accepted")
+	}
+	if _, err = mdd.ProvisionEndpoints([]Endpoint{{Conf: 9}}); err == nil {
+		t.Fatalf("Endpoint without an address or ID accepted")
+	}
+}
+
+func TestProvisionRacingCreateConference(t *testing.T) {
+	mdd := NewMDD()
+	mdd.SetConferenceParticipantLimit(7, 1)
+
+	// Each batch fails on its last endpoint, and must not take out the
+	// conference created while it ran
+	for i := 0; i < 500; i++ {
+		confID := ConfID(100 + i)
+		var wg sync.WaitGroup
+		var createErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			mdd.ProvisionEndpoints([]Endpoint{
+				{Assoc: 0x0100, Conf: confID},
+				{Assoc: 0x0101, Conf: 7},
+				{Assoc: 0x0102, Conf: 7},
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			createErr = mdd.CreateConference(confID)
+		}()
+		wg.Wait()
+
+		mdd.mu.Lock()
+		_, exists := mdd.conferences[confID]
+		mdd.mu.Unlock()
+		if createErr == nil && !exists {
+			t.Fatalf("Conference %v created, then removed by a failed batch", confID)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package percy
+
+import (
+	"log"
+	"sort"
+)
+
+// A conference can be limited to the RTP payload types its signaling
+// negotiated, so that an endpoint that's misconfigured (or worse) can't send
+// the others media in a format nobody agreed to.  Packets with any other
+// payload type are dropped before they are routed, counted in the
+// `payload_type_dropped` stat, and logged once per client and payload type.
+// The list has to include the payload types of RTX and FEC streams, if the
+// conference uses them.  The payload type is in the clear under PERC, so
+// this works in every mode.
+
+// Limits the RTP payload types forwarded in a conference; an empty list lifts
+// the limit
+func (mdd *MDD) SetConferencePayloadTypes(confID ConfID, payloadTypes []uint8) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if len(payloadTypes) == 0 {
+		conf.payloadTypes = nil
+		return
+	}
+	conf.payloadTypes = map[uint8]bool{}
+	for _, pt := range payloadTypes {
+		conf.payloadTypes[pt] = true
+	}
+}
+
+// The payload types a conference is limited to, in order, as ints so that
+// they marshal as a JSON list; nil if it isn't limited.  The caller holds
+// mdd.mu.
+func (conf *conference) allowedPayloadTypes() []int {
+	if conf.payloadTypes == nil {
+		return nil
+	}
+	payloadTypes := []int{}
+	for pt := range conf.payloadTypes {
+		payloadTypes = append(payloadTypes, int(pt))
+	}
+	sort.Ints(payloadTypes)
+	return payloadTypes
+}
+
+// Reports whether an SRTP packet has to be dropped for a payload type its
+// conference doesn't allow.  Runs on the processing loop.
+func (mdd *MDD) disallowedPayloadType(assoc *association, msg []byte) bool {
+	if len(msg) < 2 {
+		return false
+	}
+	pt := msg[1] & 0x7f
+
+	mdd.mu.Lock()
+	conf, ok := mdd.conferences[assoc.conf]
+	if !ok || conf.payloadTypes == nil || conf.payloadTypes[pt] {
+		mdd.mu.Unlock()
+		return false
+	}
+	mdd.stats.disallowed += 1
+	report := !assoc.disallowed[pt]
+	if report {
+		if assoc.disallowed == nil {
+			assoc.disallowed = map[uint8]bool{}
+		}
+		assoc.disallowed[pt] = true
+	}
+	mdd.mu.Unlock()
+
+	if report {
+		log.Printf("Dropping media with payload type %d from %s, which conference %v doesn't allow", pt, mdd.describe(assoc), assoc.conf)
+	}
+	return true
+}
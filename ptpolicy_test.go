@@ -0,0 +1,55 @@
+package percy
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestPayloadTypePolicy(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+	mdd.SetConferencePayloadTypes(DefaultConfID, []uint8{0x60, 0x6e})
+
+	sender, _ := NewClient(network, "10.0.0.1:5000")
+	defer sender.Stop()
+	receiver, _ := NewClient(network, "10.0.0.2:5000")
+	defer receiver.Stop()
+
+	video := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	audio := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06, 0x07, 0x08, 0xaa}
+	receiver.Write(video)
+	sender.Write(video)
+	AssertRecvPacket(t, receiver, video, "Allowed payload type not forwarded")
+	sender.Write(audio)
+	AssertNotRecvPacket(t, receiver, "Disallowed payload type forwarded")
+
+	stats := mdd.StatsSnapshot()
+	if stats.Global.Disallowed != 1 {
+		t.Fatalf("Incorrect disallowed count: %d", stats.Global.Disallowed)
+	}
+	if len(stats.Conferences) != 1 || len(stats.Conferences[0].PayloadTypes) != 2 || stats.Conferences[0].PayloadTypes[1] != 0x6e {
+		t.Fatalf("Incorrect conference stats: %+v", stats.Conferences)
+	}
+
+	// The limit survives a restart
+	state, _ := json.Marshal(mdd.State())
+	if !strings.Contains(string(state), `"payload_types":[96,110]`) {
+		t.Fatalf("Payload types not in state: %s", state)
+	}
+	restored := NewMDD()
+	var snapshot StateSnapshot
+	json.Unmarshal(state, &snapshot)
+	restored.RestoreState(&snapshot)
+	if pts := restored.StatsSnapshot().Conferences[0].PayloadTypes; len(pts) != 2 {
+		t.Fatalf("Payload types not restored: %v", pts)
+	}
+
+	mdd.SetConferencePayloadTypes(DefaultConfID, nil)
+	sender.Write(audio)
+	AssertRecvPacket(t, receiver, audio, "Payload type not forwarded without a limit")
+}
@@ -0,0 +1,53 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Clients that go away without saying so (closed tabs, dead networks) would
+// otherwise keep their associations forever.  An association that hasn't
+// sent anything for AssociationTimeout is evicted: it's removed as if by
+// RemoveClient, so its keys are wiped and its KD tunnel is closed (letting
+// the KD release its state too), and an EventAssociationEvicted event is
+// raised.  Associations that have never been heard from are timed from when
+// they were added.  Injectors don't receive anything, so they're left alone.
+
+const defaultAssociationTimeout = 5 * time.Minute
+
+// Evicts associations that have been idle too long.  Runs on the processing
+// loop.
+func (mdd *MDD) reapIdle(now time.Time) {
+	if mdd.AssociationTimeout <= 0 {
+		return
+	}
+
+	mdd.mu.Lock()
+	evicted := mdd.assocs.removeIf(func(assoc *association) bool {
+		last := assoc.stats.lastActivity
+		if last.IsZero() {
+			last = assoc.created
+		}
+		return assoc.injector == nil && now.Sub(last) > mdd.AssociationTimeout
+	})
+	for _, assoc := range evicted {
+		mdd.forgetPaths(assoc.id)
+		delete(mdd.rtcpPending, assoc.id)
+		mdd.stats.evicted += 1
+	}
+	mdd.mu.Unlock()
+
+	for _, assoc := range evicted {
+		mdd.teardown(assoc, mdd.tunnel(assoc))
+		log.Printf("Evicted idle association %s", mdd.describe(assoc))
+		mdd.emit(Event{
+			Type:   EventAssociationEvicted,
+			Time:   now,
+			Assoc:  assoc.id,
+			Conf:   assoc.conf,
+			Detail: fmt.Sprintf("idle for %v", mdd.AssociationTimeout),
+			Labels: mdd.assocs.labelsOf(assoc),
+		})
+	}
+}
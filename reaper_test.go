@@ -0,0 +1,60 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+type closeRecorder struct {
+	closed []AssociationID
+}
+
+func (rec *closeRecorder) Send(assocID AssociationID, msg []byte) error {
+	return nil
+}
+
+func (rec *closeRecorder) Close(assocID AssociationID) error {
+	rec.closed = append(rec.closed, assocID)
+	return nil
+}
+
+func TestIdleAssociationEviction(t *testing.T) {
+	mdd := NewMDD()
+	mdd.AssociationTimeout = time.Minute
+	tunnel := &closeRecorder{}
+	mdd.KD = tunnel
+
+	events := []Event{}
+	mdd.OnEvent(func(evt Event) {
+		events = append(events, evt)
+	})
+
+	now := time.Now()
+	mdd.SetAssociationConference(0x0001, 5)
+	key := []byte{1, 2, 3, 4}
+	mdd.association(0x0001).keys = &HBHKeys{ClientWriteKey: key}
+	mdd.SetAssociationConference(0x0002, 5)
+	mdd.association(0x0002).stats.lastActivity = now.Add(90 * time.Second)
+
+	mdd.reapIdle(now.Add(30 * time.Second))
+	if len(events) != 0 {
+		t.Fatalf("Association evicted too early: %+v", events)
+	}
+
+	mdd.reapIdle(now.Add(2 * time.Minute))
+	if _, ok := mdd.assocs.get(0x0001); ok {
+		t.Fatalf("Idle association not evicted")
+	}
+	if _, ok := mdd.assocs.get(0x0002); !ok {
+		t.Fatalf("Active association evicted")
+	}
+	if key[0] != 0 {
+		t.Fatalf("Keys of evicted association not wiped")
+	}
+	if len(tunnel.closed) != 1 || tunnel.closed[0] != 0x0001 {
+		t.Fatalf("KD tunnel not closed: %v", tunnel.closed)
+	}
+	if len(events) != 1 || events[0].Type != EventAssociationEvicted || events[0].Assoc != 0x0001 || events[0].Conf != 5 {
+		t.Fatalf("Incorrect events: %+v", events)
+	}
+}
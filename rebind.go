@@ -0,0 +1,135 @@
+package percy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// If the media socket stops working (e.g., its interface goes down or its
+// address is removed), the read loop closes it and re-binds to the configured
+// address with exponential backoff, emitting events along the way.
+
+const (
+	maxConsecutiveReadErrors = 10
+	minRebindBackoff         = 100 * time.Millisecond
+	maxRebindBackoff         = 10 * time.Second
+)
+
+func (mdd *MDD) transport() Transport {
+	mdd.connMu.RLock()
+	defer mdd.connMu.RUnlock()
+	return mdd.conn
+}
+
+func (mdd *MDD) stopping() bool {
+	select {
+	case <-mdd.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Turns on the socket options the MD is configured for.  Returns true if
+// packets have to be read with their control messages.
+func (mdd *MDD) setSocketOptions(conn Transport) bool {
+	timestamps := mdd.kernelTime && enableTimestamps(conn)
+	ecn := mdd.ecn && enableECN(conn)
+	return timestamps || ecn
+}
+
+func (mdd *MDD) readLoop(conn Transport, packetChan chan packet) {
+	defer mdd.workers.Done()
+	pinGoroutine("reader", mdd.affinity.Readers)
+
+	buf := make([]byte, 2048)
+	oob := make([]byte, 128)
+	control := mdd.setSocketOptions(conn)
+	readErrors := 0
+
+	for {
+		pkt, err := readPacket(conn, buf, oob, control)
+		if err != nil {
+			if mdd.stopping() {
+				return
+			}
+
+			readErrors += 1
+			class := mdd.countReadError(err)
+			if readErrors == 1 {
+				log.Printf("Error reading media socket (%v): %v", class, err)
+				mdd.emit(Event{Type: EventSocketError, Detail: err.Error()})
+			}
+
+			if readErrors < maxConsecutiveReadErrors && !errors.Is(err, net.ErrClosed) {
+				continue
+			}
+
+			conn = mdd.rebind(conn, err)
+			if conn == nil {
+				return
+			}
+
+			control = mdd.setSocketOptions(conn)
+			readErrors = 0
+			continue
+		}
+
+		readErrors = 0
+		select {
+		case packetChan <- pkt:
+		case <-mdd.quit:
+			return
+		}
+	}
+}
+
+// Replaces a failed socket with a new one bound to the same address.  Returns
+// nil if the MD is stopped before that succeeds.
+func (mdd *MDD) rebind(failed Transport, cause error) Transport {
+	mdd.rebindMu.Lock()
+	defer mdd.rebindMu.Unlock()
+
+	// Another reader may have replaced the socket already
+	if current := mdd.transport(); current != failed {
+		return current
+	}
+
+	addr := failed.LocalAddr()
+	failed.Close()
+
+	backoff := minRebindBackoff
+	for attempt := 1; ; attempt += 1 {
+		log.Printf("Re-binding media socket on %v (attempt %d) after: %v", addr, attempt, cause)
+		mdd.emit(Event{
+			Type:   EventSocketRebinding,
+			Detail: fmt.Sprintf("attempt %d: %v", attempt, cause),
+		})
+
+		conn, err := mdd.bind()
+		if err == nil {
+			mdd.connMu.Lock()
+			mdd.conn = conn
+			mdd.connMu.Unlock()
+
+			log.Printf("Re-bound media socket on %v", conn.LocalAddr())
+			mdd.emit(Event{Type: EventSocketRebound, Detail: conn.LocalAddr().String()})
+			return conn
+		}
+		cause = err
+
+		select {
+		case <-mdd.quit:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxRebindBackoff {
+			backoff = maxRebindBackoff
+		}
+	}
+}
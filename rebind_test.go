@@ -0,0 +1,105 @@
+package percy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestSocketRebind(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := NewMDD()
+
+	events := make(chan Event, 10)
+	mdd.OnEvent(func(evt Event) {
+		events <- evt
+	})
+
+	err := mdd.ListenTransport(func() (Transport, error) {
+		return network.Listen(mddAddr)
+	})
+	if err != nil {
+		t.Fatalf("Error starting MDD: %v", err)
+	}
+	defer mdd.Stop()
+
+	// Pull the socket out from under the read loop
+	failed := mdd.transport()
+	failed.Close()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case evt := <-events:
+			if evt.Type != EventSocketRebound {
+				continue
+			}
+
+			if mdd.transport() == failed {
+				t.Fatalf("Socket was not replaced")
+			}
+			return
+
+		case <-timeout:
+			t.Fatalf("Socket was not re-bound")
+		}
+	}
+}
+
+func TestInterfaceChange(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := NewMDD()
+
+	events := make(chan Event, 10)
+	mdd.OnEvent(func(evt Event) {
+		events <- evt
+	})
+
+	err := mdd.ListenTransport(func() (Transport, error) {
+		return network.Listen(mddAddr)
+	})
+	if err != nil {
+		t.Fatalf("Error starting MDD: %v", err)
+	}
+	defer mdd.Stop()
+
+	var mu sync.Mutex
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+	mdd.watchInterfaces(10*time.Millisecond, func() ([]net.IP, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ips, nil
+	})
+
+	original := mdd.transport()
+	mu.Lock()
+	ips = []net.IP{net.ParseIP("198.51.100.1")}
+	mu.Unlock()
+
+	changed, rebound := false, false
+	timeout := time.After(time.Second)
+	for !changed || !rebound {
+		select {
+		case evt := <-events:
+			switch evt.Type {
+			case EventInterfacesChanged:
+				changed = evt.Detail == "198.51.100.1"
+			case EventSocketRebound:
+				rebound = true
+			}
+
+		case <-timeout:
+			t.Fatalf("Interface change not handled (changed=%v, rebound=%v)", changed, rebound)
+		}
+	}
+
+	if mdd.transport() == original {
+		t.Fatalf("Socket was not replaced")
+	}
+	if addrs := mdd.AdvertisedAddresses(); len(addrs) != 1 || !addrs[0].Equal(ips[0]) {
+		t.Fatalf("Incorrect advertised addresses: %v", addrs)
+	}
+}
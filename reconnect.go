@@ -0,0 +1,100 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// A client whose network path changes (e.g., Wi-Fi to cellular, or a NAT
+// rebinding) shows up from a new address, and so as a new association with
+// no keys.  Rather than make it rekey, the MD recognizes it by its ICE
+// credentials: if a successful Binding request from a new association
+// carries the same USERNAME as a keyed association that went quiet no more
+// than ReconnectGrace ago, the old association's SRTP contexts (keys,
+// rollover counters and sequence state) and conference move to the new one,
+// and the old one is removed.
+//
+// An association that has been heard from within the last second is taken
+// to still be in use, since ICE checks every candidate pair with the same
+// USERNAME.  Only PERC associations can resume this way; in SFU mode the
+// DTLS session is tied to the old address, so the client handshakes again.
+
+const (
+	defaultReconnectGrace = 10 * time.Second
+	minReconnectSilence   = time.Second
+)
+
+// Records the USERNAME of a successful Binding request, and if it belongs
+// to an association that has just lost its path, has the processing loop
+// move that association's state over.  Called by the STUN workers.
+func (mdd *MDD) noteICEUsername(assoc *association, username string, now time.Time) {
+	previous := mdd.previousAssociation(assoc, username, now)
+	if previous == nil {
+		return
+	}
+
+	mdd.runOnLoop(func() { mdd.resume(assoc, previous) })
+}
+
+// Records the USERNAME for an association, and returns the association it
+// is reconnecting, if any
+func (mdd *MDD) previousAssociation(assoc *association, username string, now time.Time) *association {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assoc.iceUsername = username
+	if mdd.ReconnectGrace <= 0 || assoc.keys != nil {
+		return nil
+	}
+
+	for _, other := range mdd.assocs.snapshot() {
+		if other == assoc || other.iceUsername != username || other.keys == nil {
+			continue
+		}
+
+		silence := now.Sub(other.stats.lastActivity)
+		if silence >= minReconnectSilence && silence <= mdd.ReconnectGrace {
+			return other
+		}
+	}
+	return nil
+}
+
+// Moves a reconnecting client's state from its old association to its new
+// one.  Runs on the processing loop.
+func (mdd *MDD) resume(assoc, previous *association) {
+	mdd.mu.Lock()
+	if _, ok := mdd.assocs.get(previous.id); !ok || assoc.keys != nil {
+		mdd.mu.Unlock()
+		return
+	}
+
+	assoc.recv, assoc.send = previous.recv, previous.send
+	assoc.prevRecv, assoc.prevRecvUntil = previous.prevRecv, previous.prevRecvUntil
+	assoc.profile, assoc.keys = previous.profile, previous.keys
+	assoc.keyEpoch = previous.keyEpoch
+	assoc.conf = previous.conf
+	assoc.loopback = previous.loopback
+	if len(assoc.iceUfrag) == 0 {
+		assoc.iceUfrag, assoc.icePassword = previous.iceUfrag, previous.icePassword
+	}
+	if mdd.assocs.labelsOf(assoc) == nil {
+		mdd.assocs.setLabels(assoc, mdd.assocs.labelsOf(previous))
+	}
+
+	// The keys now belong to the new association, so they mustn't be wiped
+	previous.keys = nil
+	previous.keyEpoch = 0
+	mdd.assocs.remove(previous.id)
+	mdd.forgetPaths(previous.id)
+	delete(mdd.rtcpPending, previous.id)
+	mdd.stats.resumed += 1
+	mdd.mu.Unlock()
+
+	mdd.teardown(previous, mdd.tunnel(assoc))
+	mdd.auditKey(keyAuditRecord{action: keyTransferred, assoc: assoc.id, conf: assoc.conf, epoch: assoc.keyEpoch, profile: assoc.profile, from: previous.id})
+
+	log.Printf("Association %s at %v resumed %s", mdd.describe(assoc), assoc.addr, mdd.describe(previous))
+	mdd.emit(Event{Type: EventAssociationResumed, Assoc: assoc.id, Conf: assoc.conf, Detail: fmt.Sprintf("from [%04x]", previous.id)})
+}
@@ -0,0 +1,55 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectResume(t *testing.T) {
+	mdd := NewMDD()
+
+	events := []Event{}
+	mdd.OnEvent(func(evt Event) {
+		events = append(events, evt)
+	})
+
+	now := time.Now()
+	username := "md:client"
+	mdd.SetAssociationConference(0x0001, 5)
+	old := mdd.association(0x0001)
+	old.keys = &HBHKeys{ClientWriteKey: []byte{1, 2, 3, 4}}
+	old.iceUsername = username
+	old.stats.lastActivity = now
+
+	// A path that is still carrying media is not a reconnect
+	assoc := mdd.association(0x0002)
+	if prev := mdd.previousAssociation(assoc, username, now); prev != nil {
+		t.Fatalf("Active association taken over")
+	}
+
+	// Nor is one that went quiet too long ago
+	if prev := mdd.previousAssociation(assoc, username, now.Add(time.Minute)); prev != nil {
+		t.Fatalf("Association resumed after the grace period")
+	}
+
+	if prev := mdd.previousAssociation(assoc, "md:other", now.Add(2*time.Second)); prev != nil {
+		t.Fatalf("Association resumed with different credentials")
+	}
+
+	prev := mdd.previousAssociation(assoc, username, now.Add(2*time.Second))
+	if prev != old {
+		t.Fatalf("Reconnect not recognized")
+	}
+
+	recv := old.recv
+	mdd.resume(assoc, prev)
+	if assoc.recv != recv || assoc.keys == nil || assoc.keys.ClientWriteKey[0] != 1 || assoc.conf != 5 {
+		t.Fatalf("SRTP state not moved: %+v", assoc)
+	}
+	if _, ok := mdd.assocs.get(0x0001); ok {
+		t.Fatalf("Old association not removed")
+	}
+	if len(events) != 1 || events[0].Type != EventAssociationResumed || events[0].Assoc != 0x0002 {
+		t.Fatalf("Incorrect events: %+v", events)
+	}
+}
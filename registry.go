@@ -0,0 +1,98 @@
+package percy
+
+import (
+	"sync"
+)
+
+// The MD's associations are kept in a registry with its own lock, so that
+// lookups, adds and removes are safe from any goroutine: the processing loop,
+// the KD tunnels, the admin API and applications.  Code that iterates takes
+// a snapshot, so that forwarding to a set of receivers never holds the lock
+// while writing to the socket, and a receiver can be removed mid-broadcast.
+//
+// Operations that have to check other state before changing the registry
+// (e.g., participant limits) still hold mdd.mu around the check and the
+// change.  mdd.mu is always taken before the registry's lock, never after.
+
+type assocRegistry struct {
+	mu     sync.RWMutex
+	assocs map[AssociationID]*association
+}
+
+func newAssocRegistry() *assocRegistry {
+	return &assocRegistry{assocs: map[AssociationID]*association{}}
+}
+
+func (reg *assocRegistry) get(assocID AssociationID) (*association, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	assoc, ok := reg.assocs[assocID]
+	return assoc, ok
+}
+
+// Adds an association, replacing any with the same ID
+func (reg *assocRegistry) add(assoc *association) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.assocs[assoc.id] = assoc
+}
+
+// Returns the association with the given ID, adding the one create returns if
+// there isn't one.  create is called with the lock held.
+func (reg *assocRegistry) getOrAdd(assocID AssociationID, create func() *association) (*association, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if assoc, ok := reg.assocs[assocID]; ok {
+		return assoc, true
+	}
+	assoc := create()
+	reg.assocs[assocID] = assoc
+	return assoc, false
+}
+
+// Removes an association, and returns it if it was present
+func (reg *assocRegistry) remove(assocID AssociationID) (*association, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	assoc, ok := reg.assocs[assocID]
+	delete(reg.assocs, assocID)
+	return assoc, ok
+}
+
+// Removes the associations that match, and returns them
+func (reg *assocRegistry) removeIf(match func(assoc *association) bool) []*association {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	removed := []*association{}
+	for assocID, assoc := range reg.assocs {
+		if match(assoc) {
+			removed = append(removed, assoc)
+			delete(reg.assocs, assocID)
+		}
+	}
+	return removed
+}
+
+func (reg *assocRegistry) len() int {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	return len(reg.assocs)
+}
+
+// Returns the associations as of now, in no particular order
+func (reg *assocRegistry) snapshot() []*association {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	assocs := make([]*association, 0, len(reg.assocs))
+	for _, assoc := range reg.assocs {
+		assocs = append(assocs, assoc)
+	}
+	return assocs
+}
@@ -0,0 +1,47 @@
+package percy
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAssocRegistryConcurrency(t *testing.T) {
+	reg := newAssocRegistry()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				assocID := AssociationID(worker*1000 + i)
+				reg.add(newAssociation(assocID))
+				if _, ok := reg.get(assocID); !ok {
+					t.Errorf("Association %v not found after adding", assocID)
+				}
+				reg.snapshot()
+				if i%2 == 0 {
+					reg.remove(assocID)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if reg.len() != 200 {
+		t.Fatalf("Incorrect number of associations: %d", reg.len())
+	}
+
+	removed := reg.removeIf(func(assoc *association) bool { return assoc.id < 1000 })
+	if len(removed) != 50 || reg.len() != 150 {
+		t.Fatalf("Incorrect removal: %d removed, %d left", len(removed), reg.len())
+	}
+
+	assoc, existed := reg.getOrAdd(1, func() *association { return newAssociation(1) })
+	if existed || assoc.id != 1 {
+		t.Fatalf("Incorrect new association: %v %v", assoc.id, existed)
+	}
+	if again, existed := reg.getOrAdd(1, nil); !existed || again != assoc {
+		t.Fatalf("Existing association not returned")
+	}
+}
@@ -0,0 +1,164 @@
+package percy
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// Endpoints that don't do transport-wide congestion control (see
+// transportcc.go) rely on the receiver to estimate the bandwidth, and tell
+// them with a REMB message (draft-alvestrand-rmcat-remb).  With REMB set,
+// the MD does this for each sender's leg, a simplified version of the
+// receive-side estimator in draft-ietf-rmcat-gcc:
+//
+//   - Each frame's arrival is compared with its RTP timestamp, and the
+//     differences are accumulated into an estimate of the queueing delay on
+//     the leg.  Queueing delay over rembOveruseDelay is overuse.
+//   - Every second, the estimate drops below the incoming rate on overuse,
+//     drops with the loss rate when that's high, and otherwise grows by
+//     rembIncrease, but no further than rembHeadroom times what the sender
+//     is actually sending.
+//
+// Senders that get transport-wide feedback are left to run their own
+// estimator from it.
+
+const (
+	rembOveruseDelay = 30 * time.Millisecond
+	rembQueueDecay   = 0.99 // Per frame, so clock drift doesn't look like queueing
+	rembDecrease     = 0.85
+	rembIncrease     = 1.08
+	rembHeadroom     = 1.5
+	rembHighLoss     = 0.1
+	rembLowLoss      = 0.02
+	rembMinBitrate   = 30000
+)
+
+type bandwidthEstimator struct {
+	streams  map[uint32]*bweStream
+	queue    float64 // Estimated queueing delay, in seconds
+	expected uint32  // Packets this interval
+	received uint32
+	estimate float64 // Bits per second; zero until the first interval
+}
+
+// The first packet of the latest frame of a stream
+type bweStream struct {
+	seq       uint16
+	timestamp uint32
+	arrival   time.Time
+}
+
+// Accounts for a packet's arrival.  Guarded by mdd.mu.
+func (bwe *bandwidthEstimator) update(header *RTPHeader, arrival time.Time, clockRate uint32) {
+	if bwe.streams == nil {
+		bwe.streams = map[uint32]*bweStream{}
+	}
+	stream, ok := bwe.streams[header.SSRC]
+	if !ok {
+		bwe.streams[header.SSRC] = &bweStream{seq: header.SequenceNumber, timestamp: header.Timestamp, arrival: arrival}
+		bwe.expected += 1
+		bwe.received += 1
+		return
+	}
+
+	// Reordered and repeated packets don't count
+	gap := header.SequenceNumber - stream.seq
+	if gap == 0 || gap >= 0x8000 {
+		return
+	}
+	bwe.expected += uint32(gap)
+	bwe.received += 1
+	stream.seq = header.SequenceNumber
+
+	if elapsed := int32(header.Timestamp - stream.timestamp); elapsed > 0 {
+		d := arrival.Sub(stream.arrival).Seconds() - float64(elapsed)/float64(clockRate)
+		bwe.queue = math.Max(0, bwe.queue*rembQueueDecay+d)
+		stream.timestamp = header.Timestamp
+		stream.arrival = arrival
+	}
+}
+
+// Updates the estimate at the end of an interval, given what the sender
+// sent during it, and starts a new interval
+func (bwe *bandwidthEstimator) next(incoming float64) float64 {
+	loss := 0.0
+	if bwe.expected > 0 && bwe.received < bwe.expected {
+		loss = 1 - float64(bwe.received)/float64(bwe.expected)
+	}
+	bwe.expected, bwe.received = 0, 0
+
+	switch {
+	case bwe.estimate == 0:
+		bwe.estimate = incoming
+	case bwe.queue > rembOveruseDelay.Seconds():
+		bwe.estimate = math.Min(bwe.estimate, incoming) * rembDecrease
+	case loss > rembHighLoss:
+		bwe.estimate *= 1 - loss/2
+	case loss < rembLowLoss:
+		bwe.estimate *= rembIncrease
+	}
+
+	bwe.estimate = math.Min(bwe.estimate, math.Max(incoming*rembHeadroom, rembMinBitrate))
+	bwe.estimate = math.Max(bwe.estimate, rembMinBitrate)
+	return bwe.estimate
+}
+
+// Builds a REMB message for a bitrate and the SSRCs it applies to
+func rembPacket(senderSSRC uint32, bitrate float64, ssrcs []uint32) []byte {
+	mantissa, exp := uint64(bitrate), 0
+	for mantissa > 0x3ffff {
+		mantissa >>= 1
+		exp += 1
+	}
+
+	msg := make([]byte, 20, 20+4*len(ssrcs))
+	msg[0] = 0x80 | rtcpFormatREMB
+	msg[1] = RTCPTypePSFB
+	binary.BigEndian.PutUint16(msg[2:4], uint16(4+len(ssrcs)))
+	binary.BigEndian.PutUint32(msg[4:8], senderSSRC)
+	copy(msg[12:16], "REMB")
+	binary.BigEndian.PutUint32(msg[16:20], uint32(len(ssrcs))<<24|uint32(exp)<<18|uint32(mantissa))
+	for _, ssrc := range ssrcs {
+		msg = binary.BigEndian.AppendUint32(msg, ssrc)
+	}
+	return msg
+}
+
+// Sends each sender a REMB with a fresh estimate for its leg.  Runs on the
+// processing loop.
+func (mdd *MDD) sendREMB(now time.Time) {
+	if !mdd.REMB {
+		return
+	}
+
+	mdd.mu.Lock()
+	messages := map[*association][]byte{}
+	for _, sender := range mdd.assocs.snapshot() {
+		if sender.addr == nil || sender.profile == 0 || (mdd.TransportCCID != 0 && sender.transportCC.started) {
+			continue
+		}
+
+		incoming := 0.0
+		ssrcs := []uint32{}
+		for ssrc, counters := range sender.stats.ssrcs {
+			if now.Sub(counters.last) <= ssrcRateWindow {
+				incoming += counters.stats(ssrc, now).Bitrate
+				ssrcs = append(ssrcs, ssrc)
+			}
+		}
+		if len(ssrcs) == 0 {
+			continue
+		}
+		sort.Slice(ssrcs, func(i, j int) bool { return ssrcs[i] < ssrcs[j] })
+		messages[sender] = rembPacket(mdd.rtcpSSRC, sender.bwe.next(incoming), ssrcs)
+	}
+	mdd.mu.Unlock()
+
+	for sender, msg := range messages {
+		mdd.sendRTCP(sender, &rtp.RTCPPacket{Buffer: msg}, nil)
+	}
+}
@@ -0,0 +1,104 @@
+package percy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestREMBPacket(t *testing.T) {
+	msg := rembPacket(0x0a0b0c0d, 1000000, []uint32{0x01020304, 0x05060708})
+	expected := []byte{
+		0x8f, 0xce, 0x00, 0x06, 0x0a, 0x0b, 0x0c, 0x0d, 0x00, 0x00, 0x00, 0x00,
+		'R', 'E', 'M', 'B', 0x02, 0x0b, 0xd0, 0x90, // 250000 * 2^2
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	}
+	if !bytes.Equal(msg, expected) {
+		t.Fatalf("Incorrect REMB:\n%x\n%x", msg, expected)
+	}
+
+	// Precision is lost as the exponent grows
+	msg = rembPacket(0, 10000001, nil)
+	entry := binary.BigEndian.Uint32(msg[16:20])
+	if exp, mantissa := entry>>18&0x3f, entry&0x3ffff; mantissa<<exp > 10000001 || mantissa<<exp < 9990000 {
+		t.Fatalf("Incorrect REMB bitrate: %d * 2^%d", mantissa, exp)
+	}
+}
+
+func TestBandwidthEstimator(t *testing.T) {
+	var bwe bandwidthEstimator
+	start := time.Now()
+	header := &RTPHeader{SSRC: 1}
+	send := func(frames int, spacing time.Duration, skip uint16) {
+		for i := 0; i < frames; i++ {
+			header.SequenceNumber += 1 + skip
+			header.Timestamp += 3000 // 33ms at 90kHz
+			start = start.Add(spacing)
+			bwe.update(header, start, 90000)
+		}
+	}
+
+	send(30, 33333*time.Microsecond, 0)
+	if estimate := bwe.next(1000000); estimate != 1000000 {
+		t.Fatalf("Estimate didn't start at the incoming rate: %v", estimate)
+	}
+
+	// Without loss or queueing, it grows, but not past the headroom
+	for i := 0; i < 10; i++ {
+		send(30, 33333*time.Microsecond, 0)
+		bwe.next(1000000)
+	}
+	if bwe.estimate != 1000000*rembHeadroom {
+		t.Fatalf("Estimate didn't grow to the headroom: %v", bwe.estimate)
+	}
+
+	// Frames arriving further apart than they were sent mean a queue
+	send(30, 40*time.Millisecond, 0)
+	if estimate := bwe.next(800000); estimate != 800000*rembDecrease {
+		t.Fatalf("Estimate didn't drop on overuse: %v", estimate)
+	}
+
+	// Once the queue drains, heavy loss still brings it down
+	bwe.queue = 0
+	before := bwe.estimate
+	send(30, 33333*time.Microsecond, 1)
+	if estimate := bwe.next(800000); estimate != before*0.75 {
+		t.Fatalf("Estimate didn't drop with loss: %v", estimate)
+	}
+}
+
+func TestREMBGeneration(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.REMB = true
+
+	clients := newKeyedClients(t, network, mdd, "10.0.0.1:5000", "10.0.0.2:5000")
+
+	sender, receiver := clients[0], clients[1]
+	audio := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	sender.Write(audio)
+	AssertRecvPacket(t, receiver, audio, "SRTP packet not forwarded")
+
+	mdd.runOnLoop(func() { mdd.sendREMB(time.Now()) })
+	msg, err := sender.Recv()
+	if err != nil {
+		t.Fatalf("No REMB: %v", err)
+	}
+	headers, err := ParseRTCPCompound(msg)
+	if err != nil || len(headers) != 1 || headers[0].PacketType != RTCPTypePSFB || headers[0].Count != rtcpFormatREMB || string(msg[12:16]) != "REMB" {
+		t.Fatalf("Incorrect REMB: %x %v", msg, err)
+	}
+	if ssrc := binary.BigEndian.Uint32(msg[20:24]); msg[16] != 1 || ssrc != 0x01020304 {
+		t.Fatalf("REMB for the wrong streams: %x", msg)
+	}
+	AssertNotRecvPacket(t, receiver, "REMB sent to a receiver")
+	for _, stats := range mdd.StatsSnapshot().Associations {
+		if stats.ID == sender.Assoc() && stats.Estimate < rembMinBitrate {
+			t.Fatalf("Estimate not in stats: %v", stats.Estimate)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package percy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The MD learns which association sends each SSRC from the (unencrypted)
+// RTP headers, and keeps that as a routing table.  Receivers can subscribe
+// to particular SSRCs, and then only get media from those, e.g., for
+// last-N forwarding or when a client only shows some of the participants.
+// Receivers that haven't subscribed to anything get every stream in their
+// conference, as before.  Sender reports follow the media they describe;
+// DTLS isn't affected.
+//
+// Signaling that doesn't link the MD in can do the same through
+// /admin/subscriptions.
+
+// Returns the association sending each SSRC that has been seen
+func (mdd *MDD) Routes() map[uint32]AssociationID {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	routes := make(map[uint32]AssociationID, len(mdd.routes))
+	for ssrc, assocID := range mdd.routes {
+		if _, ok := mdd.assocs.get(assocID); ok {
+			routes[ssrc] = assocID
+		}
+	}
+	return routes
+}
+
+// Limits the streams a receiver gets to the given SSRCs, in addition to any
+// it has already subscribed to
+func (mdd *MDD) Subscribe(assocID AssociationID, ssrcs ...uint32) {
+	assoc := mdd.association(assocID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if assoc.subscriptions == nil {
+		assoc.subscriptions = map[uint32]bool{}
+	}
+	for _, ssrc := range ssrcs {
+		assoc.subscriptions[ssrc] = true
+	}
+}
+
+// Stops sending the given SSRCs to a receiver.  Once it has no
+// subscriptions left, it gets nothing until it subscribes again or
+// ClearSubscriptions is called.
+func (mdd *MDD) Unsubscribe(assocID AssociationID, ssrcs ...uint32) error {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assoc, ok := mdd.assocs.get(assocID)
+	if !ok {
+		return fmt.Errorf("Unknown client [%04x]", assocID)
+	}
+	if assoc.subscriptions == nil {
+		assoc.subscriptions = map[uint32]bool{}
+	}
+	for _, ssrc := range ssrcs {
+		delete(assoc.subscriptions, ssrc)
+	}
+	return nil
+}
+
+// Goes back to sending a receiver every stream in its conference
+func (mdd *MDD) ClearSubscriptions(assocID AssociationID) {
+	assoc := mdd.association(assocID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.subscriptions = nil
+}
+
+// Returns the SSRCs a receiver has subscribed to, or nil if it gets every
+// stream
+func (mdd *MDD) Subscriptions(assocID AssociationID) ([]uint32, error) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assoc, ok := mdd.assocs.get(assocID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown client [%04x]", assocID)
+	}
+	if assoc.subscriptions == nil {
+		return nil, nil
+	}
+
+	ssrcs := make([]uint32, 0, len(assoc.subscriptions))
+	for ssrc := range assoc.subscriptions {
+		ssrcs = append(ssrcs, ssrc)
+	}
+	sort.Slice(ssrcs, func(i, j int) bool { return ssrcs[i] < ssrcs[j] })
+	return ssrcs, nil
+}
+
+// Records the sender of an SSRC.  The caller holds mdd.mu.
+func (mdd *MDD) learnRoute(sender *association, ssrc uint32) {
+	mdd.routes[ssrc] = sender.id
+}
+
+// Returns the peers that should get an SRTP packet from a sender
+func (mdd *MDD) subscribers(sender *association, msg []byte) []*association {
+	peers := mdd.peers(sender)
+	ssrc := packetSSRC(packetClassSRTP, msg)
+	if mdd.mutedMedia(sender, msg) || mdd.outsideLastN(sender, msg) {
+		return peers[:0]
+	}
+
+	fec := mdd.isFEC(msg)
+	now := time.Now()
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	receivers := peers[:0]
+	for _, assoc := range peers {
+		if (assoc.subscriptions == nil || assoc.subscriptions[ssrc]) && !assoc.withheld[ssrc] &&
+			!(fec && assoc.noFEC) && mdd.onSelectedLayer(assoc, sender, ssrc, now) {
+			receivers = append(receivers, assoc)
+		}
+	}
+	return receivers
+}
+
+// GET returns a receiver's subscriptions (null for every stream), POST
+// subscribes it to the "ssrc" parameters, and DELETE unsubscribes it from
+// them.  DELETE without SSRCs goes back to every stream.
+func (api *AdminAPI) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	assocID, err := strconv.ParseUint(r.FormValue("assoc"), 0, 16)
+	if err != nil {
+		http.Error(w, "Invalid association ID", http.StatusBadRequest)
+		return
+	}
+
+	ssrcs := []uint32{}
+	for _, value := range r.Form["ssrc"] {
+		ssrc, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			http.Error(w, "Invalid SSRC", http.StatusBadRequest)
+			return
+		}
+		ssrcs = append(ssrcs, uint32(ssrc))
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		subscriptions, err := api.mdd.Subscriptions(AssociationID(assocID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, subscriptions)
+		return
+
+	case http.MethodPost:
+		api.mdd.Subscribe(AssociationID(assocID), ssrcs...)
+
+	case http.MethodDelete:
+		if len(ssrcs) == 0 {
+			api.mdd.ClearSubscriptions(AssociationID(assocID))
+			break
+		}
+		err = api.mdd.Unsubscribe(AssociationID(assocID), ssrcs...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
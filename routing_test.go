@@ -0,0 +1,88 @@
+package percy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestSSRCRouting(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+
+	clients := []*Client{}
+	for _, addr := range []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000"} {
+		client, _ := NewClient(network, addr)
+		defer client.Stop()
+		clients = append(clients, client)
+	}
+
+	// Let the MD learn everyone's address; each hears from the later ones
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	for i, client := range clients {
+		client.Write(hello)
+		for _, earlier := range clients[:i] {
+			AssertRecvPacket(t, earlier, hello, "DTLS packet was not relayed")
+		}
+	}
+
+	mdd.Subscribe(clients[1].Assoc(), 0x05060708)
+
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	clients[0].Write(srtpPacket)
+	AssertRecvPacket(t, clients[2], srtpPacket, "SRTP packet not sent to a receiver without subscriptions")
+	AssertNotRecvPacket(t, clients[1], "SRTP packet sent to a receiver not subscribed to it")
+
+	if routes := mdd.Routes(); len(routes) != 1 || routes[0x01020304] != clients[0].Assoc() {
+		t.Fatalf("Incorrect routes: %v", routes)
+	}
+
+	mdd.Subscribe(clients[1].Assoc(), 0x01020304)
+	clients[0].Write(srtpPacket)
+	AssertRecvPacket(t, clients[1], srtpPacket, "SRTP packet not sent to a subscriber")
+	AssertRecvPacket(t, clients[2], srtpPacket, "SRTP packet not sent to a receiver without subscriptions")
+}
+
+func TestSubscriptionsAdmin(t *testing.T) {
+	auth := NewMemoryAuthProvider()
+	auth.AddAdminToken("secret")
+
+	mdd := NewMDD()
+	mdd.Auth = auth
+	api := NewAdminAPI(mdd)
+	mdd.SetAssociationConference(0x0001, DefaultConfID)
+
+	request := func(method, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/subscriptions?assoc=1"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := httptest.NewRecorder()
+		api.ServeHTTP(resp, req)
+		return resp
+	}
+
+	if resp := request("POST", "&ssrc=7&ssrc=0x10"); resp.Code != http.StatusNoContent {
+		t.Fatalf("Subscribe failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := request("DELETE", "&ssrc=7"); resp.Code != http.StatusNoContent {
+		t.Fatalf("Unsubscribe failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if ssrcs, _ := mdd.Subscriptions(0x0001); len(ssrcs) != 1 || ssrcs[0] != 0x10 {
+		t.Fatalf("Incorrect subscriptions: %v", ssrcs)
+	}
+	if resp := request("GET", ""); strings.TrimSpace(resp.Body.String()) != "[16]" {
+		t.Fatalf("Incorrect subscriptions listed: %s", resp.Body.String())
+	}
+
+	request("DELETE", "")
+	if ssrcs, err := mdd.Subscriptions(0x0001); ssrcs != nil || err != nil {
+		t.Fatalf("Subscriptions not cleared: %v %v", ssrcs, err)
+	}
+	if resp := request("POST", "&ssrc=x"); resp.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid SSRC accepted: %d", resp.Code)
+	}
+}
@@ -0,0 +1,224 @@
+package percy
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// Reports are forwarded to the participants they concern (see
+// reportReceivers), which in a large conference is still most of them, so
+// the RTCP arriving on a leg grows with the size of the conference, and on a low-bandwidth leg can crowd out the media.  RFC 3550
+// (section 6.2) keeps RTCP to a small fraction of the session bandwidth by
+// spacing reports out; the MD does the same on each receiver's leg:
+//
+//   - Reports are queued per receiver, and a newer report from the same SSRC
+//     replaces a queued one, since only the latest one is useful
+//   - The queue is flushed no more often than the minimum interval
+//   - Each flush sends only what fits in the receiver's RTCP bandwidth; the
+//     rest waits for the next flush, oldest first
+//
+// Shaping runs on the processing loop, so none of this needs locking.
+
+const (
+	defaultRTCPMinInterval = time.Second
+)
+
+type RTCPShaping struct {
+	MinInterval time.Duration // Between flushes to a receiver; zero forwards immediately
+	Bandwidth   float64       // RTCP bits per second to each receiver; zero for no cap
+}
+
+type rtcpReport struct {
+	ssrc uint32
+	pkt  *rtp.RTCPPacket
+	size int
+}
+
+type rtcpShaper struct {
+	queue      []rtcpReport
+	lastFlush  time.Time
+	bucket     float64 // Bits that can be sent, up to one interval's worth
+	bucketTime time.Time
+}
+
+// Queues a report for a receiver, replacing any queued one from the same
+// SSRC.  Returns true if it replaced one.
+func (rs *rtcpShaper) enqueue(report rtcpReport) bool {
+	for i := range rs.queue {
+		if rs.queue[i].ssrc == report.ssrc {
+			rs.queue[i] = report
+			return true
+		}
+	}
+	rs.queue = append(rs.queue, report)
+	return false
+}
+
+// Returns the reports that are due to be sent, leaving the rest queued
+func (rs *rtcpShaper) due(now time.Time, shaping RTCPShaping) []rtcpReport {
+	if len(rs.queue) == 0 || (!rs.lastFlush.IsZero() && now.Sub(rs.lastFlush) < shaping.MinInterval) {
+		return nil
+	}
+	rs.lastFlush = now
+
+	if shaping.Bandwidth <= 0 {
+		due := rs.queue
+		rs.queue = nil
+		return due
+	}
+
+	capacity := shaping.Bandwidth * shaping.MinInterval.Seconds()
+	if capacity < shaping.Bandwidth/10 {
+		capacity = shaping.Bandwidth / 10
+	}
+	if rs.bucketTime.IsZero() {
+		rs.bucket = capacity
+	} else {
+		rs.bucket += shaping.Bandwidth * now.Sub(rs.bucketTime).Seconds()
+		if rs.bucket > capacity {
+			rs.bucket = capacity
+		}
+	}
+	rs.bucketTime = now
+
+	// Always send at least one report, so that a cap below the size of a
+	// single report slows RTCP down rather than stopping it
+	count := 0
+	for count < len(rs.queue) {
+		bits := float64(8 * rs.queue[count].size)
+		if count > 0 && rs.bucket < bits {
+			break
+		}
+		rs.bucket -= bits
+		count += 1
+	}
+
+	due := rs.queue[:count:count]
+	rs.queue = rs.queue[count:]
+	return due
+}
+
+// Queues a receiver report for a peer, and sends whatever is due
+func (mdd *MDD) shapeRTCP(receiver *association, report rtcpReport, now time.Time, trace *packetTrace) {
+	if receiver.rtcp.enqueue(report) {
+		mdd.countRTCPCoalesced(receiver)
+		trace.log("route", "replaced queued report from %08x for [%04x]", report.ssrc, receiver.id)
+	}
+	mdd.rtcpPending[receiver.id] = receiver
+	mdd.flushRTCPTo(receiver, now, trace)
+}
+
+// Sends the reports that have become due to every receiver with a queue
+func (mdd *MDD) flushRTCP(now time.Time) {
+	for _, receiver := range mdd.rtcpPending {
+		mdd.flushRTCPTo(receiver, now, nil)
+	}
+}
+
+func (mdd *MDD) flushRTCPTo(receiver *association, now time.Time, trace *packetTrace) {
+	for _, report := range receiver.rtcp.due(now, mdd.RTCPShaping) {
+		mdd.sendRTCP(receiver, report.pkt, trace)
+	}
+
+	if len(receiver.rtcp.queue) == 0 {
+		delete(mdd.rtcpPending, receiver.id)
+	}
+}
+
+func (mdd *MDD) sendRTCP(receiver *association, pkt *rtp.RTCPPacket, trace *packetTrace) {
+	msg, err := receiver.send.EncodeRTCP(pkt)
+	if err != nil {
+		log.Printf("Error encoding packet for [%v] [%v]", receiver.id, err)
+		mdd.countEncodeError(receiver)
+		trace.log("encrypt", "for [%04x] failed: %v", receiver.id, err)
+		return
+	}
+
+	err = mdd.sendTo(receiver, msg)
+	trace.log("egress", "to [%04x] at %v: %v", receiver.id, receiver.addr, err)
+}
+
+// Feedback (NACKs, PLIs and the like) is only useful to the sender of the
+// media it is about, and is time-critical, so it bypasses shaping.  Returns
+// the peers sending the sources that feedback in a compound packet is about,
+// or nil if there is none, or no source is known.
+func (mdd *MDD) feedbackTargets(sender *association, headers []RTCPHeader) []*association {
+	sources := map[AssociationID]bool{}
+	for _, header := range headers {
+		if assocID, ok := mdd.routes[header.MediaSSRC]; ok && header.IsFeedback() {
+			sources[assocID] = true
+		}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	var targets []*association
+	for _, assoc := range mdd.peers(sender) {
+		if sources[assoc.id] {
+			targets = append(targets, assoc)
+		}
+	}
+	return targets
+}
+
+// Reports go to the receivers of the sender's media (its sender reports) and
+// to the senders of the sources they report on (their report blocks).
+// Anything else, e.g., a BYE, or reports about sources the MD doesn't know,
+// goes to every peer.
+func (mdd *MDD) reportReceivers(sender *association, headers []RTCPHeader, msg []byte) []*association {
+	peers := mdd.peers(sender)
+
+	var sent []uint32
+	reported := map[AssociationID]bool{}
+	offset := 0
+	for _, header := range headers {
+		blocks := offset + 8
+		switch header.PacketType {
+		case RTCPTypeSR:
+			sent = append(sent, header.SSRC)
+			blocks = offset + 28
+			fallthrough
+		case RTCPTypeRR:
+			for i := 0; i < int(header.Count) && blocks+24*(i+1) <= offset+header.Size; i++ {
+				source := binary.BigEndian.Uint32(msg[blocks+24*i:])
+				assocID, ok := mdd.routes[source]
+				if !ok {
+					return peers
+				}
+				reported[assocID] = true
+			}
+		case RTCPTypeSDES:
+		default:
+			return peers
+		}
+		offset += header.Size
+	}
+	if len(sent) == 0 && len(reported) == 0 {
+		return peers
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	receivers := peers[:0]
+	for _, assoc := range peers {
+		wants := false
+		for _, ssrc := range sent {
+			wants = wants || ((assoc.subscriptions == nil || assoc.subscriptions[ssrc]) && !assoc.withheld[ssrc])
+		}
+		if wants || reported[assoc.id] {
+			receivers = append(receivers, assoc)
+		}
+	}
+	return receivers
+}
+
+func (mdd *MDD) countRTCPCoalesced(assoc *association) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.stats.rtcpCoalesced += 1
+}
@@ -0,0 +1,89 @@
+package percy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestRTCPShaping(t *testing.T) {
+	shaping := RTCPShaping{MinInterval: time.Second, Bandwidth: 8 * 200}
+	shaper := rtcpShaper{}
+	now := time.Now()
+
+	// The first report goes out right away
+	shaper.enqueue(rtcpReport{ssrc: 1, size: 100})
+	if due := shaper.due(now, shaping); len(due) != 1 {
+		t.Fatalf("First report not sent: %d", len(due))
+	}
+
+	// Reports from the same SSRC replace each other until the interval is up
+	if shaper.enqueue(rtcpReport{ssrc: 1, size: 100}) {
+		t.Fatalf("Report replaced in an empty queue")
+	}
+	if !shaper.enqueue(rtcpReport{ssrc: 1, size: 100}) {
+		t.Fatalf("Report from the same SSRC not replaced")
+	}
+	shaper.enqueue(rtcpReport{ssrc: 2, size: 100})
+	shaper.enqueue(rtcpReport{ssrc: 3, size: 100})
+	if due := shaper.due(now.Add(time.Second/2), shaping); len(due) != 0 {
+		t.Fatalf("Reports sent before the interval: %d", len(due))
+	}
+
+	// Only a second's worth of bandwidth is sent, oldest first
+	due := shaper.due(now.Add(time.Second), shaping)
+	if len(due) != 2 || due[0].ssrc != 1 || due[1].ssrc != 2 {
+		t.Fatalf("Incorrect reports sent: %+v", due)
+	}
+	due = shaper.due(now.Add(2*time.Second), shaping)
+	if len(due) != 1 || due[0].ssrc != 3 {
+		t.Fatalf("Queued report not sent: %+v", due)
+	}
+}
+
+func TestRTCPFeedbackRouting(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.RTCPShaping = RTCPShaping{}
+
+	clients := newKeyedClients(t, network, mdd, "10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000")
+
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	clients[0].Write(srtpPacket)
+	AssertRecvPacket(t, clients[1], srtpPacket, "SRTP packet not forwarded")
+	AssertRecvPacket(t, clients[2], srtpPacket, "SRTP packet not forwarded")
+
+	// A PLI for the first client's stream only goes to the first client
+	pli := []byte{
+		0x80, 0xc9, 0x00, 0x01, 0x0a, 0x0b, 0x0c, 0x0d,
+		0x81, 0xce, 0x00, 0x02, 0x0a, 0x0b, 0x0c, 0x0d, 0x01, 0x02, 0x03, 0x04,
+	}
+	clients[1].Write(pli)
+	AssertRecvPacket(t, clients[0], pli, "Feedback not sent to the media sender")
+	AssertNotRecvPacket(t, clients[2], "Feedback sent to another receiver")
+
+	// Reports go to everyone else
+	report := []byte{0x80, 0xc8, 0x00, 0x01, 0x0e, 0x0f, 0x10, 0x11}
+	clients[2].Write(report)
+	AssertRecvPacket(t, clients[0], report, "Sender report not forwarded")
+	AssertRecvPacket(t, clients[1], report, "Sender report not forwarded")
+
+	// A receiver report about the first client's stream only goes to the
+	// first client
+	rr := []byte{
+		0x81, 0xc9, 0x00, 0x07, 0x0e, 0x0f, 0x10, 0x11,
+		0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	clients[2].Write(rr)
+	AssertRecvPacket(t, clients[0], rr, "Receiver report not sent to the media sender")
+	AssertNotRecvPacket(t, clients[1], "Receiver report sent to another receiver")
+
+	// Sender reports only go to receivers that get the sender's media
+	mdd.Subscribe(clients[1].Assoc(), 0x0a0b0c0d)
+	clients[2].Write(report)
+	AssertRecvPacket(t, clients[0], report, "Sender report not forwarded")
+	AssertNotRecvPacket(t, clients[1], "Sender report sent to a receiver that isn't subscribed")
+}
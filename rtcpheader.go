@@ -0,0 +1,102 @@
+package percy
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// RTCP packets are sent in compound packets (RFC 3550, Section 6.1): a
+// series of packets, each with its own header giving its type and length.
+// Once a compound packet is decrypted, ParseRTCPCompound walks those
+// headers, so that the MD can tell reports, which go to the whole
+// conference, from feedback (RFC 4585), which is about one sender's media.
+//
+//  0                   1                   2                   3
+//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |V=2|P|  Count  |      PT       |             length            |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                  SSRC of packet sender                        |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |             SSRC of media source (feedback only)              |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+const (
+	RTCPTypeSR    = 200
+	RTCPTypeRR    = 201
+	RTCPTypeSDES  = 202
+	RTCPTypeBYE   = 203
+	RTCPTypeAPP   = 204
+	RTCPTypeRTPFB = 205 // Transport-layer feedback, e.g., NACK
+	RTCPTypePSFB  = 206 // Payload-specific feedback, e.g., PLI and FIR
+	RTCPTypeXR    = 207
+
+	rtcpFormatNACK = 1
+	rtcpFormatPLI  = 1
+	rtcpFormatFIR  = 4
+
+	rtcpFormatTransportCC = 15
+	rtcpFormatREMB        = 15 // Application layer feedback
+)
+
+type RTCPHeader struct {
+	Version    uint8
+	Padding    bool
+	Count      uint8 // Report or chunk count, or the feedback message type
+	PacketType uint8
+	SSRC       uint32 // Zero for packets too short to have one
+	MediaSSRC  uint32 // For feedback, the source it is about
+	Size       int    // Bytes, including the header
+}
+
+func (header RTCPHeader) IsFeedback() bool {
+	return header.PacketType == RTCPTypeRTPFB || header.PacketType == RTCPTypePSFB
+}
+
+// Returns the headers of the packets in a compound RTCP packet
+func ParseRTCPCompound(msg []byte) ([]RTCPHeader, error) {
+	headers := []RTCPHeader{}
+	for offset := 0; offset < len(msg); {
+		if len(msg) < offset+4 {
+			return nil, fmt.Errorf("RTCP header too short at offset %d", offset)
+		}
+
+		data := msg[offset:]
+		header := RTCPHeader{
+			Version:    data[0] >> 6,
+			Padding:    data[0]&0x20 != 0,
+			Count:      data[0] & 0x1f,
+			PacketType: data[1],
+			Size:       4 * (int(binary.BigEndian.Uint16(data[2:4])) + 1),
+		}
+		if header.Version != 2 {
+			return nil, fmt.Errorf("Unsupported RTCP version %d at offset %d", header.Version, offset)
+		}
+		if len(data) < header.Size {
+			return nil, fmt.Errorf("RTCP packet too long at offset %d: %d bytes", offset, header.Size)
+		}
+
+		if header.Size >= 8 {
+			header.SSRC = binary.BigEndian.Uint32(data[4:8])
+		}
+		if header.IsFeedback() {
+			if header.Size < 12 {
+				return nil, fmt.Errorf("RTCP feedback too short at offset %d", offset)
+			}
+			header.MediaSSRC = binary.BigEndian.Uint32(data[8:12])
+
+			// FIR names the source in its FCI instead (RFC 5104)
+			if header.PacketType == RTCPTypePSFB && header.Count == rtcpFormatFIR && header.Size >= 16 {
+				header.MediaSSRC = binary.BigEndian.Uint32(data[12:16])
+			}
+		}
+
+		headers = append(headers, header)
+		offset += header.Size
+	}
+
+	if len(headers) == 0 {
+		return nil, fmt.Errorf("Empty RTCP packet")
+	}
+	return headers, nil
+}
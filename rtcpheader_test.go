@@ -0,0 +1,45 @@
+package percy
+
+import (
+	"testing"
+)
+
+func TestParseRTCPCompound(t *testing.T) {
+	msg := []byte{
+		0x81, 0xc9, 0x00, 0x07, // RR with one report block
+		0x0a, 0x0b, 0x0c, 0x0d,
+		0x01, 0x02, 0x03, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0x81, 0xce, 0x00, 0x02, // PLI
+		0x0a, 0x0b, 0x0c, 0x0d,
+		0x01, 0x02, 0x03, 0x04,
+		0x84, 0xce, 0x00, 0x04, // FIR
+		0x0a, 0x0b, 0x0c, 0x0d,
+		0x00, 0x00, 0x00, 0x00,
+		0x05, 0x06, 0x07, 0x08, 0x01, 0x00, 0x00, 0x00,
+	}
+
+	headers, err := ParseRTCPCompound(msg)
+	if err != nil {
+		t.Fatalf("Error parsing compound packet: %v", err)
+	}
+	if len(headers) != 3 {
+		t.Fatalf("Incorrect number of packets: %d", len(headers))
+	}
+
+	rr, pli, fir := headers[0], headers[1], headers[2]
+	if rr.PacketType != RTCPTypeRR || rr.Count != 1 || rr.Size != 32 || rr.SSRC != 0x0a0b0c0d || rr.IsFeedback() {
+		t.Fatalf("Incorrect receiver report: %+v", rr)
+	}
+	if pli.PacketType != RTCPTypePSFB || pli.Count != 1 || pli.MediaSSRC != 0x01020304 || !pli.IsFeedback() {
+		t.Fatalf("Incorrect PLI: %+v", pli)
+	}
+	if fir.Count != rtcpFormatFIR || fir.MediaSSRC != 0x05060708 {
+		t.Fatalf("Incorrect FIR: %+v", fir)
+	}
+
+	for _, bad := range [][]byte{{}, msg[:2], msg[:30], msg[:40], {0x40, 0xc9, 0x00, 0x00}, {0x81, 0xce, 0x00, 0x01, 0, 0, 0, 0}} {
+		if _, err := ParseRTCPCompound(bad); err == nil {
+			t.Fatalf("Parsed a bad compound packet: %x", bad)
+		}
+	}
+}
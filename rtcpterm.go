@@ -0,0 +1,244 @@
+package percy
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// By default, RTCP reports are forwarded end to end, so a receiver's report
+// describes loss and jitter over both hops, and a sender's report counts
+// packets the MD may not have forwarded.  With RTCP termination on, the MD
+// drops the reports it receives (feedback is still routed to the media
+// sender), and generates its own for each leg, every second:
+//
+//   - To each sender, a receiver report with a block for each stream the MD
+//     receives from it, describing the client-to-MD hop
+//   - To each receiver, a sender report for each stream forwarded to it,
+//     with what the MD actually sent, and the sender's NTP/RTP timestamp
+//     mapping carried over from its own latest sender report
+//
+// The MD's reports are protected with each leg's hop-by-hop keys, so this
+// needs a keyed leg (PERC or SFU mode).  Jitter is computed as in RFC 3550,
+// Appendix A.8, which needs each stream's RTP clock rate (see MDD.ClockRates).
+
+const ntpEpochOffset = 2208988800 // Seconds from 1900 to 1970
+
+// Per-SSRC reception statistics (RFC 3550, Appendix A.1 and A.3), and the
+// sender's latest report.  Guarded by mdd.mu.
+type receptionStats struct {
+	started       bool
+	baseSeq       uint32
+	maxSeq        uint16
+	cycles        uint32
+	received      uint32
+	expectedPrior uint32
+	receivedPrior uint32
+	transit       float64
+	jitter        float64 // In RTP timestamp units
+
+	srNTP  uint64 // NTP timestamp of the sender's last report, or zero
+	srRTP  uint32
+	srTime time.Time // When it arrived
+}
+
+func (rs *receptionStats) update(header *RTPHeader, now time.Time, clockRate uint32) {
+	seq := header.SequenceNumber
+	if !rs.started {
+		rs.started = true
+		rs.baseSeq = uint32(seq)
+		rs.maxSeq = seq
+	} else if delta := seq - rs.maxSeq; delta < 0x8000 {
+		if seq < rs.maxSeq {
+			rs.cycles += 1 << 16
+		}
+		rs.maxSeq = seq
+	}
+	rs.received += 1
+
+	// Only differences in transit time matter, so the arrival time's
+	// epoch doesn't
+	arrival := float64(now.UnixNano()) / 1e9 * float64(clockRate)
+	transit := arrival - float64(header.Timestamp)
+	if rs.received > 1 {
+		d := transit - rs.transit
+		if d < 0 {
+			d = -d
+		}
+		rs.jitter += (d - rs.jitter) / 16
+	}
+	rs.transit = transit
+}
+
+// Returns a report block for the stream, and starts a new interval
+func (rs *receptionStats) reportBlock(ssrc uint32, now time.Time) []byte {
+	extendedMax := rs.cycles + uint32(rs.maxSeq)
+	expected := extendedMax - rs.baseSeq + 1
+	lost := int64(expected) - int64(rs.received)
+	if lost > 0x7fffff {
+		lost = 0x7fffff
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+
+	expectedInterval := expected - rs.expectedPrior
+	receivedInterval := rs.received - rs.receivedPrior
+	rs.expectedPrior = expected
+	rs.receivedPrior = rs.received
+
+	var fraction uint8
+	if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval > 0 && lostInterval > 0 {
+		fraction = uint8((lostInterval << 8) / int64(expectedInterval))
+	}
+
+	block := make([]byte, 24)
+	binary.BigEndian.PutUint32(block[0:4], ssrc)
+	binary.BigEndian.PutUint32(block[4:8], uint32(fraction)<<24|uint32(lost)&0xffffff)
+	binary.BigEndian.PutUint32(block[8:12], extendedMax)
+	binary.BigEndian.PutUint32(block[12:16], uint32(rs.jitter))
+	if rs.srNTP != 0 {
+		binary.BigEndian.PutUint32(block[16:20], uint32(rs.srNTP>>16))
+		binary.BigEndian.PutUint32(block[20:24], uint32(now.Sub(rs.srTime).Seconds()*65536))
+	}
+	return block
+}
+
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / 1000000000
+	return seconds<<32 | fraction
+}
+
+// Turns RTCP termination on or off for a conference
+func (mdd *MDD) SetConferenceRTCPTermination(confID ConfID, terminate bool) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.terminateRTCP = terminate
+}
+
+// Reports whether RTCP from an association is terminated by the MD
+func (mdd *MDD) terminatesRTCP(assoc *association) bool {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	return mdd.confTerminatesRTCP(assoc.conf)
+}
+
+// As terminatesRTCP, for a conference.  The caller holds mdd.mu.
+func (mdd *MDD) confTerminatesRTCP(confID ConfID) bool {
+	conf, ok := mdd.conferences[confID]
+	return ok && conf.terminateRTCP
+}
+
+// Remembers the NTP/RTP timestamp mapping in a sender's reports
+func (mdd *MDD) recordSenderReports(sender *association, headers []RTCPHeader, msg []byte, now time.Time) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	offset := 0
+	for _, header := range headers {
+		if header.PacketType == RTCPTypeSR && header.Size >= 28 {
+			if counters, ok := sender.stats.ssrcs[header.SSRC]; ok {
+				counters.reception.srNTP = binary.BigEndian.Uint64(msg[offset+8 : offset+16])
+				counters.reception.srRTP = binary.BigEndian.Uint32(msg[offset+16 : offset+20])
+				counters.reception.srTime = now
+			}
+		}
+		offset += header.Size
+	}
+}
+
+// Counts an SRTP packet sent to a receiver against its SSRC.  The caller
+// holds mdd.mu.
+func (assoc *association) countSent(msg []byte) {
+	if packetClass(msg) != packetClassSRTP || len(msg) < rtpFixedHeaderSize {
+		return
+	}
+
+	if assoc.stats.sent == nil {
+		assoc.stats.sent = map[uint32]*TrafficStats{}
+	}
+
+	ssrc := packetSSRC(packetClassSRTP, msg)
+	sent, ok := assoc.stats.sent[ssrc]
+	if !ok {
+		sent = &TrafficStats{}
+		assoc.stats.sent[ssrc] = sent
+	}
+	sent.add(len(msg) - rtpFixedHeaderSize)
+}
+
+// Builds the reports for each leg of conferences that terminate RTCP.  The
+// caller holds mdd.mu.
+func (mdd *MDD) buildReports(now time.Time) map[*association][]byte {
+	reports := map[*association][]byte{}
+	for _, assoc := range mdd.assocs.snapshot() {
+		if assoc.addr == nil || assoc.profile == 0 || !mdd.confTerminatesRTCP(assoc.conf) {
+			continue
+		}
+
+		// Receiver report on the streams from this client
+		blocks := []byte{}
+		count := 0
+		for ssrc, counters := range assoc.stats.ssrcs {
+			if count == 31 || now.Sub(counters.last) > ssrcRateWindow || !counters.reception.started {
+				continue
+			}
+			blocks = append(blocks, counters.reception.reportBlock(ssrc, now)...)
+			count += 1
+		}
+		if count > 0 {
+			rr := make([]byte, 8, 8+len(blocks))
+			rr[0] = 0x80 | uint8(count)
+			rr[1] = RTCPTypeRR
+			binary.BigEndian.PutUint16(rr[2:4], uint16((8+len(blocks))/4-1))
+			binary.BigEndian.PutUint32(rr[4:8], mdd.rtcpSSRC)
+			reports[assoc] = append(rr, blocks...)
+		}
+
+		// Sender reports on the streams forwarded to this client
+		for ssrc, sent := range assoc.stats.sent {
+			sender, ok := mdd.assocs.get(mdd.routes[ssrc])
+			if !ok {
+				continue
+			}
+			counters, ok := sender.stats.ssrcs[ssrc]
+			if !ok || counters.reception.srNTP == 0 || now.Sub(counters.last) > ssrcRateWindow {
+				continue
+			}
+
+			elapsed := now.Sub(counters.reception.srTime).Seconds()
+			rate := float64(mdd.clockRate(counters.source.payloadType))
+
+			sr := make([]byte, 28)
+			sr[0] = 0x80
+			sr[1] = RTCPTypeSR
+			binary.BigEndian.PutUint16(sr[2:4], 6)
+			binary.BigEndian.PutUint32(sr[4:8], ssrc)
+			binary.BigEndian.PutUint64(sr[8:16], ntpTime(now))
+			binary.BigEndian.PutUint32(sr[16:20], counters.reception.srRTP+uint32(elapsed*rate))
+			binary.BigEndian.PutUint32(sr[20:24], uint32(sent.Packets))
+			binary.BigEndian.PutUint32(sr[24:28], uint32(sent.Bytes))
+
+			// A compound packet has to start with a report, which an SR is
+			reports[assoc] = append(reports[assoc], sr...)
+		}
+	}
+	return reports
+}
+
+// Sends the MD's own reports on each leg of conferences that terminate
+// RTCP.  Runs on the processing loop.
+func (mdd *MDD) sendReports(now time.Time) {
+	mdd.mu.Lock()
+	reports := mdd.buildReports(now)
+	mdd.mu.Unlock()
+
+	for assoc, msg := range reports {
+		if len(msg) > 0 {
+			mdd.sendRTCP(assoc, &rtp.RTCPPacket{Buffer: msg}, nil)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package percy
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestReceptionStats(t *testing.T) {
+	var rs receptionStats
+	now := time.Now()
+	for seq := 0xfffb; seq <= 0x10004; seq++ {
+		if seq == 0xfffe {
+			continue
+		}
+		header := &RTPHeader{SequenceNumber: uint16(seq), Timestamp: uint32(seq * 960)}
+		rs.update(header, now.Add(time.Duration(seq)*20*time.Millisecond), 48000)
+	}
+
+	// Ten packets expected across the wrap, one of them lost
+	block := rs.reportBlock(0x01020304, now)
+	if ssrc := binary.BigEndian.Uint32(block[0:4]); ssrc != 0x01020304 {
+		t.Fatalf("Incorrect SSRC: %08x", ssrc)
+	}
+	if fraction, lost := block[4], binary.BigEndian.Uint32(block[4:8])&0xffffff; fraction != 25 || lost != 1 {
+		t.Fatalf("Incorrect loss: %d/256, %d packets", fraction, lost)
+	}
+	if extendedMax := binary.BigEndian.Uint32(block[8:12]); extendedMax != 0x10004 {
+		t.Fatalf("Incorrect extended highest sequence number: %x", extendedMax)
+	}
+	if jitter := binary.BigEndian.Uint32(block[12:16]); jitter != 0 {
+		t.Fatalf("Jitter for evenly spaced packets: %d", jitter)
+	}
+
+	// Nothing was lost in the next interval
+	rs.update(&RTPHeader{SequenceNumber: 5, Timestamp: 0x10005 * 960}, now.Add(0x10005*20*time.Millisecond), 48000)
+	if block := rs.reportBlock(0x01020304, now); block[4] != 0 {
+		t.Fatalf("Loss reported for a lossless interval: %d/256", block[4])
+	}
+}
+
+func TestRTCPTermination(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.RTCPShaping = RTCPShaping{}
+	mdd.SetConferenceRTCPTermination(DefaultConfID, true)
+
+	clients := newKeyedClients(t, network, mdd, "10.0.0.1:5000", "10.0.0.2:5000")
+
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	clients[0].Write(srtpPacket)
+	AssertRecvPacket(t, clients[1], srtpPacket, "SRTP packet not forwarded")
+
+	// The sender's report is terminated
+	report := []byte{
+		0x80, 0xc8, 0x00, 0x06, 0x01, 0x02, 0x03, 0x04,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, // NTP timestamp
+		0x00, 0x00, 0x10, 0x00, // RTP timestamp
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+	}
+	clients[0].Write(report)
+	AssertNotRecvPacket(t, clients[1], "Terminated report forwarded")
+
+	mdd.runOnLoop(func() { mdd.sendReports(time.Now()) })
+
+	// The sender gets a receiver report on its stream...
+	msg, err := clients[0].Recv()
+	if err != nil {
+		t.Fatalf("No receiver report: %v", err)
+	}
+	headers, err := ParseRTCPCompound(msg)
+	if err != nil || len(headers) != 1 || headers[0].PacketType != RTCPTypeRR || headers[0].Count != 1 {
+		t.Fatalf("Incorrect receiver report: %+v %v", headers, err)
+	}
+	if ssrc, lsr := binary.BigEndian.Uint32(msg[8:12]), binary.BigEndian.Uint32(msg[24:28]); ssrc != 0x01020304 || lsr != 0x00010000 {
+		t.Fatalf("Incorrect report block: %x", msg[8:])
+	}
+
+	// ... and the receiver a sender report on what the MD forwarded
+	msg, err = clients[1].Recv()
+	if err != nil {
+		t.Fatalf("No sender report: %v", err)
+	}
+	headers, err = ParseRTCPCompound(msg)
+	if err != nil || len(headers) != 1 || headers[0].PacketType != RTCPTypeSR || headers[0].SSRC != 0x01020304 {
+		t.Fatalf("Incorrect sender report: %+v %v", headers, err)
+	}
+	if packets := binary.BigEndian.Uint32(msg[20:24]); packets != 1 {
+		t.Fatalf("Incorrect packet count: %d", packets)
+	}
+}
+
+func TestRTCPTerminationWhileAddingConferences(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.RTCPShaping = RTCPShaping{}
+
+	clients := newKeyedClients(t, network, mdd, "10.0.0.1:5000", "10.0.0.2:5000")
+
+	// The loop checks for termination on every report while conferences
+	// are added
+	done := make(chan bool)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			mdd.SetConferenceRTCPTermination(ConfID(i), true)
+		}
+		done <- true
+	}()
+
+	report := []byte{
+		0x80, 0xc8, 0x00, 0x06, 0x01, 0x02, 0x03, 0x04,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x10, 0x00,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+	}
+	for i := 0; i < 20; i++ {
+		clients[0].Write(report)
+		AssertRecvPacket(t, clients[1], report, "Report not forwarded")
+	}
+	<-done
+}
@@ -0,0 +1,140 @@
+package percy
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The RTP header (RFC 3550, Section 5.1) is sent in the clear in SRTP, and
+// in PERC the MD may only read it, not the payload.  ParseRTPHeader reads
+// the fixed header, the CSRC list and the header extension, so that routing,
+// stats and anything rewriting headers agree on where the payload starts.
+//
+//  0                   1                   2                   3
+//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |V=2|P|X|  CC   |M|     PT      |       sequence number         |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                           timestamp                           |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |           synchronization source (SSRC) identifier            |
+// +=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+
+// |            contributing source (CSRC) identifiers             |
+// |                             ....                              |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+const rtpFixedHeaderSize = 12
+
+type RTPHeader struct {
+	Version        uint8
+	Padding        bool
+	Marker         bool
+	PayloadType    uint8
+	SequenceNumber uint16
+	Timestamp      uint32
+	SSRC           uint32
+	CSRCs          []uint32
+
+	// The header extension, if the X bit is set.  Data excludes the
+	// profile and length words, and refers to the parsed packet.
+	Extension        bool
+	ExtensionProfile uint16
+	ExtensionData    []byte
+
+	// Bytes of header before the payload
+	Size int
+}
+
+func ParseRTPHeader(msg []byte) (*RTPHeader, error) {
+	if len(msg) < rtpFixedHeaderSize {
+		return nil, fmt.Errorf("RTP header too short: %d bytes", len(msg))
+	}
+
+	header := &RTPHeader{
+		Version:        msg[0] >> 6,
+		Padding:        msg[0]&0x20 != 0,
+		Extension:      msg[0]&0x10 != 0,
+		Marker:         msg[1]&0x80 != 0,
+		PayloadType:    msg[1] & 0x7f,
+		SequenceNumber: binary.BigEndian.Uint16(msg[2:4]),
+		Timestamp:      binary.BigEndian.Uint32(msg[4:8]),
+		SSRC:           binary.BigEndian.Uint32(msg[8:12]),
+	}
+	if header.Version != 2 {
+		return nil, fmt.Errorf("Unsupported RTP version %d", header.Version)
+	}
+
+	offset := rtpFixedHeaderSize
+	count := int(msg[0] & 0x0f)
+	if len(msg) < offset+4*count {
+		return nil, fmt.Errorf("RTP header too short for %d CSRCs", count)
+	}
+	for i := 0; i < count; i++ {
+		header.CSRCs = append(header.CSRCs, binary.BigEndian.Uint32(msg[offset:offset+4]))
+		offset += 4
+	}
+
+	if header.Extension {
+		if len(msg) < offset+4 {
+			return nil, fmt.Errorf("RTP header too short for extension")
+		}
+
+		header.ExtensionProfile = binary.BigEndian.Uint16(msg[offset : offset+2])
+		length := 4 * int(binary.BigEndian.Uint16(msg[offset+2:offset+4]))
+		offset += 4
+		if len(msg) < offset+length {
+			return nil, fmt.Errorf("RTP header extension too long: %d bytes", length)
+		}
+
+		header.ExtensionData = msg[offset : offset+length]
+		offset += length
+	}
+
+	header.Size = offset
+	return header, nil
+}
+
+// Returns the data of the header extension element with the given ID, in
+// either the one-byte or two-byte format (RFC 8285)
+func (header *RTPHeader) ExtensionElement(id uint8) ([]byte, bool) {
+	data := header.ExtensionData
+	switch {
+	case !header.Extension || id == 0:
+		return nil, false
+
+	case header.ExtensionProfile == 0xbede:
+		for i := 0; i < len(data); {
+			if data[i] == 0 {
+				i += 1 // Padding
+				continue
+			}
+
+			elementID, length := data[i]>>4, int(data[i]&0x0f)+1
+			if elementID == 15 || i+1+length > len(data) {
+				return nil, false
+			}
+			if elementID == id {
+				return data[i+1 : i+1+length], true
+			}
+			i += 1 + length
+		}
+
+	case header.ExtensionProfile&0xfff0 == 0x1000:
+		for i := 0; i+1 < len(data); {
+			if data[i] == 0 {
+				i += 1
+				continue
+			}
+
+			elementID, length := data[i], int(data[i+1])
+			if i+2+length > len(data) {
+				return nil, false
+			}
+			if elementID == id {
+				return data[i+2 : i+2+length], true
+			}
+			i += 2 + length
+		}
+	}
+	return nil, false
+}
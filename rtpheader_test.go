@@ -0,0 +1,68 @@
+package percy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseRTPHeader(t *testing.T) {
+	msg := []byte{
+		0xb2, 0xef, 0x12, 0x34, // V=2, P, X, CC=2, M, PT=111, seq
+		0x00, 0x00, 0x03, 0xc0, // timestamp
+		0x01, 0x02, 0x03, 0x04, // SSRC
+		0x0a, 0x0b, 0x0c, 0x0d, // CSRCs
+		0x0e, 0x0f, 0x10, 0x11,
+		0xbe, 0xde, 0x00, 0x01, // one-byte extensions, one word
+		0x10, 0xff, 0x00, 0x00,
+		0xaa, 0xbb, 0x00, 0x02, // payload and padding
+	}
+
+	header, err := ParseRTPHeader(msg)
+	if err != nil {
+		t.Fatalf("Error parsing header: %v", err)
+	}
+	if header.Version != 2 || !header.Padding || !header.Marker || header.PayloadType != 111 {
+		t.Fatalf("Incorrect first word: %+v", header)
+	}
+	if header.SequenceNumber != 0x1234 || header.Timestamp != 960 || header.SSRC != 0x01020304 {
+		t.Fatalf("Incorrect sequence number, timestamp or SSRC: %+v", header)
+	}
+	if len(header.CSRCs) != 2 || header.CSRCs[0] != 0x0a0b0c0d || header.CSRCs[1] != 0x0e0f1011 {
+		t.Fatalf("Incorrect CSRCs: %x", header.CSRCs)
+	}
+	if !header.Extension || header.ExtensionProfile != 0xbede || !bytes.Equal(header.ExtensionData, []byte{0x10, 0xff, 0x00, 0x00}) {
+		t.Fatalf("Incorrect extension: %x %x", header.ExtensionProfile, header.ExtensionData)
+	}
+	if header.Size != 28 {
+		t.Fatalf("Incorrect header size: %d", header.Size)
+	}
+
+	for _, bad := range [][]byte{msg[:11], msg[:16], msg[:22], msg[:26], append([]byte{0x40}, msg[1:]...)} {
+		if _, err := ParseRTPHeader(bad); err == nil {
+			t.Fatalf("Parsed a bad header: %x", bad)
+		}
+	}
+}
+
+func TestRTPHeaderExtensionElement(t *testing.T) {
+	oneByte := &RTPHeader{
+		Extension:        true,
+		ExtensionProfile: 0xbede,
+		ExtensionData:    []byte{0x10, 0xaa, 0x00, 0x21, 0xbb, 0xcc, 0x00, 0x00},
+	}
+	if data, ok := oneByte.ExtensionElement(2); !ok || !bytes.Equal(data, []byte{0xbb, 0xcc}) {
+		t.Fatalf("Incorrect one-byte element: %x %v", data, ok)
+	}
+	if _, ok := oneByte.ExtensionElement(3); ok {
+		t.Fatalf("Found a missing element")
+	}
+
+	twoByte := &RTPHeader{
+		Extension:        true,
+		ExtensionProfile: 0x1000,
+		ExtensionData:    []byte{0x01, 0x00, 0x00, 0x20, 0x03, 0xdd, 0xee, 0xff},
+	}
+	if data, ok := twoByte.ExtensionElement(0x20); !ok || !bytes.Equal(data, []byte{0xdd, 0xee, 0xff}) {
+		t.Fatalf("Incorrect two-byte element: %x %v", data, ok)
+	}
+}
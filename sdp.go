@@ -0,0 +1,176 @@
+package percy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The MD is an ICE-lite endpoint, so its side of the SDP is mostly fixed:
+// host candidates on its bound addresses, its ICE credentials, and the DTLS
+// fingerprint clients should expect.  In PERC mode, clients do DTLS with
+// the KD through the MD, so that is the KD's fingerprint, passed through;
+// in SFU mode it is the MD's own certificate.  The media sections list
+// whatever codecs signaling has settled on.
+
+type SDPCodec struct {
+	PayloadType uint8
+	RTPMap      string   // e.g., "opus/48000/2"
+	FMTP        string   // Optional
+	Feedback    []string // rtcp-fb values, e.g., "nack pli"
+}
+
+type SDPMedia struct {
+	Kind       string // "audio" or "video"
+	MID        string
+	Direction  string // Defaults to sendrecv
+	Codecs     []SDPCodec
+	Extensions []string // Header extension URIs, numbered from 1
+}
+
+type SDPAnswer struct {
+	SessionID   uint64
+	ICEUfrag    string
+	ICEPassword string
+	Fingerprint string // SHA-256, in the form returned by CertificateFingerprint
+	Setup       string // Defaults to passive
+	Addresses   []net.IP
+	Port        int
+	Media       []SDPMedia
+}
+
+// Audio and video sections matching what the example server offers
+func DefaultSDPMedia() []SDPMedia {
+	return []SDPMedia{
+		{
+			Kind: "audio",
+			MID:  "sdparta_0",
+			Codecs: []SDPCodec{
+				{PayloadType: 109, RTPMap: "opus/48000/2", FMTP: "maxplaybackrate=48000;stereo=1;useinbandfec=1"},
+			},
+			Extensions: []string{"urn:ietf:params:rtp-hdrext:ssrc-audio-level", "urn:ietf:params:rtp-hdrext:sdes:mid"},
+		},
+		{
+			Kind: "video",
+			MID:  "sdparta_1",
+			Codecs: []SDPCodec{
+				{PayloadType: 120, RTPMap: "VP8/90000", FMTP: "max-fs=12288;max-fr=60", Feedback: []string{"nack", "nack pli", "ccm fir", "goog-remb"}},
+			},
+			Extensions: []string{"urn:ietf:params:rtp-hdrext:sdes:mid", "urn:ietf:params:rtp-hdrext:toffset"},
+		},
+	}
+}
+
+// Builds the MD's answer for a client joining a conference.  kdFingerprint
+// is used unless the conference runs in SFU mode with the MD's own
+// certificate.
+func (mdd *MDD) NewSDPAnswer(confID ConfID, ufrag, password, kdFingerprint string, media []SDPMedia) (*SDPAnswer, error) {
+	conn := mdd.transport()
+	if conn == nil {
+		return nil, fmt.Errorf("The MD is not listening")
+	}
+
+	_, portStr, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := kdFingerprint
+	mdd.mu.Lock()
+	conf, ok := mdd.conferences[confID]
+	sfu := ok && conf.mode == ModeSFU
+	mdd.mu.Unlock()
+	if sfu && mdd.DTLSCertificate != nil {
+		fingerprint = CertificateFingerprint(mdd.DTLSCertificate)
+	}
+
+	return &SDPAnswer{
+		SessionID:   uint64(mdd.stats.start.UnixNano()),
+		ICEUfrag:    ufrag,
+		ICEPassword: password,
+		Fingerprint: fingerprint,
+		Addresses:   mdd.AdvertisedAddresses(),
+		Port:        port,
+		Media:       media,
+	}, nil
+}
+
+// Returns the host candidates, one per address, highest priority first
+func (answer *SDPAnswer) Candidates() []string {
+	candidates := make([]string, len(answer.Addresses))
+	for i, ip := range answer.Addresses {
+		// RFC 8445 section 5.1.2.1, with host type preference 126 and the
+		// first address preferred
+		priority := uint32(126)<<24 | uint32(65535-i)<<8 | uint32(256-1)
+		candidates[i] = fmt.Sprintf("candidate:%d 1 UDP %d %v %d typ host", i, priority, ip, answer.Port)
+	}
+	return candidates
+}
+
+func (answer *SDPAnswer) String() string {
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=percy %d 0 IN IP4 0.0.0.0", answer.SessionID),
+		"s=-",
+		"t=0 0",
+		"a=ice-lite",
+		"a=fingerprint:sha-256 " + answer.Fingerprint,
+	}
+
+	mids := make([]string, len(answer.Media))
+	for i, media := range answer.Media {
+		mids[i] = media.MID
+	}
+	lines = append(lines, "a=group:BUNDLE "+strings.Join(mids, " "), "a=msid-semantic:WMS *")
+
+	setup := answer.Setup
+	if len(setup) == 0 {
+		setup = "passive"
+	}
+	candidates := answer.Candidates()
+
+	for _, media := range answer.Media {
+		pts := make([]string, len(media.Codecs))
+		for i, codec := range media.Codecs {
+			pts[i] = strconv.Itoa(int(codec.PayloadType))
+		}
+		direction := media.Direction
+		if len(direction) == 0 {
+			direction = "sendrecv"
+		}
+
+		lines = append(lines,
+			fmt.Sprintf("m=%s %d UDP/TLS/RTP/SAVPF %s", media.Kind, answer.Port, strings.Join(pts, " ")),
+			"c=IN IP4 0.0.0.0",
+			"a=mid:"+media.MID,
+			"a="+direction,
+			"a=ice-ufrag:"+answer.ICEUfrag,
+			"a=ice-pwd:"+answer.ICEPassword,
+			"a=setup:"+setup,
+			"a=rtcp-mux",
+		)
+		for i, uri := range media.Extensions {
+			lines = append(lines, fmt.Sprintf("a=extmap:%d %s", i+1, uri))
+		}
+		for _, codec := range media.Codecs {
+			lines = append(lines, fmt.Sprintf("a=rtpmap:%d %s", codec.PayloadType, codec.RTPMap))
+			if len(codec.FMTP) > 0 {
+				lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", codec.PayloadType, codec.FMTP))
+			}
+			for _, fb := range codec.Feedback {
+				lines = append(lines, fmt.Sprintf("a=rtcp-fb:%d %s", codec.PayloadType, fb))
+			}
+		}
+		for _, candidate := range candidates {
+			lines = append(lines, "a="+candidate)
+		}
+		lines = append(lines, "a=end-of-candidates")
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
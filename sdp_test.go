@@ -0,0 +1,39 @@
+package percy
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestSDPAnswer(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	answer, err := mdd.NewSDPAnswer(DefaultConfID, "ufrag", "password", "AA:BB", DefaultSDPMedia())
+	if err != nil {
+		t.Fatalf("Error creating answer: %v", err)
+	}
+	answer.Addresses = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+
+	sdp := answer.String()
+	for _, line := range []string{
+		"a=ice-lite",
+		"a=fingerprint:sha-256 AA:BB",
+		"a=group:BUNDLE sdparta_0 sdparta_1",
+		"m=audio 4430 UDP/TLS/RTP/SAVPF 109",
+		"a=ice-ufrag:ufrag",
+		"a=ice-pwd:password",
+		"a=setup:passive",
+		"a=rtcp-fb:120 nack pli",
+		"a=candidate:0 1 UDP 2130706431 192.0.2.1 4430 typ host",
+		"a=candidate:1 1 UDP 2130706175 2001:db8::1 4430 typ host",
+	} {
+		if !strings.Contains(sdp, line+"\r\n") {
+			t.Fatalf("Answer is missing [%s]:\n%s", line, sdp)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package percy
+
+import (
+	"log"
+)
+
+// By default the processing loop writes each packet to its receivers in
+// turn, so a receiver whose writes block (a stream transport with a full
+// buffer, say) delays every receiver after it, and every packet after that.
+// With SendQueueLength set, each receiver gets a queue of that many packets
+// and a goroutine of its own that writes them, so a conference's fan-out
+// only costs the loop a channel send per receiver.  Packets for a receiver
+// whose queue is full are dropped and counted, as shed packets are.  Send
+// errors and health changes are still reported, just from the receiver's
+// goroutine.
+
+type sendQueue struct {
+	packets chan []byte
+	closed  bool // Guarded by mdd.mu
+}
+
+// Queues a packet for an association, starting its queue if need be.  The
+// caller holds mdd.mu.
+func (mdd *MDD) enqueue(assoc *association, msg []byte) {
+	if assoc.queue == nil {
+		assoc.queue = &sendQueue{packets: make(chan []byte, mdd.SendQueueLength)}
+		go mdd.drainQueue(assoc, assoc.queue)
+	}
+	if assoc.queue.closed {
+		return
+	}
+
+	select {
+	case assoc.queue.packets <- msg:
+	default:
+		assoc.stats.queueDropped += 1
+	}
+}
+
+func (mdd *MDD) drainQueue(assoc *association, queue *sendQueue) {
+	for msg := range queue.packets {
+		mdd.mu.Lock()
+		addr := assoc.addr
+		mdd.mu.Unlock()
+		mdd.deliver(assoc, addr, msg)
+	}
+}
+
+// Stops an association's queue, once it has been removed; anything still in
+// it is sent first
+func (mdd *MDD) closeQueue(assoc *association) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if assoc.queue == nil {
+		assoc.queue = &sendQueue{closed: true}
+		return
+	}
+	if assoc.queue.closed {
+		return
+	}
+	assoc.queue.closed = true
+	close(assoc.queue.packets)
+	if pending := len(assoc.queue.packets); pending > 0 {
+		log.Printf("Flushing %d queued packets to [%04x]", pending, assoc.id)
+	}
+}
@@ -0,0 +1,55 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestSendQueues(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SendQueueLength = 8
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+
+	clients := []*Client{}
+	for _, addr := range []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000", "10.0.0.4:5000"} {
+		client, _ := NewClient(network, addr)
+		defer client.Stop()
+		clients = append(clients, client)
+
+		client.Write([]byte{0x16, 0xfe, 0xfd, 0x00})
+	}
+	for i, client := range clients[:3] {
+		for range clients[i+1:] {
+			client.Recv()
+		}
+	}
+
+	// Every other participant gets the packet, from its own queue
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	clients[0].Write(srtpPacket)
+	for _, client := range clients[1:] {
+		AssertRecvPacket(t, client, srtpPacket, "Packet not forwarded through the send queue")
+	}
+	AssertNotRecvPacket(t, clients[0], "Packet sent back to the sender")
+
+	// A full queue drops packets rather than blocking
+	assoc := newAssociation(0x0009)
+	assoc.queue = &sendQueue{packets: make(chan []byte, 1)}
+	mdd.mu.Lock()
+	mdd.enqueue(assoc, []byte{0x01})
+	mdd.enqueue(assoc, []byte{0x02})
+	dropped := assoc.stats.queueDropped
+	mdd.mu.Unlock()
+	if dropped != 1 {
+		t.Fatalf("Incorrect drop count for a full queue: %d", dropped)
+	}
+
+	// Sends to a removed association are dropped
+	mdd.closeQueue(assoc)
+	mdd.mu.Lock()
+	mdd.enqueue(assoc, []byte{0x03})
+	mdd.mu.Unlock()
+}
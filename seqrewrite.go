@@ -0,0 +1,62 @@
+package percy
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Receivers take a jump in sequence numbers for loss, and a jump in
+// timestamps for a stall, so when the MD changes what feeds a stream it
+// presents to a receiver, it carries both on from the last packet it sent:
+// the next packet gets the next sequence number, and a timestamp advanced
+// by the time that has passed at the stream's clock rate.  That happens
+// when the source changes (see ssrcrewrite.go), and when the source resumes
+// after the MD withheld it from the receiver (muted, outside the last-N set,
+// unsubscribed) for at least seqResumeGap, so the packets the receiver never
+// got don't look lost.
+//
+// Offsets are per receiver and stream, and change only at those points, so
+// packets that arrive out of order keep their order.
+
+const seqResumeGap = 500 * time.Millisecond
+
+// The offsets of one stream presented to a receiver
+type seqState struct {
+	source   uint32 // The SSRC currently feeding the stream
+	seqDelta uint16
+	tsDelta  uint32
+	lastIn   uint16 // The source's last sequence number that was sent
+	lastSeq  uint16 // As sent
+	lastTS   uint32
+	lastSent time.Time
+}
+
+// Rewrites a packet's sequence number and timestamp in place
+func (ss *seqState) rewrite(buf []byte, header *RTPHeader, clockRate uint32, now time.Time) {
+	switched := header.SSRC != ss.source
+	resumed := !switched && now.Sub(ss.lastSent) >= seqResumeGap && int16(header.SequenceNumber-ss.lastIn) > 1
+	if (switched || resumed) && !ss.lastSent.IsZero() {
+		step := uint32(now.Sub(ss.lastSent).Seconds() * float64(clockRate))
+		if step == 0 {
+			step = 1
+		}
+		ss.seqDelta = ss.lastSeq + 1 - header.SequenceNumber
+		ss.tsDelta = ss.lastTS + step - header.Timestamp
+	}
+	ss.source = header.SSRC
+
+	seq := header.SequenceNumber + ss.seqDelta
+	ts := header.Timestamp + ss.tsDelta
+	binary.BigEndian.PutUint16(buf[2:4], seq)
+	binary.BigEndian.PutUint32(buf[4:8], ts)
+
+	if ss.lastSent.IsZero() || int16(seq-ss.lastSeq) > 0 {
+		ss.lastIn, ss.lastSeq, ss.lastTS = header.SequenceNumber, seq, ts
+	}
+	ss.lastSent = now
+}
+
+// Maps a sequence number the receiver uses back to the source's
+func (ss *seqState) original(seq uint16) uint16 {
+	return seq - ss.seqDelta
+}
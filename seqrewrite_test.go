@@ -0,0 +1,47 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeqRewriting(t *testing.T) {
+	ss := seqState{}
+	now := time.Now()
+	send := func(ssrc uint32, seq uint16, ts uint32, at time.Time) *RTPHeader {
+		pkt := rewritePacket(ssrc, seq, ts)
+		header, _ := ParseRTPHeader(pkt.Buffer)
+		ss.rewrite(pkt.Buffer, header, 90000, at)
+		header, _ = ParseRTPHeader(pkt.Buffer)
+		return header
+	}
+
+	// The first source passes through unchanged, reordering included
+	send(0x1000, 10, 1000, now)
+	send(0x1000, 12, 1200, now)
+	if header := send(0x1000, 11, 1100, now); header.SequenceNumber != 11 || header.Timestamp != 1100 {
+		t.Fatalf("Reordered packet rewritten: %d %d", header.SequenceNumber, header.Timestamp)
+	}
+
+	// Losses the MD didn't cause are left for the receiver to see
+	if header := send(0x1000, 15, 1500, now.Add(10*time.Millisecond)); header.SequenceNumber != 15 {
+		t.Fatalf("Network loss hidden: %d", header.SequenceNumber)
+	}
+
+	// A stream the MD withheld carries on where it left off, with the
+	// timestamp advanced by the time that passed
+	later := now.Add(time.Second)
+	header := send(0x1000, 115, 91500, later)
+	if header.SequenceNumber != 16 || header.Timestamp != 1500+uint32(0.99*90000) {
+		t.Fatalf("Resumed stream not continuous: %d %d", header.SequenceNumber, header.Timestamp)
+	}
+	if ss.original(16) != 115 {
+		t.Fatalf("Incorrect original sequence number: %d", ss.original(16))
+	}
+
+	// So does a new source
+	header = send(0x2000, 60000, 7, later.Add(100*time.Millisecond))
+	if header.SequenceNumber != 17 || header.Timestamp != 1500+uint32(0.99*90000)+9000 {
+		t.Fatalf("Switched stream not continuous: %d %d", header.SequenceNumber, header.Timestamp)
+	}
+}
@@ -0,0 +1,260 @@
+package percy
+
+import (
+	"fmt"
+	"time"
+)
+
+// A simulcast sender encodes its video several times, at different
+// resolutions and bitrates, each as its own SSRC (RFC 8853).  The MD forwards
+// one of those layers to each receiver, chosen by the receiver's own limit
+// (SetReceiverLayer, e.g., for a thumbnail view), the conference's policy,
+// and its share of the conference budget, if there is one.  Switching to a
+// layer asks the sender for a keyframe on it, since the receiver can't
+// decode the new SSRC until one arrives.  PERC leaves the original RTP
+// header to the end-to-end protection, so the MD can't rewrite SSRCs;
+// receivers see the SSRC change, as they would with a sender that restarts,
+// unless the conference is in SFU mode and rewrites SSRCs (see
+// ssrcrewrite.go).
+//
+// Signaling tells the MD which layers a sender has, lowest first, by their
+// RIDs (with RIDExtensionID set to the ID of the rtp-stream-id extension,
+// RFC 8852, which stays readable under PERC) or by their SSRCs for clients
+// that signal SSRC groups.  Layers that haven't been heard from for a
+// simulcastLayerTimeout (senders drop upper layers when their uplink is
+// congested) aren't chosen.
+
+const simulcastLayerTimeout = time.Second
+
+type SimulcastLayer int
+
+const (
+	LayerLow SimulcastLayer = iota
+	LayerMedium
+	LayerHigh
+)
+
+func (layer SimulcastLayer) String() string {
+	switch layer {
+	case LayerLow:
+		return "low"
+	case LayerMedium:
+		return "medium"
+	case LayerHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("<%d>", int(layer))
+	}
+}
+
+type SimulcastPolicy uint8
+
+const (
+	// Each receiver gets the highest layer its limit and budget allow
+	SimulcastHighest SimulcastPolicy = iota
+
+	// As above for the dominant speaker; everyone else is sent at the lowest
+	// layer
+	SimulcastSpeaker
+)
+
+// A sender's layers, lowest first.  Guarded by mdd.mu.
+type simulcastLayers struct {
+	rids  []string
+	ssrcs []uint32 // Zero until learned, if the layers are known by RID
+}
+
+// The index of an SSRC among the layers, or -1
+func (layers *simulcastLayers) index(ssrc uint32) int {
+	for i, layerSSRC := range layers.ssrcs {
+		if layerSSRC == ssrc && ssrc != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Learns the SSRC of a layer from a packet's RID
+func (layers *simulcastLayers) learn(header *RTPHeader, ridID uint8) {
+	rid, ok := header.ExtensionElement(ridID)
+	if !ok {
+		return
+	}
+	for i, layerRID := range layers.rids {
+		if layerRID == string(rid) {
+			layers.ssrcs[i] = header.SSRC
+		}
+	}
+}
+
+// Declares a sender's simulcast layers by RID, lowest first
+func (mdd *MDD) SetSimulcastRIDs(senderID AssociationID, rids ...string) {
+	assoc := mdd.association(senderID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if len(rids) == 0 {
+		assoc.simulcast = nil
+		return
+	}
+	assoc.simulcast = &simulcastLayers{rids: append([]string{}, rids...), ssrcs: make([]uint32, len(rids))}
+}
+
+// Declares a sender's simulcast layers by SSRC, lowest first
+func (mdd *MDD) SetSimulcastSSRCs(senderID AssociationID, ssrcs ...uint32) {
+	assoc := mdd.association(senderID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if len(ssrcs) == 0 {
+		assoc.simulcast = nil
+		return
+	}
+	assoc.simulcast = &simulcastLayers{ssrcs: append([]uint32{}, ssrcs...)}
+}
+
+// Sets the highest layer a receiver wants from simulcast senders
+func (mdd *MDD) SetReceiverLayer(receiverID AssociationID, layer SimulcastLayer) error {
+	if layer < LayerLow || layer > LayerHigh {
+		return fmt.Errorf("Invalid simulcast layer %v", layer)
+	}
+
+	assoc := mdd.association(receiverID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.maxLayer = layer
+	return nil
+}
+
+// Sets how layers are chosen for a conference's receivers
+func (mdd *MDD) SetConferenceSimulcastPolicy(confID ConfID, policy SimulcastPolicy) {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	conf.simulcast = policy
+}
+
+// Returns the SSRC of the layer a receiver is getting from a sender, if the
+// sender is sending simulcast
+func (mdd *MDD) SelectedLayer(receiverID, senderID AssociationID) (uint32, bool) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	receiver, ok := mdd.assocs.get(receiverID)
+	if !ok {
+		return 0, false
+	}
+	ssrc := receiver.layers[senderID]
+	return ssrc, ssrc != 0
+}
+
+// Chooses the layer of a sender to forward to a receiver.  Returns zero if
+// none of the sender's layers are active.  The caller holds mdd.mu.
+func (mdd *MDD) chooseLayer(receiver, sender *association, now time.Time) uint32 {
+	target := int(receiver.maxLayer)
+	if conf, ok := mdd.conferences[sender.conf]; ok && conf.simulcast == SimulcastSpeaker {
+		if len(conf.speakers) == 0 || conf.speakers[0] != sender.id {
+			target = int(LayerLow)
+		}
+	}
+
+	// The highest active layer that fits, or failing that the lowest active
+	var chosen, lowest uint32
+	for i, ssrc := range sender.simulcast.ssrcs {
+		counters, ok := sender.stats.ssrcs[ssrc]
+		if ssrc == 0 || !ok || now.Sub(counters.last) > simulcastLayerTimeout {
+			continue
+		}
+		if lowest == 0 {
+			lowest = ssrc
+		}
+		fits := receiver.videoShare == 0 || counters.stats(ssrc, now).Bitrate <= receiver.videoShare
+		if i <= target && fits {
+			chosen = ssrc
+		}
+	}
+	if chosen == 0 {
+		chosen = lowest
+	}
+	return chosen
+}
+
+// Whether a packet from a simulcast sender is on the layer a receiver gets.
+// Receivers are switched to a new layer as soon as it's chosen.  The caller
+// holds mdd.mu.
+func (mdd *MDD) onSelectedLayer(receiver, sender *association, ssrc uint32, now time.Time) bool {
+	if sender.simulcast == nil || sender.simulcast.index(ssrc) < 0 {
+		return true
+	}
+
+	selected := receiver.layers[sender.id]
+	if selected == 0 {
+		selected = mdd.chooseLayer(receiver, sender, now)
+		if receiver.layers == nil {
+			receiver.layers = map[AssociationID]uint32{}
+		}
+		receiver.layers[sender.id] = selected
+	}
+	return ssrc == selected
+}
+
+// Re-chooses each receiver's layers, probing legs before moving them up (see
+// probe.go), and asks for keyframes on layers that receivers have switched
+// to.  Runs on the processing loop.
+func (mdd *MDD) selectLayers(now time.Time) {
+	switched := map[*ssrcCounters]bool{}
+	probes := map[*association]float64{}
+
+	mdd.mu.Lock()
+	assocs := mdd.assocs.snapshot()
+	for _, sender := range assocs {
+		if sender.simulcast == nil {
+			continue
+		}
+		for _, receiver := range assocs {
+			if receiver == sender || receiver.conf != sender.conf {
+				continue
+			}
+
+			ssrc := mdd.chooseLayer(receiver, sender, now)
+			current, ok := receiver.layers[sender.id]
+			if ok && current == ssrc {
+				if receiver.probe != nil && receiver.probe.sender == sender.id {
+					receiver.probe = nil
+				}
+				continue
+			}
+			if ok && current != 0 {
+				fits, rate := mdd.probed(receiver, sender, current, ssrc, now)
+				if rate > 0 {
+					probes[receiver] = rate
+				}
+				if !fits {
+					continue
+				}
+			}
+			if receiver.layers == nil {
+				receiver.layers = map[AssociationID]uint32{}
+			}
+			receiver.layers[sender.id] = ssrc
+			if ok && current != 0 {
+				mdd.record(receiver.conf, receiver.id, "LayerSwitched", "from [%04x], ssrc %08x to %08x", sender.id, current, ssrc)
+			}
+			if counters, active := sender.stats.ssrcs[ssrc]; active && ok && current != 0 {
+				switched[counters] = true
+			}
+		}
+	}
+	mdd.mu.Unlock()
+
+	for receiver, rate := range probes {
+		mdd.sendProbe(receiver, rate)
+	}
+	if len(switched) > 0 {
+		mdd.requestKeyframes(now, func(sender *association, counters *ssrcCounters) bool {
+			return switched[counters]
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+// A video packet on a simulcast layer, with its RID in extension 2
+func simulcastPacket(ssrc byte, rid string, now time.Time) packet {
+	msg := []byte{0x90, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, ssrc, 0xbe, 0xde, 0x00, 0x01}
+	msg = append(msg, 0x20|byte(len(rid)-1))
+	msg = append(msg, rid...)
+	for len(msg)%4 != 0 {
+		msg = append(msg, 0x00)
+	}
+	return packet{msg: msg, recvTime: now}
+}
+
+func TestSimulcastLayers(t *testing.T) {
+	mdd := NewMDD()
+	mdd.RIDExtensionID = 2
+
+	for _, id := range []AssociationID{0x0001, 0x0002, 0x0003} {
+		mdd.SetAssociationConference(id, DefaultConfID)
+	}
+	sender, full, thumbnail := mdd.association(0x0001), mdd.association(0x0002), mdd.association(0x0003)
+	mdd.SetSimulcastRIDs(sender.id, "q", "h", "f")
+	mdd.SetReceiverLayer(thumbnail.id, LayerMedium)
+
+	now := time.Now()
+	send := func(at time.Time, rids ...string) {
+		for i, rid := range []string{"q", "h", "f"} {
+			for _, sent := range rids {
+				if sent == rid {
+					mdd.countIn(sender, packetClassSRTP, simulcastPacket(byte(0x10*(i+1)), rid, at))
+				}
+			}
+		}
+	}
+
+	send(now, "q", "h", "f")
+	if !mdd.onSelectedLayer(full, sender, 0x30, now) || mdd.onSelectedLayer(full, sender, 0x10, now) {
+		t.Fatalf("Receiver not sent the highest layer")
+	}
+	if !mdd.onSelectedLayer(thumbnail, sender, 0x20, now) {
+		t.Fatalf("Receiver not sent the layer at its limit")
+	}
+	if !mdd.onSelectedLayer(full, sender, 0x40, now) {
+		t.Fatalf("Stream outside the sender's layers dropped")
+	}
+
+	// Only the dominant speaker is sent above the lowest layer
+	mdd.SetConferenceSimulcastPolicy(DefaultConfID, SimulcastSpeaker)
+	mdd.selectLayers(now)
+	if ssrc, _ := mdd.SelectedLayer(full.id, sender.id); ssrc != 0x10 {
+		t.Fatalf("Incorrect layer for a non-speaker: %08x", ssrc)
+	}
+	mdd.conference(DefaultConfID).promoteSpeaker(sender.id)
+	mdd.selectLayers(now)
+	if ssrc, _ := mdd.SelectedLayer(full.id, sender.id); ssrc != 0x30 {
+		t.Fatalf("Incorrect layer for the dominant speaker: %08x", ssrc)
+	}
+
+	// Receivers are moved down to fit their budget, and off inactive layers
+	mdd.SetConferenceSimulcastPolicy(DefaultConfID, SimulcastHighest)
+	full.videoShare = 1
+	mdd.selectLayers(now)
+	if ssrc, _ := mdd.SelectedLayer(full.id, sender.id); ssrc != 0x10 {
+		t.Fatalf("Incorrect layer over budget: %08x", ssrc)
+	}
+
+	full.videoShare = 0
+	later := now.Add(2 * simulcastLayerTimeout)
+	send(later, "q", "h")
+	mdd.selectLayers(later)
+	if ssrc, _ := mdd.SelectedLayer(full.id, sender.id); ssrc != 0x20 {
+		t.Fatalf("Incorrect layer with the top layer inactive: %08x", ssrc)
+	}
+}
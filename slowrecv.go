@@ -0,0 +1,195 @@
+package percy
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// All egress happens on the processing loop, so a receiver whose socket or
+// stream stops accepting writes would stall the whole MD.  Every write gets a
+// deadline, and receivers whose writes keep timing out (or failing for lack
+// of buffers) are treated as congested:
+//
+//   - After CongestedAfter unwritable writes in a row, their video is shed,
+//     leaving audio and RTCP
+//   - After FailedAfter, nothing is sent to them, and they are marked failed
+//   - Congested receivers get their video back once they've been writable
+//     for RecoverAfter; failed ones are retried as congested after RetryAfter
+//
+// Legs that are dead rather than slow (writes refused, unreachable, or
+// blocked by a firewall DeadAfter times in a row) are marked failed too.
+//
+// The MD can't tell audio from video without the SDP, so SRTP packets with
+// one of the AudioPayloadTypes are taken to be audio, and all others video.
+
+type SlowReceiverPolicy struct {
+	WriteTimeout      time.Duration // Zero for no deadline
+	CongestedAfter    int
+	FailedAfter       int
+	DeadAfter         int
+	RecoverAfter      time.Duration
+	RetryAfter        time.Duration
+	AudioPayloadTypes []uint8
+}
+
+func DefaultSlowReceiverPolicy() SlowReceiverPolicy {
+	return SlowReceiverPolicy{
+		WriteTimeout:      20 * time.Millisecond,
+		CongestedAfter:    3,
+		FailedAfter:       50,
+		DeadAfter:         10,
+		RecoverAfter:      5 * time.Second,
+		RetryAfter:        10 * time.Second,
+		AudioPayloadTypes: []uint8{0, 8, 9, 109, 111}, // PCMU, PCMA, G.722, and Opus as browsers map it
+	}
+}
+
+type receiverState uint8
+
+const (
+	receiverHealthy receiverState = iota
+	receiverCongested
+	receiverFailed
+)
+
+func (state receiverState) String() string {
+	switch state {
+	case receiverHealthy:
+		return "healthy"
+	case receiverCongested:
+		return "congested"
+	case receiverFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("<%d>", int(state))
+	}
+}
+
+// Egress health of an association, guarded by mdd.mu
+type receiverHealth struct {
+	state   receiverState
+	strikes int       // Unwritable writes in a row
+	dead    int       // Writes to an unreachable leg in a row
+	failing bool      // The last write failed
+	since   time.Time // When the state last changed, or the last strike
+}
+
+// Reports whether a write failed because the receiver can't keep up
+func unwritable(err error) bool {
+	class := classifySocketError(err)
+	return class == socketErrorTimeout || class == socketErrorNoBuffers
+}
+
+// Reports whether a write failed because the receiver's leg is gone
+func unreachable(err error) bool {
+	class := classifySocketError(err)
+	return class == socketErrorRefused || class == socketErrorUnreachable || class == socketErrorPermission
+}
+
+func (policy *SlowReceiverPolicy) isAudio(msg []byte) bool {
+	if len(msg) < 2 {
+		return false
+	}
+	return policy.isAudioPayloadType(msg[1] & 0x7f)
+}
+
+func (policy *SlowReceiverPolicy) isAudioPayloadType(pt uint8) bool {
+	for _, audio := range policy.AudioPayloadTypes {
+		if pt == audio {
+			return true
+		}
+	}
+	return false
+}
+
+// Decides whether a packet to a receiver should be shed instead of written.
+// The caller holds mdd.mu.
+func (mdd *MDD) shed(assoc *association, msg []byte, now time.Time) bool {
+	health := &assoc.health
+	if health.state == receiverFailed && now.Sub(health.since) >= mdd.SlowReceivers.RetryAfter {
+		health.state = receiverCongested
+		health.strikes = mdd.SlowReceivers.CongestedAfter
+		health.since = now
+	}
+
+	switch health.state {
+	case receiverFailed:
+		return true
+	case receiverCongested:
+		return packetClass(msg) == packetClassSRTP && !mdd.SlowReceivers.isAudio(msg)
+	default:
+		return false
+	}
+}
+
+// Updates a receiver's health after a write.  Returns the state if it
+// changed, and whether this write started a run of failures.  The caller
+// holds mdd.mu.
+func (mdd *MDD) updateHealth(assoc *association, err error, now time.Time) (state receiverState, changed bool, firstError bool) {
+	health := &assoc.health
+	policy := &mdd.SlowReceivers
+	before := health.state
+
+	switch {
+	case err == nil:
+		health.strikes = 0
+		health.dead = 0
+		health.failing = false
+		if health.state == receiverCongested && now.Sub(health.since) >= policy.RecoverAfter {
+			health.state = receiverHealthy
+			health.since = now
+		}
+
+	case unwritable(err):
+		health.strikes += 1
+		switch {
+		case policy.FailedAfter > 0 && health.strikes >= policy.FailedAfter:
+			health.state = receiverFailed
+		case policy.CongestedAfter > 0 && health.strikes >= policy.CongestedAfter && health.state == receiverHealthy:
+			health.state = receiverCongested
+		}
+		health.since = now
+
+	case unreachable(err):
+		health.dead += 1
+		if policy.DeadAfter > 0 && health.dead >= policy.DeadAfter {
+			health.state = receiverFailed
+			health.since = now
+		}
+	}
+
+	if err != nil {
+		firstError = !health.failing
+		health.failing = true
+	}
+	return health.state, health.state != before, firstError
+}
+
+// Reports the start of a run of send failures to an association; the rest
+// of the run only shows up in its stats
+func (mdd *MDD) reportSendError(err *SendError) {
+	log.Printf("Error forwarding packet: %v", err)
+	mdd.emit(Event{Type: EventSendError, Assoc: err.Assoc, Conf: err.Conf, Detail: err.Error()})
+}
+
+func (mdd *MDD) reportHealth(assoc *association, state receiverState) {
+	log.Printf("Receiver [%04x] at %v is %v", assoc.id, assoc.addr, state)
+
+	evtType := EventReceiverRecovered
+	switch state {
+	case receiverCongested:
+		evtType = EventReceiverCongested
+	case receiverFailed:
+		evtType = EventReceiverFailed
+	}
+	mdd.emit(Event{Type: evtType, Assoc: assoc.id, Conf: assoc.conf})
+}
+
+// Returns the time by which a write has to complete, or the zero time
+func (mdd *MDD) writeDeadline() time.Time {
+	if mdd.SlowReceivers.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(mdd.SlowReceivers.WriteTimeout)
+}
@@ -0,0 +1,100 @@
+package percy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSlowReceiver(t *testing.T) {
+	mdd := NewMDD()
+	assoc := mdd.association(0x0001)
+	now := time.Now()
+
+	audio := []byte{0x80, 111, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	video := []byte{0x80, 96, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+
+	strike := func(count int) {
+		for i := 0; i < count; i++ {
+			mdd.updateHealth(assoc, os.ErrDeadlineExceeded, now)
+		}
+	}
+
+	strike(mdd.SlowReceivers.CongestedAfter)
+	if assoc.health.state != receiverCongested {
+		t.Fatalf("Receiver not congested: %v", assoc.health.state)
+	}
+	if !mdd.shed(assoc, video, now) || mdd.shed(assoc, audio, now) {
+		t.Fatalf("Congested receiver should lose video but not audio")
+	}
+
+	// A clean write before RecoverAfter doesn't bring video back
+	mdd.updateHealth(assoc, nil, now)
+	if assoc.health.state != receiverCongested {
+		t.Fatalf("Receiver recovered too soon")
+	}
+	mdd.updateHealth(assoc, nil, now.Add(mdd.SlowReceivers.RecoverAfter))
+	if assoc.health.state != receiverHealthy {
+		t.Fatalf("Receiver did not recover: %v", assoc.health.state)
+	}
+
+	strike(mdd.SlowReceivers.FailedAfter)
+	if assoc.health.state != receiverFailed || !mdd.shed(assoc, audio, now) {
+		t.Fatalf("Receiver not failed: %v", assoc.health.state)
+	}
+
+	// Failed receivers are retried, starting out congested
+	if mdd.shed(assoc, audio, now.Add(mdd.SlowReceivers.RetryAfter)) {
+		t.Fatalf("Failed receiver not retried")
+	}
+	if assoc.health.state != receiverCongested {
+		t.Fatalf("Retried receiver not congested: %v", assoc.health.state)
+	}
+}
+
+// A transport whose writes are all refused
+type refusedTransport struct{}
+
+func (refusedTransport) ReadFrom(b []byte) (int, net.Addr, error) { return 0, nil, net.ErrClosed }
+func (refusedTransport) Close() error                             { return nil }
+func (refusedTransport) LocalAddr() net.Addr                      { return &net.UDPAddr{} }
+
+func (refusedTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.ECONNREFUSED)}
+}
+
+func TestDeadLeg(t *testing.T) {
+	mdd := NewMDD()
+	mdd.conn = refusedTransport{}
+	mdd.SetAssociationConference(0x0001, 3)
+	assoc := mdd.association(0x0001)
+	assoc.addr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+
+	events := []Event{}
+	mdd.OnEvent(func(evt Event) {
+		events = append(events, evt)
+	})
+
+	for i := 0; i < mdd.SlowReceivers.DeadAfter; i++ {
+		err := mdd.sendTo(assoc, []byte{0x80, 111})
+
+		var sendErr *SendError
+		if !errors.As(err, &sendErr) || sendErr.Assoc != 0x0001 || sendErr.Conf != 3 {
+			t.Fatalf("Send error does not identify the association: %v", err)
+		}
+		if classifySocketError(err) != socketErrorRefused {
+			t.Fatalf("Send error not classified: %v", err)
+		}
+	}
+
+	// One event when the errors start, and one when the leg is given up on
+	if len(events) != 2 || events[0].Type != EventSendError || events[1].Type != EventReceiverFailed {
+		t.Fatalf("Incorrect events: %+v", events)
+	}
+	if err := mdd.sendTo(assoc, []byte{0x80, 111}); err != nil {
+		t.Fatalf("Sent to a dead leg: %v", err)
+	}
+}
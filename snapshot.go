@@ -0,0 +1,260 @@
+package percy
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The MD's state snapshot records which conference each association is in and
+// how each conference is configured, so that after a crash and restart the MD
+// can pick associations back up as soon as their clients send the next STUN
+// check, without the clients having to re-signal.  Nothing secret is saved:
+// PERC associations get fresh hop-by-hop keys from the KD, and SFU ones
+// re-run DTLS.  Per-conference KD tunnels are not saved either, since they
+// are set up by the application.
+
+type ConferenceState struct {
+	ID       ConfID              `json:"id"`
+	Mode     ForwardingMode      `json:"mode"`
+	Profiles []ProtectionProfile `json:"profiles,omitempty"`
+
+	DataChannels DataChannelPolicy `json:"data_channels"`
+	Tenant       TenantID          `json:"tenant,omitempty"`
+
+	MaxParticipants int  `json:"max_participants,omitempty"`
+	Paused          bool `json:"paused,omitempty"`
+	RequirePERC     bool `json:"require_perc,omitempty"`
+
+	Expires time.Time `json:"expires"` // Zero if the conference doesn't expire
+
+	EgressRules []EgressRule `json:"egress_rules,omitempty"`
+
+	PayloadTypes []int `json:"payload_types,omitempty"`
+}
+
+type AssociationState struct {
+	ID         AssociationID `json:"id"`
+	Conference ConfID        `json:"conference"`
+	Address    string        `json:"address,omitempty"`
+	Paths      []string      `json:"paths,omitempty"` // Addresses mapped to the ID, e.g., after a collision
+	Loopback   bool          `json:"loopback,omitempty"`
+	Role       string        `json:"role,omitempty"`
+}
+
+type StateSnapshot struct {
+	Time         time.Time          `json:"time"`
+	Conferences  []ConferenceState  `json:"conferences"`
+	Associations []AssociationState `json:"associations"`
+}
+
+// Returns the MD's non-secret conference and association metadata
+func (mdd *MDD) State() *StateSnapshot {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	state := &StateSnapshot{
+		Time:         time.Now(),
+		Conferences:  []ConferenceState{},
+		Associations: []AssociationState{},
+	}
+
+	for _, conf := range mdd.conferences {
+		state.Conferences = append(state.Conferences, ConferenceState{
+			ID:       conf.id,
+			Mode:     conf.mode,
+			Profiles: conf.profiles,
+
+			DataChannels: conf.dataChannels,
+			Tenant:       conf.tenant,
+
+			MaxParticipants: conf.maxParticipants,
+			Paused:          conf.paused,
+			RequirePERC:     conf.requirePERC,
+
+			Expires: conf.expires,
+
+			EgressRules: conf.egressRules,
+
+			PayloadTypes: conf.allowedPayloadTypes(),
+		})
+	}
+
+	paths := map[AssociationID][]string{}
+	for key, assocID := range mdd.paths {
+		paths[assocID] = append(paths[assocID], key)
+	}
+
+	for _, assoc := range mdd.assocs.snapshot() {
+		// Injectors belong to the application, which recreates them
+		if assoc.injector != nil {
+			continue
+		}
+
+		assocState := AssociationState{
+			ID:         assoc.id,
+			Conference: assoc.conf,
+			Paths:      paths[assoc.id],
+			Loopback:   assoc.loopback,
+			Role:       assoc.role,
+		}
+		if assoc.addr != nil {
+			assocState.Address = assoc.addr.String()
+		}
+		sort.Strings(assocState.Paths)
+		state.Associations = append(state.Associations, assocState)
+	}
+
+	sort.Slice(state.Conferences, func(i, j int) bool {
+		return state.Conferences[i].ID < state.Conferences[j].ID
+	})
+	sort.Slice(state.Associations, func(i, j int) bool {
+		return state.Associations[i].ID < state.Associations[j].ID
+	})
+
+	return state
+}
+
+// Recreates the conferences and associations in a snapshot.  Associations
+// get their addresses and paths back, so that a client whose ID was rehashed
+// after a collision keeps it, but PERC ones have no keys until the KD sends
+// them again.  This must be called before the MD starts listening, and after
+// any tenants are added.
+func (mdd *MDD) RestoreState(state *StateSnapshot) {
+	for _, conf := range state.Conferences {
+		mdd.SetConferenceMode(conf.ID, conf.Mode)
+		mdd.SetConferenceDataChannels(conf.ID, conf.DataChannels)
+		mdd.SetConferenceParticipantLimit(conf.ID, conf.MaxParticipants)
+		mdd.SetConferencePaused(conf.ID, conf.Paused)
+		mdd.SetConferencePERCRequired(conf.ID, conf.RequirePERC)
+		if conf.PayloadTypes != nil {
+			payloadTypes := []uint8{}
+			for _, pt := range conf.PayloadTypes {
+				payloadTypes = append(payloadTypes, uint8(pt))
+			}
+			mdd.SetConferencePayloadTypes(conf.ID, payloadTypes)
+		}
+		if !conf.Expires.IsZero() {
+			mdd.SetConferenceExpiry(conf.ID, conf.Expires)
+		}
+		if conf.Profiles != nil {
+			mdd.SetConferenceProfiles(conf.ID, conf.Profiles)
+		}
+		if conf.EgressRules != nil {
+			mdd.SetConferenceEgressRules(conf.ID, conf.EgressRules)
+		}
+		if len(conf.Tenant) > 0 {
+			err := mdd.SetConferenceTenant(conf.ID, conf.Tenant)
+			if err != nil {
+				log.Printf("Error restoring conference %d: %v", conf.ID, err)
+			}
+		}
+	}
+
+	for _, assoc := range state.Associations {
+		err := mdd.SetAssociationConference(assoc.ID, assoc.Conference)
+		if err != nil {
+			log.Printf("Error restoring association [%04x]: %v", assoc.ID, err)
+		}
+		mdd.SetLoopback(assoc.ID, assoc.Loopback)
+		if len(assoc.Role) > 0 {
+			mdd.SetAssociationRole(assoc.ID, assoc.Role)
+		}
+		mdd.restoreAddresses(assoc)
+	}
+}
+
+// Gives a restored association its address and paths
+func (mdd *MDD) restoreAddresses(state AssociationState) {
+	assoc, ok := mdd.assocs.get(state.ID)
+	if !ok {
+		return
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if len(state.Address) > 0 {
+		addr, err := net.ResolveUDPAddr("udp", state.Address)
+		if err != nil {
+			log.Printf("Error restoring association [%04x]: %v", state.ID, err)
+		} else {
+			assoc.addr = addr
+		}
+	}
+	for _, path := range state.Paths {
+		mdd.paths[path] = state.ID
+	}
+}
+
+// Writes a snapshot of the MD's state to a file, replacing it atomically so
+// that a crash mid-write leaves the previous snapshot intact
+func (mdd *MDD) SaveState(path string) error {
+	data, err := json.MarshalIndent(mdd.State(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restores the state saved in a file by SaveState
+func (mdd *MDD) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	state := &StateSnapshot{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restoring %d conferences and %d associations saved at %v",
+		len(state.Conferences), len(state.Associations), state.Time)
+	mdd.RestoreState(state)
+	return nil
+}
+
+// Saves the MD's state to a file every interval, until the MD stops
+func (mdd *MDD) SnapshotState(path string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-mdd.quit:
+				return
+			}
+
+			err := mdd.SaveState(path)
+			if err != nil {
+				log.Printf("Error saving state snapshot: %v", err)
+			}
+		}
+	}()
+}
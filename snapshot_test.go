@@ -0,0 +1,81 @@
+package percy
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	mdd := NewMDD()
+	mdd.SetConferenceMode(7, ModeSFU)
+	mdd.SetConferenceProfiles(7, []ProtectionProfile{DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM})
+	mdd.SetAssociationConference(0x1234, 7)
+	mdd.SetLoopback(0x5678, true)
+
+	err := mdd.SaveState(path)
+	if err != nil {
+		t.Fatalf("Error saving state: %v", err)
+	}
+
+	restarted := NewMDD()
+	err = restarted.LoadState(path)
+	if err != nil {
+		t.Fatalf("Error loading state: %v", err)
+	}
+
+	before := mdd.State()
+	after := restarted.State()
+	if !reflect.DeepEqual(before.Conferences, after.Conferences) {
+		t.Fatalf("Conferences not restored: %+v != %+v", after.Conferences, before.Conferences)
+	}
+	if !reflect.DeepEqual(before.Associations, after.Associations) {
+		t.Fatalf("Associations not restored: %+v != %+v", after.Associations, before.Associations)
+	}
+}
+
+func TestStateSnapshotCollidingAddresses(t *testing.T) {
+	// Every address starts out with the same ID
+	collide := func(addr net.Addr, attempt int) AssociationID {
+		return AssociationID(100 + attempt)
+	}
+
+	mdd := NewMDD()
+	mdd.AssociationIDs = collide
+	for _, addr := range []string{"10.0.0.1:5000", "10.0.0.2:5000"} {
+		_, err := mdd.ProvisionEndpoints([]Endpoint{{Addr: addr, Conf: 7}})
+		if err != nil {
+			t.Fatalf("Error provisioning %s: %v", addr, err)
+		}
+	}
+
+	restarted := NewMDD()
+	restarted.AssociationIDs = collide
+	restarted.RestoreState(mdd.State())
+
+	before := mdd.State()
+	after := restarted.State()
+	if !reflect.DeepEqual(before.Associations, after.Associations) {
+		t.Fatalf("Associations not restored: %+v != %+v", after.Associations, before.Associations)
+	}
+
+	second, _ := net.ResolveUDPAddr("udp", "10.0.0.2:5000")
+	assocID, known, err := restarted.addressAssoc(second)
+	if err != nil || !known || assocID != 101 {
+		t.Fatalf("Colliding address not restored: [%04x] %v %v", assocID, known, err)
+	}
+
+	// The second client keeps its ID once the first ID is free again
+	if err := restarted.RemoveClient(100); err != nil {
+		t.Fatalf("Error removing client: %v", err)
+	}
+	restarted.mu.Lock()
+	assocID = restarted.paths["10.0.0.2:5000"]
+	restarted.mu.Unlock()
+	if assocID != 101 {
+		t.Fatalf("Rehashed ID not restored: [%04x]", assocID)
+	}
+}
@@ -0,0 +1,113 @@
+package percy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Socket errors are classified so that operators can tell a full send buffer
+// (ENOBUFS) from a firewall (EPERM) or a client that went away (ICMP port
+// unreachable, which shows up as ECONNREFUSED on the next operation).
+
+type socketErrorClass uint8
+
+const (
+	socketErrorPermission socketErrorClass = iota
+	socketErrorNoBuffers
+	socketErrorRefused
+	socketErrorUnreachable
+	socketErrorTooLarge
+	socketErrorTimeout
+	socketErrorClosed
+	socketErrorOther
+)
+
+func (class socketErrorClass) String() string {
+	switch class {
+	case socketErrorPermission:
+		return "eperm"
+	case socketErrorNoBuffers:
+		return "enobufs"
+	case socketErrorRefused:
+		return "connection_refused"
+	case socketErrorUnreachable:
+		return "unreachable"
+	case socketErrorTooLarge:
+		return "message_too_long"
+	case socketErrorTimeout:
+		return "timeout"
+	case socketErrorClosed:
+		return "closed"
+	default:
+		return "other"
+	}
+}
+
+func classifySocketError(err error) socketErrorClass {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return socketErrorPermission
+	case errors.Is(err, syscall.ENOBUFS):
+		return socketErrorNoBuffers
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socketErrorRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return socketErrorUnreachable
+	case errors.Is(err, syscall.EMSGSIZE):
+		return socketErrorTooLarge
+	case errors.Is(err, net.ErrClosed):
+		return socketErrorClosed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socketErrorTimeout
+	default:
+		return socketErrorOther
+	}
+}
+
+// Counts of socket errors by class
+type socketErrorCounts [socketErrorOther + 1]uint64
+
+func (counts *socketErrorCounts) add(err error) socketErrorClass {
+	class := classifySocketError(err)
+	counts[class] += 1
+	return class
+}
+
+// Returns the non-zero counts by class name, or nil if there are none
+func (counts *socketErrorCounts) byName() map[string]uint64 {
+	var named map[string]uint64
+	for class, count := range counts {
+		if count == 0 {
+			continue
+		}
+		if named == nil {
+			named = map[string]uint64{}
+		}
+		named[socketErrorClass(class).String()] = count
+	}
+	return named
+}
+
+func (mdd *MDD) countReadError(err error) socketErrorClass {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	return mdd.stats.readErrors.add(err)
+}
+
+// SendError identifies the association that a failed send was for
+type SendError struct {
+	Assoc AssociationID
+	Conf  ConfID
+	Err   error
+}
+
+func (err *SendError) Error() string {
+	return fmt.Sprintf("Send to [%04x] failed (%v): %v", err.Assoc, classifySocketError(err.Err), err.Err)
+}
+
+func (err *SendError) Unwrap() error {
+	return err.Err
+}
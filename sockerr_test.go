@@ -0,0 +1,30 @@
+package percy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifySocketError(t *testing.T) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", err)}
+	}
+
+	cases := map[error]socketErrorClass{
+		opError(syscall.ENOBUFS):      socketErrorNoBuffers,
+		opError(syscall.EPERM):        socketErrorPermission,
+		opError(syscall.ECONNREFUSED): socketErrorRefused,
+		opError(net.ErrClosed):        socketErrorClosed,
+		os.ErrDeadlineExceeded:        socketErrorTimeout,
+		errors.New("something else"):  socketErrorOther,
+	}
+
+	for err, expected := range cases {
+		if class := classifySocketError(err); class != expected {
+			t.Fatalf("Incorrect class for %v: %v != %v", err, class, expected)
+		}
+	}
+}
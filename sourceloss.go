@@ -0,0 +1,124 @@
+package percy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// When a sender's stream stops abruptly (a crashed client, a dropped
+// camera), receivers just stop getting packets, and their decoders and UIs
+// are left waiting.  The MD notices streams that go quiet for
+// SourceLossTimeout, and raises an EventSourceLost event, so that signaling
+// can update participant lists, and EventSourceRestored if they come back.
+//
+// Applications can also have the MD send a placeholder on the lost stream,
+// e.g., an Opus silence frame or a small black keyframe, by registering one
+// for the stream's payload type.  Placeholders continue the stream's sequence
+// numbers and timestamps.  They are encrypted with the receivers' hop-by-hop
+// keys in SFU mode and sent as-is in relay mode; in PERC mode, where
+// receivers expect end-to-end encryption the MD can't add, only the events
+// are raised.
+
+const defaultSourceLossTimeout = 2 * time.Second
+
+type Placeholder struct {
+	Payload   []byte
+	ClockRate uint32 // Used to advance the RTP timestamp
+}
+
+// Guarded by mdd.mu
+type sourceState struct {
+	payloadType uint8
+	seq         uint16
+	timestamp   uint32
+	lost        bool
+}
+
+// Remembers the last RTP header seen on a stream.  The caller holds mdd.mu.
+func (ss *sourceState) update(header *RTPHeader) {
+	ss.payloadType = header.PayloadType
+	ss.seq = header.SequenceNumber
+	ss.timestamp = header.Timestamp
+}
+
+// Sets the placeholder sent on lost streams with the given payload type; a
+// nil placeholder removes it
+func (mdd *MDD) SetPlaceholder(payloadType uint8, placeholder *Placeholder) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if placeholder == nil {
+		delete(mdd.fillers, payloadType)
+		return
+	}
+	mdd.fillers[payloadType] = placeholder
+}
+
+type sourceChange struct {
+	assoc *association
+	ssrc  uint32
+	lost  bool
+	pkt   *rtp.RTPPacket // Placeholder to send, if any
+}
+
+// Raises events (and sends placeholders) for streams that have stopped or
+// started again.  Runs on the processing loop.
+func (mdd *MDD) checkSourceLoss(now time.Time) {
+	if mdd.SourceLossTimeout == 0 {
+		return
+	}
+
+	changes := []sourceChange{}
+	mdd.mu.Lock()
+	for _, assoc := range mdd.assocs.snapshot() {
+		for ssrc, counters := range assoc.stats.ssrcs {
+			silent := now.Sub(counters.last) > mdd.SourceLossTimeout
+			if silent == counters.source.lost {
+				continue
+			}
+
+			counters.source.lost = silent
+			change := sourceChange{assoc: assoc, ssrc: ssrc, lost: silent}
+			if placeholder, ok := mdd.fillers[counters.source.payloadType]; ok && silent {
+				change.pkt = counters.placeholder(ssrc, placeholder, now)
+			}
+			changes = append(changes, change)
+		}
+	}
+	mdd.mu.Unlock()
+
+	for _, change := range changes {
+		detail := fmt.Sprintf("ssrc=%08x", change.ssrc)
+		if !change.lost {
+			log.Printf("Stream %08x from [%04x] restored", change.ssrc, change.assoc.id)
+			mdd.emit(Event{Type: EventSourceRestored, Assoc: change.assoc.id, Conf: change.assoc.conf, Detail: detail})
+			continue
+		}
+
+		log.Printf("Stream %08x from [%04x] lost", change.ssrc, change.assoc.id)
+		mdd.emit(Event{Type: EventSourceLost, Assoc: change.assoc.id, Conf: change.assoc.conf, Detail: detail})
+
+		mode := mdd.mode(change.assoc)
+		if change.pkt != nil && mode != ModePERC {
+			mdd.inject(change.assoc, change.pkt, mode == ModeSFU)
+		}
+	}
+}
+
+// Builds a placeholder packet continuing a stream.  The caller holds mdd.mu.
+func (sc *ssrcCounters) placeholder(ssrc uint32, placeholder *Placeholder, now time.Time) *rtp.RTPPacket {
+	elapsed := uint32(now.Sub(sc.last).Seconds() * float64(placeholder.ClockRate))
+
+	buf := make([]byte, 12+len(placeholder.Payload))
+	buf[0] = 0x80
+	buf[1] = 0x80 | sc.source.payloadType
+	binary.BigEndian.PutUint16(buf[2:4], sc.source.seq+1)
+	binary.BigEndian.PutUint32(buf[4:8], sc.source.timestamp+elapsed)
+	binary.BigEndian.PutUint32(buf[8:12], ssrc)
+	copy(buf[12:], placeholder.Payload)
+	return &rtp.RTPPacket{Buffer: buf}
+}
@@ -0,0 +1,68 @@
+package percy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestSourceLoss(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+	mdd.SetPlaceholder(0x6f, &Placeholder{Payload: []byte{0xf8, 0xff, 0xfe}, ClockRate: 48000})
+
+	events := make(chan Event, 10)
+	mdd.OnEvent(func(evt Event) {
+		if evt.Type == EventSourceLost || evt.Type == EventSourceRestored {
+			events <- evt
+		}
+	})
+
+	client1, _ := NewClient(network, "10.0.0.1:5000")
+	defer client1.Stop()
+	client2, _ := NewClient(network, "10.0.0.2:5000")
+	defer client2.Stop()
+
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+	client1.Write(hello)
+	client2.Write(hello)
+	AssertRecvPacket(t, client1, hello, "DTLS packet was not relayed")
+
+	srtpPacket := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	client1.Write(srtpPacket)
+	AssertRecvPacket(t, client2, srtpPacket, "SRTP packet was not relayed")
+
+	check := func(now time.Time) {
+		mdd.runOnLoop(func() { mdd.checkSourceLoss(now) })
+	}
+
+	check(time.Now())
+	check(time.Now().Add(mdd.SourceLossTimeout + time.Second))
+	evt := <-events
+	if evt.Type != EventSourceLost || evt.Assoc != client1.Assoc() || evt.Detail != "ssrc=01020304" {
+		t.Fatalf("Incorrect loss event: %+v", evt)
+	}
+
+	placeholder, err := client2.Recv()
+	if err != nil {
+		t.Fatalf("Placeholder not sent: %v", err)
+	}
+	if !bytes.Equal(placeholder[:4], []byte{0x80, 0xef, 0x00, 0x02}) || !bytes.Equal(placeholder[8:], []byte{0x01, 0x02, 0x03, 0x04, 0xf8, 0xff, 0xfe}) {
+		t.Fatalf("Incorrect placeholder: %x", placeholder)
+	}
+
+	// Loss is only reported once
+	check(time.Now().Add(mdd.SourceLossTimeout + 2*time.Second))
+	AssertNotRecvPacket(t, client2, "Placeholder sent twice")
+
+	client1.Write(srtpPacket)
+	AssertRecvPacket(t, client2, srtpPacket, "SRTP packet was not relayed")
+	check(time.Now())
+	if evt := <-events; evt.Type != EventSourceRestored {
+		t.Fatalf("Incorrect restore event: %+v", evt)
+	}
+}
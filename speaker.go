@@ -0,0 +1,147 @@
+package percy
+
+import (
+	"log"
+	"time"
+)
+
+// Clients report how loud each audio packet is in the client-to-mixer audio
+// level extension (RFC 6464), which PERC leaves unencrypted so that the MD
+// can see it.  With AudioLevelID set to the extension's ID, the MD keeps a
+// smoothed level for each association, and picks the loudest participant in
+// each conference as its dominant speaker.  A new speaker only takes over
+// once the current one has held the floor for minSpeakerHold, or has gone
+// quiet, so that coughs and crosstalk don't flip the view.  Changes raise an
+// EventDominantSpeakerChanged event.  Conferences can use this for last-N
+// forwarding (see lastn.go).
+
+const (
+	speakerCheckInterval = 100 * time.Millisecond
+	speechTimeout        = time.Second // Levels older than this don't count
+	speechThreshold      = -50.0       // dBov; anything quieter is silence
+	minSpeakerHold       = time.Second
+	maxRecentSpeakers    = 16
+)
+
+// Guarded by mdd.mu
+type speechState struct {
+	level float64   // Smoothed, in dBov
+	last  time.Time // Arrival of the last level
+}
+
+// Updates the state with a packet of an audio stream
+func (ss *speechState) update(header *RTPHeader, now time.Time, audioLevelID uint8) {
+	ext, ok := header.ExtensionElement(audioLevelID)
+	if !ok || len(ext) == 0 {
+		return
+	}
+
+	// The low seven bits are the level in -dBov; the top one flags voice
+	level := -float64(ext[0] & 0x7f)
+	if now.Sub(ss.last) > speechTimeout {
+		ss.level = level
+	} else {
+		ss.level += (level - ss.level) / 4
+	}
+	ss.last = now
+}
+
+func (ss *speechState) speaking(now time.Time) bool {
+	return now.Sub(ss.last) <= speechTimeout && ss.level >= speechThreshold
+}
+
+// Returns a conference's dominant speaker, if anyone has spoken
+func (mdd *MDD) DominantSpeaker(confID ConfID) (AssociationID, bool) {
+	speakers := mdd.Speakers(confID)
+	if len(speakers) == 0 {
+		return 0, false
+	}
+	return speakers[0], true
+}
+
+// Returns a conference's recent speakers, the dominant one first
+func (mdd *MDD) Speakers(confID ConfID) []AssociationID {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	conf, ok := mdd.conferences[confID]
+	if !ok {
+		return nil
+	}
+	return mdd.liveSpeakers(conf, len(conf.speakers))
+}
+
+// Returns up to n of a conference's recent speakers that are still
+// associated.  The caller holds mdd.mu.
+func (mdd *MDD) liveSpeakers(conf *conference, n int) []AssociationID {
+	live := []AssociationID{}
+	for _, id := range conf.speakers {
+		if len(live) == n {
+			break
+		}
+		if assoc, ok := mdd.assocs.get(id); ok && assoc.conf == conf.id {
+			live = append(live, id)
+		}
+	}
+	return live
+}
+
+// Re-evaluates the dominant speaker in a conference, at most every
+// speakerCheckInterval.  Runs on the processing loop.
+func (mdd *MDD) checkSpeaker(confID ConfID, now time.Time) {
+	if mdd.AudioLevelID == 0 {
+		return
+	}
+
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	if now.Sub(conf.speakerCheck) < speakerCheckInterval {
+		mdd.mu.Unlock()
+		return
+	}
+	conf.speakerCheck = now
+
+	var loudest, current *association
+	for _, assoc := range mdd.assocs.snapshot() {
+		if assoc.conf != confID {
+			continue
+		}
+		if len(conf.speakers) > 0 && assoc.id == conf.speakers[0] {
+			current = assoc
+		}
+		if assoc.speech.speaking(now) && (loudest == nil || assoc.speech.level > loudest.speech.level) {
+			loudest = assoc
+		}
+	}
+
+	changed := loudest != nil && loudest != current &&
+		(current == nil || !current.speech.speaking(now) || now.Sub(conf.speakerSince) >= minSpeakerHold)
+	entered := false
+	if changed {
+		entered = !mdd.inLastN(conf, loudest.id)
+		conf.promoteSpeaker(loudest.id)
+		conf.speakerSince = now
+	}
+	mdd.mu.Unlock()
+
+	if changed {
+		log.Printf("Dominant speaker in conference %v is now %s", confID, mdd.describe(loudest))
+		mdd.emit(Event{Type: EventDominantSpeakerChanged, Assoc: loudest.id, Conf: confID})
+	}
+	if entered {
+		mdd.lastNEntered(loudest, now)
+	}
+}
+
+// Moves a speaker to the front of the recent speakers.  The caller holds
+// mdd.mu.
+func (conf *conference) promoteSpeaker(assocID AssociationID) {
+	speakers := []AssociationID{assocID}
+	for _, id := range conf.speakers {
+		if id != assocID && len(speakers) < maxRecentSpeakers {
+			speakers = append(speakers, id)
+		}
+	}
+	conf.speakers = speakers
+}
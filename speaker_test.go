@@ -0,0 +1,80 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+// An Opus packet carrying an audio level of -level dBov in extension 1
+func audioLevelPacket(t *testing.T, level byte) *RTPHeader {
+	msg := []byte{
+		0x90, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0xbe, 0xde, 0x00, 0x01, 0x10, 0x80 | level, 0x00, 0x00,
+	}
+	header, err := ParseRTPHeader(msg)
+	if err != nil {
+		t.Fatalf("Error parsing RTP header: %v", err)
+	}
+	return header
+}
+
+func TestDominantSpeaker(t *testing.T) {
+	mdd := NewMDD()
+	mdd.AudioLevelID = 1
+
+	events := []Event{}
+	mdd.OnEvent(func(evt Event) {
+		events = append(events, evt)
+	})
+
+	assocs := []*association{}
+	for _, id := range []AssociationID{0x0001, 0x0002, 0x0003} {
+		mdd.SetAssociationConference(id, DefaultConfID)
+		assocs = append(assocs, mdd.association(id))
+	}
+
+	now := time.Now()
+	speak := func(at time.Time, levels ...byte) {
+		for i, level := range levels {
+			assocs[i].speech.update(audioLevelPacket(t, level), at, mdd.AudioLevelID)
+		}
+		mdd.checkSpeaker(DefaultConfID, at)
+	}
+
+	speak(now, 30, 90, 127)
+	if speaker, ok := mdd.DominantSpeaker(DefaultConfID); !ok || speaker != 0x0001 {
+		t.Fatalf("Incorrect dominant speaker: %04x %v", speaker, ok)
+	}
+
+	// A louder participant has to wait for the current speaker's hold
+	for i := 1; i < 8; i++ {
+		speak(now.Add(time.Duration(i)*speakerCheckInterval), 40, 10, 127)
+	}
+	if speaker, _ := mdd.DominantSpeaker(DefaultConfID); speaker != 0x0001 {
+		t.Fatalf("Dominant speaker changed too soon: %04x", speaker)
+	}
+
+	later := now.Add(minSpeakerHold)
+	for i := 0; i < 2; i++ {
+		speak(later.Add(time.Duration(i)*speakerCheckInterval), 40, 10, 127)
+	}
+	speakers := mdd.Speakers(DefaultConfID)
+	if len(speakers) != 2 || speakers[0] != 0x0002 || speakers[1] != 0x0001 {
+		t.Fatalf("Incorrect speakers: %v", speakers)
+	}
+	if len(events) != 2 || events[1].Type != EventDominantSpeakerChanged || events[1].Assoc != 0x0002 {
+		t.Fatalf("Incorrect events: %+v", events)
+	}
+
+	// With last-N, only the recent speakers' video gets through
+	video := []byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06, 0x07, 0x08}
+	audio := []byte{0x80, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x06, 0x07, 0x08}
+	mdd.SetConferenceLastN(DefaultConfID, 1)
+	if !mdd.outsideLastN(assocs[0], video) || mdd.outsideLastN(assocs[1], video) || mdd.outsideLastN(assocs[0], audio) {
+		t.Fatalf("Incorrect last-N filtering")
+	}
+	mdd.SetConferenceLastN(DefaultConfID, 3)
+	if mdd.outsideLastN(assocs[2], video) {
+		t.Fatalf("Video filtered before enough participants have spoken")
+	}
+}
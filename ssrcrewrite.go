@@ -0,0 +1,185 @@
+package percy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// When a receiver is switched from one stream to another (a simulcast layer
+// change, or a new speaker entering the last-N set), it normally sees the
+// old SSRC stop and a new one start, and has to set up a new decoder and
+// jitter buffer.  With SSRC rewriting, the MD instead presents each receiver
+// with stable streams: each sender's audio, and each video "slot", keep one
+// SSRC, with sequence numbers and timestamps carried on across switches
+// (see seqrewrite.go).  A video slot whose sender has gone quiet for
+// rewriteSlotReuse is handed to the next sender that needs one, which is
+// what keeps last-N switching clean.  Presented SSRCs are chosen at random, avoiding any the receiver
+// has been given or the MD has seen from a sender.  Feedback from the
+// receiver is mapped back to the original stream before it goes to the
+// sender; receiver reports can't be, so conferences that rewrite SSRCs
+// should also terminate RTCP.
+//
+// Rewriting needs the MD to own the RTP header, so it only works in SFU
+// mode: in PERC mode the original header is covered by the end-to-end
+// encryption.
+
+const (
+	rewriteSlotReuse  = 2 * time.Second
+	rewriteSlotExpiry = time.Minute // Unused slots are forgotten after this
+)
+
+type rewriteKey struct {
+	sender AssociationID
+	video  bool
+}
+
+// One stream as a receiver sees it
+type rewriteSlot struct {
+	key  rewriteKey
+	ssrc uint32 // Presented to the receiver
+	seq  seqState
+}
+
+// A receiver's mapping tables.  Guarded by mdd.mu.
+type ssrcRewriter struct {
+	slots     map[rewriteKey]*rewriteSlot
+	presented map[uint32]*rewriteSlot
+}
+
+func newSSRCRewriter() *ssrcRewriter {
+	return &ssrcRewriter{
+		slots:     map[rewriteKey]*rewriteSlot{},
+		presented: map[uint32]*rewriteSlot{},
+	}
+}
+
+// Turns SSRC rewriting on or off for a conference, which has to be in SFU
+// mode
+func (mdd *MDD) SetConferenceSSRCRewriting(confID ConfID, rewrite bool) error {
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if rewrite && conf.mode != ModeSFU {
+		return fmt.Errorf("Conference %v is in %v mode; SSRCs can only be rewritten in sfu mode", confID, conf.mode)
+	}
+	conf.rewriteSSRCs = rewrite
+	return nil
+}
+
+// Returns the SSRCs presented to a receiver, and the original SSRC each is
+// currently carrying
+func (mdd *MDD) RewrittenSSRCs(receiverID AssociationID) map[uint32]uint32 {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	receiver, ok := mdd.assocs.get(receiverID)
+	if !ok || receiver.rewriter == nil {
+		return nil
+	}
+	ssrcs := map[uint32]uint32{}
+	for ssrc, slot := range receiver.rewriter.presented {
+		ssrcs[ssrc] = slot.seq.source
+	}
+	return ssrcs
+}
+
+// Whether media from a sender is rewritten.  The caller holds mdd.mu.
+func (mdd *MDD) rewritesSSRCs(sender *association) bool {
+	conf, ok := mdd.conferences[sender.conf]
+	return ok && conf.rewriteSSRCs && conf.mode == ModeSFU
+}
+
+// Rewrites the header of a decrypted packet from a sender for a receiver.
+// Runs on the processing loop.
+func (mdd *MDD) rewriteSSRC(receiver, sender *association, pkt *rtp.RTPPacket, now time.Time) {
+	header, err := ParseRTPHeader(pkt.Buffer)
+	if err != nil {
+		return
+	}
+	key := rewriteKey{sender: sender.id, video: !mdd.SlowReceivers.isAudioPayloadType(header.PayloadType)}
+	clockRate := mdd.clockRate(header.PayloadType)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if receiver.rewriter == nil {
+		receiver.rewriter = newSSRCRewriter()
+	}
+
+	slot := receiver.rewriter.slot(key, now, func(ssrc uint32) bool {
+		_, seen := mdd.routes[ssrc]
+		return seen
+	})
+	slot.seq.rewrite(pkt.Buffer, header, clockRate, now)
+	binary.BigEndian.PutUint32(pkt.Buffer[8:12], slot.ssrc)
+}
+
+// Returns the slot for a stream, reusing an idle video slot or setting up a
+// new one if it has none
+func (rw *ssrcRewriter) slot(key rewriteKey, now time.Time, seen func(uint32) bool) *rewriteSlot {
+	if slot, ok := rw.slots[key]; ok {
+		return slot
+	}
+
+	for ssrc, slot := range rw.presented {
+		if now.Sub(slot.seq.lastSent) > rewriteSlotExpiry {
+			delete(rw.slots, slot.key)
+			delete(rw.presented, ssrc)
+		}
+	}
+
+	if key.video {
+		for _, slot := range rw.presented {
+			if slot.key.video && now.Sub(slot.seq.lastSent) > rewriteSlotReuse {
+				delete(rw.slots, slot.key)
+				slot.key = key
+				rw.slots[key] = slot
+				return slot
+			}
+		}
+	}
+
+	ssrc := randomUint32()
+	for ssrc == 0 || rw.presented[ssrc] != nil || seen(ssrc) {
+		ssrc = randomUint32()
+	}
+	slot := &rewriteSlot{key: key, ssrc: ssrc}
+	rw.slots[key] = slot
+	rw.presented[ssrc] = slot
+	return slot
+}
+
+// Maps feedback from a receiver about presented SSRCs back to the original
+// streams, in place, so that it can be routed to their senders
+func (mdd *MDD) restoreFeedback(receiver *association, headers []RTCPHeader, msg []byte) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if receiver.rewriter == nil {
+		return
+	}
+
+	offset := 0
+	for i, header := range headers {
+		slot, ok := receiver.rewriter.presented[header.MediaSSRC]
+		if header.IsFeedback() && ok {
+			at := offset + 8
+			if header.PacketType == RTCPTypePSFB && header.Count == rtcpFormatFIR {
+				at = offset + 12
+			}
+			binary.BigEndian.PutUint32(msg[at:], slot.seq.source)
+			headers[i].MediaSSRC = slot.seq.source
+
+			// Generic NACKs name the lost packets by sequence number
+			if header.PacketType == RTCPTypeRTPFB && header.Count == rtcpFormatNACK {
+				for fci := offset + 12; fci+4 <= offset+header.Size; fci += 4 {
+					pid := binary.BigEndian.Uint16(msg[fci:])
+					binary.BigEndian.PutUint16(msg[fci:], slot.seq.original(pid))
+				}
+			}
+		}
+		offset += header.Size
+	}
+}
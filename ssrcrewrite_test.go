@@ -0,0 +1,86 @@
+package percy
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+func rewritePacket(ssrc uint32, seq uint16, ts uint32) *rtp.RTPPacket {
+	buf := []byte{0x80, 0x60, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xaa}
+	binary.BigEndian.PutUint16(buf[2:4], seq)
+	binary.BigEndian.PutUint32(buf[4:8], ts)
+	binary.BigEndian.PutUint32(buf[8:12], ssrc)
+	return &rtp.RTPPacket{Buffer: buf}
+}
+
+func TestSSRCRewriting(t *testing.T) {
+	mdd := NewMDD()
+	if err := mdd.SetConferenceSSRCRewriting(5, true); err == nil {
+		t.Fatalf("SSRC rewriting allowed in PERC mode")
+	}
+	mdd.SetConferenceMode(5, ModeSFU)
+	if err := mdd.SetConferenceSSRCRewriting(5, true); err != nil {
+		t.Fatalf("Error turning on SSRC rewriting: %v", err)
+	}
+
+	assocs := []*association{}
+	for _, id := range []AssociationID{0x0001, 0x0002, 0x0003} {
+		mdd.SetAssociationConference(id, 5)
+		assocs = append(assocs, mdd.association(id))
+	}
+	receiver, sender, other := assocs[0], assocs[1], assocs[2]
+	mdd.mu.Lock()
+	rewrite := mdd.rewritesSSRCs(sender)
+	mdd.mu.Unlock()
+	if !rewrite {
+		t.Fatalf("Sender not rewritten")
+	}
+
+	// A layer switch keeps the presented SSRC, and carries on its sequence
+	// numbers and timestamps
+	now := time.Now()
+	low := rewritePacket(0x1000, 100, 5000)
+	mdd.rewriteSSRC(receiver, sender, low, now)
+	presented := packetSSRC(packetClassSRTP, low.Buffer)
+	if presented == 0x1000 {
+		t.Fatalf("SSRC not rewritten")
+	}
+
+	high := rewritePacket(0x2000, 7000, 900000)
+	mdd.rewriteSSRC(receiver, sender, high, now.Add(100*time.Millisecond))
+	header, _ := ParseRTPHeader(high.Buffer)
+	if header.SSRC != presented || header.SequenceNumber != 101 || header.Timestamp != 5000+9000 {
+		t.Fatalf("Switch not continuous: %08x %d %d", header.SSRC, header.SequenceNumber, header.Timestamp)
+	}
+	if ssrcs := mdd.RewrittenSSRCs(receiver.id); ssrcs[presented] != 0x2000 {
+		t.Fatalf("Incorrect mapping table: %v", ssrcs)
+	}
+
+	// Feedback about the presented SSRC goes back to the original stream
+	nack := []byte{0x81, 0xcd, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x65, 0x00, 0x00}
+	binary.BigEndian.PutUint32(nack[8:12], presented)
+	headers, _ := ParseRTCPCompound(nack)
+	mdd.restoreFeedback(receiver, headers, nack)
+	if headers[0].MediaSSRC != 0x2000 || binary.BigEndian.Uint32(nack[8:12]) != 0x2000 || binary.BigEndian.Uint16(nack[12:14]) != 7000 {
+		t.Fatalf("Feedback not restored: %x", nack)
+	}
+
+	// Once the sender's video goes quiet, another sender takes over its slot
+	later := now.Add(time.Second + rewriteSlotReuse)
+	next := rewritePacket(0x3000, 40, 1234)
+	mdd.rewriteSSRC(receiver, other, next, later)
+	if ssrc := packetSSRC(packetClassSRTP, next.Buffer); ssrc != presented {
+		t.Fatalf("Idle video slot not reused: %08x", ssrc)
+	}
+
+	// Audio keeps a slot per sender
+	audio := rewritePacket(0x4000, 1, 1)
+	audio.Buffer[1] = 0x6f
+	mdd.rewriteSSRC(receiver, other, audio, later)
+	if ssrc := packetSSRC(packetClassSRTP, audio.Buffer); ssrc == presented || ssrc == 0x4000 {
+		t.Fatalf("Audio not given its own SSRC: %08x", ssrc)
+	}
+}
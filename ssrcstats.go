@@ -0,0 +1,163 @@
+package percy
+
+import (
+	"time"
+)
+
+// Per-SSRC rates are computed over a rolling window, from counts kept in
+// one-second buckets.  The RTP header is in the clear, so this works in every
+// forwarding mode.  Frames are counted from the marker bit, which marks the
+// last packet of a video frame; for audio it marks the start of a talkspurt,
+// so the frame rate is only meaningful for video.
+//
+// Jitter is the mean deviation of the time between the first packets of
+// successive frames (packets with a new RTP timestamp), smoothed as in RFC
+// 3550.  Without the codec's clock rate, it can't be compared against the
+// RTP timestamps themselves, but it shows how evenly a sender's media
+// arrives, measured from the kernel's receive times.
+
+const (
+	ssrcRateBucket  = time.Second
+	ssrcRateBuckets = 5
+	ssrcRateWindow  = ssrcRateBucket * ssrcRateBuckets
+	ssrcIdleTimeout = 30 * time.Second // Streams idle this long are forgotten
+)
+
+type SSRCStats struct {
+	SSRC       uint32       `json:"ssrc"`
+	Bitrate    float64      `json:"bitrate"` // Bits per second
+	PacketRate float64      `json:"packet_rate"`
+	FrameRate  float64      `json:"frame_rate"`
+	Total      TrafficStats `json:"total"`
+
+	Jitter        time.Duration `json:"jitter"`
+	SinceKeyframe time.Duration `json:"since_keyframe,omitempty"` // Video only
+
+	// The media section and RTP stream it was sent for, with MIDExtensionID
+	MID string `json:"mid,omitempty"`
+	RID string `json:"rid,omitempty"`
+}
+
+type rateBucket struct {
+	start   time.Time
+	packets uint64
+	bytes   uint64
+	frames  uint64
+}
+
+type ssrcCounters struct {
+	first   time.Time
+	last    time.Time
+	total   TrafficStats
+	buckets [ssrcRateBuckets]rateBucket
+	source  sourceState
+
+	reception receptionStats
+	keyframes keyframeState
+
+	// Arrival of the last new frame, the smoothed time between frames, and
+	// its mean deviation
+	frameArrival time.Time
+	frameGap     time.Duration
+	jitter       time.Duration
+}
+
+func (sc *ssrcCounters) add(now time.Time, bytes int, marker bool) {
+	if sc.first.IsZero() {
+		sc.first = now
+	}
+	sc.last = now
+	sc.total.add(bytes)
+
+	start := now.Truncate(ssrcRateBucket)
+	bucket := &sc.buckets[(start.UnixNano()/int64(ssrcRateBucket))%ssrcRateBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = rateBucket{start: start}
+	}
+
+	bucket.packets += 1
+	bucket.bytes += uint64(bytes)
+	if marker {
+		bucket.frames += 1
+	}
+}
+
+func (sc *ssrcCounters) stats(ssrc uint32, now time.Time) SSRCStats {
+	stats := SSRCStats{SSRC: ssrc, Total: sc.total, Jitter: sc.jitter}
+
+	cutoff := now.Truncate(ssrcRateBucket).Add(-ssrcRateWindow + ssrcRateBucket)
+	var packets, bytes, frames uint64
+	for _, bucket := range sc.buckets {
+		if bucket.start.Before(cutoff) {
+			continue
+		}
+		packets += bucket.packets
+		bytes += bucket.bytes
+		frames += bucket.frames
+	}
+
+	// Streams younger than the window are measured over their lifetime
+	span := now.Sub(cutoff)
+	if sc.first.After(cutoff) {
+		span = now.Sub(sc.first)
+	}
+	if span < ssrcRateBucket/10 {
+		span = ssrcRateBucket / 10
+	}
+
+	seconds := span.Seconds()
+	stats.Bitrate = float64(8*bytes) / seconds
+	stats.PacketRate = float64(packets) / seconds
+	stats.FrameRate = float64(frames) / seconds
+	if !sc.keyframes.last.IsZero() {
+		stats.SinceKeyframe = now.Sub(sc.keyframes.last)
+	}
+	return stats
+}
+
+// Updates the jitter estimate with a packet that starts a new frame
+func (sc *ssrcCounters) frameArrived(now time.Time) {
+	if !sc.frameArrival.IsZero() {
+		gap := now.Sub(sc.frameArrival)
+		if sc.frameGap == 0 {
+			sc.frameGap = gap
+		}
+
+		deviation := gap - sc.frameGap
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		sc.jitter += (deviation - sc.jitter) / 16
+		sc.frameGap += (gap - sc.frameGap) / 16
+	}
+	sc.frameArrival = now
+}
+
+// Counts an RTP packet against its SSRC, and returns the SSRC's counters.
+// The caller holds mdd.mu.
+func (assoc *association) countSSRC(header *RTPHeader, size int, now time.Time) *ssrcCounters {
+	if assoc.stats.ssrcs == nil {
+		assoc.stats.ssrcs = map[uint32]*ssrcCounters{}
+	}
+
+	ssrc := header.SSRC
+	counters, ok := assoc.stats.ssrcs[ssrc]
+	if !ok {
+		// Forget streams that have gone away before adding a new one
+		for old, oldCounters := range assoc.stats.ssrcs {
+			if now.Sub(oldCounters.last) > ssrcIdleTimeout {
+				delete(assoc.stats.ssrcs, old)
+			}
+		}
+
+		counters = &ssrcCounters{}
+		assoc.stats.ssrcs[ssrc] = counters
+	}
+
+	counters.add(now, size, header.Marker)
+	if !ok || header.Timestamp != counters.source.timestamp {
+		counters.frameArrived(now)
+	}
+	counters.source.update(header)
+	return counters
+}
@@ -0,0 +1,72 @@
+package percy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSSRCRates(t *testing.T) {
+	// 50 packets of 100 bytes per second, with every other one ending a
+	// frame, for 5 seconds
+	start := time.Unix(1000, 0)
+	counters := &ssrcCounters{}
+	for i := 0; i < 250; i++ {
+		counters.add(start.Add(time.Duration(i)*20*time.Millisecond), 100, i%2 == 1)
+	}
+
+	stats := counters.stats(0x1234, start.Add(5*time.Second))
+	if stats.PacketRate != 50 || stats.Bitrate != 40000 || stats.FrameRate != 25 {
+		t.Fatalf("Incorrect rates: %+v", stats)
+	}
+	if stats.Total.Packets != 250 || stats.Total.Bytes != 25000 {
+		t.Fatalf("Incorrect totals: %+v", stats.Total)
+	}
+
+	// A stream younger than the window is measured over its lifetime
+	counters = &ssrcCounters{}
+	for i := 0; i < 25; i++ {
+		counters.add(start.Add(time.Duration(i)*20*time.Millisecond), 100, false)
+	}
+
+	stats = counters.stats(0x1234, start.Add(500*time.Millisecond))
+	if stats.PacketRate != 50 {
+		t.Fatalf("Incorrect rate for a new stream: %+v", stats)
+	}
+}
+
+func TestSSRCJitter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	assoc := newAssociation(0x0001)
+	pkt := []byte{0x80, 0x6f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04}
+
+	// Frames every 20ms, each in two packets, arriving evenly...
+	now := start
+	for i := 0; i < 100; i++ {
+		pkt[7] = byte(i)
+		header, _ := ParseRTPHeader(pkt)
+		assoc.countSSRC(header, len(pkt), now)
+		assoc.countSSRC(header, len(pkt), now.Add(time.Millisecond))
+		now = now.Add(20 * time.Millisecond)
+	}
+
+	counters := assoc.stats.ssrcs[0x01020304]
+	if jitter := counters.stats(0x01020304, now).Jitter; jitter != 0 {
+		t.Fatalf("Jitter for evenly spaced frames: %v", jitter)
+	}
+
+	// ... then alternately 10ms early and late
+	for i := 100; i < 200; i++ {
+		pkt[7] = byte(i)
+		offset := 10 * time.Millisecond
+		if i%2 == 0 {
+			offset = -offset
+		}
+		header, _ := ParseRTPHeader(pkt)
+		assoc.countSSRC(header, len(pkt), now.Add(offset))
+		now = now.Add(20 * time.Millisecond)
+	}
+
+	if jitter := counters.stats(0x01020304, now).Jitter; jitter < 10*time.Millisecond {
+		t.Fatalf("Jitter too low for uneven frames: %v", jitter)
+	}
+}
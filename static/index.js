@@ -28,7 +28,7 @@ function run() {
 
   console.log("wtf?");
 
-  const socket = new WebSocket('wss://localhost:' + RELAY_PORT + '/ws');
+  const socket = new WebSocket('wss://' + window.location.hostname + ':' + RELAY_PORT + '/ws');
 
   var answer_set;
   var answer_is_set = new Promise(r => answer_set = r);
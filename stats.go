@@ -0,0 +1,410 @@
+package percy
+
+import (
+	"sort"
+	"time"
+)
+
+// Counters are updated by the processing loop and read by StatsSnapshot from
+// other goroutines, so they are all guarded by mdd.mu.
+
+type TrafficStats struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+func (ts *TrafficStats) add(bytes int) {
+	ts.Packets += 1
+	ts.Bytes += uint64(bytes)
+}
+
+func (ts *TrafficStats) merge(other TrafficStats) {
+	ts.Packets += other.Packets
+	ts.Bytes += other.Bytes
+}
+
+type assocCounters struct {
+	in            TrafficStats
+	out           TrafficStats
+	decodeErrors  uint64
+	encodeErrors  uint64
+	sendErrors    uint64
+	sendClasses   socketErrorCounts
+	lastSendError string
+	rtcpCoalesced uint64 // Queued reports replaced by newer ones
+	shed          uint64 // Packets not sent because the client is congested
+	held          uint64 // Packets not forwarded because the conference is paused
+	queueDropped  uint64 // Packets dropped because the client's send queue was full
+	lastActivity  time.Time
+	ice           iceCounters
+	ecn           ECNStats
+	ssrcs         map[uint32]*ssrcCounters // Streams received from the client
+	sent          map[uint32]*TrafficStats // Streams sent to the client
+}
+
+type globalCounters struct {
+	start       time.Time
+	in          TrafficStats
+	out         TrafficStats
+	classes     [packetClassUnknown + 1]uint64
+	sendErrors  uint64
+	sendClasses socketErrorCounts
+	readErrors  socketErrorCounts
+	stunDropped uint64 // STUN messages dropped because the workers were busy
+	resumed     uint64 // Associations that moved to a new address
+	pathChanges uint64 // Associations that moved to another ICE-verified path
+	collisions  uint64 // Addresses whose association ID was already taken
+	evicted     uint64 // Associations removed for being idle
+	backfilled  uint64 // Packets decrypted once their keys were installed
+	unfilled    uint64 // Packets that arrived before keys and were dropped
+	violations  map[ParseViolation]uint64
+	stunCached  uint64 // Binding requests answered from the cache
+	notAdmitted uint64 // Packets dropped from sources that weren't added
+	strayed     uint64 // Packets on a conference's own socket from outside it
+
+	// Packets that failed with the current keys during a rollover, and were
+	// or weren't decrypted with the previous ones
+	rolloverDecrypts uint64
+	rolloverFailures uint64
+
+	// Media refused for lack of double encryption
+	downgraded uint64
+
+	// Packets not forwarded because the receiver already got them
+	duplicates uint64
+
+	// Media with payload types its conference doesn't allow
+	disallowed uint64
+
+	// Traffic by the kind of path it took
+	networks map[string]*networkCounters
+}
+
+type AssociationStats struct {
+	ID            AssociationID     `json:"id"`
+	Conference    ConfID            `json:"conference"`
+	Address       string            `json:"address"`
+	Profile       ProtectionProfile `json:"profile"`
+	Keyed         bool              `json:"keyed"`
+	Loopback      bool              `json:"loopback,omitempty"`
+	In            TrafficStats      `json:"in"`
+	Out           TrafficStats      `json:"out"`
+	DecodeErrors  uint64            `json:"decode_errors"`
+	EncodeErrors  uint64            `json:"encode_errors"`
+	SendErrors    uint64            `json:"send_errors"`
+	SendClasses   map[string]uint64 `json:"send_error_classes,omitempty"`
+	LastSendError string            `json:"last_send_error,omitempty"`
+	RTCPCoalesced uint64            `json:"rtcp_coalesced,omitempty"`
+	Egress        string            `json:"egress,omitempty"` // "congested" or "failed" if the client can't keep up
+	Shed          uint64            `json:"shed,omitempty"`
+	Held          uint64            `json:"held,omitempty"`
+	QueueDropped  uint64            `json:"queue_dropped,omitempty"`
+	MutedAudio    bool              `json:"muted_audio,omitempty"`
+	MutedVideo    bool              `json:"muted_video,omitempty"`
+	Network       string            `json:"network,omitempty"` // e.g., "udp/ipv4"; see network.go
+	LastActivity  time.Time         `json:"last_activity"`
+	ICE           *ICEStats         `json:"ice,omitempty"`
+	ECN           *ECNStats         `json:"ecn,omitempty"`
+	Estimate      float64           `json:"estimated_bitrate,omitempty"` // Of its leg, if REMB is on
+	RTT           time.Duration     `json:"rtt,omitempty"`
+	Streams       []SSRCStats       `json:"streams,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+type ConferenceStats struct {
+	ID           ConfID       `json:"id"`
+	Associations int          `json:"associations"`
+	Paused       bool         `json:"paused,omitempty"`
+	RequirePERC  bool         `json:"require_perc,omitempty"`
+	In           TrafficStats `json:"in"`
+	Out          TrafficStats `json:"out"`
+
+	// Senders whose video is forwarded, under a last-N limit
+	LastN []AssociationID `json:"last_n,omitempty"`
+
+	// The conference's own socket, if it has one
+	Socket string `json:"socket,omitempty"`
+
+	// The only payload types forwarded, if the conference is limited
+	PayloadTypes []int `json:"payload_types,omitempty"`
+}
+
+type GlobalStats struct {
+	Uptime       time.Duration     `json:"uptime"`
+	Associations int               `json:"associations"`
+	Conferences  int               `json:"conferences"`
+	In           TrafficStats      `json:"in"`
+	Out          TrafficStats      `json:"out"`
+	Classes      map[string]uint64 `json:"classes"`
+	SendErrors   uint64            `json:"send_errors"`
+	SendClasses  map[string]uint64 `json:"send_error_classes,omitempty"`
+	ReadErrors   map[string]uint64 `json:"read_errors,omitempty"`
+	STUNDropped  uint64            `json:"stun_dropped,omitempty"`
+	Resumed      uint64            `json:"resumed,omitempty"`
+	PathChanges  uint64            `json:"path_changes,omitempty"`
+	Collisions   uint64            `json:"assoc_id_collisions,omitempty"`
+	Evicted      uint64            `json:"evicted,omitempty"`
+	Backfilled   uint64            `json:"backfilled,omitempty"`
+	Unfilled     uint64            `json:"backfill_dropped,omitempty"`
+	Violations   map[string]uint64 `json:"parse_violations,omitempty"`
+	STUNCached   uint64            `json:"stun_cached,omitempty"`
+	Idle         bool              `json:"idle,omitempty"`
+	NotAdmitted  uint64            `json:"not_admitted,omitempty"`
+	Strayed      uint64            `json:"stray_packets,omitempty"`
+	Latency      LatencyStats      `json:"latency"`
+
+	// Packets decrypted with the keys a rekey replaced, and packets that
+	// failed with both
+	RolloverDecrypts uint64 `json:"rollover_decrypts,omitempty"`
+	RolloverFailures uint64 `json:"rollover_failures,omitempty"`
+
+	// Media refused by a conference's encryption policy
+	Downgraded uint64 `json:"downgrade_dropped,omitempty"`
+
+	// Repeats of packets already forwarded to their receivers
+	Duplicates uint64 `json:"duplicate_dropped,omitempty"`
+
+	// Media with a payload type its conference doesn't allow
+	Disallowed uint64 `json:"payload_type_dropped,omitempty"`
+
+	// Associations and traffic by the kind of path, e.g., "udp/ipv4"
+	Networks map[string]NetworkStats `json:"networks,omitempty"`
+
+	// The processing loop's current poll interval, and the packets per
+	// second it handled when that was chosen
+	PollInterval time.Duration `json:"poll_interval"`
+	LoopRate     float64       `json:"loop_packet_rate"`
+}
+
+type StatsSnapshot struct {
+	Time         time.Time          `json:"time"`
+	Global       GlobalStats        `json:"global"`
+	Conferences  []ConferenceStats  `json:"conferences"`
+	Associations []AssociationStats `json:"associations"`
+}
+
+func (class dtlsSRTPPacketClass) String() string {
+	switch class {
+	case packetClassDTLS:
+		return "dtls"
+	case packetClassSRTP:
+		return "srtp"
+	case packetClassSRTCP:
+		return "srtcp"
+	case packetClassSTUN:
+		return "stun"
+	case packetClassHBHKey:
+		return "hbhkey"
+	default:
+		return "unknown"
+	}
+}
+
+func (mdd *MDD) countIn(assoc *association, class dtlsSRTPPacketClass, pkt packet) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	msg, recvTime := pkt.msg, pkt.recvTime
+	mdd.stats.in.add(len(msg))
+	mdd.stats.classes[class] += 1
+	if assoc != nil {
+		assoc.stats.in.add(len(msg))
+		if network := mdd.networkCounters(assoc); network != nil {
+			network.in.add(len(msg))
+		}
+		assoc.stats.ecn.count(pkt.ecn)
+		assoc.stats.lastActivity = recvTime
+		if class != packetClassSRTP {
+			return
+		}
+		if header, err := ParseRTPHeader(msg); err == nil {
+			counters := assoc.countSSRC(header, len(msg), recvTime)
+			counters.reception.update(header, recvTime, mdd.clockRate(header.PayloadType))
+			if mdd.REMB {
+				assoc.bwe.update(header, recvTime, mdd.clockRate(header.PayloadType))
+			}
+			if !mdd.SlowReceivers.isAudioPayloadType(header.PayloadType) {
+				counters.keyframes.update(header, len(msg), recvTime, mdd.FrameMarkingID)
+				if assoc.simulcast != nil && mdd.RIDExtensionID != 0 {
+					assoc.simulcast.learn(header, mdd.RIDExtensionID)
+				}
+			} else if mdd.AudioLevelID != 0 {
+				assoc.speech.update(header, recvTime, mdd.AudioLevelID)
+			}
+			if mdd.MIDExtensionID != 0 {
+				mdd.learnBundle(assoc, header)
+			}
+			mdd.learnRoute(assoc, header.SSRC)
+		}
+	}
+}
+
+func (mdd *MDD) countOut(assoc *association, bytes int, err error) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	var counters *assocCounters
+	if assoc != nil {
+		counters = &assoc.stats
+	}
+
+	if err != nil {
+		mdd.stats.sendErrors += 1
+		mdd.stats.sendClasses.add(err)
+		if counters != nil {
+			counters.sendErrors += 1
+			counters.sendClasses.add(err)
+			counters.lastSendError = err.Error()
+		}
+		return
+	}
+
+	mdd.stats.out.add(bytes)
+	if counters != nil {
+		counters.out.add(bytes)
+		if network := mdd.networkCounters(assoc); network != nil {
+			network.out.add(bytes)
+		}
+	}
+}
+
+func (mdd *MDD) countDecodeError(assoc *association) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.stats.decodeErrors += 1
+}
+
+func (mdd *MDD) countEncodeError(assoc *association) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	assoc.stats.encodeErrors += 1
+}
+
+// Returns a consistent, JSON-serializable view of all of the MD's counters
+func (mdd *MDD) StatsSnapshot() *StatsSnapshot {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	now := time.Now()
+	snap := &StatsSnapshot{
+		Time: now,
+		Global: GlobalStats{
+			Uptime:       now.Sub(mdd.stats.start),
+			Associations: mdd.assocs.len(),
+			Conferences:  len(mdd.conferences),
+			In:           mdd.stats.in,
+			Out:          mdd.stats.out,
+			Classes:      map[string]uint64{},
+			SendErrors:   mdd.stats.sendErrors,
+			SendClasses:  mdd.stats.sendClasses.byName(),
+			ReadErrors:   mdd.stats.readErrors.byName(),
+			STUNDropped:  mdd.stats.stunDropped,
+			Resumed:      mdd.stats.resumed,
+			PathChanges:  mdd.stats.pathChanges,
+			Collisions:   mdd.stats.collisions,
+			Evicted:      mdd.stats.evicted,
+			Backfilled:   mdd.stats.backfilled,
+			Unfilled:     mdd.stats.unfilled,
+			Violations:   mdd.violationStats(),
+			STUNCached:   mdd.stats.stunCached,
+			Idle:         mdd.idle,
+			NotAdmitted:  mdd.stats.notAdmitted,
+			Strayed:      mdd.stats.strayed,
+			Latency:      mdd.latency.stats(),
+
+			RolloverDecrypts: mdd.stats.rolloverDecrypts,
+			RolloverFailures: mdd.stats.rolloverFailures,
+
+			Downgraded: mdd.stats.downgraded,
+			Duplicates: mdd.stats.duplicates,
+			Disallowed: mdd.stats.disallowed,
+			Networks:   mdd.networkStats(),
+
+			PollInterval: mdd.timeout,
+			LoopRate:     mdd.loopRate,
+		},
+		Conferences:  []ConferenceStats{},
+		Associations: []AssociationStats{},
+	}
+
+	for class, count := range mdd.stats.classes {
+		snap.Global.Classes[dtlsSRTPPacketClass(class).String()] = count
+	}
+
+	confStats := map[ConfID]*ConferenceStats{}
+	for confID, conf := range mdd.conferences {
+		confStats[confID] = &ConferenceStats{ID: confID, Paused: conf.paused, RequirePERC: conf.requirePERC, LastN: mdd.lastNSenders(conf)}
+		if conf.socket != nil {
+			confStats[confID].Socket = conf.socket.conn.LocalAddr().String()
+		}
+		confStats[confID].PayloadTypes = conf.allowedPayloadTypes()
+	}
+
+	for _, assoc := range mdd.assocs.snapshot() {
+		stats := AssociationStats{
+			ID:            assoc.id,
+			Conference:    assoc.conf,
+			Profile:       assoc.profile,
+			Keyed:         assoc.profile != 0,
+			Loopback:      assoc.loopback,
+			In:            assoc.stats.in,
+			Out:           assoc.stats.out,
+			DecodeErrors:  assoc.stats.decodeErrors,
+			EncodeErrors:  assoc.stats.encodeErrors,
+			SendErrors:    assoc.stats.sendErrors,
+			SendClasses:   assoc.stats.sendClasses.byName(),
+			LastSendError: assoc.stats.lastSendError,
+			RTCPCoalesced: assoc.stats.rtcpCoalesced,
+			Shed:          assoc.stats.shed,
+			Held:          assoc.stats.held,
+			QueueDropped:  assoc.stats.queueDropped,
+			MutedAudio:    assoc.mutedAudio,
+			MutedVideo:    assoc.mutedVideo,
+			Estimate:      assoc.bwe.estimate,
+			RTT:           assoc.rtt,
+			LastActivity:  assoc.stats.lastActivity,
+			ICE:           assoc.stats.ice.stats(now),
+			ECN:           assoc.stats.ecn.orNil(),
+			Labels:        mdd.assocs.labelsOf(assoc),
+		}
+		if assoc.addr != nil {
+			stats.Address = assoc.addr.String()
+			stats.Network = assoc.network
+		}
+		if assoc.health.state != receiverHealthy {
+			stats.Egress = assoc.health.state.String()
+		}
+		for ssrc, counters := range assoc.stats.ssrcs {
+			if now.Sub(counters.last) <= ssrcIdleTimeout {
+				stream := counters.stats(ssrc, now)
+				if bundle, ok := assoc.bundle[ssrc]; ok {
+					stream.MID, stream.RID = bundle.MID, bundle.RID
+				}
+				stats.Streams = append(stats.Streams, stream)
+			}
+		}
+		sort.Slice(stats.Streams, func(i, j int) bool {
+			return stats.Streams[i].SSRC < stats.Streams[j].SSRC
+		})
+		snap.Associations = append(snap.Associations, stats)
+
+		if conf, ok := confStats[assoc.conf]; ok {
+			conf.Associations += 1
+			conf.In.merge(assoc.stats.in)
+			conf.Out.merge(assoc.stats.out)
+		}
+	}
+
+	for _, conf := range confStats {
+		snap.Conferences = append(snap.Conferences, *conf)
+	}
+
+	sort.Slice(snap.Conferences, func(i, j int) bool {
+		return snap.Conferences[i].ID < snap.Conferences[j].ID
+	})
+	sort.Slice(snap.Associations, func(i, j int) bool {
+		return snap.Associations[i].ID < snap.Associations[j].ID
+	})
+
+	return snap
+}
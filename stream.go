@@ -0,0 +1,135 @@
+package percy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Clients on networks that block UDP can reach the MD over TLS on TCP (e.g.,
+// port 443, like TURN-TLS).  Each packet is framed with a two-byte length
+// prefix, as in RFC 4571, and fed into the same processing loop as UDP
+// packets, with the TCP remote address standing in for the UDP one.
+
+const (
+	maxStreamFrameSize = 0xFFFF
+)
+
+type streamConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+// Writes a frame, giving up at the deadline unless it is zero
+func (stream *streamConn) write(msg []byte, deadline time.Time) (int, error) {
+	if len(msg) > maxStreamFrameSize {
+		return 0, fmt.Errorf("Packet too large for stream framing [%d]", len(msg))
+	}
+
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+
+	stream.writeMu.Lock()
+	defer stream.writeMu.Unlock()
+
+	stream.conn.SetWriteDeadline(deadline)
+	_, err := stream.conn.Write(frame)
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+type streamListener struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[string]*streamConn
+}
+
+func (sl *streamListener) lookup(addr net.Addr) (*streamConn, bool) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	stream, ok := sl.conns[addr.String()]
+	return stream, ok
+}
+
+func (sl *streamListener) close() {
+	sl.listener.Close()
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	for key, stream := range sl.conns {
+		stream.conn.Close()
+		delete(sl.conns, key)
+	}
+}
+
+func (sl *streamListener) serve(conn net.Conn, packetChan chan packet) {
+	addr := conn.RemoteAddr()
+	stream := &streamConn{conn: conn}
+
+	sl.mu.Lock()
+	sl.conns[addr.String()] = stream
+	sl.mu.Unlock()
+
+	defer func() {
+		sl.mu.Lock()
+		delete(sl.conns, addr.String())
+		sl.mu.Unlock()
+		conn.Close()
+	}()
+
+	header := make([]byte, 2)
+	for {
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading stream from %v: %v", addr, err)
+			}
+			return
+		}
+
+		msg := make([]byte, binary.BigEndian.Uint16(header))
+		_, err = io.ReadFull(conn, msg)
+		if err != nil {
+			log.Printf("Error reading stream from %v: %v", addr, err)
+			return
+		}
+
+		packetChan <- packet{addr: addr, msg: msg, recvTime: time.Now()}
+	}
+}
+
+// Accepts media over TLS on the given TCP address (e.g., ":443"), in addition
+// to the UDP port passed to Listen.
+func (mdd *MDD) ListenTLS(addr string, config *tls.Config) error {
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+
+	mdd.streams = &streamListener{
+		listener: listener,
+		conns:    map[string]*streamConn{},
+	}
+
+	go func(sl *streamListener, packetChan chan packet) {
+		for {
+			conn, err := sl.listener.Accept()
+			if err != nil {
+				log.Printf("Stopped accepting TLS streams: %v", err)
+				return
+			}
+
+			go sl.serve(conn, packetChan)
+		}
+	}(mdd.streams, mdd.packetChan)
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package percy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSTUNOverTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("static/cert.pem", "static/key.pem")
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+
+	auth := NewMemoryAuthProvider()
+	auth.SetICEPassword("local", "abcdefabcdefabcdefabcdef")
+
+	mdd := NewMDD()
+	mdd.Auth = auth
+	err = mdd.Listen(2100)
+	if err != nil {
+		t.Fatalf("Error starting MDD: %v", err)
+	}
+	defer mdd.Stop()
+
+	err = mdd.ListenTLS("localhost:2101", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Error starting TLS listener: %v", err)
+	}
+
+	conn, err := tls.Dial("tcp", "localhost:2101", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	request := NewBindingRequest(TransactionID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, "abcdefabcdefabcdefabcdef")
+	request.Add(ATTR_USERNAME, []byte("local:remote"))
+	request.AddMessageIntegrity()
+	msg, err := request.Serialize()
+	if err != nil {
+		t.Fatalf("Error serializing request: %v", err)
+	}
+
+	frame := append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+	_, err = conn.Write(frame)
+	if err != nil {
+		t.Fatalf("Error writing request: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 2)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+
+	msg = make([]byte, binary.BigEndian.Uint16(header))
+	_, err = io.ReadFull(conn, msg)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+
+	response, err := ParseSTUN(msg)
+	if err != nil {
+		t.Fatalf("Error parsing response: %v", err)
+	}
+	if response.msgType != MSG_TYPE_SUCCESS {
+		t.Fatalf("Incorrect response type: %v", response.msgType)
+	}
+	if response.header.TxnID != request.header.TxnID {
+		t.Fatalf("Incorrect transaction ID: %v", response.header.TxnID)
+	}
+	if _, ok := response.Get(ATTR_XOR_MAPPED_ADDRESS); !ok {
+		t.Fatalf("Response has no XOR-MAPPED-ADDRESS")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/bifurcation/mint/syntax"
+	"github.com/bifurcation/percy/internal/cryptoutil"
 	"hash/crc32"
 	"log"
 	"net"
@@ -273,6 +274,23 @@ func (msg STUNMessage) String() string {
 	return val
 }
 
+// Creates a Binding request to be signed (if MESSAGE-INTEGRITY is added) with
+// the receiver's ICE password
+func NewBindingRequest(txnID TransactionID, password string) *STUNMessage {
+	msg := &STUNMessage{msgType: MSG_TYPE_REQUEST, icePassword: password}
+	msg.header.Type = MSG_BINDING
+	msg.header.TxnID = txnID
+	return msg
+}
+
+func (msg *STUNMessage) Type() MessageType {
+	return msg.msgType
+}
+
+func (msg *STUNMessage) TransactionID() TransactionID {
+	return msg.header.TxnID
+}
+
 func ParseSTUN(msg []byte) (*STUNMessage, error) {
 	// TODO: validate MESSAGE-INTEGRITY and FINGERPRINT -- see RFC5245 §7.2
 	request := STUNMessage{}
@@ -363,28 +381,49 @@ func (msg *STUNMessage) Add(tag STUNAttrType, value []byte) {
 	msg.attributes = append(msg.attributes, attr)
 }
 
+// Returns the value of the first attribute with the given tag
+func (msg *STUNMessage) Get(tag STUNAttrType) ([]byte, bool) {
+	for _, attr := range msg.attributes {
+		if attr.Tag == tag {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
 func (msg *STUNMessage) AddErrorCode(code uint, reason string) {
 	msg.Add(ATTR_ERROR_CODE, append([]byte{0, 0, byte(code / 100), byte(code % 100)}, []byte(reason)...))
 }
 
-func MakeMappedAddress(addr *net.UDPAddr) []byte {
+// Returns the IP address and port of a UDP or TCP address
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return net.IPv4zero, 0
+}
+
+func MakeMappedAddress(addr net.Addr) []byte {
 	var family byte
 	var address []byte
-	if address = addr.IP.To4(); address != nil {
+	ip, port := addrIPPort(addr)
+	if address = ip.To4(); address != nil {
 		family = 1
 	} else {
-		address = addr.IP
+		address = ip
 		family = 2
 	}
-	port := addr.Port
 	return append([]byte{0, family, byte(port >> 8), byte(port)}, address...)
 }
 
-func (msg *STUNMessage) AddMappedAddress(addr *net.UDPAddr) {
+func (msg *STUNMessage) AddMappedAddress(addr net.Addr) {
 	msg.Add(ATTR_MAPPED_ADDRESS, MakeMappedAddress(addr))
 }
 
-func (msg *STUNMessage) AddXorMappedAddress(addr *net.UDPAddr) {
+func (msg *STUNMessage) AddXorMappedAddress(addr net.Addr) {
 	messageHeader, err := syntax.Marshal(&msg.header)
 	if err != nil {
 		log.Println("Could not serialize STUN message header when adding XOR Mapped Address")
@@ -404,6 +443,72 @@ func (msg *STUNMessage) AddXorMappedAddress(addr *net.UDPAddr) {
 	msg.Add(ATTR_XOR_MAPPED_ADDRESS, mappedAddress)
 }
 
+// Checks the MESSAGE-INTEGRITY attribute of a serialized message against an
+// ICE password.  Returns false if the attribute is missing.
+func CheckMessageIntegrity(msg []byte, password string) bool {
+	return checkMessageIntegrity(msg, []byte(password))
+}
+
+// Checks MESSAGE-INTEGRITY with an HMAC key: the ICE password for short-term
+// credentials, or the long-term credential key
+func checkMessageIntegrity(msg []byte, key []byte) bool {
+	offset, value, ok := findSTUNAttribute(msg, ATTR_MESSAGE_INTEGRITY)
+	if !ok {
+		return false
+	}
+
+	// The length covers the message up to and including this attribute
+	header := append([]byte{}, msg[:STUN_HEADER_SIZE]...)
+	length := offset - STUN_HEADER_SIZE + 24
+	header[2] = byte(length >> 8)
+	header[3] = byte(length & 0xFF)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(header)
+	mac.Write(msg[STUN_HEADER_SIZE:offset])
+	return cryptoutil.Equal(mac.Sum(nil), value)
+}
+
+// Checks the FINGERPRINT attribute of a serialized message.  Returns false if
+// the attribute is missing.
+func CheckFingerprint(msg []byte) bool {
+	offset, value, ok := findSTUNAttribute(msg, ATTR_FINGERPRINT)
+	if !ok || len(value) != 4 {
+		return false
+	}
+
+	header := append([]byte{}, msg[:STUN_HEADER_SIZE]...)
+	length := offset - STUN_HEADER_SIZE + 8
+	header[2] = byte(length >> 8)
+	header[3] = byte(length & 0xFF)
+
+	checksum := crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, msg[STUN_HEADER_SIZE:offset])
+	return cryptoutil.Equal(u32intToBytes(checksum^0x5354554e), value)
+}
+
+// Returns the offset and value of the first attribute with the given tag in
+// a serialized message
+func findSTUNAttribute(msg []byte, tag STUNAttrType) (int, []byte, bool) {
+	if len(msg) < STUN_HEADER_SIZE {
+		return 0, nil, false
+	}
+
+	offset := STUN_HEADER_SIZE
+	for offset+4 <= len(msg) {
+		attrTag := STUNAttrType(uint16(msg[offset])<<8 | uint16(msg[offset+1]))
+		attrLen := int(uint16(msg[offset+2])<<8 | uint16(msg[offset+3]))
+		if offset+4+attrLen > len(msg) {
+			return 0, nil, false
+		}
+
+		if attrTag == tag {
+			return offset, msg[offset+4 : offset+4+attrLen], true
+		}
+		offset += 4 + ((attrLen+3)/4)*4
+	}
+	return 0, nil, false
+}
+
 func (msg *STUNMessage) AddMessageIntegrity() {
 	// We leave this empty, as it will be calculated during serialization
 	msg.Add(ATTR_MESSAGE_INTEGRITY, []byte{})
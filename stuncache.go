@@ -0,0 +1,78 @@
+package percy
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+// Clients retransmit Binding requests over UDP until they get a response, so
+// a slow or lost response can bring several copies of the same request.  As
+// RFC 8489 (section 6.3.1) suggests, the MD remembers the response it sent
+// for each transaction for as long as the client might retransmit, and
+// sends the same bytes again, rather than checking and computing the
+// HMACs again.  Only byte-for-byte copies of the original request count as
+// retransmits.
+
+const (
+	stunCacheTTL  = 40 * time.Second // Ti, the longest a client retransmits
+	stunCacheSize = 4096
+)
+
+type stunCacheKey struct {
+	addr  string
+	txnID TransactionID
+}
+
+type stunCacheEntry struct {
+	key      stunCacheKey
+	request  []byte
+	response []byte
+	time     time.Time
+}
+
+// Shared by the STUN workers, so it has its own lock
+type stunCache struct {
+	mu      sync.Mutex
+	entries map[stunCacheKey]*stunCacheEntry
+	order   []*stunCacheEntry // Oldest first
+}
+
+func newSTUNCache() *stunCache {
+	return &stunCache{entries: map[stunCacheKey]*stunCacheEntry{}}
+}
+
+// Returns the response sent for a request, if it is still remembered
+func (sc *stunCache) get(addr net.Addr, txnID TransactionID, request []byte, now time.Time) ([]byte, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	entry, ok := sc.entries[stunCacheKey{addr.String(), txnID}]
+	if !ok || now.Sub(entry.time) > stunCacheTTL || !bytes.Equal(entry.request, request) {
+		return nil, false
+	}
+	return entry.response, true
+}
+
+func (sc *stunCache) put(addr net.Addr, txnID TransactionID, request, response []byte, now time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	// Entries are added in time order, so the expired ones are at the front
+	expired := 0
+	for expired < len(sc.order) && (now.Sub(sc.order[expired].time) > stunCacheTTL || len(sc.order)-expired >= stunCacheSize) {
+		delete(sc.entries, sc.order[expired].key)
+		expired += 1
+	}
+	sc.order = sc.order[expired:]
+
+	entry := &stunCacheEntry{
+		key:      stunCacheKey{addr.String(), txnID},
+		request:  append([]byte{}, request...),
+		response: response,
+		time:     now,
+	}
+	sc.entries[entry.key] = entry
+	sc.order = append(sc.order, entry)
+}
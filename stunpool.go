@@ -0,0 +1,74 @@
+package percy
+
+import (
+	"net"
+)
+
+// STUN is handled by a small pool of workers with their own queue, so that
+// the burst of connectivity checks when a large conference starts doesn't
+// hold up media on the processing loop.  When the queue is full, checks are
+// dropped; clients retransmit them.
+
+const (
+	defaultSTUNWorkers = 2
+	defaultSTUNQueue   = 256
+)
+
+type stunJob struct {
+	assoc *association
+	addr  net.Addr
+	msg   []byte
+}
+
+// Starts the STUN workers; called when the MD starts listening
+func (mdd *MDD) startSTUNWorkers() {
+	for i := 0; i < mdd.stunWorkers; i++ {
+		mdd.workers.Add(1)
+		go mdd.stunWorker(mdd.stunQueue)
+	}
+}
+
+func (mdd *MDD) stunWorker(queue chan stunJob) {
+	defer mdd.workers.Done()
+	pinGoroutine("STUN worker", mdd.affinity.STUN)
+
+	for {
+		select {
+		case job := <-queue:
+			mdd.handleSTUN(job.assoc, job.addr, job.msg)
+		case <-mdd.stunRetire:
+			return
+		case <-mdd.quit:
+			return
+		}
+	}
+}
+
+// Stops all but one of the STUN workers while the MD is idle
+func (mdd *MDD) shrinkSTUNWorkers() {
+	for i := 1; i < mdd.stunWorkers; i++ {
+		select {
+		case mdd.stunRetire <- struct{}{}:
+		case <-mdd.quit:
+			return
+		}
+	}
+}
+
+func (mdd *MDD) growSTUNWorkers() {
+	for i := 1; i < mdd.stunWorkers; i++ {
+		mdd.workers.Add(1)
+		go mdd.stunWorker(mdd.stunQueue)
+	}
+}
+
+// Hands a STUN message to the workers
+func (mdd *MDD) dispatchSTUN(assoc *association, addr net.Addr, msg []byte) {
+	select {
+	case mdd.stunQueue <- stunJob{assoc: assoc, addr: addr, msg: msg}:
+	default:
+		mdd.mu.Lock()
+		mdd.stats.stunDropped += 1
+		mdd.mu.Unlock()
+	}
+}
@@ -0,0 +1,235 @@
+package percy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bifurcation/percy/internal/cryptoutil"
+)
+
+// Tenants let one MD serve several customers.  Each tenant owns a set of
+// conferences, and is held to its quota: how many conferences it can have,
+// how many participants can be in them, and how much media they can send
+// through the MD.  Tenants get their own admin API tokens, which only see
+// the tenant's stats.  Conferences without a tenant are not limited.
+
+type TenantID string
+
+// Limits on a tenant's use of the MD; zero means unlimited
+type TenantQuota struct {
+	MaxConferences  int     `json:"max_conferences,omitempty"`
+	MaxParticipants int     `json:"max_participants,omitempty"`
+	MaxBitrate      float64 `json:"max_bitrate,omitempty"` // Ingress, in bits per second
+}
+
+type tenant struct {
+	id     TenantID
+	quota  TenantQuota
+	tokens []string
+
+	// Ingress token bucket, holding up to a second's worth of bits
+	bucket     float64
+	bucketTime time.Time
+	dropped    uint64
+}
+
+type TenantStats struct {
+	ID           TenantID           `json:"id"`
+	Quota        TenantQuota        `json:"quota"`
+	Participants int                `json:"participants"`
+	In           TrafficStats       `json:"in"`
+	Out          TrafficStats       `json:"out"`
+	Dropped      uint64             `json:"dropped"` // Packets over the bitrate quota
+	Conferences  []ConferenceStats  `json:"conferences"`
+	Associations []AssociationStats `json:"associations"`
+}
+
+// Adds a tenant, or updates the quota of an existing one.  Lowering a quota
+// does not evict conferences or participants that are already admitted.
+func (mdd *MDD) AddTenant(tenantID TenantID, quota TenantQuota) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if ten, ok := mdd.tenants[tenantID]; ok {
+		ten.quota = quota
+		return
+	}
+	mdd.tenants[tenantID] = &tenant{id: tenantID, quota: quota, tokens: []string{}}
+}
+
+// Adds an admin API token that grants access to a tenant's stats
+func (mdd *MDD) AddTenantToken(tenantID TenantID, token string) error {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	ten, ok := mdd.tenants[tenantID]
+	if !ok {
+		return fmt.Errorf("Unknown tenant '%s'", tenantID)
+	}
+	if !cryptoutil.OneOf(token, ten.tokens) {
+		ten.tokens = append(ten.tokens, token)
+	}
+	return nil
+}
+
+// Returns the tenant that an admin API token belongs to
+func (mdd *MDD) tenantForToken(token string) (TenantID, bool) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	for _, ten := range mdd.tenants {
+		if cryptoutil.OneOf(token, ten.tokens) {
+			return ten.id, true
+		}
+	}
+	return "", false
+}
+
+// Assigns a conference to a tenant, subject to its conference quota
+func (mdd *MDD) SetConferenceTenant(confID ConfID, tenantID TenantID) error {
+	if confID == DefaultConfID {
+		return fmt.Errorf("The default conference cannot belong to a tenant")
+	}
+
+	conf := mdd.conference(confID)
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	ten, ok := mdd.tenants[tenantID]
+	if !ok {
+		return fmt.Errorf("Unknown tenant '%s'", tenantID)
+	}
+	if conf.tenant == tenantID {
+		return nil
+	}
+
+	if ten.quota.MaxConferences > 0 && mdd.tenantConferences(tenantID) >= ten.quota.MaxConferences {
+		return fmt.Errorf("Tenant '%s' is at its limit of %d conferences", tenantID, ten.quota.MaxConferences)
+	}
+
+	conf.tenant = tenantID
+	return nil
+}
+
+// Counts a tenant's conferences.  The caller holds mdd.mu.
+func (mdd *MDD) tenantConferences(tenantID TenantID) int {
+	count := 0
+	for _, conf := range mdd.conferences {
+		if conf.tenant == tenantID {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Counts the participants in a tenant's conferences.  The caller holds mdd.mu.
+func (mdd *MDD) tenantParticipants(tenantID TenantID) int {
+	count := 0
+	for _, assoc := range mdd.assocs.snapshot() {
+		if conf, ok := mdd.conferences[assoc.conf]; ok && conf.tenant == tenantID {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Checks whether an association can join a conference without taking its
+// tenant over the participant quota.  The caller holds mdd.mu.
+func (mdd *MDD) checkParticipantQuota(assoc *association, known bool, conf *conference) error {
+	if len(conf.tenant) == 0 {
+		return nil
+	}
+
+	ten, ok := mdd.tenants[conf.tenant]
+	if !ok || ten.quota.MaxParticipants == 0 {
+		return nil
+	}
+
+	if current, ok := mdd.conferences[assoc.conf]; known && ok && current.tenant == conf.tenant {
+		return nil
+	}
+
+	if mdd.tenantParticipants(conf.tenant) >= ten.quota.MaxParticipants {
+		return fmt.Errorf("Tenant '%s' is at its limit of %d participants", conf.tenant, ten.quota.MaxParticipants)
+	}
+	return nil
+}
+
+// Charges a packet against its tenant's bitrate quota.  Returns false if the
+// packet should be dropped.
+func (mdd *MDD) admitTenantTraffic(assoc *association, bytes int, now time.Time) bool {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	conf, ok := mdd.conferences[assoc.conf]
+	if !ok || len(conf.tenant) == 0 {
+		return true
+	}
+
+	ten, ok := mdd.tenants[conf.tenant]
+	if !ok || ten.quota.MaxBitrate <= 0 {
+		return true
+	}
+
+	if ten.bucketTime.IsZero() {
+		ten.bucket = ten.quota.MaxBitrate
+	} else {
+		ten.bucket += ten.quota.MaxBitrate * now.Sub(ten.bucketTime).Seconds()
+		if ten.bucket > ten.quota.MaxBitrate {
+			ten.bucket = ten.quota.MaxBitrate
+		}
+	}
+	ten.bucketTime = now
+
+	bits := float64(8 * bytes)
+	if ten.bucket < bits {
+		ten.dropped += 1
+		return false
+	}
+	ten.bucket -= bits
+	return true
+}
+
+// Returns the stats for a tenant's conferences and associations only
+func (mdd *MDD) TenantStats(tenantID TenantID) (*TenantStats, error) {
+	snap := mdd.StatsSnapshot()
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	ten, ok := mdd.tenants[tenantID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown tenant '%s'", tenantID)
+	}
+
+	stats := &TenantStats{
+		ID:           tenantID,
+		Quota:        ten.quota,
+		Dropped:      ten.dropped,
+		Conferences:  []ConferenceStats{},
+		Associations: []AssociationStats{},
+	}
+
+	owned := func(confID ConfID) bool {
+		conf, ok := mdd.conferences[confID]
+		return ok && conf.tenant == tenantID
+	}
+
+	for _, conf := range snap.Conferences {
+		if owned(conf.ID) {
+			stats.Conferences = append(stats.Conferences, conf)
+		}
+	}
+
+	for _, assoc := range snap.Associations {
+		if owned(assoc.Conference) {
+			stats.Associations = append(stats.Associations, assoc)
+			stats.Participants += 1
+			stats.In.merge(assoc.In)
+			stats.Out.merge(assoc.Out)
+		}
+	}
+
+	return stats, nil
+}
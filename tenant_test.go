@@ -0,0 +1,121 @@
+package percy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTenantQuotas(t *testing.T) {
+	mdd := NewMDD()
+	mdd.AddTenant("acme", TenantQuota{MaxConferences: 1, MaxParticipants: 2, MaxBitrate: 8000})
+
+	err := mdd.SetConferenceTenant(1, "acme")
+	if err != nil {
+		t.Fatalf("Error assigning conference: %v", err)
+	}
+	err = mdd.SetConferenceTenant(2, "acme")
+	if err == nil {
+		t.Fatalf("Conference quota not enforced")
+	}
+	err = mdd.SetConferenceTenant(3, "nobody")
+	if err == nil {
+		t.Fatalf("Unknown tenant accepted")
+	}
+
+	for _, assocID := range []AssociationID{0x0001, 0x0002} {
+		err = mdd.SetAssociationConference(assocID, 1)
+		if err != nil {
+			t.Fatalf("Error adding participant: %v", err)
+		}
+	}
+	err = mdd.SetAssociationConference(0x0003, 1)
+	if err == nil {
+		t.Fatalf("Participant quota not enforced")
+	}
+
+	// A second's worth of bits is allowed through, then packets are dropped
+	assoc := mdd.association(0x0001)
+	now := time.Now()
+	if !mdd.admitTenantTraffic(assoc, 1000, now) {
+		t.Fatalf("Packet within bitrate quota dropped")
+	}
+	if mdd.admitTenantTraffic(assoc, 1000, now) {
+		t.Fatalf("Packet over bitrate quota admitted")
+	}
+	if !mdd.admitTenantTraffic(assoc, 1000, now.Add(time.Second)) {
+		t.Fatalf("Bitrate quota not refilled")
+	}
+
+	stats, err := mdd.TenantStats("acme")
+	if err != nil {
+		t.Fatalf("Error getting tenant stats: %v", err)
+	}
+	if len(stats.Conferences) != 1 || stats.Participants != 2 || stats.Dropped != 1 {
+		t.Fatalf("Incorrect tenant stats: %+v", stats)
+	}
+}
+
+func TestTenantTrafficWhileAddingConferences(t *testing.T) {
+	mdd := NewMDD()
+	mdd.AddTenant("acme", TenantQuota{MaxBitrate: 8000000})
+	mdd.SetConferenceTenant(1, "acme")
+	mdd.SetAssociationConference(0x0001, 1)
+	assoc := mdd.association(0x0001)
+
+	// Traffic is charged to the tenant while conferences are added
+	done := make(chan bool)
+	go func() {
+		for i := 2; i <= 100; i++ {
+			mdd.SetConferenceTenant(ConfID(i), "acme")
+		}
+		done <- true
+	}()
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if !mdd.admitTenantTraffic(assoc, 100, now) {
+			t.Fatalf("Packet within bitrate quota dropped")
+		}
+	}
+	<-done
+}
+
+func TestTenantToken(t *testing.T) {
+	mdd := NewMDD()
+	mdd.AddTenant("acme", TenantQuota{})
+	mdd.AddTenant("globex", TenantQuota{})
+	mdd.AddTenantToken("acme", "acme-token")
+	mdd.SetConferenceTenant(1, "acme")
+	mdd.SetConferenceTenant(2, "globex")
+	mdd.SetAssociationConference(0x0001, 1)
+	mdd.SetAssociationConference(0x0002, 2)
+	api := NewAdminAPI(mdd)
+
+	req := httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Set("Authorization", "Bearer acme-token")
+	resp := httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Tenant stats request failed: %d", resp.Code)
+	}
+
+	var stats TenantStats
+	err := json.Unmarshal(resp.Body.Bytes(), &stats)
+	if err != nil {
+		t.Fatalf("Error parsing tenant stats: %v", err)
+	}
+	if stats.ID != "acme" || len(stats.Associations) != 1 || stats.Associations[0].ID != 0x0001 {
+		t.Fatalf("Tenant stats not isolated: %+v", stats)
+	}
+
+	req = httptest.NewRequest("POST", "/loopback?assoc=2", nil)
+	req.Header.Set("Authorization", "Bearer acme-token")
+	resp = httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("Tenant token allowed an operator endpoint: %d", resp.Code)
+	}
+}
@@ -0,0 +1,200 @@
+// Package testnet provides an in-process virtual datagram network, so that
+// MDs, KDs, and fake clients can exchange packets in unit tests without real
+// sockets.  Connections satisfy net.PacketConn, and use *net.UDPAddr
+// addresses so that code which inspects addresses (e.g., STUN) works
+// unchanged.  Latency and loss can be configured for the whole network.
+package testnet
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	inboxSize      = 256
+	firstEphemeral = 49152
+)
+
+type datagram struct {
+	msg  []byte
+	from *net.UDPAddr
+}
+
+type Network struct {
+	mu       sync.Mutex
+	conns    map[string]*Conn
+	latency  time.Duration
+	loss     float64
+	rand     *rand.Rand
+	nextPort int
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		conns:    map[string]*Conn{},
+		rand:     rand.New(rand.NewSource(1)),
+		nextPort: firstEphemeral,
+	}
+}
+
+// Delays every packet by the given amount
+func (n *Network) SetLatency(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = latency
+}
+
+// Drops each packet with the given probability (0 to 1)
+func (n *Network) SetLoss(loss float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loss = loss
+}
+
+// Binds a connection to an address such as "10.0.0.1:5000".  If the port is
+// zero, an unused one is chosen.
+func (n *Network) Listen(address string) (*Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if addr.Port == 0 {
+		for {
+			addr.Port = n.nextPort
+			n.nextPort += 1
+			if _, taken := n.conns[addr.String()]; !taken {
+				break
+			}
+		}
+	}
+
+	if _, taken := n.conns[addr.String()]; taken {
+		return nil, fmt.Errorf("testnet: address %v already in use", addr)
+	}
+
+	conn := &Conn{
+		network: n,
+		addr:    addr,
+		inbox:   make(chan datagram, inboxSize),
+		closed:  make(chan struct{}),
+	}
+	n.conns[addr.String()] = conn
+	return conn, nil
+}
+
+func (n *Network) send(msg []byte, from *net.UDPAddr, to net.Addr) {
+	n.mu.Lock()
+	dest, ok := n.conns[to.String()]
+	drop := n.loss > 0 && n.rand.Float64() < n.loss
+	latency := n.latency
+	n.mu.Unlock()
+
+	// Like UDP, packets to nowhere just disappear
+	if !ok || drop {
+		return
+	}
+
+	pkt := datagram{msg: append([]byte{}, msg...), from: from}
+	if latency == 0 {
+		dest.deliver(pkt)
+		return
+	}
+
+	time.AfterFunc(latency, func() { dest.deliver(pkt) })
+}
+
+type Conn struct {
+	network *Network
+	addr    *net.UDPAddr
+	inbox   chan datagram
+	closed  chan struct{}
+	once    sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *Conn) deliver(pkt datagram) {
+	select {
+	case <-c.closed:
+	case c.inbox <- pkt:
+	default:
+		// Inbox full; drop, as a socket buffer would
+	}
+}
+
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case pkt := <-c.inbox:
+		n := copy(b, pkt.msg)
+		return n, pkt.from, nil
+	}
+}
+
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.network.send(b, c.addr, addr)
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+
+		c.network.mu.Lock()
+		delete(c.network.conns, c.addr.String())
+		c.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// Writes never block, so write deadlines have no effect
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
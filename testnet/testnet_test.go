@@ -0,0 +1,40 @@
+package testnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyAndLoss(t *testing.T) {
+	network := NewNetwork()
+	a, _ := network.Listen("10.0.0.1:1000")
+	b, _ := network.Listen("10.0.0.2:0")
+	defer a.Close()
+	defer b.Close()
+
+	network.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	b.WriteTo([]byte{1}, a.LocalAddr())
+
+	buf := make([]byte, 10)
+	n, from, err := a.ReadFrom(buf)
+	if err != nil || n != 1 || from.String() != b.LocalAddr().String() {
+		t.Fatalf("Incorrect delivery: %d %v %v", n, from, err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("Packet delivered early")
+	}
+
+	network.SetLatency(0)
+	network.SetLoss(1)
+	b.WriteTo([]byte{2}, a.LocalAddr())
+	a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := a.ReadFrom(buf); err == nil {
+		t.Fatalf("Packet delivered despite total loss")
+	}
+
+	a.Close()
+	if _, _, err := a.ReadFrom(buf); err == nil {
+		t.Fatalf("Read from closed connection")
+	}
+}
@@ -0,0 +1,154 @@
+package percy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// For postmortems of call quality, the MD keeps a timeline of what happened
+// in each conference: participants joining and leaving, keys being installed
+// and rotated, receivers switching simulcast layers, and every event raised
+// about the conference or its associations (congested and failed receivers,
+// lost sources, dominant speakers, and so on).  Each timeline keeps the last
+// timelineLength entries, and outlives its conference: the timelines of the
+// last maxEndedTimelines conferences to end are kept for GET
+// /admin/timeline?conf=N, until a conference with the same ID starts again.
+
+const (
+	timelineLength    = 256
+	maxEndedTimelines = 64
+)
+
+type TimelineEntry struct {
+	Time   time.Time     `json:"time"`
+	Kind   string        `json:"kind"`
+	Assoc  AssociationID `json:"assoc,omitempty"`
+	Detail string        `json:"detail,omitempty"`
+}
+
+type ConferenceTimeline struct {
+	Conf    ConfID          `json:"conf"`
+	Ended   *time.Time      `json:"ended,omitempty"`
+	Dropped uint64          `json:"dropped,omitempty"` // Oldest entries, over the limit
+	Entries []TimelineEntry `json:"entries"`
+}
+
+type timeline struct {
+	entries []TimelineEntry
+	dropped uint64
+	ended   time.Time
+}
+
+type timelines struct {
+	mu    sync.Mutex
+	confs map[ConfID]*timeline
+	ended []ConfID // Oldest first
+}
+
+func newTimelines() *timelines {
+	return &timelines{confs: map[ConfID]*timeline{}}
+}
+
+func (tl *timelines) record(confID ConfID, entry TimelineEntry) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	conf, ok := tl.confs[confID]
+	if !ok || !conf.ended.IsZero() {
+		conf = tl.start(confID)
+	}
+	if len(conf.entries) == timelineLength {
+		conf.entries = append(conf.entries[:0], conf.entries[1:]...)
+		conf.dropped += 1
+	}
+	conf.entries = append(conf.entries, entry)
+}
+
+// Starts a new timeline for a conference, replacing any from an earlier
+// conference with the same ID.  The caller holds tl.mu.
+func (tl *timelines) start(confID ConfID) *timeline {
+	for i, id := range tl.ended {
+		if id == confID {
+			tl.ended = append(tl.ended[:i], tl.ended[i+1:]...)
+			break
+		}
+	}
+
+	conf := &timeline{entries: make([]TimelineEntry, 0, 16)}
+	tl.confs[confID] = conf
+	return conf
+}
+
+// Marks a conference's timeline as ended, and forgets the oldest ended ones
+// over the limit
+func (tl *timelines) end(confID ConfID, now time.Time) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	conf, ok := tl.confs[confID]
+	if !ok || !conf.ended.IsZero() {
+		return
+	}
+	conf.ended = now
+	tl.ended = append(tl.ended, confID)
+	for len(tl.ended) > maxEndedTimelines {
+		delete(tl.confs, tl.ended[0])
+		tl.ended = tl.ended[1:]
+	}
+}
+
+// Adds an entry to a conference's timeline
+func (mdd *MDD) record(confID ConfID, assocID AssociationID, kind string, format string, args ...interface{}) {
+	mdd.timelines.record(confID, TimelineEntry{
+		Time:   time.Now(),
+		Kind:   kind,
+		Assoc:  assocID,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// Returns a conference's timeline, oldest entry first.  Timelines of
+// conferences that have ended are kept for a while.
+func (mdd *MDD) Timeline(confID ConfID) (ConferenceTimeline, error) {
+	mdd.timelines.mu.Lock()
+	defer mdd.timelines.mu.Unlock()
+
+	conf, ok := mdd.timelines.confs[confID]
+	if !ok {
+		return ConferenceTimeline{}, fmt.Errorf("No timeline for conference %v", confID)
+	}
+	timeline := ConferenceTimeline{
+		Conf:    confID,
+		Dropped: conf.dropped,
+		Entries: append([]TimelineEntry{}, conf.entries...),
+	}
+	if !conf.ended.IsZero() {
+		ended := conf.ended
+		timeline.Ended = &ended
+	}
+	return timeline, nil
+}
+
+// GET returns a conference's timeline
+func (api *AdminAPI) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	confID, err := strconv.ParseUint(r.FormValue("conf"), 0, 32)
+	if err != nil {
+		http.Error(w, "Invalid conference ID", http.StatusBadRequest)
+		return
+	}
+
+	timeline, err := api.mdd.Timeline(ConfID(confID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, timeline)
+}
@@ -0,0 +1,79 @@
+package percy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConferenceTimeline(t *testing.T) {
+	mdd := NewMDD()
+	auth := NewMemoryAuthProvider()
+	auth.AddAdminToken("secret")
+	mdd.Auth = auth
+
+	mdd.SetAssociationConference(0x0001, 5)
+	mdd.PauseConference(5)
+	if err := mdd.DestroyConference(5); err != nil {
+		t.Fatalf("Error destroying conference: %v", err)
+	}
+
+	// The timeline is still there once the conference is gone
+	api := NewAdminAPI(mdd)
+	req := httptest.NewRequest(http.MethodGet, "/timeline?conf=5", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Timeline request failed: %d %s", w.Code, w.Body.String())
+	}
+
+	timeline := ConferenceTimeline{}
+	if err := json.Unmarshal(w.Body.Bytes(), &timeline); err != nil {
+		t.Fatalf("Invalid timeline: %v", err)
+	}
+	kinds := []string{}
+	for _, entry := range timeline.Entries {
+		kinds = append(kinds, entry.Kind)
+	}
+	expected := []string{"Joined", "ConferencePaused", "Left", "ConferenceDestroyed"}
+	if timeline.Ended == nil || len(kinds) != len(expected) {
+		t.Fatalf("Incorrect timeline: %+v", timeline)
+	}
+	for i := range expected {
+		if kinds[i] != expected[i] {
+			t.Fatalf("Incorrect timeline entries: %v", kinds)
+		}
+	}
+
+	// A new conference with the same ID starts a new timeline
+	mdd.SetAssociationConference(0x0002, 5)
+	timeline, err := mdd.Timeline(5)
+	if err != nil || timeline.Ended != nil || len(timeline.Entries) != 1 {
+		t.Fatalf("Timeline not restarted: %+v %v", timeline, err)
+	}
+
+	if _, err := mdd.Timeline(6); err == nil {
+		t.Fatalf("Timeline returned for unknown conference")
+	}
+}
+
+func TestTimelineLimits(t *testing.T) {
+	tl := newTimelines()
+	for i := 0; i < timelineLength+10; i++ {
+		tl.record(1, TimelineEntry{Kind: "Joined", Assoc: AssociationID(i)})
+	}
+	if conf := tl.confs[1]; len(conf.entries) != timelineLength || conf.dropped != 10 || conf.entries[0].Assoc != 10 {
+		t.Fatalf("Timeline not bounded: %d entries, %d dropped", len(conf.entries), conf.dropped)
+	}
+
+	for i := 0; i <= maxEndedTimelines; i++ {
+		tl.record(ConfID(i+1), TimelineEntry{Kind: "Joined"})
+		tl.end(ConfID(i+1), time.Now())
+	}
+	if _, ok := tl.confs[1]; ok || len(tl.ended) != maxEndedTimelines {
+		t.Fatalf("Oldest ended timeline kept")
+	}
+}
@@ -0,0 +1,118 @@
+package percy
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// When no packet arrives, the processing loop wakes up every poll interval to
+// flush shaped RTCP.  A fixed interval is either too coarse for short legs
+// or needlessly busy for long ones, so it is adapted every expiry check:
+//
+//   - From RTT: shaping should add at most a tenth of the shortest leg's
+//     round trip, measured from the receiver reports on the MD's own sender
+//     reports (so only in conferences that terminate RTCP).  Without a
+//     measurement, defaultPollInterval is used.
+//   - From load: at pollBusyRate packets a second or more, RTCP is flushed
+//     after each packet anyway, and the poll only covers lulls, so it goes to
+//     MaxPollInterval and leaves the loop to the media.
+//
+// The result is kept between MinPollInterval and MaxPollInterval.  The
+// interval in use, the loop's packet rate and each leg's RTT are in /stats.
+
+const (
+	defaultPollInterval    = 10 * time.Millisecond
+	defaultMinPollInterval = 2 * time.Millisecond
+	defaultMaxPollInterval = 50 * time.Millisecond
+
+	pollRTTDivisor = 10
+	pollBusyRate   = 1000 // Packets per second
+
+	maxRTT = 10 * time.Second // Longer measurements are taken to be bogus
+)
+
+// Takes round-trip times from the report blocks a receiver sends about the
+// MD's sender reports (RFC 3550, Section 6.4.1), smoothed as TCP does
+func (mdd *MDD) recordRTT(receiver *association, headers []RTCPHeader, msg []byte, now time.Time) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+	if !mdd.confTerminatesRTCP(receiver.conf) {
+		return
+	}
+
+	middle := uint32(ntpTime(now) >> 16)
+	offset := 0
+	for _, header := range headers {
+		blocks := -1
+		switch header.PacketType {
+		case RTCPTypeSR:
+			blocks = offset + 28
+		case RTCPTypeRR:
+			blocks = offset + 8
+		}
+		for i := 0; blocks >= 0 && i < int(header.Count); i++ {
+			block := blocks + 24*i
+			if block+24 > offset+header.Size {
+				break
+			}
+			lsr := binary.BigEndian.Uint32(msg[block+16 : block+20])
+			dlsr := binary.BigEndian.Uint32(msg[block+20 : block+24])
+			if lsr == 0 {
+				continue
+			}
+
+			rtt := time.Duration(float64(middle-lsr-dlsr) / 65536 * float64(time.Second))
+			if rtt <= 0 || rtt > maxRTT {
+				continue
+			}
+			if receiver.rtt == 0 {
+				receiver.rtt = rtt
+			} else {
+				receiver.rtt += (rtt - receiver.rtt) / 8
+			}
+		}
+		offset += header.Size
+	}
+}
+
+// Re-derives the poll interval from the shortest RTT and the packets the loop
+// handled since the last time.  Runs on the processing loop.
+func (mdd *MDD) adaptTimers(now time.Time) {
+	elapsed := now.Sub(mdd.loopSince)
+	rate := 0.0
+	if elapsed > 0 && !mdd.loopSince.IsZero() {
+		rate = float64(mdd.loopPackets) / elapsed.Seconds()
+	}
+	mdd.loopPackets = 0
+	mdd.loopSince = now
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	var shortest time.Duration
+	for _, assoc := range mdd.assocs.snapshot() {
+		if assoc.rtt > 0 && (shortest == 0 || assoc.rtt < shortest) {
+			shortest = assoc.rtt
+		}
+	}
+
+	interval := defaultPollInterval
+	if shortest > 0 {
+		interval = shortest / pollRTTDivisor
+	}
+	if rate >= pollBusyRate && mdd.MaxPollInterval > 0 {
+		interval = mdd.MaxPollInterval
+	}
+	if interval < mdd.MinPollInterval {
+		interval = mdd.MinPollInterval
+	}
+	if mdd.MaxPollInterval > 0 && interval > mdd.MaxPollInterval {
+		interval = mdd.MaxPollInterval
+	}
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	mdd.timeout = interval
+	mdd.loopRate = rate
+}
@@ -0,0 +1,139 @@
+package percy
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func receiverReport(lsr, dlsr uint32) []byte {
+	msg := make([]byte, 32)
+	copy(msg, []byte{0x81, RTCPTypeRR, 0x00, 0x07, 0x01, 0x02, 0x03, 0x04})
+	binary.BigEndian.PutUint32(msg[8:12], 0x0a0b0c0d)
+	binary.BigEndian.PutUint32(msg[24:28], lsr)
+	binary.BigEndian.PutUint32(msg[28:32], dlsr)
+	return msg
+}
+
+func TestRecordRTT(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	kd := make(MDDChan, 10)
+	mdd.KD = kd
+
+	client, _ := NewClient(network, "10.0.0.1:5000")
+	defer client.Stop()
+	client.Write([]byte{0x16, 0xfe, 0xfd, 0x00})
+	<-kd
+	assoc, _ := mdd.assocs.get(client.Assoc())
+
+	now := time.Now()
+	lsr := uint32(ntpTime(now.Add(-150*time.Millisecond)) >> 16)
+	msg := receiverReport(lsr, 65536/20) // Held for 50ms
+	headers, err := ParseRTCPCompound(msg)
+	if err != nil {
+		t.Fatalf("Error parsing report: %v", err)
+	}
+
+	// Without termination, the reports aren't about the MD's own
+	mdd.recordRTT(assoc, headers, msg, now)
+	mdd.mu.Lock()
+	rtt := assoc.rtt
+	mdd.mu.Unlock()
+	if rtt != 0 {
+		t.Fatalf("RTT measured without RTCP termination: %v", rtt)
+	}
+
+	mdd.SetConferenceRTCPTermination(DefaultConfID, true)
+	mdd.recordRTT(assoc, headers, msg, now)
+	mdd.mu.Lock()
+	rtt = assoc.rtt
+	mdd.mu.Unlock()
+	if rtt < 99*time.Millisecond || rtt > 101*time.Millisecond {
+		t.Fatalf("Incorrect RTT: %v", rtt)
+	}
+
+	// Later measurements are smoothed
+	lsr = uint32(ntpTime(now.Add(-900*time.Millisecond)) >> 16)
+	msg = receiverReport(lsr, 0)
+	mdd.recordRTT(assoc, headers, msg, now)
+	mdd.mu.Lock()
+	rtt = assoc.rtt
+	mdd.mu.Unlock()
+	if rtt < 199*time.Millisecond || rtt > 201*time.Millisecond {
+		t.Fatalf("RTT not smoothed: %v", rtt)
+	}
+
+	// Reports without a sender report to refer to are skipped
+	mdd.recordRTT(assoc, headers, receiverReport(0, 0), now)
+	mdd.mu.Lock()
+	unchanged := assoc.rtt == rtt
+	mdd.mu.Unlock()
+	if !unchanged {
+		t.Fatalf("RTT measured from an empty report block")
+	}
+
+	for _, stats := range mdd.StatsSnapshot().Associations {
+		if stats.ID == client.Assoc() && stats.RTT != rtt {
+			t.Fatalf("RTT not in stats: %v", stats.RTT)
+		}
+	}
+}
+
+func TestAdaptTimers(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+
+	kd := make(MDDChan, 10)
+	mdd.KD = kd
+
+	client, _ := NewClient(network, "10.0.0.1:5000")
+	defer client.Stop()
+	client.Write([]byte{0x16, 0xfe, 0xfd, 0x00})
+	<-kd
+	assoc, _ := mdd.assocs.get(client.Assoc())
+
+	var rate float64
+	adapt := func(rtt time.Duration, packets int) time.Duration {
+		mdd.mu.Lock()
+		assoc.rtt = rtt
+		mdd.mu.Unlock()
+
+		// Read on the loop, before the next expiry check adapts it again
+		done := make(chan GlobalStats)
+		mdd.runOnLoop(func() {
+			now := time.Now()
+			mdd.loopSince = now.Add(-time.Second)
+			mdd.loopPackets = packets
+			mdd.adaptTimers(now)
+			done <- mdd.StatsSnapshot().Global
+		})
+		global := <-done
+		rate = global.LoopRate
+		return global.PollInterval
+	}
+
+	if interval := adapt(0, 0); interval != defaultPollInterval {
+		t.Fatalf("Incorrect interval without an RTT: %v", interval)
+	}
+	if interval := adapt(200*time.Millisecond, 0); interval != 20*time.Millisecond {
+		t.Fatalf("Incorrect interval for the RTT: %v", interval)
+	}
+	if interval := adapt(5*time.Millisecond, 0); interval != mdd.MinPollInterval {
+		t.Fatalf("Interval not clamped to the minimum: %v", interval)
+	}
+	if interval := adapt(5*time.Second, 0); interval != mdd.MaxPollInterval {
+		t.Fatalf("Interval not clamped to the maximum: %v", interval)
+	}
+	if interval := adapt(200*time.Millisecond, 2*pollBusyRate); interval != mdd.MaxPollInterval {
+		t.Fatalf("Interval not backed off under load: %v", interval)
+	}
+	if rate < 2*pollBusyRate-1 {
+		t.Fatalf("Loop rate not in stats: %v", rate)
+	}
+}
@@ -0,0 +1,71 @@
+package percy
+
+import (
+	"net"
+	"time"
+)
+
+// Packets are stamped with the time the kernel received them, where the
+// platform supports it (SO_TIMESTAMPNS on Linux), rather than the time a
+// reader goroutine got around to them.  Under load, packets can sit in the
+// socket buffer for a while, which would otherwise show up as jitter that
+// the network didn't cause, and be left out of the forwarding latency.
+// Transports other than UDP sockets are stamped when they are read.
+
+// Reads a packet.  With control set, the time it was received and its ECN
+// bits are taken from the socket's control messages where present.
+func readPacket(conn Transport, buf, oob []byte, control bool) (packet, error) {
+	udp, ok := conn.(*net.UDPConn)
+	if !control || !ok {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packet{}, err
+		}
+		return newPacket(addr, buf[:n], time.Now()), nil
+	}
+
+	n, oobn, _, addr, err := udp.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return packet{}, err
+	}
+
+	pkt := newPacket(addr, buf[:n], time.Time{})
+	parseControlMessages(oob[:oobn], &pkt)
+	if pkt.recvTime.IsZero() {
+		pkt.recvTime = time.Now()
+	}
+	return pkt, nil
+}
+
+// Copies a packet out of a read buffer
+func newPacket(addr net.Addr, msg []byte, recvTime time.Time) packet {
+	pkt := packet{addr: addr, msg: make([]byte, len(msg)), recvTime: recvTime}
+	copy(pkt.msg, msg)
+	return pkt
+}
+
+// Asks the kernel to timestamp packets on a transport.  Returns false if
+// the transport or platform doesn't support it.
+func enableTimestamps(conn Transport) bool {
+	return setSocketOptions(conn, setTimestampOption)
+}
+
+// Calls set with a UDP transport's file descriptor.  Returns false if the
+// transport isn't a UDP socket, or set fails.
+func setSocketOptions(conn Transport, set func(fd uintptr) error) bool {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return false
+	}
+
+	raw, err := udp.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = set(fd)
+	})
+	return err == nil && sockErr == nil
+}
@@ -0,0 +1,60 @@
+package percy
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func setTimestampOption(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+}
+
+// The socket may be IPv4 or IPv6, so both are tried, and it's enough for
+// either to work
+func setECNOptions(fd uintptr) error {
+	err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+	if err4 == nil {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, ecnECT1)
+	}
+
+	err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1)
+	if err6 == nil {
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, ecnECT1)
+	}
+
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// Fills in a packet's kernel receive time and ECN bits from its control
+// messages
+func parseControlMessages(oob []byte, pkt *packet) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_SOCKET && msg.Header.Type == syscall.SCM_TIMESTAMPNS:
+			if len(msg.Data) >= int(unsafe.Sizeof(syscall.Timespec{})) {
+				ts := (*syscall.Timespec)(unsafe.Pointer(&msg.Data[0]))
+				pkt.recvTime = time.Unix(ts.Unix())
+			}
+
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_TOS:
+			if len(msg.Data) >= 1 {
+				pkt.ecn = msg.Data[0] & ecnMask
+			}
+
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_TCLASS:
+			// An int in host byte order; the traffic class is in its low byte
+			if len(msg.Data) >= 4 {
+				pkt.ecn = uint8(*(*int32)(unsafe.Pointer(&msg.Data[0]))) & ecnMask
+			}
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package percy
+
+import (
+	"fmt"
+)
+
+func setTimestampOption(fd uintptr) error {
+	return fmt.Errorf("Kernel timestamps are only supported on Linux")
+}
+
+func setECNOptions(fd uintptr) error {
+	return fmt.Errorf("ECN is only supported on Linux")
+}
+
+func parseControlMessages(oob []byte, pkt *packet) {}
@@ -0,0 +1,44 @@
+package percy
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestKernelTimestamps(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer conn.Close()
+
+	kernel := enableTimestamps(conn)
+	if kernel != (runtime.GOOS == "linux") {
+		t.Fatalf("Incorrect timestamp support: %v", kernel)
+	}
+
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer sender.Close()
+
+	before := time.Now()
+	sender.Write([]byte{1, 2, 3})
+
+	buf := make([]byte, 2048)
+	oob := make([]byte, 64)
+	pkt, err := readPacket(conn, buf, oob, kernel)
+	after := time.Now()
+	if err != nil || !bytes.Equal(pkt.msg, []byte{1, 2, 3}) || pkt.addr.String() != sender.LocalAddr().String() {
+		t.Fatalf("Incorrect read: %+v %v", pkt, err)
+	}
+
+	// Kernel timestamps have no monotonic reading, so allow for clock steps
+	if pkt.recvTime.Before(before.Add(-time.Second)) || pkt.recvTime.After(after.Add(time.Second)) {
+		t.Fatalf("Incorrect receive time: %v (sent at %v)", pkt.recvTime, before)
+	}
+}
@@ -0,0 +1,139 @@
+package percy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Packet tracing records every decision made for packets from selected SSRCs
+// or associations into a bounded ring, so that a single misbehaving stream can
+// be debugged on a busy MD without turning on verbose logging for everyone.
+
+const (
+	traceRingSize = 1024
+)
+
+type TraceEntry struct {
+	Time   time.Time     `json:"time"`
+	Assoc  AssociationID `json:"assoc"`
+	SSRC   uint32        `json:"ssrc"`
+	Stage  string        `json:"stage"`
+	Detail string        `json:"detail"`
+}
+
+type tracer struct {
+	mu     sync.Mutex
+	ssrcs  map[uint32]bool
+	assocs map[AssociationID]bool
+	ring   []TraceEntry
+	next   int
+}
+
+func newTracer() *tracer {
+	return &tracer{
+		ssrcs:  map[uint32]bool{},
+		assocs: map[AssociationID]bool{},
+		ring:   make([]TraceEntry, 0, traceRingSize),
+	}
+}
+
+func (tr *tracer) enabled(assocID AssociationID, ssrc uint32) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.assocs[assocID] || (ssrc != 0 && tr.ssrcs[ssrc])
+}
+
+func (tr *tracer) record(entry TraceEntry) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if len(tr.ring) < traceRingSize {
+		tr.ring = append(tr.ring, entry)
+		return
+	}
+
+	tr.ring[tr.next] = entry
+	tr.next = (tr.next + 1) % traceRingSize
+}
+
+// Returns the SSRC of an RTP or RTCP packet, or zero if there isn't one
+func packetSSRC(class dtlsSRTPPacketClass, msg []byte) uint32 {
+	switch {
+	case class == packetClassSRTP && len(msg) >= 12:
+		return binary.BigEndian.Uint32(msg[8:12])
+	case class == packetClassSRTCP && len(msg) >= 8:
+		return binary.BigEndian.Uint32(msg[4:8])
+	}
+	return 0
+}
+
+// Per-packet trace context, so that the filters are only consulted once
+type packetTrace struct {
+	tracer *tracer
+	assoc  AssociationID
+	ssrc   uint32
+}
+
+func (mdd *MDD) startTrace(assocID AssociationID, ssrc uint32) *packetTrace {
+	if !mdd.tracer.enabled(assocID, ssrc) {
+		return nil
+	}
+	return &packetTrace{tracer: mdd.tracer, assoc: assocID, ssrc: ssrc}
+}
+
+// Safe to call on a nil trace, in which case nothing is recorded
+func (pt *packetTrace) log(stage string, format string, args ...interface{}) {
+	if pt == nil {
+		return
+	}
+
+	pt.tracer.record(TraceEntry{
+		Time:   time.Now(),
+		Assoc:  pt.assoc,
+		SSRC:   pt.ssrc,
+		Stage:  stage,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+func (mdd *MDD) TraceSSRC(ssrc uint32, on bool) {
+	mdd.tracer.mu.Lock()
+	defer mdd.tracer.mu.Unlock()
+	if on {
+		mdd.tracer.ssrcs[ssrc] = true
+	} else {
+		delete(mdd.tracer.ssrcs, ssrc)
+	}
+}
+
+func (mdd *MDD) TraceAssociation(assocID AssociationID, on bool) {
+	mdd.tracer.mu.Lock()
+	defer mdd.tracer.mu.Unlock()
+	if on {
+		mdd.tracer.assocs[assocID] = true
+	} else {
+		delete(mdd.tracer.assocs, assocID)
+	}
+}
+
+// Returns the recorded trace entries, oldest first
+func (mdd *MDD) TraceEntries() []TraceEntry {
+	tr := mdd.tracer
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	entries := make([]TraceEntry, 0, len(tr.ring))
+	entries = append(entries, tr.ring[tr.next:]...)
+	entries = append(entries, tr.ring[:tr.next]...)
+	return entries
+}
+
+func (mdd *MDD) ClearTrace() {
+	tr := mdd.tracer
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.ring = tr.ring[:0]
+	tr.next = 0
+}
@@ -0,0 +1,209 @@
+package percy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTraceFilterAndRing(t *testing.T) {
+	mdd := NewMDD()
+	mdd.TraceSSRC(0x1234, true)
+
+	if trace := mdd.startTrace(1, 0x5678); trace != nil {
+		t.Fatalf("Traced a packet that matches no filter")
+	}
+
+	trace := mdd.startTrace(1, 0x1234)
+	if trace == nil {
+		t.Fatalf("Failed to trace a packet from a traced SSRC")
+	}
+
+	for i := 0; i < traceRingSize+10; i += 1 {
+		trace.log("test", "%d", i)
+	}
+
+	entries := mdd.TraceEntries()
+	if len(entries) != traceRingSize {
+		t.Fatalf("Incorrect number of entries: %d", len(entries))
+	}
+	if entries[0].Detail != "10" || entries[traceRingSize-1].Detail != "1033" {
+		t.Fatalf("Ring out of order: %s ... %s", entries[0].Detail, entries[traceRingSize-1].Detail)
+	}
+
+	mdd.TraceSSRC(0x1234, false)
+	mdd.TraceAssociation(2, true)
+	if mdd.startTrace(1, 0x1234) != nil || mdd.startTrace(2, 0) == nil {
+		t.Fatalf("Trace filters not updated")
+	}
+
+	mdd.ClearTrace()
+	if len(mdd.TraceEntries()) != 0 {
+		t.Fatalf("Trace not cleared")
+	}
+}
+
+func TestAdminAPIAuthorization(t *testing.T) {
+	auth := NewMemoryAuthProvider()
+	auth.AddAdminToken("secret")
+
+	mdd := NewMDD()
+	mdd.Auth = auth
+	api := NewAdminAPI(mdd)
+
+	req := httptest.NewRequest("GET", "/stats", nil)
+	resp := httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Unauthorized request allowed: %d", resp.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp = httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Authorized request failed: %d", resp.Code)
+	}
+
+	var snap StatsSnapshot
+	err := json.Unmarshal(resp.Body.Bytes(), &snap)
+	if err != nil {
+		t.Fatalf("Error parsing stats: %v", err)
+	}
+	if snap.Global.Conferences != 1 {
+		t.Fatalf("Incorrect conference count: %d", snap.Global.Conferences)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	auth := NewMemoryAuthProvider()
+	auth.AddAdminToken("secret")
+
+	mdd := NewMDD()
+	mdd.Auth = auth
+	api := NewAdminAPI(mdd)
+
+	req := httptest.NewRequest("GET", "/capabilities", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Capabilities request failed: %d", resp.Code)
+	}
+
+	var caps Capabilities
+	err := json.Unmarshal(resp.Body.Bytes(), &caps)
+	if err != nil {
+		t.Fatalf("Error parsing capabilities: %v", err)
+	}
+	if caps.APIVersion != AdminAPIVersion {
+		t.Fatalf("Incorrect API version: %d", caps.APIVersion)
+	}
+
+	supported := map[string]bool{}
+	for _, feature := range caps.Features {
+		supported[feature.Name] = feature.Supported
+	}
+	if !supported["stats"] || supported["recording"] {
+		t.Fatalf("Incorrect features: %+v", caps.Features)
+	}
+}
+
+func TestUnknownTraffic(t *testing.T) {
+	auth := NewMemoryAuthProvider()
+	auth.AddAdminToken("secret")
+
+	mdd := NewMDD()
+	mdd.Auth = auth
+	api := NewAdminAPI(mdd)
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9999}
+	payload := make([]byte, 2*unknownSampleBytes)
+	payload[0] = 0x10
+	for i := 0; i < unknownSampleRingSize+1; i++ {
+		mdd.process(packet{addr: addr, msg: payload, recvTime: time.Now()})
+	}
+
+	req := httptest.NewRequest("GET", "/unknown", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unknown traffic request failed: %d", resp.Code)
+	}
+
+	var report UnknownTraffic
+	err := json.Unmarshal(resp.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("Error parsing unknown traffic: %v", err)
+	}
+	if len(report.Sources) != 1 || report.Sources[0].Address != addr.String() || report.Sources[0].Packets != unknownSampleRingSize+1 {
+		t.Fatalf("Incorrect sources: %+v", report.Sources)
+	}
+	if len(report.Samples) != unknownSampleRingSize || len(report.Samples[0].Payload) != 2*unknownSampleBytes {
+		t.Fatalf("Samples not capped")
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	auth := NewMemoryAuthProvider()
+	auth.AddAdminToken("secret")
+
+	mdd := NewMDD()
+	mdd.Auth = auth
+	mdd.Node = "md-1"
+	mdd.Region = "eu-west"
+	mdd.Capacity = 1
+	api := NewAdminAPI(mdd)
+
+	place := func() PlacementDecision {
+		req := httptest.NewRequest("POST", "/place?conf=5&region=us-east", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := httptest.NewRecorder()
+		api.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Placement request failed: %d", resp.Code)
+		}
+
+		var decision PlacementDecision
+		err := json.Unmarshal(resp.Body.Bytes(), &decision)
+		if err != nil {
+			t.Fatalf("Error parsing placement decision: %v", err)
+		}
+		return decision
+	}
+
+	if !place().Accept {
+		t.Fatalf("Node with room refused a participant")
+	}
+
+	mdd.SetAssociationConference(0x0001, 5)
+	if decision := place(); decision.Accept {
+		t.Fatalf("Node at capacity accepted a participant")
+	}
+
+	mdd.Placement = func(req PlacementRequest, node NodeInfo) PlacementDecision {
+		if req.Region != node.Region {
+			return PlacementDecision{Redirect: "md-" + req.Region}
+		}
+		return PlacementDecision{Accept: true}
+	}
+	if decision := place(); decision.Accept || decision.Redirect != "md-us-east" {
+		t.Fatalf("Placement hook not used: %+v", decision)
+	}
+
+	req := httptest.NewRequest("GET", "/node", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+
+	var node NodeInfo
+	err := json.Unmarshal(resp.Body.Bytes(), &node)
+	if err != nil || node.Node != "md-1" || node.Region != "eu-west" || node.Associations != 1 || node.Load != 1 {
+		t.Fatalf("Incorrect node info: %+v %v", node, err)
+	}
+}
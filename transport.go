@@ -0,0 +1,15 @@
+package percy
+
+import (
+	"net"
+)
+
+// Transport is the part of net.PacketConn that the MD and the KD forwarder
+// use, so that in-memory transports can stand in for UDP sockets in tests,
+// and other datagram transports can be plugged in.
+type Transport interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+}
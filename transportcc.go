@@ -0,0 +1,211 @@
+package percy
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/fluffy/rtp"
+)
+
+// Browsers run congestion control from transport-wide feedback
+// (draft-holmer-rmcat-transport-wide-cc-extensions): each packet carries a
+// sequence number counting across all of the sender's streams, and the
+// receiver reports when each one arrived.  Relayed end to end, that feedback
+// would measure two legs and the MD's selective forwarding at once.  So with
+// TransportCCID set, each leg is its own transport:
+//
+//   - The MD reports the arrival of the packets it gets from each sender,
+//     at most every transportCCInterval
+//   - Packets to each receiver are renumbered with a sequence of their own
+//   - Receivers' feedback is about the MD's leg, so it isn't relayed
+//
+// Feedback uses two-bit status vector chunks throughout; they cost a little
+// more than run lengths, but are always valid.
+
+const (
+	transportCCInterval  = 100 * time.Millisecond
+	transportCCMaxStatus = 0x1000 // Packets covered by one feedback message
+
+	transportCCRefUnit   = 64 * time.Millisecond
+	transportCCDeltaUnit = 250 * time.Microsecond
+
+	transportCCNotReceived = 0
+	transportCCSmallDelta  = 1
+	transportCCLargeDelta  = 2
+)
+
+// Arrivals on a sender's leg, guarded by mdd.mu
+type transportCCState struct {
+	started  bool
+	highest  int64               // Unwrapped sequence number
+	next     int64               // First sequence number the next feedback covers
+	arrivals map[int64]time.Time // Since the last feedback
+	sent     time.Time
+	count    uint8 // Feedback packet count
+}
+
+// Extends a 16-bit sequence number to the one nearest the highest seen
+func (tcc *transportCCState) unwrap(seq uint16) int64 {
+	if !tcc.started {
+		tcc.started = true
+		tcc.highest = int64(seq)
+		tcc.next = int64(seq)
+	}
+	unwrapped := tcc.highest + int64(int16(seq-uint16(tcc.highest)))
+	if unwrapped > tcc.highest {
+		tcc.highest = unwrapped
+	}
+	return unwrapped
+}
+
+// Records a packet's arrival.  Packets already reported are ignored.
+func (tcc *transportCCState) record(seq uint16, arrival time.Time) {
+	unwrapped := tcc.unwrap(seq)
+	if unwrapped < tcc.next {
+		return
+	}
+	if tcc.arrivals == nil {
+		tcc.arrivals = map[int64]time.Time{}
+	}
+	if _, ok := tcc.arrivals[unwrapped]; !ok {
+		tcc.arrivals[unwrapped] = arrival
+	}
+}
+
+// Builds a feedback message for the packets received since the last one,
+// and starts afresh.  Times are relative to the epoch.
+func (tcc *transportCCState) feedback(senderSSRC, mediaSSRC uint32, epoch time.Time) []byte {
+	if len(tcc.arrivals) == 0 {
+		return nil
+	}
+
+	base := tcc.next
+	if tcc.highest-base >= transportCCMaxStatus {
+		base = tcc.highest - transportCCMaxStatus + 1
+	}
+	received := []int64{}
+	for seq := range tcc.arrivals {
+		if seq >= base {
+			received = append(received, seq)
+		}
+	}
+	sort.Slice(received, func(i, j int) bool { return received[i] < received[j] })
+	status := int(tcc.highest - base + 1)
+
+	// Deltas are in whole units from the reference time, so that rounding
+	// doesn't accumulate
+	refTicks := int64(tcc.arrivals[received[0]].Sub(epoch) / transportCCRefUnit)
+	reference := epoch.Add(time.Duration(refTicks) * transportCCRefUnit)
+	symbols := make([]uint8, status)
+	deltas := []byte{}
+	var last int64
+	for _, seq := range received {
+		ticks := int64(tcc.arrivals[seq].Sub(reference) / transportCCDeltaUnit)
+		delta := ticks - last
+		last = ticks
+		if delta >= 0 && delta <= 0xff {
+			symbols[seq-base] = transportCCSmallDelta
+			deltas = append(deltas, byte(delta))
+			continue
+		}
+		if delta > 0x7fff {
+			delta = 0x7fff
+		} else if delta < -0x8000 {
+			delta = -0x8000
+		}
+		symbols[seq-base] = transportCCLargeDelta
+		deltas = binary.BigEndian.AppendUint16(deltas, uint16(int16(delta)))
+	}
+
+	msg := make([]byte, 20, 20+2*(status+6)/7+len(deltas)+3)
+	msg[0] = 0x80 | rtcpFormatTransportCC
+	msg[1] = RTCPTypeRTPFB
+	binary.BigEndian.PutUint32(msg[4:8], senderSSRC)
+	binary.BigEndian.PutUint32(msg[8:12], mediaSSRC)
+	binary.BigEndian.PutUint16(msg[12:14], uint16(base))
+	binary.BigEndian.PutUint16(msg[14:16], uint16(status))
+	binary.BigEndian.PutUint32(msg[16:20], uint32(refTicks)<<8|uint32(tcc.count))
+	for i := 0; i < status; i += 7 {
+		chunk := uint16(0xc000)
+		for j := 0; j < 7; j++ {
+			if i+j < status {
+				chunk |= uint16(symbols[i+j]) << (12 - 2*j)
+			}
+		}
+		msg = binary.BigEndian.AppendUint16(msg, chunk)
+	}
+	msg = append(msg, deltas...)
+	if padding := (4 - len(msg)%4) % 4; padding > 0 {
+		msg = append(msg, make([]byte, padding)...)
+		msg[0] |= 0x20
+		msg[len(msg)-1] = byte(padding)
+	}
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)/4-1))
+
+	tcc.next = tcc.highest + 1
+	tcc.arrivals = nil
+	tcc.count++
+	return msg
+}
+
+// Records the arrival of a sender's packet, and sends it feedback if it's
+// due.  Runs on the processing loop.
+func (mdd *MDD) recordTransportSeq(sender *association, pkt *rtp.RTPPacket, arrival, now time.Time, trace *packetTrace) {
+	if mdd.TransportCCID == 0 {
+		return
+	}
+	header, err := ParseRTPHeader(pkt.Buffer)
+	if err != nil {
+		return
+	}
+	element, ok := header.ExtensionElement(mdd.TransportCCID)
+	if !ok || len(element) < 2 {
+		return
+	}
+
+	mdd.mu.Lock()
+	tcc := &sender.transportCC
+	tcc.record(binary.BigEndian.Uint16(element), arrival)
+	var msg []byte
+	if now.Sub(tcc.sent) >= transportCCInterval {
+		msg = tcc.feedback(mdd.rtcpSSRC, header.SSRC, mdd.stats.start)
+		tcc.sent = now
+	}
+	mdd.mu.Unlock()
+
+	if msg != nil {
+		trace.log("route", "transport-wide feedback to [%04x]", sender.id)
+		mdd.sendRTCP(sender, &rtp.RTCPPacket{Buffer: msg}, trace)
+	}
+}
+
+// Renumbers a packet in the receiver's transport-wide sequence
+func (mdd *MDD) sequenceTransport(receiver *association, pkt *rtp.RTPPacket) {
+	if mdd.TransportCCID == 0 {
+		return
+	}
+	header, err := ParseRTPHeader(pkt.Buffer)
+	if err != nil {
+		return
+	}
+	element, ok := header.ExtensionElement(mdd.TransportCCID)
+	if !ok || len(element) < 2 {
+		return
+	}
+
+	mdd.mu.Lock()
+	receiver.transportSeq++
+	binary.BigEndian.PutUint16(element, receiver.transportSeq)
+	mdd.mu.Unlock()
+}
+
+// Reports whether a compound packet is only transport-wide feedback
+func transportFeedbackOnly(headers []RTCPHeader) bool {
+	for _, header := range headers {
+		if header.PacketType != RTCPTypeRTPFB || header.Count != rtcpFormatTransportCC {
+			return false
+		}
+	}
+	return len(headers) > 0
+}
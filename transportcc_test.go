@@ -0,0 +1,105 @@
+package percy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestTransportCCFeedback(t *testing.T) {
+	epoch := time.Now()
+	var tcc transportCCState
+	tcc.record(10, epoch.Add(100*time.Millisecond))
+	tcc.record(11, epoch.Add(101*time.Millisecond))
+	tcc.record(13, epoch.Add(400*time.Millisecond))
+	tcc.record(11, epoch.Add(500*time.Millisecond)) // Duplicate
+
+	// 12 is lost, and 13 comes too late for a one-byte delta
+	msg := tcc.feedback(0x0a0b0c0d, 0x01020304, epoch)
+	expected := []byte{
+		0xaf, 0xcd, 0x00, 0x06, 0x0a, 0x0b, 0x0c, 0x0d, 0x01, 0x02, 0x03, 0x04,
+		0x00, 0x0a, 0x00, 0x04, 0x00, 0x00, 0x01, 0x00,
+		0xd4, 0x80,
+		0x90, 0x04, 0x04, 0xac,
+		0x00, 0x02,
+	}
+	if !bytes.Equal(msg, expected) {
+		t.Fatalf("Incorrect feedback:\n%x\n%x", msg, expected)
+	}
+	if headers, err := ParseRTCPCompound(msg); err != nil || !transportFeedbackOnly(headers) {
+		t.Fatalf("Feedback doesn't parse: %+v %v", headers, err)
+	}
+
+	// Packets already reported aren't reported again, and sequence numbers
+	// carry on across a wrap
+	if tcc.record(12, epoch.Add(time.Second)); tcc.feedback(0, 0, epoch) != nil {
+		t.Fatalf("Late packet reported")
+	}
+	for seq := 14; seq <= 0xffff; seq++ {
+		tcc.unwrap(uint16(seq))
+	}
+	tcc.next = 0xffff
+	tcc.record(0xffff, epoch.Add(time.Second))
+	tcc.record(0x0000, epoch.Add(time.Second))
+	msg = tcc.feedback(0, 0, epoch)
+	if base, count := binary.BigEndian.Uint16(msg[12:14]), binary.BigEndian.Uint16(msg[14:16]); base != 0xffff || count != 2 || msg[19] != 1 {
+		t.Fatalf("Incorrect feedback across a wrap: %x", msg)
+	}
+}
+
+func TestTransportCCLegs(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.RTCPShaping = RTCPShaping{}
+	mdd.TransportCCID = 5
+
+	clients := newKeyedClients(t, network, mdd, "10.0.0.1:5000", "10.0.0.2:5000")
+	sender, receiver := clients[0], clients[1]
+
+	media := []byte{
+		0x90, 0x6f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0xbe, 0xde, 0x00, 0x01, 0x51, 0x12, 0x34, 0x00,
+		0xaa,
+	}
+	sender.Write(media)
+
+	// The receiver's leg has its own sequence
+	msg, err := receiver.Recv()
+	if err != nil || len(msg) != len(media) {
+		t.Fatalf("Media not forwarded: %x %v", msg, err)
+	}
+	if seq := binary.BigEndian.Uint16(msg[17:19]); seq != 1 {
+		t.Fatalf("Packet not renumbered for the receiver: %d", seq)
+	}
+
+	// The sender hears about its own leg
+	msg, err = sender.Recv()
+	if err != nil {
+		t.Fatalf("No transport-wide feedback: %v", err)
+	}
+	headers, err := ParseRTCPCompound(msg)
+	if err != nil || !transportFeedbackOnly(headers) || headers[0].MediaSSRC != 0x01020304 {
+		t.Fatalf("Incorrect feedback: %+v %v", headers, err)
+	}
+	if base, count := binary.BigEndian.Uint16(msg[12:14]), binary.BigEndian.Uint16(msg[14:16]); base != 0x1234 || count != 1 {
+		t.Fatalf("Incorrect feedback: %x", msg)
+	}
+
+	// The receiver's feedback is about the MD's leg, so it stops there
+	feedback := []byte{
+		0xaf, 0xcd, 0x00, 0x05, 0x0a, 0x0b, 0x0c, 0x0d, 0x01, 0x02, 0x03, 0x04,
+		0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x00,
+		0xd0, 0x00, 0x10, 0x01,
+	}
+	receiver.Write(feedback)
+	AssertNotRecvPacket(t, sender, "Receiver's transport-wide feedback relayed")
+
+	// Without the extension, it's relayed as any other feedback
+	mdd.runOnLoop(func() { mdd.TransportCCID = 0 })
+	receiver.Write(feedback)
+	AssertRecvPacket(t, sender, feedback, "Transport-wide feedback not relayed")
+}
@@ -0,0 +1,87 @@
+package percy
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+)
+
+// At high packet rates, the default GC pacing (GOGC=100) collects often
+// enough to show up as forwarding latency spikes.  For media nodes, a higher
+// GC percent trades memory for fewer collections; a memory limit keeps the
+// heap bounded if that goes too far.
+
+type RuntimeConfig struct {
+	MaxProcs    int   `json:"max_procs"`    // Zero keeps the runtime default (one per CPU)
+	GCPercent   int   `json:"gc_percent"`   // Zero keeps the current setting; negative disables GC
+	MemoryLimit int64 `json:"memory_limit"` // Soft limit in bytes; zero for none
+
+	// Goroutines reading the media socket.  More than one can keep up with
+	// higher packet rates, but packets may be reordered between them.
+	Readers int `json:"readers"`
+
+	// Packets queued between the socket readers and the processing loop
+	PacketQueue int `json:"packet_queue"`
+
+	// Goroutines answering STUN, and the checks queued for them
+	STUNWorkers int `json:"stun_workers"`
+	STUNQueue   int `json:"stun_queue"`
+
+	// CPUs to pin each group of goroutines to (Linux only)
+	Affinity CPUAffinity `json:"affinity"`
+
+	// Stamp packets with the time the kernel received them (Linux only)
+	KernelTimestamps bool `json:"kernel_timestamps"`
+
+	// Mark packets as ECN-capable, and count congestion marks (Linux only)
+	ECN bool `json:"ecn"`
+}
+
+func DefaultRuntimeConfig() RuntimeConfig {
+	return RuntimeConfig{
+		GCPercent:   400,
+		Readers:     1,
+		PacketQueue: 1024,
+		STUNWorkers: defaultSTUNWorkers,
+		STUNQueue:   defaultSTUNQueue,
+
+		KernelTimestamps: true,
+	}
+}
+
+// Applies the process-wide settings.  Since these affect the whole process,
+// they are left to the application rather than applied by the MD.
+func (config RuntimeConfig) Apply() {
+	if config.MaxProcs > 0 {
+		runtime.GOMAXPROCS(config.MaxProcs)
+	}
+	if config.GCPercent != 0 {
+		debug.SetGCPercent(config.GCPercent)
+	}
+	if config.MemoryLimit > 0 {
+		debug.SetMemoryLimit(config.MemoryLimit)
+	}
+
+	log.Printf("Runtime: GOMAXPROCS=%d, GC percent=%d, memory limit=%d",
+		runtime.GOMAXPROCS(0), config.GCPercent, config.MemoryLimit)
+}
+
+// Sizes the MD's own goroutines and queues.  This must be called before the
+// MD starts listening.
+func (mdd *MDD) Tune(config RuntimeConfig) {
+	if config.Readers > 0 {
+		mdd.readers = config.Readers
+	}
+	if config.PacketQueue > 0 {
+		mdd.packetChan = make(chan packet, config.PacketQueue)
+	}
+	if config.STUNWorkers > 0 {
+		mdd.stunWorkers = config.STUNWorkers
+	}
+	if config.STUNQueue > 0 {
+		mdd.stunQueue = make(chan stunJob, config.STUNQueue)
+	}
+	mdd.affinity = config.Affinity
+	mdd.kernelTime = config.KernelTimestamps
+	mdd.ecn = config.ECN
+}
@@ -1,17 +1,18 @@
 package percy
 
 import (
+	"fmt"
 	"log"
 	"net"
-
-	"github.com/bifurcation/mint/syntax"
+	"sync"
+	"time"
 )
 
 type ProtectionProfile uint16
 
 type HBHKeys struct {
 	Marker         uint8
-	Profile        uint16
+	Profile        ProtectionProfile
 	ClientWriteKey []byte `tls:"head=1"`
 	ServerWriteKey []byte `tls:"head=1"`
 	MasterSalt     []byte `tls:"head=1"`
@@ -30,12 +31,64 @@ type MDDTunnel interface {
 
 const (
 	kdBufferSize = 2048
+
+	// How long to wait for the KD to select a codec before falling back to
+	// the standard one, or with sequenced codecs on offer, starting over
+	codecNegotiationTimeout = time.Second
+
+	// DTLS records held per association while its tunnel is down, and how
+	// long to wait between attempts to bring it back
+	defaultTunnelQueue = 16
+	tunnelRetryMin     = 100 * time.Millisecond
+	tunnelRetryMax     = 5 * time.Second
 )
 
+// The forwarder's side of one association's tunnel.  Until the codec is
+// negotiated, and while the tunnel is down, outgoing messages are held back.
+type kdTunnel struct {
+	conn    Transport
+	mu      sync.Mutex
+	codec   TunnelCodec
+	pending [][]byte
+	down    bool // Reconnecting
+	closed  bool
+
+	// With a sequenced codec, the epoch of the current transport, the last
+	// sequence number sent, and those received
+	epoch    uint64
+	sent     uint64
+	received replayWindow
+
+	// Fires if the KD doesn't answer the current offer
+	negotiation *time.Timer
+}
+
+// Forwards each association's DTLS to the KD over its own transport, so that
+// the KD can tell associations apart by source address.
+//
+// If a tunnel's transport fails, it is dialed again, backing off up to
+// tunnelRetryMax between attempts, and codecs are negotiated afresh.  In the
+// meantime, up to QueueLimit records are held for the association (the
+// oldest are dropped first) and sent once the tunnel is back, so that a
+// short outage costs clients a delayed flight rather than a retransmission
+// backoff.
 type UDPForwarder struct {
-	MD     MDDTunnel
-	server *net.UDPAddr
-	conns  map[AssociationID]*net.UDPConn
+	MD MDDTunnel
+
+	// Codecs to offer the KD, in order of preference.  If empty, the
+	// standard codec is used without negotiation.
+	Codecs []TunnelCodec
+
+	// DTLS records to hold per association while its tunnel is down
+	QueueLimit int
+
+	// Key shared with the KD, which authenticates messages under sequenced
+	// codecs.  Without one, sequenced codecs are not offered.
+	TunnelKey []byte
+
+	server  net.Addr
+	dial    func() (Transport, error)
+	tunnels map[AssociationID]*kdTunnel
 }
 
 func NewUDPForwarder(server string) (*UDPForwarder, error) {
@@ -44,63 +97,413 @@ func NewUDPForwarder(server string) (*UDPForwarder, error) {
 		return nil, err
 	}
 
+	return NewForwarder(serverAddr, func() (Transport, error) {
+		return net.ListenUDP("udp", nil)
+	}), nil
+}
+
+// Creates a forwarder that reaches the KD at server over transports created
+// by dial, one per association
+func NewForwarder(server net.Addr, dial func() (Transport, error)) *UDPForwarder {
 	return &UDPForwarder{
-		server: serverAddr,
-		conns:  map[AssociationID]*net.UDPConn{},
-	}, nil
+		QueueLimit: defaultTunnelQueue,
+		server:     server,
+		dial:       dial,
+		tunnels:    map[AssociationID]*kdTunnel{},
+	}
+}
+
+// Sets the tunnel's codec (if not already set) and flushes held messages;
+// the caller holds tunnel.mu
+func (fwd *UDPForwarder) selectCodec(assocID AssociationID, tunnel *kdTunnel, codec TunnelCodec) {
+	if tunnel.codec != nil {
+		return
+	}
+
+	log.Printf("Using %s tunnel codec for %v", codec.Name(), assocID)
+	stopNegotiation(tunnel)
+	tunnel.codec = codec
+	fwd.flush(assocID, tunnel)
 }
 
-func (fwd *UDPForwarder) monitor(assocID AssociationID, conn *net.UDPConn) {
+// Stops waiting for the KD to answer an offer; the caller holds tunnel.mu
+func stopNegotiation(tunnel *kdTunnel) {
+	if tunnel.negotiation != nil {
+		tunnel.negotiation.Stop()
+		tunnel.negotiation = nil
+	}
+}
+
+// Sends the held messages, keeping any that fail; the caller holds tunnel.mu
+func (fwd *UDPForwarder) flush(assocID AssociationID, tunnel *kdTunnel) {
+	for len(tunnel.pending) > 0 {
+		err := fwd.write(tunnel, tunnel.pending[0])
+		if err != nil {
+			log.Printf("Error flushing KD tunnel for %v: %v", assocID, err)
+			tunnel.down = true
+			tunnel.conn.Close()
+			return
+		}
+		tunnel.pending = tunnel.pending[1:]
+	}
+	tunnel.pending = nil
+}
+
+// Holds a message until the tunnel can take it; the caller holds tunnel.mu
+func (fwd *UDPForwarder) hold(assocID AssociationID, tunnel *kdTunnel, msg []byte) {
+	if fwd.QueueLimit > 0 && len(tunnel.pending) >= fwd.QueueLimit {
+		log.Printf("KD tunnel queue for %v is full; dropping its oldest record", assocID)
+		tunnel.pending = tunnel.pending[1:]
+	}
+	tunnel.pending = append(tunnel.pending, msg)
+}
+
+// Lists the codecs we can offer the KD, keyed with TunnelKey
+func (fwd *UDPForwarder) offered() []TunnelCodec {
+	codecs := make([]TunnelCodec, 0, len(fwd.Codecs))
+	for _, codec := range fwd.Codecs {
+		if isSequenced(codec) && len(fwd.TunnelKey) == 0 {
+			continue
+		}
+		codecs = append(codecs, KeyedCodec(codec, fwd.TunnelKey, TunnelEndMD))
+	}
+	return codecs
+}
+
+// Reports whether a sequenced codec is among those we offer, in which case
+// the tunnel never falls back to the standard codec
+func (fwd *UDPForwarder) sequencedOffered() bool {
+	for _, codec := range fwd.offered() {
+		if isSequenced(codec) {
+			return true
+		}
+	}
+	return false
+}
+
+// Picks out the codec the KD selected, in answer to the offer for epoch,
+// from the ones we offered
+func (fwd *UDPForwarder) selected(msg []byte, epoch uint64) (TunnelCodec, error) {
+	names, answered, err := decodeNegotiation(msg, fwd.TunnelKey, TunnelEndKD)
+	if err != nil {
+		return nil, err
+	}
+	if len(fwd.TunnelKey) > 0 && answered != epoch {
+		return nil, fmt.Errorf("KD answered an earlier offer")
+	}
+	if len(names) != 1 {
+		return nil, fmt.Errorf("KD selected %d codecs", len(names))
+	}
+
+	for _, codec := range fwd.offered() {
+		if codec.Name() == names[0] {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("KD selected a codec that was not offered: %q", names[0])
+}
+
+func (fwd *UDPForwarder) monitor(assocID AssociationID, tunnel *kdTunnel) {
 	buf := make([]byte, kdBufferSize)
 
 	for {
-		n, _, err := conn.ReadFromUDP(buf)
+		tunnel.mu.Lock()
+		conn := tunnel.conn
+		tunnel.mu.Unlock()
+
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
-			log.Printf("Error reading KD socket: %v", err)
-			return
+			if !fwd.reconnect(assocID, tunnel, err) {
+				return
+			}
+			continue
+		}
+
+		if addr.String() != fwd.server.String() {
+			log.Printf("Ignoring packet from non-KD address %v", addr)
+			continue
+		}
+
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+
+		log.Printf("MD <-- KD for %v with [%d] bytes", assocID, len(msg))
+
+		if msg[0] == tunnelNegotiationMarker {
+			fwd.answered(assocID, tunnel, msg)
+			continue
 		}
-		buf = buf[:n]
 
-		log.Printf("MD <-- KD for %v with [%d] bytes", assocID, len(buf))
+		tunnel.mu.Lock()
+		codec := tunnel.codec
+		tunnel.mu.Unlock()
+		if codec == nil {
+			codec = StandardCodec
+		}
+
+		tmsg, err := codec.Decode(msg)
+		if err != nil {
+			log.Printf("Error decoding tunnel message: %v", err)
+			continue
+		}
 
-		switch packetClass(buf) {
-		case packetClassDTLS:
-			err = fwd.MD.Send(assocID, buf)
+		if isSequenced(codec) {
+			tunnel.mu.Lock()
+			current := tmsg.Epoch == tunnel.epoch
+			fresh := current && tunnel.received.accept(tmsg.Seq)
+			tunnel.mu.Unlock()
+			if !current {
+				log.Printf("Dropping tunnel message from an earlier epoch for %v", assocID)
+				continue
+			}
+			if !fresh {
+				log.Printf("Dropping replayed tunnel message %d for %v", tmsg.Seq, assocID)
+				continue
+			}
+		}
+
+		switch {
+		case tmsg.Keys != nil:
+			err = fwd.MD.SetKeys(assocID, *tmsg.Keys)
 			if err != nil {
-				log.Printf("Error forwarding DTLS packet: %v", err)
+				log.Printf("Error setting HBH keys: %v", err)
 			}
 
-		case packetClassHBHKey:
-			var keys HBHKeys
-			_, err := syntax.Unmarshal(buf, &keys)
+		case tmsg.DTLS != nil:
+			err = fwd.MD.Send(assocID, tmsg.DTLS)
 			if err != nil {
-				log.Printf("Error parsing HBHKeys struct: %v", err)
+				log.Printf("Error forwarding DTLS packet: %v", err)
+			}
+		}
+	}
+}
+
+// Takes the KD's answer to our offer.  If it doesn't check, the tunnel falls
+// back to the standard codec, or with sequenced codecs on offer, starts over.
+func (fwd *UDPForwarder) answered(assocID AssociationID, tunnel *kdTunnel, msg []byte) {
+	tunnel.mu.Lock()
+	defer tunnel.mu.Unlock()
+
+	if tunnel.codec != nil {
+		log.Printf("Ignoring codec selection for %v after negotiation", assocID)
+		return
+	}
+
+	codec, err := fwd.selected(msg, tunnel.epoch)
+	switch {
+	case err == nil:
+		fwd.selectCodec(assocID, tunnel, codec)
+
+	case fwd.sequencedOffered():
+		log.Printf("Error negotiating tunnel codec for %v, starting over: %v", assocID, err)
+		stopNegotiation(tunnel)
+		tunnel.conn.Close()
+
+	default:
+		log.Printf("Error negotiating tunnel codec for %v: %v", assocID, err)
+		fwd.selectCodec(assocID, tunnel, StandardCodec)
+	}
+}
+
+// Handles a KD that didn't answer the offer for epoch in time
+func (fwd *UDPForwarder) negotiationTimedOut(assocID AssociationID, tunnel *kdTunnel, epoch uint64) {
+	tunnel.mu.Lock()
+	defer tunnel.mu.Unlock()
+
+	// A later offer, or an answer, got here first
+	if tunnel.closed || tunnel.codec != nil || tunnel.epoch != epoch {
+		return
+	}
+
+	tunnel.negotiation = nil
+	if fwd.sequencedOffered() {
+		log.Printf("KD did not select a tunnel codec for %v; starting over", assocID)
+		tunnel.conn.Close()
+		return
+	}
+	fwd.selectCodec(assocID, tunnel, StandardCodec)
+}
+
+// Dials a new transport for a tunnel whose transport failed, until it
+// succeeds or the tunnel is closed.  Returns false if it was closed.
+func (fwd *UDPForwarder) reconnect(assocID AssociationID, tunnel *kdTunnel, cause error) bool {
+	tunnel.mu.Lock()
+	if tunnel.closed {
+		tunnel.mu.Unlock()
+		return false
+	}
+	tunnel.down = true
+	stopNegotiation(tunnel)
+	tunnel.mu.Unlock()
+	log.Printf("KD tunnel for %v is down, reconnecting: %v", assocID, cause)
+
+	delay := tunnelRetryMin
+	for {
+		conn, err := fwd.dial()
+		if err == nil {
+			tunnel.mu.Lock()
+			defer tunnel.mu.Unlock()
+			if tunnel.closed {
+				conn.Close()
+				return false
 			}
 
-			fwd.MD.SetKeys(assocID, keys)
+			// The KD sees a new source, so negotiation starts over, and
+			// with it a new epoch
+			tunnel.conn.Close()
+			tunnel.conn = conn
+			tunnel.down = false
+			log.Printf("KD tunnel for %v is back; sending %d held records", assocID, len(tunnel.pending))
+			if len(fwd.Codecs) == 0 {
+				fwd.flush(assocID, tunnel)
+				return true
+			}
+
+			tunnel.codec = nil
+			if err := fwd.offer(assocID, tunnel); err != nil {
+				log.Printf("Error offering codecs for %v: %v", assocID, err)
+				tunnel.down = true
+				tunnel.conn.Close()
+			}
+			return true
 		}
 
-		buf = buf[:kdBufferSize]
+		log.Printf("Error redialing KD tunnel for %v: %v", assocID, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > tunnelRetryMax {
+			delay = tunnelRetryMax
+		}
+
+		tunnel.mu.Lock()
+		closed := tunnel.closed
+		tunnel.mu.Unlock()
+		if closed {
+			return false
+		}
 	}
 }
 
+// Encodes and sends a DTLS record; the caller holds tunnel.mu
+func (fwd *UDPForwarder) write(tunnel *kdTunnel, msg []byte) error {
+	tmsg := TunnelMessage{DTLS: msg}
+	if isSequenced(tunnel.codec) {
+		tunnel.sent += 1
+		tmsg.Epoch, tmsg.Seq = tunnel.epoch, tunnel.sent
+	}
+
+	data, err := tunnel.codec.Encode(tmsg)
+	if err != nil {
+		return err
+	}
+
+	_, err = tunnel.conn.WriteTo(data, fwd.server)
+	return err
+}
+
+// Sets up the tunnel for a new association, offering our codecs to the KD if
+// there are any to choose from
+func (fwd *UDPForwarder) open(assocID AssociationID) (*kdTunnel, error) {
+	conn, err := fwd.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel := &kdTunnel{conn: conn}
+	if len(fwd.Codecs) == 0 {
+		tunnel.codec = StandardCodec
+		return tunnel, nil
+	}
+
+	err = fwd.offer(assocID, tunnel)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// Offers our codecs to the KD, and starts a new epoch.  If the KD doesn't
+// answer in time, see negotiationTimedOut.  The caller holds tunnel.mu, or
+// has the tunnel to itself.
+func (fwd *UDPForwarder) offer(assocID AssociationID, tunnel *kdTunnel) error {
+	epoch, err := newTunnelEpoch()
+	if err != nil {
+		return err
+	}
+	tunnel.epoch = epoch
+	tunnel.sent = 0
+	tunnel.received = replayWindow{}
+
+	codecs := fwd.offered()
+	if len(codecs) < len(fwd.Codecs) {
+		log.Printf("Not offering sequenced tunnel codecs for %v without a tunnel key", assocID)
+	}
+	names := make([]string, len(codecs))
+	for i, codec := range codecs {
+		names[i] = codec.Name()
+	}
+
+	msg, err := encodeNegotiation(names, epoch, fwd.TunnelKey, TunnelEndMD)
+	if err != nil {
+		return err
+	}
+	_, err = tunnel.conn.WriteTo(msg, fwd.server)
+	if err != nil {
+		return err
+	}
+
+	stopNegotiation(tunnel)
+	tunnel.negotiation = time.AfterFunc(codecNegotiationTimeout, func() {
+		fwd.negotiationTimedOut(assocID, tunnel, epoch)
+	})
+	return nil
+}
+
+// Closes an association's tunnel, e.g., when its conference has ended
+func (fwd *UDPForwarder) Close(assocID AssociationID) error {
+	tunnel, ok := fwd.tunnels[assocID]
+	if !ok {
+		return nil
+	}
+
+	delete(fwd.tunnels, assocID)
+	tunnel.mu.Lock()
+	defer tunnel.mu.Unlock()
+	tunnel.closed = true
+	stopNegotiation(tunnel)
+	return tunnel.conn.Close()
+}
+
 func (fwd *UDPForwarder) Send(assocID AssociationID, msg []byte) error {
 	var err error
-	conn, ok := fwd.conns[assocID]
+	tunnel, ok := fwd.tunnels[assocID]
 	if !ok {
-		conn, err = net.DialUDP("udp", nil, fwd.server)
+		tunnel, err = fwd.open(assocID)
 		if err != nil {
 			return err
 		}
 
-		conn.SetReadBuffer(kdBufferSize)
-
-		fwd.conns[assocID] = conn
-		go fwd.monitor(assocID, conn)
+		fwd.tunnels[assocID] = tunnel
+		go fwd.monitor(assocID, tunnel)
 	}
 
 	log.Printf("MD --> KD for %v with [%d] bytes", assocID, len(msg))
 
-	_, err = conn.Write(msg)
-	return err
+	tunnel.mu.Lock()
+	defer tunnel.mu.Unlock()
+	if tunnel.codec == nil || tunnel.down {
+		fwd.hold(assocID, tunnel, msg)
+		return nil
+	}
+
+	err = fwd.write(tunnel, msg)
+	if err != nil {
+		// Closing the transport has the monitor bring the tunnel back
+		log.Printf("Error writing to KD tunnel for %v: %v", assocID, err)
+		fwd.hold(assocID, tunnel, msg)
+		tunnel.down = true
+		tunnel.conn.Close()
+	}
+	return nil
 }
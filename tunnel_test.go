@@ -2,59 +2,48 @@ package percy
 
 import (
 	"bytes"
+	"fmt"
 	"net"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/testnet"
 )
 
 type KdEchoServer struct {
-	stopChan chan bool
+	conn *testnet.Conn
 }
 
-func NewKdEchoServer(port int) (*KdEchoServer, error) {
-	addr := &net.UDPAddr{Port: port}
-	conn, err := net.ListenUDP("udp", addr)
+func NewKdEchoServer(network *testnet.Network, addr string) (*KdEchoServer, error) {
+	conn, err := network.Listen(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	stopped := false
-	stopChan := make(chan bool)
-	packetChan := make(chan packet)
-
 	go func() {
 		buf := make([]byte, 2048)
 
-		for !stopped {
-			n, addr, err := conn.ReadFromUDP(buf)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
 			if err != nil {
-				continue
+				return
 			}
 
-			buf = buf[:n]
-			packetChan <- packet{addr: addr, msg: buf[:n]}
+			msg := append(buf[:n], 0x01)
+			conn.WriteTo(msg, addr)
 		}
 	}()
 
-	go func() {
-		var pkt packet
-
-		for {
-			select {
-			case <-stopChan:
-				conn.Close()
-				return
-			case pkt = <-packetChan:
-				pkt.msg = append(pkt.msg, 0x01)
-				conn.WriteToUDP(pkt.msg, pkt.addr)
-			}
-		}
-	}()
+	return &KdEchoServer{conn: conn}, nil
+}
 
-	return &KdEchoServer{stopChan: stopChan}, nil
+func (echo *KdEchoServer) Addr() net.Addr {
+	return echo.conn.LocalAddr()
 }
 
 func (echo *KdEchoServer) Stop() {
-	echo.stopChan <- true
+	echo.conn.Close()
 }
 
 type assocPacket struct {
@@ -74,20 +63,18 @@ func (mdd MDDChan) SetKeys(assocID AssociationID, keys HBHKeys) error {
 }
 
 func TestUDPForwarder(t *testing.T) {
-	port := 2000
-	server := "localhost:2000"
+	network := testnet.NewNetwork()
 
 	md := make(MDDChan)
-	echo, err := NewKdEchoServer(port)
+	echo, err := NewKdEchoServer(network, "10.0.0.1:4433")
 	if err != nil {
 		t.Fatalf("Error creating kd echo server: %v", err)
 	}
+	defer echo.Stop()
 
-	fwd, err := NewUDPForwarder(server)
-	if err != nil {
-		t.Fatalf("Error creating echo server: %v", err)
-	}
-
+	fwd := NewForwarder(echo.Addr(), func() (Transport, error) {
+		return network.Listen("10.0.0.2:0")
+	})
 	fwd.MD = md
 
 	var assoc1 AssociationID = 1
@@ -107,6 +94,474 @@ func TestUDPForwarder(t *testing.T) {
 			t.Fatalf("Incorrect packet message: %x != %x", pkt.msg, msgOut)
 		}
 	}
+}
+
+func TestTunnelCodecs(t *testing.T) {
+	keys := &HBHKeys{
+		Marker:         0xFF,
+		Profile:        DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM,
+		ClientWriteKey: bytes.Repeat([]byte{0xA0}, 16),
+		ServerWriteKey: bytes.Repeat([]byte{0xB0}, 16),
+		MasterSalt:     bytes.Repeat([]byte{0xC0}, 12),
+	}
+	dtls := append([]byte{0x16, 0xfe, 0xfd}, bytes.Repeat([]byte{0x42}, 300)...)
+
+	for _, codec := range []TunnelCodec{StandardCodec, ProtobufCodec, CBORCodec} {
+		data, err := codec.Encode(TunnelMessage{DTLS: dtls})
+		if err != nil {
+			t.Fatalf("[%s] Error encoding DTLS: %v", codec.Name(), err)
+		}
+		msg, err := codec.Decode(data)
+		if err != nil || msg.Keys != nil || !bytes.Equal(msg.DTLS, dtls) {
+			t.Fatalf("[%s] DTLS round trip failed: %v", codec.Name(), err)
+		}
+
+		data, err = codec.Encode(TunnelMessage{Keys: keys})
+		if err != nil {
+			t.Fatalf("[%s] Error encoding keys: %v", codec.Name(), err)
+		}
+		msg, err = codec.Decode(data)
+		if err != nil || msg.Keys == nil || !reflect.DeepEqual(*msg.Keys, *keys) {
+			t.Fatalf("[%s] Keys round trip failed: %v %+v", codec.Name(), err, msg.Keys)
+		}
+	}
+}
+
+func TestTunnelCodecNegotiation(t *testing.T) {
+	network := testnet.NewNetwork()
+
+	// A KD that selects CBOR and echoes DTLS with a byte appended
+	conn, err := network.Listen("10.0.0.1:4433")
+	if err != nil {
+		t.Fatalf("Error creating KD: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if buf[0] == tunnelNegotiationMarker {
+				conn.WriteTo(encodeCodecNames([]string{"cbor"}), addr)
+				continue
+			}
+
+			msg, err := CBORCodec.Decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			reply, _ := CBORCodec.Encode(TunnelMessage{DTLS: append(msg.DTLS, 0x01)})
+			conn.WriteTo(reply, addr)
+		}
+	}()
+
+	md := make(MDDChan)
+	fwd := NewForwarder(conn.LocalAddr(), func() (Transport, error) {
+		return network.Listen("10.0.0.2:0")
+	})
+	fwd.MD = md
+	fwd.Codecs = []TunnelCodec{CBORCodec, StandardCodec}
+
+	err = fwd.Send(1, []byte{0x16, 0x00})
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+
+	select {
+	case pkt := <-md:
+		if !bytes.Equal(pkt.msg, []byte{0x16, 0x00, 0x01}) {
+			t.Fatalf("Incorrect packet message: %x", pkt.msg)
+		}
+	case <-time.After(codecNegotiationTimeout / 2):
+		t.Fatalf("Packet was not forwarded after negotiation")
+	}
+}
+
+func TestTunnelReplayProtection(t *testing.T) {
+	unkeyed, ok := LookupTunnelCodec("cbor+seq")
+	if !ok {
+		t.Fatalf("Sequenced codec not registered")
+	}
+
+	dtls := []byte{0x16, 0xfe, 0xfd, 0x00}
+	if _, err := unkeyed.Encode(TunnelMessage{DTLS: dtls, Seq: 1}); err == nil {
+		t.Fatalf("Encoded a message without a key")
+	}
+
+	md := KeyedCodec(unkeyed, testTunnelKey, TunnelEndMD)
+	kd := KeyedCodec(unkeyed, testTunnelKey, TunnelEndKD)
+	if _, err := md.Encode(TunnelMessage{DTLS: dtls}); err == nil {
+		t.Fatalf("Encoded a message without a sequence number")
+	}
+	data, err := md.Encode(TunnelMessage{DTLS: dtls, Seq: 7, Epoch: 3})
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	msg, err := kd.Decode(data)
+	if err != nil || msg.Seq != 7 || msg.Epoch != 3 || !bytes.Equal(msg.DTLS, dtls) {
+		t.Fatalf("Round trip failed: %+v %v", msg, err)
+	}
+
+	// A rewritten sequence number, a message under another key, or one
+	// reflected back to its sender is refused
+	tampered := append([]byte{}, data...)
+	tampered[15] = 8
+	if _, err := kd.Decode(tampered); err == nil {
+		t.Fatalf("Decoded a message with a rewritten sequence number")
+	}
+	if _, err := KeyedCodec(unkeyed, bytes.Repeat([]byte{0xff}, 16), TunnelEndKD).Decode(data); err == nil {
+		t.Fatalf("Decoded a message under the wrong key")
+	}
+	if _, err := md.Decode(data); err == nil {
+		t.Fatalf("Decoded a message reflected back to its sender")
+	}
+
+	// Negotiation is authenticated the same way
+	offer, err := encodeNegotiation([]string{"cbor+seq"}, 3, testTunnelKey, TunnelEndMD)
+	if err != nil {
+		t.Fatalf("Error encoding offer: %v", err)
+	}
+	names, epoch, err := decodeNegotiation(offer, testTunnelKey, TunnelEndMD)
+	if err != nil || epoch != 3 || !reflect.DeepEqual(names, []string{"cbor+seq"}) {
+		t.Fatalf("Offer round trip failed: %v %d %v", names, epoch, err)
+	}
+	if _, _, err := decodeNegotiation(offer, testTunnelKey, TunnelEndKD); err == nil {
+		t.Fatalf("Offer taken as an answer")
+	}
+	if _, _, err := decodeNegotiation(encodeCodecNames([]string{"standard"}), testTunnelKey, TunnelEndKD); err == nil {
+		t.Fatalf("Unauthenticated answer accepted")
+	}
+
+	// Without a key, the forwarder doesn't offer sequenced codecs
+	fwd := NewForwarder(nil, nil)
+	fwd.Codecs = []TunnelCodec{unkeyed, StandardCodec}
+	if offered := fwd.offered(); len(offered) != 1 || offered[0] != StandardCodec {
+		t.Fatalf("Sequenced codec offered without a key: %v", offered)
+	}
+	fwd.TunnelKey = testTunnelKey
+	if offered := fwd.offered(); len(offered) != 2 || !isSequenced(offered[0]) {
+		t.Fatalf("Sequenced codec not offered with a key: %v", offered)
+	}
+
+	var window replayWindow
+	for _, c := range []struct {
+		seq    uint64
+		accept bool
+	}{
+		{0, false},
+		{1, true},
+		{3, true},
+		{1, false},
+		{2, true},
+		{100, true},
+		{36, false}, // Outside the window
+		{37, true},
+		{37, false},
+		{200, true},
+		{100, false},
+	} {
+		if window.accept(c.seq) != c.accept {
+			t.Fatalf("Incorrect replay decision for %d", c.seq)
+		}
+	}
+}
+
+var testTunnelKey = []byte("0123456789abcdef")
+
+type keysChan chan HBHKeys
+
+func (mdd keysChan) Send(assocID AssociationID, msg []byte) error {
+	return nil
+}
+
+func (mdd keysChan) SetKeys(assocID AssociationID, keys HBHKeys) error {
+	mdd <- keys
+	return nil
+}
+
+func TestTunnelReplayAcrossReconnect(t *testing.T) {
+	network := testnet.NewNetwork()
+	unkeyed, _ := LookupTunnelCodec("cbor+seq")
+	codec := KeyedCodec(unkeyed, testTunnelKey, TunnelEndKD)
+
+	// A KD that answers each DTLS record with keys, and replays the first
+	// keys it sent once the tunnel has reconnected
+	conn, err := network.Listen("10.0.0.1:4433")
+	if err != nil {
+		t.Fatalf("Error creating KD: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 2048)
+		var captured []byte
+		offers := 0
+		sent := uint64(0)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if buf[0] == tunnelNegotiationMarker {
+				_, epoch, err := decodeNegotiation(buf[:n], testTunnelKey, TunnelEndMD)
+				if err != nil {
+					continue
+				}
+				offers += 1
+				sent = 0
+				answer, _ := encodeNegotiation([]string{codec.Name()}, epoch, testTunnelKey, TunnelEndKD)
+				conn.WriteTo(answer, addr)
+				if offers > 1 && captured != nil {
+					conn.WriteTo(captured, addr)
+				}
+				continue
+			}
+
+			msg, err := codec.Decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			sent += 1
+			keys := &HBHKeys{Profile: DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM, ClientWriteKey: []byte{byte(offers)}}
+			reply, _ := codec.Encode(TunnelMessage{Keys: keys, Epoch: msg.Epoch, Seq: sent})
+			if captured == nil {
+				captured = reply
+			}
+			conn.WriteTo(reply, addr)
+		}
+	}()
+
+	md := make(keysChan, 10)
+	fwd := NewForwarder(conn.LocalAddr(), func() (Transport, error) {
+		return network.Listen("10.0.0.2:0")
+	})
+	fwd.MD = md
+	fwd.Codecs = []TunnelCodec{unkeyed}
+	fwd.TunnelKey = testTunnelKey
+	defer fwd.Close(1)
+
+	recvKeys := func() HBHKeys {
+		select {
+		case keys := <-md:
+			return keys
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No keys from the KD")
+		}
+		return HBHKeys{}
+	}
+
+	fwd.Send(1, []byte{0x16, 0x01})
+	if keys := recvKeys(); keys.ClientWriteKey[0] != 1 {
+		t.Fatalf("Incorrect keys: %x", keys.ClientWriteKey)
+	}
+
+	// After the reconnect, the replayed keys have sequence number one, as
+	// the new transport's first message does, but an old epoch
+	fwd.tunnels[1].mu.Lock()
+	fwd.tunnels[1].conn.Close()
+	fwd.tunnels[1].mu.Unlock()
+	for i := 0; i < 100; i++ {
+		fwd.tunnels[1].mu.Lock()
+		ready := !fwd.tunnels[1].down && fwd.tunnels[1].codec != nil
+		fwd.tunnels[1].mu.Unlock()
+		if ready {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fwd.Send(1, []byte{0x16, 0x02})
+	if keys := recvKeys(); keys.ClientWriteKey[0] != 2 {
+		t.Fatalf("Keys from before the reconnect were accepted: %x", keys.ClientWriteKey)
+	}
+}
+
+func TestTunnelNegotiationFailsClosed(t *testing.T) {
+	unkeyed, _ := LookupTunnelCodec("cbor+seq")
+
+	// One KD answers offers with an unauthenticated selection of the
+	// standard codec, as an attacker spoofing it might, and the other
+	// doesn't answer at all.  Either way, the MD offers again rather than
+	// go without replay protection.
+	for _, answer := range []bool{true, false} {
+		network := testnet.NewNetwork()
+		conn, err := network.Listen("10.0.0.1:4433")
+		if err != nil {
+			t.Fatalf("Error creating KD: %v", err)
+		}
+
+		offers := make(chan bool, 100)
+		records := make(chan bool, 100)
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				_, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				if buf[0] != tunnelNegotiationMarker {
+					records <- true
+					continue
+				}
+
+				offers <- true
+				if answer {
+					conn.WriteTo(encodeCodecNames([]string{"standard"}), addr)
+				}
+			}
+		}()
+
+		fwd := NewForwarder(conn.LocalAddr(), func() (Transport, error) {
+			return network.Listen("10.0.0.2:0")
+		})
+		fwd.MD = make(MDDChan, 10)
+		fwd.Codecs = []TunnelCodec{unkeyed}
+		fwd.TunnelKey = testTunnelKey
+		fwd.Send(1, []byte{0x16, 0x01})
+
+		for i := 0; i < 2; i++ {
+			select {
+			case <-offers:
+			case <-time.After(2 * codecNegotiationTimeout):
+				t.Fatalf("Codecs not offered again (answer: %v)", answer)
+			}
+		}
 
-	echo.Stop()
+		fwd.tunnels[1].mu.Lock()
+		codec := fwd.tunnels[1].codec
+		fwd.tunnels[1].mu.Unlock()
+		if codec != nil {
+			t.Fatalf("Tunnel fell back to %s (answer: %v)", codec.Name(), answer)
+		}
+		select {
+		case <-records:
+			t.Fatalf("Record sent without a negotiated codec (answer: %v)", answer)
+		default:
+		}
+
+		fwd.Close(1)
+		conn.Close()
+	}
+}
+
+func TestTunnelNegotiationTimeout(t *testing.T) {
+	network := testnet.NewNetwork()
+	conn, err := network.Listen("10.0.0.2:5000")
+	if err != nil {
+		t.Fatalf("Error creating transport: %v", err)
+	}
+	defer conn.Close()
+
+	cbor, _ := LookupTunnelCodec("cbor")
+	fwd := NewForwarder(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4433}, nil)
+	fwd.Codecs = []TunnelCodec{cbor}
+
+	// A timer left over from an earlier offer doesn't settle the current one
+	tunnel := &kdTunnel{conn: conn, epoch: 2}
+	fwd.negotiationTimedOut(1, tunnel, 1)
+	if tunnel.codec != nil {
+		t.Fatalf("Earlier offer's timer selected %s", tunnel.codec.Name())
+	}
+	fwd.negotiationTimedOut(1, tunnel, 2)
+	if tunnel.codec != StandardCodec {
+		t.Fatalf("No fallback without sequenced codecs: %v", tunnel.codec)
+	}
+}
+
+func TestTunnelOutage(t *testing.T) {
+	network := testnet.NewNetwork()
+
+	md := make(MDDChan, 10)
+	echo, err := NewKdEchoServer(network, "10.0.0.1:4433")
+	if err != nil {
+		t.Fatalf("Error creating kd echo server: %v", err)
+	}
+	defer echo.Stop()
+
+	outage := make(chan bool, 1)
+	outage <- false
+	fwd := NewForwarder(echo.Addr(), func() (Transport, error) {
+		down := <-outage
+		outage <- down
+		if down {
+			return nil, fmt.Errorf("KD unreachable")
+		}
+		return network.Listen("10.0.0.2:0")
+	})
+	fwd.MD = md
+	fwd.QueueLimit = 2
+
+	fwd.Send(1, []byte{0x14, 0x00})
+	<-md
+
+	// Break the tunnel and keep it from coming back for a while
+	<-outage
+	outage <- true
+	fwd.tunnels[1].conn.Close()
+	for _, flight := range []byte{0x01, 0x02, 0x03} {
+		if err := fwd.Send(1, []byte{0x16, flight}); err != nil {
+			t.Fatalf("Record not held during the outage: %v", err)
+		}
+	}
+
+	<-outage
+	outage <- false
+	for _, flight := range []byte{0x02, 0x03} {
+		select {
+		case pkt := <-md:
+			if !bytes.Equal(pkt.msg, []byte{0x16, flight, 0x01}) {
+				t.Fatalf("Incorrect record after the outage: %x", pkt.msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Held record not sent after the outage")
+		}
+	}
+
+	fwd.Close(1)
+}
+
+func TestTunnelCompression(t *testing.T) {
+	codecs, err := ParseTunnelCodecs("protobuf+deflate,cbor+deflate+seq")
+	if err != nil || len(codecs) != 2 {
+		t.Fatalf("Compressed codecs not registered: %v", err)
+	}
+
+	keys := &HBHKeys{
+		Profile:        DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM,
+		ClientWriteKey: bytes.Repeat([]byte{0x01}, 16),
+		ServerWriteKey: bytes.Repeat([]byte{0x02}, 16),
+		MasterSalt:     bytes.Repeat([]byte{0x03}, 12),
+	}
+	large := bytes.Repeat([]byte{0x16, 0xfe, 0xfd, 0x00}, 1000)
+	for _, codec := range codecs {
+		codec, peer := KeyedCodec(codec, testTunnelKey, TunnelEndMD), KeyedCodec(codec, testTunnelKey, TunnelEndKD)
+		for _, tmsg := range []TunnelMessage{{Keys: keys, Seq: 1}, {DTLS: large, Seq: 2}} {
+			data, err := codec.Encode(tmsg)
+			if err != nil {
+				t.Fatalf("Error encoding with %s: %v", codec.Name(), err)
+			}
+			if tmsg.DTLS != nil && len(data) >= len(large) {
+				t.Fatalf("Large message not compressed by %s: %d bytes", codec.Name(), len(data))
+			}
+
+			msg, err := peer.Decode(data)
+			if err != nil || !bytes.Equal(msg.DTLS, tmsg.DTLS) || (tmsg.Keys != nil && !bytes.Equal(msg.Keys.MasterSalt, keys.MasterSalt)) {
+				t.Fatalf("Round trip with %s failed: %+v %v", codec.Name(), msg, err)
+			}
+		}
+	}
+
+	// Messages that inflate too far are refused
+	bomb, err := CompressedCodec(StandardCodec).Encode(TunnelMessage{DTLS: make([]byte, 2*maxInflatedMessage)})
+	if err != nil || bomb[0] != tunnelMessageDeflated {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if _, err := CompressedCodec(StandardCodec).Decode(bomb); err == nil {
+		t.Fatalf("Decoded an oversized message")
+	}
 }
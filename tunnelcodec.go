@@ -0,0 +1,480 @@
+package percy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// A message on the tunnel between the MD and the KD: either a DTLS record to
+// or from the client, or hop-by-hop keys for the MD
+type TunnelMessage struct {
+	DTLS []byte
+	Keys *HBHKeys
+	Seq  uint64 // Only carried by sequenced codecs
+
+	// Only carried by sequenced codecs; see tunnelreplay.go
+	Epoch uint64
+}
+
+// TunnelCodec encodes tunnel messages on the wire.  The standard codec frames
+// them as the draft does (raw DTLS records, and HBHKeys structs); custom KD
+// deployments can negotiate another one at tunnel setup.
+type TunnelCodec interface {
+	Name() string
+	Encode(msg TunnelMessage) ([]byte, error)
+	Decode(data []byte) (TunnelMessage, error)
+}
+
+var (
+	StandardCodec TunnelCodec = standardCodec{}
+	ProtobufCodec TunnelCodec = protobufCodec{}
+	CBORCodec     TunnelCodec = cborCodec{}
+
+	tunnelCodecs = map[string]TunnelCodec{}
+)
+
+func init() {
+	for _, codec := range []TunnelCodec{StandardCodec, ProtobufCodec, CBORCodec} {
+		RegisterTunnelCodec(codec)
+		RegisterTunnelCodec(SequencedCodec(codec))
+		RegisterTunnelCodec(CompressedCodec(codec))
+		RegisterTunnelCodec(SequencedCodec(CompressedCodec(codec)))
+	}
+}
+
+// Makes a codec available for negotiation by name
+func RegisterTunnelCodec(codec TunnelCodec) {
+	tunnelCodecs[codec.Name()] = codec
+}
+
+func LookupTunnelCodec(name string) (TunnelCodec, bool) {
+	codec, ok := tunnelCodecs[name]
+	return codec, ok
+}
+
+// Parses a comma-separated list of codec names, e.g., "cbor,standard"
+func ParseTunnelCodecs(names string) ([]TunnelCodec, error) {
+	codecs := []TunnelCodec{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+
+		codec, ok := LookupTunnelCodec(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown tunnel codec %q", name)
+		}
+		codecs = append(codecs, codec)
+	}
+	return codecs, nil
+}
+
+//////////
+
+// Negotiation messages are marked so that they can't be mistaken for DTLS or
+// HBHKeys.  The MD offers a list of codec names, and the KD answers with a
+// list holding the one it selected.
+const (
+	tunnelNegotiationMarker = 0xFE
+)
+
+func encodeCodecNames(names []string) []byte {
+	msg := []byte{tunnelNegotiationMarker}
+	for _, name := range names {
+		msg = append(msg, byte(len(name)))
+		msg = append(msg, name...)
+	}
+	return msg
+}
+
+func decodeCodecNames(msg []byte) ([]string, error) {
+	if len(msg) == 0 || msg[0] != tunnelNegotiationMarker {
+		return nil, fmt.Errorf("Not a codec negotiation message")
+	}
+
+	names := []string{}
+	for rest := msg[1:]; len(rest) > 0; {
+		n := int(rest[0])
+		if len(rest) < 1+n {
+			return nil, fmt.Errorf("Truncated codec name")
+		}
+		names = append(names, string(rest[1:1+n]))
+		rest = rest[1+n:]
+	}
+	return names, nil
+}
+
+//////////
+
+type standardCodec struct{}
+
+func (standardCodec) Name() string {
+	return "standard"
+}
+
+func (standardCodec) Encode(msg TunnelMessage) ([]byte, error) {
+	if msg.Keys != nil {
+		keys := *msg.Keys
+		keys.Marker = 0xFF
+		return syntax.Marshal(keys)
+	}
+	return msg.DTLS, nil
+}
+
+func (standardCodec) Decode(data []byte) (TunnelMessage, error) {
+	switch packetClass(data) {
+	case packetClassDTLS:
+		return TunnelMessage{DTLS: data}, nil
+
+	case packetClassHBHKey:
+		var keys HBHKeys
+		_, err := syntax.Unmarshal(data, &keys)
+		if err != nil {
+			return TunnelMessage{}, err
+		}
+		return TunnelMessage{Keys: &keys}, nil
+	}
+
+	return TunnelMessage{}, fmt.Errorf("Unknown tunnel message type")
+}
+
+//////////
+
+// Protocol buffers encoding of:
+//
+//	message TunnelMessage {
+//	  bytes dtls = 1;
+//	  HBHKeys keys = 2;
+//	}
+//
+//	message HBHKeys {
+//	  uint32 profile = 1;
+//	  bytes client_write_key = 2;
+//	  bytes server_write_key = 3;
+//	  bytes master_salt = 4;
+//	}
+type protobufCodec struct{}
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+func protoAppendBytes(buf []byte, field int, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|protoBytes))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func protoAppendVarint(buf []byte, field int, value uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|protoVarint))
+	return binary.AppendUvarint(buf, value)
+}
+
+// Calls fn for each field in a message, with either the varint value or the
+// bytes of a length-delimited field.  Fixed-width fields are skipped.
+func protoFields(data []byte, fn func(field int, value uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("Malformed protobuf field key")
+		}
+		data = data[n:]
+
+		field := int(key >> 3)
+		var value uint64
+		var bytes []byte
+		switch key & 7 {
+		case protoVarint:
+			value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("Malformed protobuf varint")
+			}
+		case protoBytes:
+			length, m := binary.Uvarint(data)
+			if m <= 0 || uint64(len(data)-m) < length {
+				return fmt.Errorf("Malformed protobuf length")
+			}
+			bytes = data[m : m+int(length)]
+			n = m + int(length)
+		case protoFixed64:
+			n = 8
+		case protoFixed32:
+			n = 4
+		default:
+			return fmt.Errorf("Unsupported protobuf wire type %d", key&7)
+		}
+
+		if len(data) < n {
+			return fmt.Errorf("Truncated protobuf field")
+		}
+		data = data[n:]
+
+		err := fn(field, value, bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Encode(msg TunnelMessage) ([]byte, error) {
+	if msg.Keys != nil {
+		keys := protoAppendVarint(nil, 1, uint64(msg.Keys.Profile))
+		keys = protoAppendBytes(keys, 2, msg.Keys.ClientWriteKey)
+		keys = protoAppendBytes(keys, 3, msg.Keys.ServerWriteKey)
+		keys = protoAppendBytes(keys, 4, msg.Keys.MasterSalt)
+		return protoAppendBytes(nil, 2, keys), nil
+	}
+	return protoAppendBytes(nil, 1, msg.DTLS), nil
+}
+
+func (protobufCodec) Decode(data []byte) (TunnelMessage, error) {
+	msg := TunnelMessage{}
+	err := protoFields(data, func(field int, _ uint64, value []byte) error {
+		switch field {
+		case 1:
+			msg.DTLS = value
+		case 2:
+			keys := &HBHKeys{Marker: 0xFF}
+			msg.Keys = keys
+			return protoFields(value, func(field int, profile uint64, value []byte) error {
+				switch field {
+				case 1:
+					keys.Profile = ProtectionProfile(profile)
+				case 2:
+					keys.ClientWriteKey = value
+				case 3:
+					keys.ServerWriteKey = value
+				case 4:
+					keys.MasterSalt = value
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return TunnelMessage{}, err
+	}
+
+	if msg.DTLS == nil && msg.Keys == nil {
+		return TunnelMessage{}, fmt.Errorf("Empty tunnel message")
+	}
+	return msg, nil
+}
+
+//////////
+
+// CBOR encoding, as a map with integer keys:
+//
+//	{1: dtls} or {2: {1: profile, 2: client_write_key,
+//	                  3: server_write_key, 4: master_salt}}
+type cborCodec struct{}
+
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+)
+
+func cborAppendHead(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= 0xff:
+		return append(buf, major|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(buf, major|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(buf, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major|27), n)
+	}
+}
+
+func cborAppendBytes(buf []byte, value []byte) []byte {
+	return append(cborAppendHead(buf, cborBytes, uint64(len(value))), value...)
+}
+
+// Reads the head of a data item, returning its major type and argument
+func cborReadHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, fmt.Errorf("Truncated CBOR item")
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	if info < 24 {
+		return major, uint64(info), data, nil
+	}
+	if info > 27 {
+		return 0, 0, nil, fmt.Errorf("Unsupported CBOR argument %d", info)
+	}
+
+	size := 1 << (info - 24)
+	if len(data) < size {
+		return 0, 0, nil, fmt.Errorf("Truncated CBOR item")
+	}
+
+	var n uint64
+	for _, b := range data[:size] {
+		n = n<<8 | uint64(b)
+	}
+	return major, n, data[size:], nil
+}
+
+// Reads an item of the given major type; for byte strings, the contents are
+// returned as well
+func cborRead(data []byte, want byte) (uint64, []byte, []byte, error) {
+	major, n, rest, err := cborReadHead(data)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if major != want {
+		return 0, nil, nil, fmt.Errorf("Unexpected CBOR major type %d", major)
+	}
+
+	if major != cborBytes {
+		return n, nil, rest, nil
+	}
+	if uint64(len(rest)) < n {
+		return 0, nil, nil, fmt.Errorf("Truncated CBOR byte string")
+	}
+	return n, rest[:n], rest[n:], nil
+}
+
+// Skips a data item, so that unknown map entries can be ignored
+func cborSkip(data []byte) ([]byte, error) {
+	major, n, rest, err := cborReadHead(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint, cborNegInt:
+		return rest, nil
+	case cborBytes, cborText:
+		if uint64(len(rest)) < n {
+			return nil, fmt.Errorf("Truncated CBOR string")
+		}
+		return rest[n:], nil
+	case cborArray, cborMap:
+		if major == cborMap {
+			n *= 2
+		}
+		for i := uint64(0); i < n; i++ {
+			rest, err = cborSkip(rest)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+	}
+	return nil, fmt.Errorf("Unsupported CBOR major type %d", major)
+}
+
+// Calls fn for each entry of a map with integer keys, which reads the value
+// and returns what follows it
+func cborMapEntries(data []byte, fn func(key uint64, value []byte) ([]byte, error)) ([]byte, error) {
+	count, _, rest, err := cborRead(data, cborMap)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < count; i++ {
+		var key uint64
+		key, _, rest, err = cborRead(rest, cborUint)
+		if err != nil {
+			return nil, err
+		}
+
+		rest, err = fn(key, rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rest, nil
+}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Encode(msg TunnelMessage) ([]byte, error) {
+	buf := cborAppendHead(nil, cborMap, 1)
+	if msg.Keys != nil {
+		buf = cborAppendHead(buf, cborUint, 2)
+		buf = cborAppendHead(buf, cborMap, 4)
+		buf = cborAppendHead(buf, cborUint, 1)
+		buf = cborAppendHead(buf, cborUint, uint64(msg.Keys.Profile))
+		buf = cborAppendHead(buf, cborUint, 2)
+		buf = cborAppendBytes(buf, msg.Keys.ClientWriteKey)
+		buf = cborAppendHead(buf, cborUint, 3)
+		buf = cborAppendBytes(buf, msg.Keys.ServerWriteKey)
+		buf = cborAppendHead(buf, cborUint, 4)
+		buf = cborAppendBytes(buf, msg.Keys.MasterSalt)
+		return buf, nil
+	}
+
+	buf = cborAppendHead(buf, cborUint, 1)
+	return cborAppendBytes(buf, msg.DTLS), nil
+}
+
+func (cborCodec) Decode(data []byte) (TunnelMessage, error) {
+	msg := TunnelMessage{}
+	_, err := cborMapEntries(data, func(key uint64, value []byte) ([]byte, error) {
+		switch key {
+		case 1:
+			_, dtls, rest, err := cborRead(value, cborBytes)
+			msg.DTLS = dtls
+			return rest, err
+
+		case 2:
+			keys := &HBHKeys{Marker: 0xFF}
+			msg.Keys = keys
+			return cborMapEntries(value, func(key uint64, value []byte) ([]byte, error) {
+				var profile uint64
+				var rest []byte
+				var err error
+				switch key {
+				case 1:
+					profile, _, rest, err = cborRead(value, cborUint)
+					keys.Profile = ProtectionProfile(profile)
+				case 2:
+					_, keys.ClientWriteKey, rest, err = cborRead(value, cborBytes)
+				case 3:
+					_, keys.ServerWriteKey, rest, err = cborRead(value, cborBytes)
+				case 4:
+					_, keys.MasterSalt, rest, err = cborRead(value, cborBytes)
+				default:
+					rest, err = cborSkip(value)
+				}
+				return rest, err
+			})
+		}
+		return cborSkip(value)
+	})
+	if err != nil {
+		return TunnelMessage{}, err
+	}
+
+	if msg.DTLS == nil && msg.Keys == nil {
+		return TunnelMessage{}, fmt.Errorf("Empty tunnel message")
+	}
+	return msg, nil
+}
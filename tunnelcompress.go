@@ -0,0 +1,93 @@
+package percy
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// When a standby MD takes over, or a large conference is provisioned, the
+// KD sends keys for thousands of associations at once, and the time that
+// takes is time clients spend without media.  So any codec can be
+// negotiated with compression (named with a "+deflate" suffix, e.g.,
+// "cbor+deflate", or "cbor+deflate+seq" with replay protection).  Each
+// message is prefixed with a byte saying whether the rest is deflated
+// (RFC 1951).  Only messages of at least compressionThreshold bytes are
+// compressed, and only if that makes them smaller; DTLS records are mostly
+// ciphertext, and don't shrink.
+
+const (
+	compressedCodecSuffix = "+deflate"
+	compressionThreshold  = 256
+	maxInflatedMessage    = 1 << 20
+
+	tunnelMessagePlain    = 0
+	tunnelMessageDeflated = 1
+)
+
+type compressedCodec struct {
+	inner TunnelCodec
+}
+
+// Returns the compressed variant of a codec
+func CompressedCodec(inner TunnelCodec) TunnelCodec {
+	return compressedCodec{inner}
+}
+
+func (codec compressedCodec) Name() string {
+	return codec.inner.Name() + compressedCodecSuffix
+}
+
+func (codec compressedCodec) Encode(msg TunnelMessage) ([]byte, error) {
+	data, err := codec.inner.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) >= compressionThreshold {
+		var buf bytes.Buffer
+		buf.WriteByte(tunnelMessageDeflated)
+		w, err := flate.NewWriter(&buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if buf.Len() <= len(data) {
+			return buf.Bytes(), nil
+		}
+	}
+	return append([]byte{tunnelMessagePlain}, data...), nil
+}
+
+func (codec compressedCodec) Decode(data []byte) (TunnelMessage, error) {
+	if len(data) == 0 {
+		return TunnelMessage{}, fmt.Errorf("Empty compressed tunnel message")
+	}
+
+	switch data[0] {
+	case tunnelMessagePlain:
+		return codec.inner.Decode(data[1:])
+
+	case tunnelMessageDeflated:
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		defer r.Close()
+
+		// Don't let a small message inflate without bound
+		inflated, err := io.ReadAll(io.LimitReader(r, maxInflatedMessage+1))
+		if err != nil {
+			return TunnelMessage{}, err
+		}
+		if len(inflated) > maxInflatedMessage {
+			return TunnelMessage{}, fmt.Errorf("Compressed tunnel message too large")
+		}
+		return codec.inner.Decode(inflated)
+	}
+
+	return TunnelMessage{}, fmt.Errorf("Unknown tunnel compression %d", data[0])
+}
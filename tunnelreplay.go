@@ -0,0 +1,249 @@
+package percy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Tunnel messages carry nothing that stops a captured message from being
+// sent again, e.g., stale keys after a rotation, or a DTLS record that
+// confuses the handshake.  Over transports that don't protect against this
+// themselves, the MD and KD can negotiate a sequenced variant of any codec
+// (named with a "+seq" suffix, e.g., "cbor+seq").  Each message is then
+// prefixed with a 64-bit epoch and a 64-bit sequence number, and the
+// receiver drops any it has seen before, or that is older than its replay
+// window.
+//
+// The MD picks a random epoch each time it negotiates a codec, i.e., for
+// each transport the tunnel has had, and sequence numbers count from one in
+// each direction within it.  The KD answers with the epoch of the MD's
+// messages on that transport, and the MD drops messages with any other, so
+// that nothing captured before a reconnect is accepted after it, even
+// though the sequence numbers start over.
+//
+// The epoch and sequence number would be no use if an attacker could
+// rewrite them, so a sequenced codec needs a key shared by the MD and KD
+// (UDPForwarder.TunnelKey), and each message ends with an HMAC-SHA256 tag,
+// truncated to sequenceTagSize bytes, over the direction it was sent in
+// ("md->kd" or "kd->md"), the epoch, the sequence number and the encoded
+// message.  Messages whose tag doesn't check are dropped before their
+// sequence number is recorded, and with the direction in the tag, the MD's
+// own messages can't be reflected back to it.
+//
+// Negotiation is authenticated the same way, so that replay protection
+// can't be negotiated away.  With a key, an offer is the marker, the epoch,
+// a tag over the direction (with " codecs" appended), the epoch and the
+// list of names, then the list; the KD answers in kind, with the MD's
+// epoch.  Once a sequenced codec is on offer, the MD never falls back to
+// the standard codec: if the answer doesn't check, or doesn't come, it
+// starts the tunnel over.
+
+const (
+	sequencedCodecSuffix = "+seq"
+	replayWindowSize     = 64
+	sequenceTagSize      = 16
+	minTunnelKeySize     = 16
+)
+
+// Which end of a tunnel a keyed codec is used at
+type TunnelEnd uint8
+
+const (
+	TunnelEndMD TunnelEnd = iota
+	TunnelEndKD
+)
+
+// Labels the messages sent from an end
+func (end TunnelEnd) direction() string {
+	if end == TunnelEndKD {
+		return "kd->md"
+	}
+	return "md->kd"
+}
+
+func (end TunnelEnd) peer() TunnelEnd {
+	if end == TunnelEndKD {
+		return TunnelEndMD
+	}
+	return TunnelEndKD
+}
+
+type sequencedCodec struct {
+	inner TunnelCodec
+	key   []byte
+	end   TunnelEnd
+}
+
+// Returns the sequenced variant of a codec.  It can only encode and decode
+// messages once it has a key; see KeyedCodec.
+func SequencedCodec(inner TunnelCodec) TunnelCodec {
+	return sequencedCodec{inner: inner}
+}
+
+// Returns a sequenced codec that authenticates the messages it encodes as
+// sent from end, and those it decodes as sent from the other end, under
+// key.  Other codecs are returned as they are.
+func KeyedCodec(codec TunnelCodec, key []byte, end TunnelEnd) TunnelCodec {
+	sc, ok := codec.(sequencedCodec)
+	if !ok {
+		return codec
+	}
+	sc.key, sc.end = key, end
+	return sc
+}
+
+func (codec sequencedCodec) Name() string {
+	return codec.inner.Name() + sequencedCodecSuffix
+}
+
+// Computes the tag over a label and the parts of a message
+func tunnelTag(key []byte, label string, parts ...[]byte) ([]byte, error) {
+	if len(key) < minTunnelKeySize {
+		return nil, fmt.Errorf("Tunnel key must be at least %d bytes", minTunnelKeySize)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)[:sequenceTagSize], nil
+}
+
+func (codec sequencedCodec) Encode(msg TunnelMessage) ([]byte, error) {
+	if msg.Seq == 0 {
+		return nil, fmt.Errorf("Sequenced tunnel message without a sequence number")
+	}
+
+	data, err := codec.inner.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	prefix := binary.BigEndian.AppendUint64(nil, msg.Epoch)
+	prefix = binary.BigEndian.AppendUint64(prefix, msg.Seq)
+	tag, err := tunnelTag(codec.key, codec.end.direction(), prefix, data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append(prefix, data...)
+	return append(out, tag...), nil
+}
+
+func (codec sequencedCodec) Decode(data []byte) (TunnelMessage, error) {
+	if len(data) < 16+sequenceTagSize {
+		return TunnelMessage{}, fmt.Errorf("Truncated sequenced tunnel message")
+	}
+
+	prefix, body := data[:16], data[16:len(data)-sequenceTagSize]
+	tag, err := tunnelTag(codec.key, codec.end.peer().direction(), prefix, body)
+	if err != nil {
+		return TunnelMessage{}, err
+	}
+	if !hmac.Equal(tag, data[len(data)-sequenceTagSize:]) {
+		return TunnelMessage{}, fmt.Errorf("Sequenced tunnel message failed authentication")
+	}
+
+	msg, err := codec.inner.Decode(body)
+	if err != nil {
+		return TunnelMessage{}, err
+	}
+	msg.Epoch = binary.BigEndian.Uint64(prefix[:8])
+	msg.Seq = binary.BigEndian.Uint64(prefix[8:16])
+	return msg, nil
+}
+
+// Encodes a negotiation message sent from end, authenticated along with the
+// epoch if there is a key
+func encodeNegotiation(names []string, epoch uint64, key []byte, from TunnelEnd) ([]byte, error) {
+	list := encodeCodecNames(names)
+	if len(key) == 0 {
+		return list, nil
+	}
+
+	prefix := binary.BigEndian.AppendUint64(nil, epoch)
+	tag, err := tunnelTag(key, from.direction()+" codecs", prefix, list[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	msg := append([]byte{tunnelNegotiationMarker}, prefix...)
+	msg = append(msg, tag...)
+	return append(msg, list[1:]...), nil
+}
+
+// Decodes a negotiation message sent from end, checking its tag if there is
+// a key.  Returns the names and epoch it carries.
+func decodeNegotiation(msg []byte, key []byte, from TunnelEnd) ([]string, uint64, error) {
+	if len(key) == 0 {
+		names, err := decodeCodecNames(msg)
+		return names, 0, err
+	}
+	if len(msg) < 1+8+sequenceTagSize || msg[0] != tunnelNegotiationMarker {
+		return nil, 0, fmt.Errorf("Truncated codec negotiation message")
+	}
+
+	prefix, tag, list := msg[1:9], msg[9:9+sequenceTagSize], msg[9+sequenceTagSize:]
+	expected, err := tunnelTag(key, from.direction()+" codecs", prefix, list)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !hmac.Equal(tag, expected) {
+		return nil, 0, fmt.Errorf("Codec negotiation message failed authentication")
+	}
+
+	names, err := decodeCodecNames(append([]byte{tunnelNegotiationMarker}, list...))
+	return names, binary.BigEndian.Uint64(prefix), err
+}
+
+// Draws a random epoch for a tunnel's transport
+func newTunnelEpoch() (uint64, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func isSequenced(codec TunnelCodec) bool {
+	_, ok := codec.(sequencedCodec)
+	return ok
+}
+
+// Tracks the sequence numbers received on a tunnel, as SRTP does (RFC 3711,
+// Section 3.3.2)
+type replayWindow struct {
+	top    uint64 // Highest sequence number received
+	bitmap uint64 // Bit i is set if top-i has been received
+}
+
+// Records a sequence number, and reports whether it's new
+func (rw *replayWindow) accept(seq uint64) bool {
+	switch {
+	case seq == 0:
+		return false
+
+	case seq > rw.top:
+		if shift := seq - rw.top; shift < replayWindowSize {
+			rw.bitmap = rw.bitmap<<shift | 1
+		} else {
+			rw.bitmap = 1
+		}
+		rw.top = seq
+		return true
+
+	case rw.top-seq >= replayWindowSize:
+		return false
+
+	default:
+		bit := uint64(1) << (rw.top - seq)
+		if rw.bitmap&bit != 0 {
+			return false
+		}
+		rw.bitmap |= bit
+		return true
+	}
+}
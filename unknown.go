@@ -0,0 +1,125 @@
+package percy
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Packets that aren't STUN, DTLS, SRTP or SRTCP are counted by source, and a
+// few of them are kept as samples, so that operators can tell what is
+// hitting the media port: scanners, misconfigured clients, or a protocol the
+// MD doesn't speak yet.
+
+const (
+	unknownSampleRingSize = 64
+	unknownSampleBytes    = 64   // Only the start of each payload is kept
+	maxUnknownSources     = 1024 // Sources beyond this are only counted in total
+)
+
+type UnknownSource struct {
+	Address   string    `json:"address"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type UnknownSample struct {
+	Time    time.Time `json:"time"`
+	Address string    `json:"address"`
+	Length  int       `json:"length"`
+	Payload string    `json:"payload"` // Hex, truncated
+}
+
+type UnknownTraffic struct {
+	Sources          []UnknownSource `json:"sources"`
+	Samples          []UnknownSample `json:"samples"`
+	UntrackedPackets uint64          `json:"untracked_packets,omitempty"` // From sources over the limit
+}
+
+type unknownTraffic struct {
+	mu        sync.Mutex
+	sources   map[string]*UnknownSource
+	untracked uint64
+	ring      []UnknownSample
+	next      int
+}
+
+func newUnknownTraffic() *unknownTraffic {
+	return &unknownTraffic{
+		sources: map[string]*UnknownSource{},
+		ring:    make([]UnknownSample, 0, unknownSampleRingSize),
+	}
+}
+
+func (ut *unknownTraffic) record(addr net.Addr, msg []byte, now time.Time) {
+	key := addr.String()
+	payload := msg
+	if len(payload) > unknownSampleBytes {
+		payload = payload[:unknownSampleBytes]
+	}
+	sample := UnknownSample{Time: now, Address: key, Length: len(msg), Payload: hex.EncodeToString(payload)}
+
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	source, ok := ut.sources[key]
+	if !ok {
+		if len(ut.sources) >= maxUnknownSources {
+			ut.untracked += 1
+			return
+		}
+
+		log.Printf("Unknown packet type received from %v", addr)
+		source = &UnknownSource{Address: key, FirstSeen: now}
+		ut.sources[key] = source
+	}
+	source.Packets += 1
+	source.Bytes += uint64(len(msg))
+	source.LastSeen = now
+
+	if len(ut.ring) < unknownSampleRingSize {
+		ut.ring = append(ut.ring, sample)
+		return
+	}
+	ut.ring[ut.next] = sample
+	ut.next = (ut.next + 1) % unknownSampleRingSize
+}
+
+// Returns the unknown traffic seen so far, busiest sources and oldest
+// samples first
+func (mdd *MDD) UnknownTraffic() *UnknownTraffic {
+	ut := mdd.unknown
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	report := &UnknownTraffic{
+		Sources:          make([]UnknownSource, 0, len(ut.sources)),
+		Samples:          make([]UnknownSample, 0, len(ut.ring)),
+		UntrackedPackets: ut.untracked,
+	}
+	for _, source := range ut.sources {
+		report.Sources = append(report.Sources, *source)
+	}
+	sort.Slice(report.Sources, func(i, j int) bool {
+		return report.Sources[i].Packets > report.Sources[j].Packets
+	})
+
+	report.Samples = append(report.Samples, ut.ring[ut.next:]...)
+	report.Samples = append(report.Samples, ut.ring[:ut.next]...)
+	return report
+}
+
+func (mdd *MDD) ClearUnknownTraffic() {
+	ut := mdd.unknown
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	ut.sources = map[string]*UnknownSource{}
+	ut.untracked = 0
+	ut.ring = ut.ring[:0]
+	ut.next = 0
+}
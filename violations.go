@@ -0,0 +1,198 @@
+package percy
+
+import (
+	"encoding/binary"
+)
+
+// Broken client stacks send packets that bend the specs without breaking
+// them outright: STUN attributes after FINGERPRINT, RTP header extensions
+// that run past their end, RTCP padding in the middle of a compound packet.
+// By default the MD accepts these, but counts each kind of violation (the
+// parse_violations stat), so that the clients responsible can be found.
+// With StrictParsing, packets with any violation are dropped instead.
+//
+// Packets too malformed to parse at all are dropped either way.  Only what
+// the MD can see is checked: the clear RTP header of SRTP, and RTCP once it
+// has been decrypted.
+
+type ParseViolation string
+
+const (
+	ViolationSTUNUnalignedLength     ParseViolation = "stun-unaligned-length"
+	ViolationSTUNTrailingBytes       ParseViolation = "stun-trailing-bytes"
+	ViolationSTUNAfterIntegrity      ParseViolation = "stun-attribute-after-integrity"
+	ViolationSTUNAfterFingerprint    ParseViolation = "stun-attribute-after-fingerprint"
+	ViolationRTPReservedPayloadType  ParseViolation = "rtp-reserved-payload-type"
+	ViolationRTPExtensionProfile     ParseViolation = "rtp-unknown-extension-profile"
+	ViolationRTPExtensionReservedID  ParseViolation = "rtp-extension-reserved-id"
+	ViolationRTPExtensionOverrun     ParseViolation = "rtp-extension-overrun"
+	ViolationRTCPPaddingNotLast      ParseViolation = "rtcp-padding-not-last"
+	ViolationRTCPInvalidPadding      ParseViolation = "rtcp-invalid-padding"
+	ViolationRTCPReportCountMismatch ParseViolation = "rtcp-report-count-mismatch"
+)
+
+// Returns the violations in a STUN message
+func stunViolations(msg []byte) []ParseViolation {
+	if len(msg) < STUN_HEADER_SIZE {
+		return nil
+	}
+
+	violations := []ParseViolation{}
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if length%4 != 0 {
+		violations = append(violations, ViolationSTUNUnalignedLength)
+	}
+	if len(msg) > STUN_HEADER_SIZE+length {
+		violations = append(violations, ViolationSTUNTrailingBytes)
+	} else if len(msg) < STUN_HEADER_SIZE+length {
+		return violations
+	}
+
+	integrity, fingerprint := false, false
+	for attrs := msg[STUN_HEADER_SIZE : STUN_HEADER_SIZE+length]; len(attrs) >= 4; {
+		attrType := STUNAttrType(binary.BigEndian.Uint16(attrs[0:2]))
+		switch {
+		case fingerprint:
+			violations = append(violations, ViolationSTUNAfterFingerprint)
+		case integrity && attrType != ATTR_FINGERPRINT:
+			violations = append(violations, ViolationSTUNAfterIntegrity)
+		}
+		integrity = integrity || attrType == ATTR_MESSAGE_INTEGRITY
+		fingerprint = fingerprint || attrType == ATTR_FINGERPRINT
+
+		skip := 4 + (int(binary.BigEndian.Uint16(attrs[2:4]))+3)/4*4
+		if skip > len(attrs) {
+			break
+		}
+		attrs = attrs[skip:]
+	}
+	return violations
+}
+
+// Returns the violations in an RTP header
+func rtpViolations(header *RTPHeader) []ParseViolation {
+	violations := []ParseViolation{}
+
+	// These conflict with RTCP packet types (RFC 5761, Section 4)
+	if header.PayloadType >= 64 && header.PayloadType <= 95 {
+		violations = append(violations, ViolationRTPReservedPayloadType)
+	}
+	if !header.Extension {
+		return violations
+	}
+
+	data := header.ExtensionData
+	switch {
+	case header.ExtensionProfile == 0xbede:
+		for i := 0; i < len(data); {
+			if data[i] == 0 {
+				i += 1
+				continue
+			}
+			if data[i]>>4 == 15 {
+				violations = append(violations, ViolationRTPExtensionReservedID)
+				break
+			}
+
+			i += 2 + int(data[i]&0x0f)
+			if i > len(data) {
+				violations = append(violations, ViolationRTPExtensionOverrun)
+			}
+		}
+
+	case header.ExtensionProfile&0xfff0 == 0x1000:
+		for i := 0; i < len(data); {
+			if data[i] == 0 {
+				i += 1
+				continue
+			}
+			if i+1 >= len(data) {
+				violations = append(violations, ViolationRTPExtensionOverrun)
+				break
+			}
+
+			i += 2 + int(data[i+1])
+			if i > len(data) {
+				violations = append(violations, ViolationRTPExtensionOverrun)
+			}
+		}
+
+	default:
+		violations = append(violations, ViolationRTPExtensionProfile)
+	}
+	return violations
+}
+
+// Returns the violations in a decrypted compound RTCP packet
+func rtcpViolations(msg []byte, headers []RTCPHeader) []ParseViolation {
+	violations := []ParseViolation{}
+	offset := 0
+	for i, header := range headers {
+		last := i == len(headers)-1
+		if header.Padding && !last {
+			violations = append(violations, ViolationRTCPPaddingNotLast)
+		}
+		if header.Padding && last {
+			if pad := int(msg[offset+header.Size-1]); pad == 0 || pad > header.Size-4 {
+				violations = append(violations, ViolationRTCPInvalidPadding)
+			}
+		}
+
+		count := int(header.Count)
+		switch {
+		case header.PacketType == RTCPTypeSR && header.Size < 28+24*count,
+			header.PacketType == RTCPTypeRR && header.Size < 8+24*count:
+			violations = append(violations, ViolationRTCPReportCountMismatch)
+		}
+		offset += header.Size
+	}
+	return violations
+}
+
+// Counts a packet's violations, and reports whether it should be processed
+func (mdd *MDD) conforms(violations []ParseViolation, trace *packetTrace) bool {
+	if len(violations) == 0 {
+		return true
+	}
+
+	mdd.mu.Lock()
+	for _, violation := range violations {
+		mdd.stats.violations[violation] += 1
+	}
+	mdd.mu.Unlock()
+
+	trace.log("parse", "violations: %v", violations)
+	if mdd.StrictParsing {
+		trace.log("route", "dropped in strict parsing mode")
+		return false
+	}
+	return true
+}
+
+// Checks the parts of a packet that can be checked before it's decrypted
+func (mdd *MDD) conformsOnArrival(class dtlsSRTPPacketClass, msg []byte, trace *packetTrace) bool {
+	switch class {
+	case packetClassSTUN:
+		return mdd.conforms(stunViolations(msg), trace)
+	case packetClassSRTP:
+		header, err := ParseRTPHeader(msg)
+		if err != nil {
+			return true
+		}
+		return mdd.conforms(rtpViolations(header), trace)
+	}
+	return true
+}
+
+// The caller holds mdd.mu
+func (mdd *MDD) violationStats() map[string]uint64 {
+	if len(mdd.stats.violations) == 0 {
+		return nil
+	}
+
+	stats := make(map[string]uint64, len(mdd.stats.violations))
+	for violation, count := range mdd.stats.violations {
+		stats[string(violation)] = count
+	}
+	return stats
+}
@@ -0,0 +1,90 @@
+package percy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bifurcation/percy/testnet"
+)
+
+func TestParseViolations(t *testing.T) {
+	request := NewBindingRequest(TransactionID{1, 2, 3}, "abcdefabcdefabcdefabcdef")
+	request.Add(ATTR_USERNAME, []byte("local:remote"))
+	request.AddMessageIntegrity()
+	request.AddFingerprint()
+	stun, _ := request.Serialize()
+	if violations := stunViolations(stun); len(violations) != 0 {
+		t.Fatalf("Violations in a valid STUN message: %v", violations)
+	}
+
+	// An attribute after FINGERPRINT, with the length left alone
+	late := append(append([]byte{}, stun...), 0x80, 0x22, 0x00, 0x00)
+	expected := []ParseViolation{ViolationSTUNTrailingBytes}
+	if violations := stunViolations(late); !reflect.DeepEqual(violations, expected) {
+		t.Fatalf("Incorrect STUN violations: %v", violations)
+	}
+	late[3] += 4
+	expected = []ParseViolation{ViolationSTUNAfterFingerprint}
+	if violations := stunViolations(late); !reflect.DeepEqual(violations, expected) {
+		t.Fatalf("Incorrect STUN violations: %v", violations)
+	}
+
+	header := &RTPHeader{
+		PayloadType:      96,
+		Extension:        true,
+		ExtensionProfile: 0xbede,
+		ExtensionData:    []byte{0x10, 0xaa, 0x23, 0xbb},
+	}
+	expected = []ParseViolation{ViolationRTPExtensionOverrun}
+	if violations := rtpViolations(header); !reflect.DeepEqual(violations, expected) {
+		t.Fatalf("Incorrect RTP violations: %v", violations)
+	}
+
+	// An RR claiming a report block it doesn't have, padded mid-compound
+	rtcp := []byte{
+		0xa1, 0xc9, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04,
+		0x81, 0xce, 0x00, 0x02, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	}
+	headers, err := ParseRTCPCompound(rtcp)
+	if err != nil {
+		t.Fatalf("Error parsing RTCP: %v", err)
+	}
+	expected = []ParseViolation{ViolationRTCPPaddingNotLast, ViolationRTCPReportCountMismatch}
+	if violations := rtcpViolations(rtcp, headers); !reflect.DeepEqual(violations, expected) {
+		t.Fatalf("Incorrect RTCP violations: %v", violations)
+	}
+}
+
+func TestStrictParsing(t *testing.T) {
+	network := testnet.NewNetwork()
+	mdd := newTestMDD(t, network)
+	defer mdd.Stop()
+	mdd.SetConferenceMode(DefaultConfID, ModeRelay)
+
+	sender, _ := NewClient(network, "10.0.0.1:5000")
+	defer sender.Stop()
+	receiver, _ := NewClient(network, "10.0.0.2:5000")
+	defer receiver.Stop()
+	receiver.Write([]byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x0a, 0x0b, 0x0c, 0x0d})
+	AssertNotRecvPacket(t, sender, "Packet forwarded to a client that has not joined")
+
+	// Payload type 80 is reserved to avoid conflicts with RTCP
+	reserved := []byte{0x80, 0x50, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0xaa}
+	sender.Write(reserved)
+	AssertRecvPacket(t, receiver, reserved, "Packet dropped in lenient mode")
+
+	done := make(chan bool)
+	mdd.runOnLoop(func() {
+		mdd.StrictParsing = true
+		done <- true
+	})
+	<-done
+
+	sender.Write(reserved)
+	AssertNotRecvPacket(t, receiver, "Packet forwarded in strict mode")
+
+	violations := mdd.StatsSnapshot().Global.Violations
+	if violations[string(ViolationRTPReservedPayloadType)] != 2 {
+		t.Fatalf("Incorrect violation counts: %v", violations)
+	}
+}